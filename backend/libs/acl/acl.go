@@ -0,0 +1,387 @@
+package acl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"spacenode/libs/syncmap"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+
+	// 允许的连接没有包之后，回程的包还能通过的时间
+	flowTTL = 2 * time.Minute
+	// 每记录这么多次连接清理一次过期的
+	sweepEvery = 4096
+)
+
+// Addrs 一组地址，Any 为 true 时匹配任意地址
+type Addrs struct {
+	Any      bool
+	Prefixes []netip.Prefix
+}
+
+func (a Addrs) Contains(addr netip.Addr) bool {
+	if a.Any {
+		return true
+	}
+	for _, p := range a.Prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// PortRange 端口范围，包括两端
+type PortRange struct {
+	First, Last uint16
+}
+
+// Rule 一条规则，Proto 和 Ports 为空时匹配任意协议和端口
+type Rule struct {
+	Accept   bool
+	Src, Dst Addrs
+	Proto    []uint8
+	// 目的端口，只对 tcp 和 udp 有效
+	Ports []PortRange
+}
+
+func (r *Rule) match(p *packet) bool {
+	if !r.Src.Contains(p.src) || !r.Dst.Contains(p.dst) {
+		return false
+	}
+	if p.opaque {
+		// 加密的包看不到协议和端口
+		return len(r.Proto) == 0 && len(r.Ports) == 0
+	}
+	if len(r.Proto) > 0 && !contains(r.Proto, p.proto) {
+		return false
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	if !p.hasPorts {
+		return false
+	}
+	for _, pr := range r.Ports {
+		if p.dport >= pr.First && p.dport <= pr.Last {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(arr []uint8, v uint8) bool {
+	for _, a := range arr {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Table 编译好的策略，按顺序使用第一条匹配的规则
+type Table struct {
+	Rules []Rule
+	// 没有规则匹配时放行
+	DefaultAccept bool
+	// 被拒绝的包写入日志
+	LogDenied bool
+
+	// 每条规则拒绝的包
+	denied []atomic.Uint64
+}
+
+// Stats 拒绝的包的计数
+type Stats struct {
+	// 全部拒绝的包，包括没有规则匹配时按默认动作拒绝的
+	Denied        uint64 `json:"denied"`
+	DefaultDenied uint64 `json:"default_denied"`
+	// 每条规则拒绝的包，下标与策略中的规则相同
+	Rules []uint64 `json:"rules"`
+	// 正在跟踪的连接
+	Flows int `json:"flows"`
+}
+
+type flowKey struct {
+	proto        uint8
+	src, dst     netip.Addr
+	sport, dport uint16
+}
+
+// Filter 在路由器中按策略过滤结点之间的包
+// 允许的包记录反方向的连接，回程的包不再匹配规则
+type Filter struct {
+	table         atomic.Pointer[Table]
+	flows         syncmap.SyncMap[flowKey, *atomic.Int64]
+	tracked       atomic.Uint64
+	denied        atomic.Uint64
+	defaultDenied atomic.Uint64
+}
+
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// Load 热加载策略，t 为 nil 时放行所有包
+// 规则数量不变时保留每条规则的计数，结点上下线重新编译策略时不清零
+func (f *Filter) Load(t *Table) {
+	if t != nil {
+		t.denied = make([]atomic.Uint64, len(t.Rules))
+		if old := f.table.Load(); old != nil && len(old.Rules) == len(t.Rules) {
+			for i := range old.denied {
+				t.denied[i].Store(old.denied[i].Load())
+			}
+		}
+	}
+	f.table.Store(t)
+}
+
+// Reset 清空跟踪的连接和计数，修改策略之后已经建立的连接重新匹配规则
+func (f *Filter) Reset() {
+	f.flows.Range(func(key flowKey, value *atomic.Int64) bool {
+		f.flows.Delete(key)
+		return true
+	})
+	f.denied.Store(0)
+	f.defaultDenied.Store(0)
+	if t := f.table.Load(); t != nil {
+		for i := range t.denied {
+			t.denied[i].Store(0)
+		}
+	}
+}
+
+// Allow 是否转发明文的 ip 包
+func (f *Filter) Allow(pkt []byte) bool {
+	t := f.table.Load()
+	if t == nil {
+		return true
+	}
+	p, ok := parse(pkt)
+	if !ok {
+		f.denied.Add(1)
+		return false
+	}
+	return f.check(t, &p)
+}
+
+// AllowSealed 是否转发端到端加密的包，只能按外层头部的地址匹配
+func (f *Filter) AllowSealed(src, dst netip.Addr) bool {
+	t := f.table.Load()
+	if t == nil {
+		return true
+	}
+	return f.check(t, &packet{src: src.Unmap(), dst: dst.Unmap(), opaque: true})
+}
+
+func (f *Filter) check(t *Table, p *packet) bool {
+	now := time.Now().UnixNano()
+	if exp, ok := f.flows.Load(p.key()); ok && exp.Load() > now {
+		exp.Store(now + int64(flowTTL))
+		return true
+	}
+	for i := range t.Rules {
+		r := &t.Rules[i]
+		if !r.match(p) {
+			continue
+		}
+		if r.Accept {
+			f.track(p, now)
+			return true
+		}
+		t.denied[i].Add(1)
+		f.deny(t, p, fmt.Sprintf("rule %d", i))
+		return false
+	}
+	if t.DefaultAccept {
+		f.track(p, now)
+		return true
+	}
+	f.defaultDenied.Add(1)
+	f.deny(t, p, "default")
+	return false
+}
+
+func (f *Filter) deny(t *Table, p *packet, reason string) {
+	f.denied.Add(1)
+	if t.LogDenied {
+		logrus.Infof("acl: deny %s by %s", p, reason)
+	}
+}
+
+// track 记录反方向的连接
+func (f *Filter) track(p *packet, now int64) {
+	key := p.reverse()
+	exp := now + int64(flowTTL)
+	if old, ok := f.flows.Load(key); ok {
+		old.Store(exp)
+		return
+	}
+	v := &atomic.Int64{}
+	v.Store(exp)
+	f.flows.Store(key, v)
+	if f.tracked.Add(1)%sweepEvery == 0 {
+		f.sweep(now)
+	}
+}
+
+func (f *Filter) sweep(now int64) {
+	f.flows.Range(func(key flowKey, value *atomic.Int64) bool {
+		if value.Load() <= now {
+			f.flows.Delete(key)
+		}
+		return true
+	})
+}
+
+func (f *Filter) Stats() Stats {
+	st := Stats{
+		Denied:        f.denied.Load(),
+		DefaultDenied: f.defaultDenied.Load(),
+		Rules:         []uint64{},
+	}
+	if t := f.table.Load(); t != nil {
+		for i := range t.denied {
+			st.Rules = append(st.Rules, t.denied[i].Load())
+		}
+	}
+	now := time.Now().UnixNano()
+	f.flows.Range(func(key flowKey, value *atomic.Int64) bool {
+		if value.Load() > now {
+			st.Flows++
+		}
+		return true
+	})
+	return st
+}
+
+// packet 规则用到的字段
+type packet struct {
+	proto        uint8
+	src, dst     netip.Addr
+	sport, dport uint16
+	hasPorts     bool
+	// 端到端加密的包，只有地址
+	opaque bool
+}
+
+func (p *packet) key() flowKey {
+	return flowKey{proto: p.proto, src: p.src, dst: p.dst, sport: p.sport, dport: p.dport}
+}
+
+func (p *packet) reverse() flowKey {
+	return flowKey{proto: p.proto, src: p.dst, dst: p.src, sport: p.dport, dport: p.sport}
+}
+
+func (p *packet) String() string {
+	if p.opaque {
+		return fmt.Sprintf("sealed %s -> %s", p.src, p.dst)
+	}
+	if p.hasPorts {
+		return fmt.Sprintf("%s %s -> %s", protoName(p.proto),
+			netip.AddrPortFrom(p.src, p.sport), netip.AddrPortFrom(p.dst, p.dport))
+	}
+	return fmt.Sprintf("%s %s -> %s", protoName(p.proto), p.src, p.dst)
+}
+
+// parse 解析 IPv4 或 IPv6 包的协议、地址和端口，IPv6 不解析扩展头
+func parse(pkt []byte) (packet, bool) {
+	var p packet
+	if len(pkt) == 0 {
+		return p, false
+	}
+	var off int
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return p, false
+		}
+		off = int(pkt[0]&0x0f) * 4
+		p.proto = pkt[9]
+		p.src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		p.dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		// 后续的分片没有端口
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return p, true
+		}
+	case 6:
+		if len(pkt) < 40 {
+			return p, false
+		}
+		off = 40
+		p.proto = pkt[6]
+		p.src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		p.dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+	default:
+		return p, false
+	}
+	if (p.proto == protoTCP || p.proto == protoUDP) && len(pkt) >= off+4 {
+		p.sport = binary.BigEndian.Uint16(pkt[off:])
+		p.dport = binary.BigEndian.Uint16(pkt[off+2:])
+		p.hasPorts = true
+	}
+	return p, true
+}
+
+func protoName(proto uint8) string {
+	switch proto {
+	case protoICMP, protoICMPv6:
+		return "icmp"
+	case protoTCP:
+		return "tcp"
+	case protoUDP:
+		return "udp"
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// ParseProto 解析 tcp、udp、icmp 或协议号，icmp 同时匹配 ICMPv6，为空时匹配任意协议
+func ParseProto(s string) ([]uint8, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return nil, nil
+	case "tcp":
+		return []uint8{protoTCP}, nil
+	case "udp":
+		return []uint8{protoUDP}, nil
+	case "icmp":
+		return []uint8{protoICMP, protoICMPv6}, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol %q", s)
+	}
+	return []uint8{uint8(n)}, nil
+}
+
+// ParsePorts 解析端口，例如 22、8000-8100
+func ParsePorts(arr []string) ([]PortRange, error) {
+	var ports []PortRange
+	for _, s := range arr {
+		first, last, found := strings.Cut(s, "-")
+		a, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		b := a
+		if found {
+			if b, err = strconv.ParseUint(last, 10, 16); err != nil || b < a {
+				return nil, fmt.Errorf("invalid port range %q", s)
+			}
+		}
+		ports = append(ports, PortRange{First: uint16(a), Last: uint16(b)})
+	}
+	return ports, nil
+}
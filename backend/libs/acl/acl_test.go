@@ -0,0 +1,137 @@
+package acl
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func tcpPacket(t *testing.T, src, dst string, sport, dport uint16) []byte {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), SYN: true}
+	return serialize(t, ip, tcp)
+}
+
+func udp6Packet(t *testing.T, src, dst string, sport, dport uint16) []byte {
+	t.Helper()
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+	return serialize(t, ip, udp)
+}
+
+func serialize(t *testing.T, ip gopacket.NetworkLayer, l4 interface {
+	gopacket.SerializableLayer
+	SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+}) []byte {
+	t.Helper()
+	if err := l4.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip.(gopacket.SerializableLayer), l4, gopacket.Payload("hi")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func addrs(arr ...string) Addrs {
+	var a Addrs
+	for _, s := range arr {
+		a.Prefixes = append(a.Prefixes, netip.MustParsePrefix(s))
+	}
+	return a
+}
+
+func TestParse(t *testing.T) {
+	p, ok := parse(tcpPacket(t, "10.0.0.2", "10.0.0.3", 40000, 22))
+	if !ok || p.proto != protoTCP || p.src.String() != "10.0.0.2" || p.dst.String() != "10.0.0.3" || !p.hasPorts || p.dport != 22 {
+		t.Fatalf("unexpected %+v", p)
+	}
+	p, ok = parse(udp6Packet(t, "fd00::2", "fd00::3", 5353, 53))
+	if !ok || p.proto != protoUDP || p.dst.String() != "fd00::3" || p.sport != 5353 || p.dport != 53 {
+		t.Fatalf("unexpected %+v", p)
+	}
+	if _, ok := parse([]byte{0x45, 0}); ok {
+		t.Fatalf("expect short packet to fail")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := NewFilter()
+	ssh := tcpPacket(t, "10.0.0.2", "10.0.0.3", 40000, 22)
+	if !f.Allow(ssh) {
+		t.Fatalf("expect everything allowed without a table")
+	}
+
+	f.Load(&Table{Rules: []Rule{
+		{Accept: true, Src: addrs("10.0.0.2/32"), Dst: Addrs{Any: true}, Proto: []uint8{protoTCP}, Ports: []PortRange{{First: 22, Last: 22}}},
+		{Src: Addrs{Any: true}, Dst: addrs("10.0.0.9/32")},
+	}})
+	if !f.Allow(ssh) {
+		t.Fatalf("expect ssh allowed")
+	}
+	// 回程的包属于已经允许的连接
+	if !f.Allow(tcpPacket(t, "10.0.0.3", "10.0.0.2", 22, 40000)) {
+		t.Fatalf("expect reply allowed")
+	}
+	if f.Allow(tcpPacket(t, "10.0.0.3", "10.0.0.2", 22, 40001)) {
+		t.Fatalf("expect packet of another flow denied")
+	}
+	if f.Allow(tcpPacket(t, "10.0.0.2", "10.0.0.3", 40000, 80)) {
+		t.Fatalf("expect other port denied")
+	}
+	if f.Allow(tcpPacket(t, "10.0.0.5", "10.0.0.9", 1, 22)) {
+		t.Fatalf("expect deny rule to match")
+	}
+	// 加密的包看不到端口，带端口的规则不匹配
+	if f.AllowSealed(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.4")) {
+		t.Fatalf("expect sealed packet denied")
+	}
+
+	st := f.Stats()
+	if st.Denied != 4 || st.DefaultDenied != 3 || len(st.Rules) != 2 || st.Rules[1] != 1 || st.Flows != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	// 重新编译同一个策略保留计数，Reset 清空连接
+	f.Load(&Table{Rules: make([]Rule, 2)})
+	if st := f.Stats(); st.Rules[1] != 1 {
+		t.Fatalf("expect rule counters kept, got %+v", st)
+	}
+	f.Reset()
+	if st := f.Stats(); st.Denied != 0 || st.Flows != 0 || st.Rules[1] != 0 {
+		t.Fatalf("expect stats reset, got %+v", st)
+	}
+
+	f.Load(&Table{DefaultAccept: true, Rules: []Rule{{Src: Addrs{Any: true}, Dst: addrs("fd00::3/128"), Proto: []uint8{protoUDP}}}})
+	if f.Allow(udp6Packet(t, "fd00::2", "fd00::3", 5353, 53)) {
+		t.Fatalf("expect IPv6 udp denied")
+	}
+	if !f.Allow(tcpPacket(t, "10.0.0.2", "10.0.0.3", 40000, 80)) {
+		t.Fatalf("expect default accept")
+	}
+	f.Load(nil)
+	if !f.Allow(udp6Packet(t, "fd00::2", "fd00::3", 5353, 53)) {
+		t.Fatalf("expect everything allowed after unloading")
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts([]string{"22", "8000-8100"})
+	if err != nil || len(ports) != 2 || ports[1] != (PortRange{First: 8000, Last: 8100}) {
+		t.Fatalf("unexpected %v %v", ports, err)
+	}
+	for _, bad := range []string{"x", "100-10", "70000"} {
+		if _, err := ParsePorts([]string{bad}); err == nil {
+			t.Fatalf("expect %q to fail", bad)
+		}
+	}
+	if _, err := ParseProto("sctp"); err == nil {
+		t.Fatalf("expect unknown protocol name to fail")
+	}
+}
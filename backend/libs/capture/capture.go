@@ -0,0 +1,256 @@
+package capture
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	DefaultDuration = time.Minute
+	MaxDuration     = time.Hour
+	DefaultMaxBytes = 64 << 20
+	DefaultSnapLen  = 65535
+	// 写文件跟不上时最多缓存的包，超过之后丢弃并计数
+	queueSize = 1024
+)
+
+// Options 抓包的过滤条件和限制，零值使用默认值
+type Options struct {
+	// 类似 tcpdump 的过滤表达式，见 Compile
+	Filter string
+	// 只抓这些地址收发的包，以及 From 为这些地址的结点发出的包，为空时抓所有的
+	Addrs []netip.Addr
+	// 只用于显示，比如抓包的结点
+	Node     string
+	Duration time.Duration
+	// 写入的包的总字节数，不包括 pcapng 的头部
+	MaxBytes int64
+	// 为 0 时不限制
+	MaxPackets int64
+	// 每个包最多保存的字节数
+	SnapLen int
+}
+
+// Info 抓包的状态
+type Info struct {
+	ID       string    `json:"id"`
+	Node     string    `json:"node,omitempty"`
+	Filter   string    `json:"filter,omitempty"`
+	Started  time.Time `json:"started"`
+	Deadline time.Time `json:"deadline"`
+	Running  bool      `json:"running"`
+	Packets  int64     `json:"packets"`
+	Bytes    int64     `json:"bytes"`
+	// 写入跟不上时丢弃的包
+	Dropped int64  `json:"dropped"`
+	Error   string `json:"error,omitempty"`
+}
+
+type record struct {
+	ts   time.Time
+	data []byte
+	// 原始长度，超过 SnapLen 时 data 被截断
+	length int
+}
+
+// Capture 一次抓包，把匹配的包写成 pcapng，链路类型为裸 IP
+type Capture struct {
+	id      string
+	opts    Options
+	match   func(pkt []byte) bool
+	addrs   map[string]bool
+	started time.Time
+
+	queue chan record
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	packets atomic.Int64
+	bytes   atomic.Int64
+	dropped atomic.Int64
+	err     atomic.Value
+}
+
+// Start 开始抓包，结果写入 w，到达时长或大小的限制、调用 Stop 或者写入失败时结束
+// 结束之后 w 由调用方关闭
+func Start(w io.Writer, opts Options) (*Capture, error) {
+	match, err := Compile(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = DefaultDuration
+	}
+	if opts.Duration > MaxDuration {
+		opts.Duration = MaxDuration
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.SnapLen <= 0 || opts.SnapLen > DefaultSnapLen {
+		opts.SnapLen = DefaultSnapLen
+	}
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = "space"
+	intf.LinkType = layers.LinkTypeRaw
+	intf.SnapLength = uint32(opts.SnapLen)
+	intf.Filter = opts.Filter
+	ngw, err := pcapgo.NewNgWriterInterface(w, intf, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{
+		id:      newID(),
+		opts:    opts,
+		match:   match,
+		started: time.Now(),
+		queue:   make(chan record, queueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if len(opts.Addrs) > 0 {
+		c.addrs = make(map[string]bool)
+		for _, a := range opts.Addrs {
+			c.addrs[a.Unmap().String()] = true
+		}
+	}
+	// 先把文件头写出去，下载的一方马上就能识别格式
+	if err := c.flush(ngw, w); err != nil {
+		return nil, err
+	}
+	go c.run(ngw, w)
+	return c, nil
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (c *Capture) ID() string {
+	return c.id
+}
+
+// Done 抓包结束之后关闭
+func (c *Capture) Done() <-chan struct{} {
+	return c.done
+}
+
+// Stop 结束抓包，可以多次调用
+func (c *Capture) Stop() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+// Packet 路由器收到的包，from 为发出数据包的结点的地址，服务端生成的包为空
+// 只做匹配和复制，写入在另外的 goroutine 中
+func (c *Capture) Packet(from string, pkt []byte) {
+	select {
+	case <-c.stop:
+		return
+	default:
+	}
+	if c.addrs != nil && !c.addrs[from] && !c.involves(pkt) {
+		return
+	}
+	if !c.match(pkt) {
+		return
+	}
+	n := min(len(pkt), c.opts.SnapLen)
+	r := record{ts: time.Now(), data: append([]byte(nil), pkt[:n]...), length: len(pkt)}
+	select {
+	case c.queue <- r:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// involves 包的源地址或目的地址是否为要抓的地址
+func (c *Capture) involves(pkt []byte) bool {
+	p, ok := decode(pkt)
+	return ok && (c.addrs[p.src.String()] || c.addrs[p.dst.String()])
+}
+
+func (c *Capture) run(ngw *pcapgo.NgWriter, w io.Writer) {
+	defer close(c.done)
+	defer c.Stop()
+	timer := time.NewTimer(c.opts.Duration)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-c.queue:
+			ci := gopacket.CaptureInfo{Timestamp: r.ts, CaptureLength: len(r.data), Length: r.length}
+			if err := ngw.WritePacket(ci, r.data); err != nil {
+				c.err.Store(err.Error())
+				return
+			}
+			packets := c.packets.Add(1)
+			bytes := c.bytes.Add(int64(len(r.data)))
+			if bytes >= c.opts.MaxBytes || (c.opts.MaxPackets > 0 && packets >= c.opts.MaxPackets) {
+				c.finish(ngw, w)
+				return
+			}
+			// 队列空的时候才刷新，流式下载可以马上看到
+			if len(c.queue) == 0 {
+				if err := c.flush(ngw, w); err != nil {
+					c.err.Store(err.Error())
+					return
+				}
+			}
+		case <-timer.C:
+			c.finish(ngw, w)
+			return
+		case <-c.stop:
+			c.finish(ngw, w)
+			return
+		}
+	}
+}
+
+func (c *Capture) finish(ngw *pcapgo.NgWriter, w io.Writer) {
+	if err := c.flush(ngw, w); err != nil {
+		c.err.Store(err.Error())
+	}
+}
+
+func (c *Capture) flush(ngw *pcapgo.NgWriter, w io.Writer) error {
+	if err := ngw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (c *Capture) Info() Info {
+	info := Info{
+		ID:       c.id,
+		Node:     c.opts.Node,
+		Filter:   c.opts.Filter,
+		Started:  c.started,
+		Deadline: c.started.Add(c.opts.Duration),
+		Packets:  c.packets.Load(),
+		Bytes:    c.bytes.Load(),
+		Dropped:  c.dropped.Load(),
+	}
+	select {
+	case <-c.done:
+	default:
+		info.Running = true
+	}
+	if err, ok := c.err.Load().(string); ok {
+		info.Error = err
+	}
+	return info
+}
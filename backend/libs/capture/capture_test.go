@@ -0,0 +1,154 @@
+package capture
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func tcpPacket(t *testing.T, src, dst string, sport, dport uint16) []byte {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), SYN: true}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func icmp6Packet(t *testing.T, src, dst string) []byte {
+	t.Helper()
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+	if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, icmp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompile(t *testing.T) {
+	ssh := tcpPacket(t, "10.0.0.2", "10.0.0.3", 40000, 22)
+	ping := icmp6Packet(t, "fd00::2", "fd00::3")
+	cases := []struct {
+		expr      string
+		ssh, ping bool
+	}{
+		{"", true, true},
+		{"ip", true, false},
+		{"ip6 and icmp", false, true},
+		{"tcp port 22", true, false},
+		{"src port 22", false, false},
+		{"dst portrange 20-30", true, false},
+		{"host 10.0.0.3", true, false},
+		{"src host 10.0.0.3", false, false},
+		{"net fd00::/64", false, true},
+		{"not tcp", false, true},
+		{"!(udp || icmp) && dst net 10.0.0.0/24", true, false},
+		{"tcp or icmp", true, true},
+		{"tcp dst port 22", true, false},
+	}
+	for _, c := range cases {
+		match, err := Compile(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		if match(ssh) != c.ssh || match(ping) != c.ping {
+			t.Fatalf("%q: expect ssh %v ping %v", c.expr, c.ssh, c.ping)
+		}
+	}
+	for _, bad := range []string{"host", "host x", "port 70000", "portrange 30-20", "(tcp", "tcp )", "foo", "tcp and"} {
+		if _, err := Compile(bad); err == nil {
+			t.Fatalf("expect %q to fail", bad)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := Start(&buf, Options{
+		Filter:     "tcp",
+		Addrs:      []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+		MaxPackets: 2,
+		SnapLen:    40,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 结点发出的包，结点收到的包，其它结点之间的包，不匹配过滤条件的包
+	c.Packet("10.0.0.2", tcpPacket(t, "10.0.0.2", "10.0.0.3", 40000, 22))
+	c.Packet("10.0.0.5", tcpPacket(t, "10.0.0.5", "10.0.0.6", 40000, 22))
+	c.Packet("10.0.0.2", icmp6Packet(t, "fd00::2", "fd00::3"))
+	c.Packet("10.0.0.3", tcpPacket(t, "10.0.0.3", "10.0.0.2", 22, 40000))
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect capture to finish after max packets")
+	}
+	info := c.Info()
+	if info.Running || info.Packets != 2 || info.Bytes != 80 || info.Dropped != 0 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	// 结束之后的包被忽略
+	c.Packet("10.0.0.2", tcpPacket(t, "10.0.0.2", "10.0.0.3", 40000, 22))
+
+	r, err := pcapgo.NewNgReader(&buf, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeRaw {
+		t.Fatalf("unexpected link type %v", r.LinkType())
+	}
+	var ports []layers.TCPPort
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		if ci.CaptureLength != 40 || ci.Length <= 40 {
+			t.Fatalf("expect packet truncated to snaplen, got %+v", ci)
+		}
+		p := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		if tcp, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			ports = append(ports, tcp.DstPort)
+		}
+	}
+	if len(ports) != 2 || ports[0] != 22 || ports[1] != 40000 {
+		t.Fatalf("unexpected packets %v", ports)
+	}
+}
+
+func TestStop(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := Start(&buf, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Info().Running {
+		t.Fatal("expect capture running")
+	}
+	c.Stop()
+	c.Stop()
+	<-c.Done()
+	if _, err := pcapgo.NewNgReader(&buf, pcapgo.DefaultNgReaderOptions); err != nil {
+		t.Fatalf("expect empty capture to be readable, got %v", err)
+	}
+	if _, err := Start(&buf, Options{Filter: "port"}); err == nil {
+		t.Fatal("expect invalid filter to fail")
+	}
+}
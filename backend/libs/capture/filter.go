@@ -0,0 +1,258 @@
+package capture
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetInfo 过滤条件用到的字段
+type packetInfo struct {
+	v6           bool
+	proto        layers.IPProtocol
+	src, dst     netip.Addr
+	sport, dport uint16
+	hasPorts     bool
+}
+
+// decode 用 gopacket 解析 IPv4 或 IPv6 包，只在有抓包时调用
+func decode(pkt []byte) (*packetInfo, bool) {
+	if len(pkt) == 0 {
+		return nil, false
+	}
+	info := &packetInfo{}
+	var p gopacket.Packet
+	switch pkt[0] >> 4 {
+	case 4:
+		p = gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		ip, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !ok {
+			return nil, false
+		}
+		info.proto = ip.Protocol
+		info.src, _ = netip.AddrFromSlice(ip.SrcIP.To4())
+		info.dst, _ = netip.AddrFromSlice(ip.DstIP.To4())
+	case 6:
+		p = gopacket.NewPacket(pkt, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		ip, ok := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		if !ok {
+			return nil, false
+		}
+		info.v6 = true
+		info.proto = ip.NextHeader
+		info.src, _ = netip.AddrFromSlice(ip.SrcIP)
+		info.dst, _ = netip.AddrFromSlice(ip.DstIP)
+	default:
+		return nil, false
+	}
+	switch l := p.TransportLayer().(type) {
+	case *layers.TCP:
+		info.sport, info.dport, info.hasPorts = uint16(l.SrcPort), uint16(l.DstPort), true
+	case *layers.UDP:
+		info.sport, info.dport, info.hasPorts = uint16(l.SrcPort), uint16(l.DstPort), true
+	}
+	return info, true
+}
+
+// matcher 编译好的过滤条件
+type matcher func(p *packetInfo) bool
+
+// Compile 编译类似 tcpdump 的过滤表达式，为空时匹配所有的包，支持:
+// ip、ip6、tcp、udp、icmp，[src|dst] host 地址，[src|dst] net CIDR，
+// [src|dst] port 端口，[src|dst] portrange 起-止，以及 and(&&)、or(||)、not(!) 和括号
+func Compile(expr string) (func(pkt []byte) bool, error) {
+	m, err := compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(pkt []byte) bool {
+		p, ok := decode(pkt)
+		return ok && m(p)
+	}, nil
+}
+
+func compile(expr string) (matcher, error) {
+	p := &parser{tokens: tokenize(expr)}
+	if len(p.tokens) == 0 {
+		return func(*packetInfo) bool { return true }, nil
+	}
+	m, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return m, nil
+}
+
+func tokenize(expr string) []string {
+	r := strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ")
+	return strings.Fields(strings.ToLower(r.Replace(expr)))
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) or() (matcher, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pi *packetInfo) bool { return l(pi) || right(pi) }
+	}
+	return left, nil
+}
+
+func (p *parser) and() (matcher, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "and":
+			p.next()
+		case "", "or", ")":
+			return left, nil
+		}
+		// 和 tcpdump 一样，相邻的条件之间省略 and
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pi *packetInfo) bool { return l(pi) && right(pi) }
+	}
+}
+
+func (p *parser) not() (matcher, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		m, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(pi *packetInfo) bool { return !m(pi) }, nil
+	case "(":
+		p.next()
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return m, nil
+	}
+	return p.primitive()
+}
+
+func (p *parser) primitive() (matcher, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	case "ip":
+		return func(pi *packetInfo) bool { return !pi.v6 }, nil
+	case "ip6":
+		return func(pi *packetInfo) bool { return pi.v6 }, nil
+	case "tcp":
+		return protoMatcher(layers.IPProtocolTCP), nil
+	case "udp":
+		return protoMatcher(layers.IPProtocolUDP), nil
+	case "icmp":
+		return func(pi *packetInfo) bool {
+			return pi.proto == layers.IPProtocolICMPv4 || pi.proto == layers.IPProtocolICMPv6
+		}, nil
+	}
+	// 方向，省略时源和目的都可以
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+		tok = p.next()
+	case "dst":
+		src = false
+		tok = p.next()
+	}
+	arg := p.next()
+	if arg == "" {
+		return nil, fmt.Errorf("%s requires an argument", tok)
+	}
+	switch tok {
+	case "host":
+		addr, err := netip.ParseAddr(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q", arg)
+		}
+		return addrMatcher(src, dst, netip.PrefixFrom(addr, addr.BitLen())), nil
+	case "net":
+		prefix, err := netip.ParsePrefix(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q", arg)
+		}
+		return addrMatcher(src, dst, prefix.Masked()), nil
+	case "port":
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", arg)
+		}
+		return portMatcher(src, dst, uint16(port), uint16(port)), nil
+	case "portrange":
+		first, last, ok := strings.Cut(arg, "-")
+		a, err1 := strconv.ParseUint(first, 10, 16)
+		b, err2 := strconv.ParseUint(last, 10, 16)
+		if !ok || err1 != nil || err2 != nil || b < a {
+			return nil, fmt.Errorf("invalid portrange %q", arg)
+		}
+		return portMatcher(src, dst, uint16(a), uint16(b)), nil
+	}
+	return nil, fmt.Errorf("unknown filter %q", tok)
+}
+
+func protoMatcher(proto layers.IPProtocol) matcher {
+	return func(pi *packetInfo) bool { return pi.proto == proto }
+}
+
+func addrMatcher(src, dst bool, prefix netip.Prefix) matcher {
+	return func(pi *packetInfo) bool {
+		return (src && prefix.Contains(pi.src)) || (dst && prefix.Contains(pi.dst))
+	}
+}
+
+func portMatcher(src, dst bool, first, last uint16) matcher {
+	in := func(port uint16) bool { return port >= first && port <= last }
+	return func(pi *packetInfo) bool {
+		return pi.hasPorts && ((src && in(pi.sport)) || (dst && in(pi.dport)))
+	}
+}
@@ -0,0 +1,336 @@
+package e2e
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"spacenode/libs/models"
+	"spacenode/libs/replay"
+	"spacenode/libs/utils"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 端到端加密，space 服务端只能看到外层的地址
+//
+// 每个结点有一个长期的静态密钥和每次连接生成的临时密钥，公钥都通过 space 分发
+// 两个结点之间的密钥:
+//
+//	ikm = DH(静态, 静态) || DH(临时, 临时)
+//	key(a->b) = HKDF-SHA256(ikm, salt=protocolName, info="key" || a静态公钥 || b静态公钥 || a临时公钥 || b临时公钥)
+//
+// 临时密钥保证每次连接的密钥都不同，计数器不会在同一个密钥下重复
+//
+// 加密之后的格式:
+//
+//	Family(1) | Dst | Src | Counter(8) | ChaCha20-Poly1305(packet)
+//
+// Family 为 4 或 6，决定地址长度，外层头部作为 AEAD 的附加数据
+const protocolName = "spacenode-e2e-v1"
+
+const (
+	// KeyFile 结点静态私钥的文件名，和证书保存在同一个目录
+	KeyFile = "node_e2e.key"
+
+	KeySize     = 32
+	counterSize = 8
+)
+
+var (
+	ErrNoPeer     = errors.New("no key for peer")
+	ErrReplay     = errors.New("replayed packet")
+	ErrBadPacket  = errors.New("malformed packet")
+	ErrOpenFailed = errors.New("decrypt failed")
+)
+
+type KeyPair struct {
+	Private [KeySize]byte
+	Public  [KeySize]byte
+}
+
+func GenerateKeyPair() (*KeyPair, error) {
+	kp := &KeyPair{}
+	if _, err := io.ReadFull(rand.Reader, kp.Private[:]); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(kp.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+// LoadOrCreateKeyPair 从文件读取 base64 的私钥，不存在时生成
+func LoadOrCreateKeyPair(path string) (*KeyPair, error) {
+	if utils.FileExists(path) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(priv) != KeySize {
+			return nil, fmt.Errorf("invalid key file %s", path)
+		}
+		kp := &KeyPair{}
+		copy(kp.Private[:], priv)
+		pub, err := curve25519.X25519(kp.Private[:], curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		copy(kp.Public[:], pub)
+		return kp, nil
+	}
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(kp.Private[:])), 0600); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+func (k *KeyPair) PublicString() string {
+	return base64.StdEncoding.EncodeToString(k.Public[:])
+}
+
+// ParseKey 解析 base64 的公钥
+func ParseKey(s string) ([KeySize]byte, error) {
+	var key [KeySize]byte
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(data) != KeySize {
+		return key, fmt.Errorf("invalid public key %q", s)
+	}
+	copy(key[:], data)
+	return key, nil
+}
+
+type peer struct {
+	static    [KeySize]byte
+	ephemeral [KeySize]byte
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	counter   atomic.Uint64
+	replay    replay.Window
+}
+
+// Tunnel 保存本结点的密钥和所有对端的会话密钥
+type Tunnel struct {
+	static    *KeyPair
+	ephemeral *KeyPair
+	mu        sync.RWMutex
+	peers     map[string]*peer // key 为对端的 ip，包括 IPv6 地址
+}
+
+// NewTunnel 每次连接生成新的临时密钥
+func NewTunnel(static *KeyPair) (*Tunnel, error) {
+	eph, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return &Tunnel{
+		static:    static,
+		ephemeral: eph,
+		peers:     make(map[string]*peer),
+	}, nil
+}
+
+func (t *Tunnel) PublicKey() string {
+	return t.static.PublicString()
+}
+
+func (t *Tunnel) EphemeralKey() string {
+	return t.ephemeral.PublicString()
+}
+
+// SetPeers 用服务端下发的结点列表更新会话密钥，密钥没变化的对端保留原有的计数器
+func (t *Tunnel) SetPeers(list []models.Peer) error {
+	peers := make(map[string]*peer, len(list))
+	t.mu.RLock()
+	old := t.peers
+	t.mu.RUnlock()
+
+	var errs []error
+	for _, v := range list {
+		static, err := ParseKey(v.PublicKey)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if static == t.static.Public {
+			continue
+		}
+		ephemeral, err := ParseKey(v.EphemeralKey)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p, ok := old[v.IP]
+		if !ok || p.static != static || p.ephemeral != ephemeral {
+			if p, err = t.newPeer(static, ephemeral); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		// 同一个对端的 IPv4 和 IPv6 地址共用会话密钥
+		peers[v.IP] = p
+		if v.IPv6 != "" {
+			peers[v.IPv6] = p
+		}
+	}
+
+	t.mu.Lock()
+	t.peers = peers
+	t.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// HasPeer 是否有发往 ip 的会话密钥
+func (t *Tunnel) HasPeer(ip string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.peers[ip]
+	return ok
+}
+
+func (t *Tunnel) newPeer(static, ephemeral [KeySize]byte) (*peer, error) {
+	ss, err := curve25519.X25519(t.static.Private[:], static[:])
+	if err != nil {
+		return nil, err
+	}
+	ee, err := curve25519.X25519(t.ephemeral.Private[:], ephemeral[:])
+	if err != nil {
+		return nil, err
+	}
+	ikm := append(ss, ee...)
+
+	derive := func(fromS, toS, fromE, toE [KeySize]byte) (cipher.AEAD, error) {
+		info := []byte("key")
+		info = append(info, fromS[:]...)
+		info = append(info, toS[:]...)
+		info = append(info, fromE[:]...)
+		info = append(info, toE[:]...)
+		key := make([]byte, chacha20poly1305.KeySize)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, []byte(protocolName), info), key); err != nil {
+			return nil, err
+		}
+		return chacha20poly1305.New(key)
+	}
+
+	p := &peer{static: static, ephemeral: ephemeral}
+	if p.send, err = derive(t.static.Public, static, t.ephemeral.Public, ephemeral); err != nil {
+		return nil, err
+	}
+	if p.recv, err = derive(static, t.static.Public, ephemeral, t.ephemeral.Public); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// addrs 返回 ip 包的源地址和目的地址
+func addrs(pkt []byte) (family byte, src, dst net.IP, err error) {
+	if len(pkt) < 1 {
+		return 0, nil, nil, ErrBadPacket
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return 0, nil, nil, ErrBadPacket
+		}
+		return 4, net.IP(pkt[12:16]), net.IP(pkt[16:20]), nil
+	case 6:
+		if len(pkt) < 40 {
+			return 0, nil, nil, ErrBadPacket
+		}
+		return 6, net.IP(pkt[8:24]), net.IP(pkt[24:40]), nil
+	}
+	return 0, nil, nil, ErrBadPacket
+}
+
+func addrLen(family byte) int {
+	if family == 6 {
+		return net.IPv6len
+	}
+	return net.IPv4len
+}
+
+// Header 解析外层头部，路由器只需要这部分就能转发
+func Header(sealed []byte) (src, dst net.IP, err error) {
+	if len(sealed) < 1 || (sealed[0] != 4 && sealed[0] != 6) {
+		return nil, nil, ErrBadPacket
+	}
+	n := addrLen(sealed[0])
+	if len(sealed) < 1+2*n+counterSize {
+		return nil, nil, ErrBadPacket
+	}
+	return net.IP(sealed[1+n : 1+2*n]), net.IP(sealed[1 : 1+n]), nil
+}
+
+// Seal 加密发往 space 内其它结点的 ip 包
+func (t *Tunnel) Seal(pkt []byte) ([]byte, error) {
+	family, src, dst, err := addrs(pkt)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.RLock()
+	p, ok := t.peers[dst.String()]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrNoPeer, dst)
+	}
+
+	n := addrLen(family)
+	hdrLen := 1 + 2*n + counterSize
+	out := make([]byte, hdrLen, hdrLen+len(pkt)+p.send.Overhead())
+	out[0] = family
+	copy(out[1:], dst)
+	copy(out[1+n:], src)
+	counter := p.counter.Add(1)
+	binary.BigEndian.PutUint64(out[1+2*n:], counter)
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return p.send.Seal(out, nonce, pkt, out[:hdrLen]), nil
+}
+
+// Open 解密其它结点发来的包
+func (t *Tunnel) Open(sealed []byte) ([]byte, error) {
+	src, _, err := Header(sealed)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.RLock()
+	p, ok := t.peers[src.String()]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrNoPeer, src)
+	}
+
+	n := addrLen(sealed[0])
+	hdrLen := 1 + 2*n + counterSize
+	counter := binary.BigEndian.Uint64(sealed[1+2*n:])
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	pkt, err := p.recv.Open(nil, nonce, sealed[hdrLen:], sealed[:hdrLen])
+	if err != nil {
+		return nil, ErrOpenFailed
+	}
+	// 认证通过之后才更新防重放窗口
+	if !p.replay.Accept(counter) {
+		return nil, ErrReplay
+	}
+	return pkt, nil
+}
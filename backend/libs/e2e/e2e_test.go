@@ -0,0 +1,152 @@
+package e2e
+
+import (
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"spacenode/libs/models"
+	"spacenode/libs/replay"
+	"testing"
+)
+
+func ipv4(src, dst [4]byte, payload string) []byte {
+	pkt := make([]byte, 20, 20+len(payload))
+	pkt[0] = 0x45
+	copy(pkt[12:], src[:])
+	copy(pkt[16:], dst[:])
+	return append(pkt, payload...)
+}
+
+func ipv6(src, dst netip.Addr, payload string) []byte {
+	pkt := make([]byte, 40, 40+len(payload))
+	pkt[0] = 0x60
+	copy(pkt[8:], src.AsSlice())
+	copy(pkt[24:], dst.AsSlice())
+	return append(pkt, payload...)
+}
+
+func newPair(t *testing.T) (*Tunnel, *Tunnel) {
+	t.Helper()
+	ka, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := LoadOrCreateKeyPair(filepath.Join(t.TempDir(), KeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := NewTunnel(ka)
+	b, _ := NewTunnel(kb)
+	peers := []models.Peer{
+		{NodeID: "a", IP: "10.0.0.1", IPv6: "fd00::1", PublicKey: a.PublicKey(), EphemeralKey: a.EphemeralKey()},
+		{NodeID: "b", IP: "10.0.0.2", IPv6: "fd00::2", PublicKey: b.PublicKey(), EphemeralKey: b.EphemeralKey()},
+	}
+	if err := a.SetPeers(peers); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetPeers(peers); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestSealOpen(t *testing.T) {
+	a, b := newPair(t)
+	if !a.HasPeer("10.0.0.2") || !a.HasPeer("fd00::2") || a.HasPeer("10.0.0.1") {
+		t.Fatalf("expect a to have keys of b only")
+	}
+	pkt := ipv4([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, "hello")
+
+	sealed, err := a.Seal(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, dst, err := Header(sealed)
+	if err != nil || src.String() != "10.0.0.1" || dst.String() != "10.0.0.2" {
+		t.Fatalf("unexpected header %s -> %s, %v", src, dst, err)
+	}
+	got, err := b.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(pkt) {
+		t.Fatalf("opened packet differs")
+	}
+
+	// a 只能解密发给自己的包
+	if _, err := a.Open(sealed); err == nil {
+		t.Fatalf("expect a to fail opening its own packet")
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := b.Open(tampered); !errors.Is(err, ErrOpenFailed) {
+		t.Fatalf("expect tampered packet to fail, got %v", err)
+	}
+
+	if _, err := a.Seal(ipv4([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 9}, "x")); !errors.Is(err, ErrNoPeer) {
+		t.Fatalf("expect ErrNoPeer, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	a, b := newPair(t)
+	pkt := ipv4([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, "hello")
+
+	var sealed [][]byte
+	for i := 0; i < replay.Size+2; i++ {
+		s, err := a.Seal(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed = append(sealed, s)
+	}
+	// 乱序到达的包可以接收，重复的包被拒绝
+	if _, err := b.Open(sealed[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Open(sealed[1]); err != nil {
+		t.Fatalf("out of order packet: %v", err)
+	}
+	if _, err := b.Open(sealed[2]); !errors.Is(err, ErrReplay) {
+		t.Fatalf("expect ErrReplay, got %v", err)
+	}
+	if _, err := b.Open(sealed[replay.Size+1]); err != nil {
+		t.Fatal(err)
+	}
+	// 超出窗口的旧包被拒绝
+	if _, err := b.Open(sealed[0]); !errors.Is(err, ErrReplay) {
+		t.Fatalf("expect packet outside the window to be rejected, got %v", err)
+	}
+}
+
+func TestSealOpenIPv6(t *testing.T) {
+	a, b := newPair(t)
+	src, dst := netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")
+	pkt := ipv6(src, dst, "hello")
+
+	sealed, err := a.Seal(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsrc, hdst, err := Header(sealed)
+	if err != nil || hsrc.String() != "fd00::1" || hdst.String() != "fd00::2" {
+		t.Fatalf("unexpected header %s -> %s, %v", hsrc, hdst, err)
+	}
+	got, err := b.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(pkt) {
+		t.Fatalf("opened packet differs")
+	}
+
+	// IPv4 和 IPv6 共用计数器，两个地址族的包不会重放彼此的计数
+	sealed4, err := a.Seal(ipv4([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Open(sealed4); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,275 +1,420 @@
 package ippool
 
 import (
+	"container/heap"
+	"encoding/binary"
 	"errors"
+	"hash/fnv"
+	"math/bits"
 	"math/rand"
-	"net"
+	"net/netip"
 	"sync"
 	"time"
 )
 
-// IPPool 结构体表示一个 IP 地址池
+var (
+	ErrInvalidIP   = errors.New("invalid IP address")
+	ErrOutOfRange  = errors.New("IP address not in pool range")
+	ErrExhausted   = errors.New("no available IP addresses")
+	ErrUnavailable = errors.New("IP address is not available")
+)
+
+// 主机位最多 24 位，位图最大 2MB
+const maxHostBits = 24
+
+// IPPool 一个网段内的 IPv4 地址池
+//
+// 地址用相对网络地址的偏移表示，used 位图记录已分配和保留的地址，
+// 租约按过期时间放在最小堆中，过期的租约在分配之前从堆顶回收
 type IPPool struct {
-	mu          sync.Mutex
-	startIP     net.IP
-	mask        net.IPMask
-	network     *net.IPNet
-	allocated   map[string]time.Time // 记录已分配的IP及其过期时间
-	available   []net.IP             // 可用的IP列表
-	initialized bool
+	mu      sync.Mutex
+	prefix  netip.Prefix
+	network uint32
+	// 偏移 [1, size] 为可分配的主机地址，不包括网络地址和广播地址
+	size uint32
+	// 已分配或保留的地址
+	used []uint64
+	// 保留给指定结点的地址，不参与随机分配
+	reserved []uint64
+	// 不在可分配范围内或者被排除的地址，同时记在 used 中
+	blocked []uint64
+	// 除去 blocked 之后可分配的地址数
+	capacity uint32
+	free     uint32
+	leases   leaseHeap
+	// 配置的可分配范围，为空时为整个网段
+	ranges []offRange
+}
+
+type lease struct {
+	off     uint32
+	expires int64
 }
 
-// NewIPPool 创建一个新的IP池
+// NewIPPool 创建一个新的IP池，startIP 所在的网段由 mask 决定
 func NewIPPool(startIP string, mask string) (*IPPool, error) {
-	ip := net.ParseIP(startIP)
-	if ip == nil {
+	ip, err := netip.ParseAddr(startIP)
+	if err != nil || !ip.Unmap().Is4() {
 		return nil, errors.New("invalid start IP address")
 	}
-
-	parsedMask := net.ParseIP(mask)
-	if parsedMask == nil {
+	m, err := netip.ParseAddr(mask)
+	if err != nil || !m.Unmap().Is4() {
 		return nil, errors.New("invalid mask")
 	}
-
-	m := net.IPMask(parsedMask.To4())
-	if m == nil {
+	mv := binary.BigEndian.Uint32(m.Unmap().AsSlice())
+	ones := bits.LeadingZeros32(^mv)
+	if ones == 0 || uint32(0xffffffff)<<(32-ones) != mv {
 		return nil, errors.New("invalid mask format")
 	}
+	return New(netip.PrefixFrom(ip.Unmap(), ones))
+}
 
-	network := &net.IPNet{
-		IP:   ip.Mask(m),
-		Mask: m,
+// New 用网段创建地址池
+func New(prefix netip.Prefix) (*IPPool, error) {
+	if !prefix.IsValid() || !prefix.Addr().Is4() {
+		return nil, errors.New("invalid IPv4 prefix")
 	}
-
-	pool := &IPPool{
-		startIP:     ip,
-		mask:        m,
-		network:     network,
-		allocated:   make(map[string]time.Time),
-		available:   make([]net.IP, 0),
-		initialized: false,
+	prefix = prefix.Masked()
+	hostBits := 32 - prefix.Bits()
+	if hostBits > maxHostBits {
+		return nil, errors.New("network too large")
 	}
-
-	// 初始化可用IP列表
-	if err := pool.initialize(); err != nil {
-		return nil, err
+	total := uint32(1) << hostBits
+	if total <= 2 { // 网络地址和广播地址
+		return nil, errors.New("network too small")
 	}
+	words := (total + 63) / 64
+	return &IPPool{
+		prefix:   prefix,
+		network:  binary.BigEndian.Uint32(prefix.Addr().AsSlice()),
+		size:     total - 2,
+		used:     make([]uint64, words),
+		reserved: make([]uint64, words),
+		blocked:  make([]uint64, words),
+		capacity: total - 2,
+		free:     total - 2,
+		leases:   leaseHeap{index: make(map[uint32]int)},
+	}, nil
+}
 
-	return pool, nil
+// Prefix 地址池的网段
+func (p *IPPool) Prefix() netip.Prefix {
+	return p.prefix
 }
 
-// initialize 初始化IP池，生成所有可用的IP地址
-func (p *IPPool) initialize() error {
+// Size 可分配的地址数
+func (p *IPPool) Size() int {
+	return int(p.capacity)
+}
+
+// Used 已分配和保留的地址数，过期的租约不计入
+func (p *IPPool) Used() int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.cleanExpired(time.Now())
+	return int(p.capacity - p.free)
+}
 
-	if p.initialized {
-		return nil
-	}
+// Random 随机分配一个IP地址，并指定存活时间
+// 从随机位置开始取第一个空闲地址
+func (p *IPPool) Random(ttl time.Duration) (netip.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	// 计算网络中的IP数量
-	ones, bits := p.mask.Size()
-	if ones == 0 || bits == 0 {
-		return errors.New("invalid mask")
+	now := time.Now()
+	p.cleanExpired(now)
+	off, ok := p.nextFree(1 + uint32(rand.Int63n(int64(p.size))))
+	if !ok {
+		return netip.Addr{}, ErrExhausted
 	}
+	p.allocate(off, now.Add(ttl))
+	return p.addr(off), nil
+}
 
-	totalIPs := 1 << uint(bits-ones)
-	if totalIPs <= 2 { // 网络地址和广播地址
-		return errors.New("network too small")
+// Preferred 按 key 的哈希选择地址，地址被占用时依次探测下一个地址
+// 同一个 key 在地址空闲时总是分配到同一个地址
+func (p *IPPool) Preferred(key string, ttl time.Duration) (netip.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.cleanExpired(now)
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	off, ok := p.nextFree(1 + h.Sum32()%p.size)
+	if !ok {
+		return netip.Addr{}, ErrExhausted
 	}
+	p.allocate(off, now.Add(ttl))
+	return p.addr(off), nil
+}
 
-	// 生成所有可用的IP地址（排除网络地址和广播地址）
-	ip := p.startIP.Mask(p.mask)
-	for i := 1; i < totalIPs-1; i++ {
-		nextIP := make(net.IP, len(ip))
-		copy(nextIP, ip)
+// RequestIP 申请指定的IP地址，并指定存活时间，地址已被占用时返回 false
+func (p *IPPool) RequestIP(ip netip.Addr, ttl time.Duration) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		// 增加IP
-		for j := len(nextIP) - 1; j >= 0; j-- {
-			nextIP[j]++
-			if nextIP[j] > 0 {
-				break
-			}
-		}
+	off, err := p.offset(ip)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	p.expire(off, now)
+	if p.isUsed(off) {
+		return false, nil
+	}
+	p.allocate(off, now.Add(ttl))
+	return true, nil
+}
 
-		// 检查是否超出网络范围
-		if !p.network.Contains(nextIP) {
-			break
-		}
+// CleanIP 清理指定的IP地址，使其重新可用，保留的地址仍然保留
+func (p *IPPool) CleanIP(ip netip.Addr) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		p.available = append(p.available, nextIP)
-		ip = nextIP
+	off, err := p.offset(ip)
+	if err != nil {
+		return err
 	}
-
-	p.initialized = true
+	p.release(off)
 	return nil
 }
 
-// Random 随机分配一个IP地址，并指定存活时间
-func (p *IPPool) Random(ttl time.Duration) (net.IP, error) {
+// CheckIP 检查IP状态，返回是否被占用和剩余存活时间
+// 保留但没有分配的地址视为未占用
+func (p *IPPool) CheckIP(ip netip.Addr) (bool, time.Duration, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if !p.initialized {
-		return nil, errors.New("IP pool not initialized")
+	off, err := p.offset(ip)
+	if err != nil {
+		return false, 0, err
 	}
+	i, ok := p.leases.index[off]
+	if !ok {
+		return false, 0, nil
+	}
+	left := time.Until(time.Unix(0, p.leases.items[i].expires))
+	if left <= 0 {
+		return false, 0, nil
+	}
+	return true, left, nil
+}
 
-	// 清理过期的IP
-	p.cleanExpired()
+// Renew 续期已分配的IP，IP 已过期或未分配时重新分配给调用方
+// 用于结点断线重连时恢复原来的地址，调用方负责确认 IP 属于该结点
+func (p *IPPool) Renew(ip netip.Addr, ttl time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	if len(p.available) == 0 {
-		return nil, errors.New("no available IP addresses")
+	off, err := p.offset(ip)
+	if err != nil {
+		return err
 	}
+	return p.claim(off, time.Now().Add(ttl))
+}
 
-	// 随机选择一个IP
-	idx := rand.Intn(len(p.available))
-	ip := p.available[idx]
+// Restore 恢复持久化的租约，expiry 为租约的过期时间
+func (p *IPPool) Restore(ip netip.Addr, expiry time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	// 从可用列表中移除
-	p.available = append(p.available[:idx], p.available[idx+1:]...)
+	off, err := p.offset(ip)
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(expiry) {
+		return errors.New("lease expired")
+	}
+	return p.claim(off, expiry)
+}
 
-	// 记录到已分配列表
-	p.allocated[ip.String()] = time.Now().Add(ttl)
+// Reserve 保留地址，保留的地址只能通过 Renew 分配
+// 调用方负责确认地址没有被其它结点使用
+func (p *IPPool) Reserve(ip netip.Addr) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	return ip, nil
+	off, err := p.offset(ip)
+	if err != nil {
+		return err
+	}
+	if isSet(p.reserved, off) {
+		return nil
+	}
+	if !p.isUsed(off) {
+		p.free--
+	}
+	set(p.used, off)
+	set(p.reserved, off)
+	return nil
 }
 
-// RequestIP 申请指定的IP地址，并指定存活时间
-func (p *IPPool) RequestIP(ipStr string, ttl time.Duration) (bool, error) {
+// Unreserve 取消保留，地址没有被分配时重新可用
+func (p *IPPool) Unreserve(ip netip.Addr) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if !p.initialized {
-		return false, errors.New("IP pool not initialized")
+	off, err := p.offset(ip)
+	if err != nil {
+		return err
 	}
-
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return false, errors.New("invalid IP address")
+	if !isSet(p.reserved, off) {
+		return nil
 	}
-
-	// 检查IP是否在范围内
-	if !p.network.Contains(ip) {
-		return false, errors.New("IP address not in pool range")
+	unset(p.reserved, off)
+	if _, leased := p.leases.index[off]; !leased {
+		unset(p.used, off)
+		p.free++
 	}
+	return nil
+}
 
-	// 检查IP是否已被分配
-	if expiry, exists := p.allocated[ip.String()]; exists {
-		if time.Now().Before(expiry) {
-			return false, nil // IP已被分配且未过期
-		}
-		// IP已过期，可以重新分配
+// offset 地址相对网络地址的偏移，只接受主机地址
+func (p *IPPool) offset(ip netip.Addr) (uint32, error) {
+	if !ip.IsValid() {
+		return 0, ErrInvalidIP
 	}
-
-	// 检查IP是否在可用列表中
-	found := false
-	for i, availableIP := range p.available {
-		if availableIP.Equal(ip) {
-			// 从可用列表中移除
-			p.available = append(p.available[:i], p.available[i+1:]...)
-			found = true
-			break
-		}
+	ip = ip.Unmap()
+	if !p.prefix.Contains(ip) {
+		return 0, ErrOutOfRange
 	}
-
-	if !found {
-		return false, nil
+	off := binary.BigEndian.Uint32(ip.AsSlice()) - p.network
+	if off == 0 || off > p.size {
+		return 0, errors.New("IP address is not a host address")
 	}
+	if isSet(p.blocked, off) {
+		return 0, ErrExcluded
+	}
+	return off, nil
+}
 
-	// 记录到已分配列表
-	p.allocated[ip.String()] = time.Now().Add(ttl)
-
-	return true, nil
+func (p *IPPool) addr(off uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], p.network+off)
+	return netip.AddrFrom4(b)
 }
 
-// CleanIP 清理指定的IP地址，使其重新可用
-func (p *IPPool) CleanIP(ipStr string) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+func (p *IPPool) isUsed(off uint32) bool {
+	return isSet(p.used, off)
+}
 
-	if !p.initialized {
-		return errors.New("IP pool not initialized")
+// nextFree 从 start 开始找第一个空闲地址，到末尾之后从头开始
+func (p *IPPool) nextFree(start uint32) (uint32, bool) {
+	if p.free == 0 {
+		return 0, false
 	}
-
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return errors.New("invalid IP address")
+	if off, ok := p.scan(start, p.size); ok {
+		return off, true
 	}
+	return p.scan(1, start-1)
+}
 
-	// 检查IP是否在范围内
-	if !p.network.Contains(ip) {
-		return errors.New("IP address not in pool range")
+// scan 在 [from, to] 中按 64 位一组找空闲地址
+func (p *IPPool) scan(from, to uint32) (uint32, bool) {
+	for off := from; off <= to; {
+		w := ^p.used[off/64] >> (off % 64)
+		if w != 0 {
+			found := off + uint32(bits.TrailingZeros64(w))
+			if found <= to {
+				return found, true
+			}
+			return 0, false
+		}
+		off = (off/64 + 1) * 64
 	}
+	return 0, false
+}
 
-	// 检查IP是否已被分配
-	if _, exists := p.allocated[ip.String()]; exists {
-		delete(p.allocated, ip.String())
-		// 添加到可用列表
-		p.available = append(p.available, ip)
-		return nil
+func (p *IPPool) allocate(off uint32, expires time.Time) {
+	if !p.isUsed(off) {
+		p.free--
 	}
-
-	// 检查IP是否已经在可用列表中
-	for _, availableIP := range p.available {
-		if availableIP.Equal(ip) {
-			return nil // 已经在可用列表中
-		}
+	set(p.used, off)
+	if i, ok := p.leases.index[off]; ok {
+		p.leases.items[i].expires = expires.UnixNano()
+		heap.Fix(&p.leases, i)
+		return
 	}
+	heap.Push(&p.leases, lease{off: off, expires: expires.UnixNano()})
+}
 
-	// 如果既不在已分配列表也不在可用列表，添加到可用列表
-	p.available = append(p.available, ip)
+// claim 续期或者分配给调用方，地址空闲、保留或者已经分配给调用方时成功
+func (p *IPPool) claim(off uint32, expires time.Time) error {
+	p.expire(off, time.Now())
+	_, leased := p.leases.index[off]
+	if p.isUsed(off) && !leased && !isSet(p.reserved, off) {
+		return ErrUnavailable
+	}
+	p.allocate(off, expires)
 	return nil
 }
 
-// CheckIP 检查IP状态，返回是否被占用和剩余存活时间
-func (p *IPPool) CheckIP(ipStr string) (bool, time.Duration, error) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	if !p.initialized {
-		return false, 0, errors.New("IP pool not initialized")
+// release 删除租约，没有保留的地址重新可用
+func (p *IPPool) release(off uint32) {
+	if i, ok := p.leases.index[off]; ok {
+		heap.Remove(&p.leases, i)
 	}
-
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return false, 0, errors.New("invalid IP address")
+	if p.isUsed(off) && !isSet(p.reserved, off) {
+		unset(p.used, off)
+		p.free++
 	}
+}
 
-	// 检查IP是否在范围内
-	if !p.network.Contains(ip) {
-		return false, 0, errors.New("IP address not in pool range")
+// expire 回收 off 上已经过期的租约
+func (p *IPPool) expire(off uint32, now time.Time) {
+	if i, ok := p.leases.index[off]; ok && p.leases.items[i].expires <= now.UnixNano() {
+		p.release(off)
 	}
+}
 
-	// 检查IP是否已被分配
-	if expiry, exists := p.allocated[ip.String()]; exists {
-		if time.Now().Before(expiry) {
-			return true, time.Until(expiry), nil
-		}
-		// IP已过期，视为可用
-		return false, 0, nil
+// cleanExpired 回收所有过期的租约
+func (p *IPPool) cleanExpired(now time.Time) {
+	n := now.UnixNano()
+	for len(p.leases.items) > 0 && p.leases.items[0].expires <= n {
+		p.release(p.leases.items[0].off)
 	}
+}
 
-	// 检查IP是否在可用列表中
-	for _, availableIP := range p.available {
-		if availableIP.Equal(ip) {
-			return false, 0, nil
-		}
-	}
+func isSet(bm []uint64, off uint32) bool {
+	return bm[off/64]&(1<<(off%64)) != 0
+}
 
-	// 如果既不在已分配列表也不在可用列表，视为可用
-	return false, 0, nil
+func set(bm []uint64, off uint32) {
+	bm[off/64] |= 1 << (off % 64)
 }
 
-// cleanExpired 清理过期的IP地址
-func (p *IPPool) cleanExpired() {
-	now := time.Now()
-	for ipStr, expiry := range p.allocated {
-		if now.After(expiry) {
-			delete(p.allocated, ipStr)
-			ip := net.ParseIP(ipStr)
-			if ip != nil {
-				p.available = append(p.available, ip)
-			}
-		}
-	}
+func unset(bm []uint64, off uint32) {
+	bm[off/64] &^= 1 << (off % 64)
+}
+
+// leaseHeap 按过期时间排序的租约，index 记录租约在堆中的下标
+type leaseHeap struct {
+	items []lease
+	index map[uint32]int
+}
+
+func (h *leaseHeap) Len() int { return len(h.items) }
+
+func (h *leaseHeap) Less(i, j int) bool {
+	return h.items[i].expires < h.items[j].expires
+}
+
+func (h *leaseHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].off] = i
+	h.index[h.items[j].off] = j
+}
+
+func (h *leaseHeap) Push(x any) {
+	l := x.(lease)
+	h.index[l.off] = len(h.items)
+	h.items = append(h.items, l)
+}
+
+func (h *leaseHeap) Pop() any {
+	l := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, l.off)
+	return l
 }
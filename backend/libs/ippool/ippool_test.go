@@ -0,0 +1,256 @@
+package ippool
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPreferred(t *testing.T) {
+	p1, _ := NewIPPool("10.0.0.0", "255.255.255.0")
+	p2, _ := NewIPPool("10.0.0.0", "255.255.255.0")
+
+	// 同一个 key 在不同的池中得到同一个地址
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("node%d", i)
+		ip1, err := p1.Preferred(key, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip2, _ := p2.Preferred(key, time.Hour)
+		if ip1 != ip2 {
+			t.Fatalf("%s: %s != %s", key, ip1, ip2)
+		}
+	}
+
+	// 冲突时探测下一个地址
+	ip, _ := p1.Preferred("node0", time.Hour)
+	if used, _, _ := p1.CheckIP(ip); !used {
+		t.Fatalf("expect %s to be allocated", ip)
+	}
+	p1.CleanIP(ip)
+	again, _ := p1.Preferred("node0", time.Hour)
+	if again != ip {
+		t.Fatalf("expect %s after release, got %s", ip, again)
+	}
+}
+
+func TestPreferredExhausted(t *testing.T) {
+	p, _ := NewIPPool("10.0.0.0", "255.255.255.248")
+	seen := map[string]bool{}
+	for i := 0; i < 6; i++ {
+		ip, err := p.Preferred("same", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[ip.String()] {
+			t.Fatalf("%s allocated twice", ip)
+		}
+		seen[ip.String()] = true
+	}
+	if _, err := p.Preferred("same", time.Hour); err == nil {
+		t.Fatalf("expect exhausted pool to fail")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	p, _ := NewIPPool("10.0.0.0", "255.255.255.248")
+	if err := p.Reserve(netip.MustParseAddr("10.0.0.0")); err == nil {
+		t.Fatalf("expect network address to be refused")
+	}
+	if err := p.Reserve(netip.MustParseAddr("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := p.RequestIP(netip.MustParseAddr("10.0.0.3"), time.Hour); ok {
+		t.Fatalf("expect reserved ip not to be requested")
+	}
+	for i := 0; i < 5; i++ {
+		ip, err := p.Random(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip == netip.MustParseAddr("10.0.0.3") {
+			t.Fatalf("reserved ip is allocated randomly")
+		}
+	}
+	if _, err := p.Random(time.Hour); err == nil {
+		t.Fatalf("expect pool to be exhausted")
+	}
+
+	// 只能通过 Renew 分配给保留的结点
+	if err := p.Renew(netip.MustParseAddr("10.0.0.3"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	p.CleanIP(netip.MustParseAddr("10.0.0.3"))
+	if _, err := p.Random(time.Hour); err == nil {
+		t.Fatalf("expect released reserved ip to stay reserved")
+	}
+
+	p.Unreserve(netip.MustParseAddr("10.0.0.3"))
+	if ok, _ := p.RequestIP(netip.MustParseAddr("10.0.0.3"), time.Hour); !ok {
+		t.Fatalf("expect ip to be available after unreserve")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	p, _ := NewIPPool("10.0.0.0", "255.255.255.252")
+	a, _ := p.Random(20 * time.Millisecond)
+	b, _ := p.Random(time.Hour)
+	if used, left, _ := p.CheckIP(a); !used || left <= 0 {
+		t.Fatalf("expect %s to be allocated", a)
+	}
+	if _, err := p.Random(time.Hour); err == nil {
+		t.Fatalf("expect pool to be exhausted")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if used, _, _ := p.CheckIP(a); used {
+		t.Fatalf("expect %s to be expired", a)
+	}
+	// 过期的地址重新分配
+	c, err := p.Random(time.Hour)
+	if err != nil || c != a {
+		t.Fatalf("expect expired %s to be reused, got %s %v", a, c, err)
+	}
+	if p.Used() != 2 {
+		t.Fatalf("expect 2 used, got %d", p.Used())
+	}
+	// 续期之后不会过期
+	if err := p.Renew(b, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Restore(b, time.Now().Add(-time.Second)); err == nil {
+		t.Fatalf("expect expired lease not to be restored")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := NewIPPool("10.0.0.0", "255.0.255.0"); err == nil {
+		t.Fatalf("expect non-contiguous mask to fail")
+	}
+	if _, err := NewIPPool("10.0.0.0", "255.255.255.254"); err == nil {
+		t.Fatalf("expect /31 to fail")
+	}
+	if _, err := NewIPPool("10.0.0.0", "254.0.0.0"); err == nil {
+		t.Fatalf("expect /7 to fail")
+	}
+	p, err := NewIPPool("10.0.3.7", "255.255.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Prefix() != netip.MustParsePrefix("10.0.0.0/16") || p.Size() != 65534 {
+		t.Fatalf("unexpected pool %s size %d", p.Prefix(), p.Size())
+	}
+	for _, ip := range []string{"10.1.0.1", "10.0.0.0", "10.0.255.255"} {
+		if ok, err := p.RequestIP(netip.MustParseAddr(ip), time.Hour); ok || err == nil {
+			t.Fatalf("expect %s to be refused", ip)
+		}
+	}
+	if ok, err := p.RequestIP(netip.MustParseAddr("::ffff:10.0.0.1"), time.Hour); !ok || err != nil {
+		t.Fatalf("expect mapped address to be accepted: %v", err)
+	}
+}
+
+// fill 分配 n 个地址，返回分配的地址
+func fill(tb testing.TB, p *IPPool, n int) []netip.Addr {
+	addrs := make([]netip.Addr, 0, n)
+	for i := 0; i < n; i++ {
+		ip, err := p.Random(time.Hour + time.Duration(i)*time.Second)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs
+}
+
+func TestLargePool(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	p, _ := NewIPPool("10.0.0.0", "255.255.0.0")
+	addrs := fill(t, p, 60000)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(p)
+
+	seen := make(map[netip.Addr]bool, len(addrs))
+	for _, ip := range addrs {
+		if seen[ip] {
+			t.Fatalf("%s allocated twice", ip)
+		}
+		seen[ip] = true
+	}
+	if p.Used() != 60000 {
+		t.Fatalf("expect 60000 used, got %d", p.Used())
+	}
+	size := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	t.Logf("pool with 60000 leases uses %d KB", size/1024)
+	if size > 8<<20 {
+		t.Fatalf("pool uses %d bytes", size)
+	}
+}
+
+func BenchmarkRandom(b *testing.B) {
+	p, _ := NewIPPool("10.0.0.0", "255.255.0.0")
+	fill(b, p, 60000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip, err := p.Random(time.Hour)
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.CleanIP(ip)
+	}
+}
+
+func BenchmarkPreferred(b *testing.B) {
+	p, _ := NewIPPool("10.0.0.0", "255.255.0.0")
+	fill(b, p, 60000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip, err := p.Preferred(strconv.Itoa(i), time.Hour)
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.CleanIP(ip)
+	}
+}
+
+func BenchmarkRequestIP(b *testing.B) {
+	p, _ := NewIPPool("10.0.0.0", "255.255.0.0")
+	addrs := fill(b, p, 60000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := addrs[i%len(addrs)]
+		p.CleanIP(ip)
+		if ok, err := p.RequestIP(ip, time.Hour); !ok || err != nil {
+			b.Fatalf("request %s: %v", ip, err)
+		}
+	}
+}
+
+func BenchmarkCheckIP(b *testing.B) {
+	p, _ := NewIPPool("10.0.0.0", "255.255.0.0")
+	addrs := fill(b, p, 60000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.CheckIP(addrs[i%len(addrs)])
+	}
+}
+
+func BenchmarkRenew(b *testing.B) {
+	p, _ := NewIPPool("10.0.0.0", "255.255.0.0")
+	addrs := fill(b, p, 60000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Renew(addrs[i%len(addrs)], time.Hour+time.Duration(i)*time.Millisecond)
+	}
+}
@@ -0,0 +1,224 @@
+package ippool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrExcluded 地址不在可分配的范围内，或者被排除
+var ErrExcluded = errors.New("IP address is excluded from the pool")
+
+// Range 一段连续的 IPv4 地址，包括 Start 和 End
+type Range struct {
+	Start netip.Addr
+	End   netip.Addr
+}
+
+// ParseRange 解析 "10.0.0.1"、"10.0.0.0/25" 或 "10.0.0.10-10.0.0.200"
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		start, err := netip.ParseAddr(strings.TrimSpace(from))
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid range %q: %w", s, err)
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(to))
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid range %q: %w", s, err)
+		}
+		r := Range{Start: start.Unmap(), End: end.Unmap()}
+		if !r.Start.Is4() || !r.End.Is4() {
+			return Range{}, fmt.Errorf("invalid range %q: not IPv4", s)
+		}
+		if r.End.Less(r.Start) {
+			return Range{}, fmt.Errorf("invalid range %q: end is before start", s)
+		}
+		return r, nil
+	}
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil || !prefix.Addr().Unmap().Is4() {
+			return Range{}, fmt.Errorf("invalid range %q", s)
+		}
+		// IPv4 映射的地址去掉前缀之后位数不能超过 32，比如 ::ffff:10.0.0.0/120
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+		if !prefix.IsValid() || prefix.Bits() > 32 {
+			return Range{}, fmt.Errorf("invalid range %q", s)
+		}
+		first := binary.BigEndian.Uint32(prefix.Addr().AsSlice())
+		last := first | uint32(1<<(32-prefix.Bits())-1)
+		return Range{Start: prefix.Addr(), End: addrFrom(last)}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil || !addr.Unmap().Is4() {
+		return Range{}, fmt.Errorf("invalid address %q", s)
+	}
+	return Range{Start: addr.Unmap(), End: addr.Unmap()}, nil
+}
+
+func (r Range) String() string {
+	if r.Start == r.End {
+		return r.Start.String()
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
+
+func (r Range) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.Less(r.Start) && !r.End.Less(addr)
+}
+
+// Config 地址池的配置
+type Config struct {
+	Prefix netip.Prefix
+	// 可分配的范围，为空时整个网段都可以分配，范围之间不能重叠
+	Ranges []Range
+	// 不分配的地址，比如网关和 DNS
+	Exclude []Range
+}
+
+// RangeStat 一段地址的使用情况
+type RangeStat struct {
+	Range string `json:"range"`
+	// 可分配的地址数，不包括排除的地址
+	Size int `json:"size"`
+	// 已分配和保留的地址数
+	Used int `json:"used"`
+}
+
+// Utilization 已使用的比例
+func (s RangeStat) Utilization() float64 {
+	if s.Size == 0 {
+		return 0
+	}
+	return float64(s.Used) / float64(s.Size)
+}
+
+// NewWithConfig 创建只在 Ranges 中分配、并且跳过 Exclude 的地址池
+func NewWithConfig(cfg Config) (*IPPool, error) {
+	p, err := New(cfg.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]offRange, 0, len(cfg.Ranges))
+	for _, r := range cfg.Ranges {
+		or, err := p.offRange(r)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, or)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].from < ranges[j].from })
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].from <= ranges[i-1].to {
+			return nil, fmt.Errorf("range %s overlaps %s", p.rangeOf(ranges[i]), p.rangeOf(ranges[i-1]))
+		}
+	}
+	if len(ranges) > 0 {
+		p.ranges = ranges
+		// 先排除整个网段，再放开配置的范围
+		for off := uint32(1); off <= p.size; off++ {
+			set(p.blocked, off)
+		}
+		for _, r := range ranges {
+			for off := r.from; off <= r.to; off++ {
+				unset(p.blocked, off)
+			}
+		}
+	}
+	for _, r := range cfg.Exclude {
+		or, err := p.offRange(r)
+		if err != nil {
+			return nil, fmt.Errorf("exclude: %w", err)
+		}
+		for off := or.from; off <= or.to; off++ {
+			set(p.blocked, off)
+		}
+	}
+
+	for off := uint32(1); off <= p.size; off++ {
+		if isSet(p.blocked, off) {
+			set(p.used, off)
+			p.capacity--
+			p.free--
+		}
+	}
+	if p.capacity == 0 {
+		return nil, errors.New("no address left to allocate")
+	}
+	return p, nil
+}
+
+// offRange 用偏移表示的一段主机地址，包括 from 和 to
+type offRange struct {
+	from, to uint32
+}
+
+// offRange 把 r 转换为偏移，去掉网络地址和广播地址
+func (p *IPPool) offRange(r Range) (offRange, error) {
+	if !p.prefix.Contains(r.Start.Unmap()) || !p.prefix.Contains(r.End.Unmap()) {
+		return offRange{}, fmt.Errorf("%s is not in %s", r, p.prefix)
+	}
+	from := binary.BigEndian.Uint32(r.Start.Unmap().AsSlice()) - p.network
+	to := binary.BigEndian.Uint32(r.End.Unmap().AsSlice()) - p.network
+	from = max(from, 1)
+	to = min(to, p.size)
+	if from > to {
+		return offRange{}, fmt.Errorf("%s has no host address", r)
+	}
+	return offRange{from: from, to: to}, nil
+}
+
+func (p *IPPool) rangeOf(r offRange) Range {
+	return Range{Start: p.addr(r.from), End: p.addr(r.to)}
+}
+
+// Stats 每个范围的使用情况，没有配置范围时只有整个网段
+func (p *IPPool) Stats() []RangeStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cleanExpired(time.Now())
+
+	ranges := p.ranges
+	if len(ranges) == 0 {
+		ranges = []offRange{{from: 1, to: p.size}}
+	}
+	stats := make([]RangeStat, 0, len(ranges))
+	for _, r := range ranges {
+		blocked := countRange(p.blocked, r.from, r.to)
+		stats = append(stats, RangeStat{
+			Range: p.rangeOf(r).String(),
+			Size:  int(r.to-r.from+1) - blocked,
+			Used:  countRange(p.used, r.from, r.to) - blocked,
+		})
+	}
+	return stats
+}
+
+// countRange [from, to] 中置位的个数
+func countRange(bm []uint64, from, to uint32) int {
+	n := 0
+	for off := from; off <= to; {
+		w := bm[off/64] >> (off % 64)
+		width := 64 - off%64
+		if rem := to - off + 1; rem < width {
+			w &= 1<<rem - 1
+			width = rem
+		}
+		n += bits.OnesCount64(w)
+		off += width
+	}
+	return n
+}
+
+func addrFrom(v uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return netip.AddrFrom4(b)
+}
@@ -0,0 +1,129 @@
+package ippool
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.1":               "10.0.0.1",
+		" 10.0.0.10 - 10.0.0.20": "10.0.0.10-10.0.0.20",
+		"10.0.0.77/26":           "10.0.0.64-10.0.0.127",
+	}
+	for in, want := range cases {
+		r, err := ParseRange(in)
+		if err != nil {
+			t.Fatalf("%q: %v", in, err)
+		}
+		if r.String() != want {
+			t.Fatalf("%q: expect %s, got %s", in, want, r)
+		}
+	}
+	for _, in := range []string{"", "10.0.0.20-10.0.0.10", "fd00::1", "10.0.0.0/33", "a-b", "::ffff:10.0.0.0/120"} {
+		if _, err := ParseRange(in); err == nil {
+			t.Fatalf("expect %q to fail", in)
+		}
+	}
+}
+
+func mustRanges(t *testing.T, arr ...string) []Range {
+	t.Helper()
+	ranges := make([]Range, 0, len(arr))
+	for _, s := range arr {
+		r, err := ParseRange(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+func TestRanges(t *testing.T) {
+	p, err := NewWithConfig(Config{
+		Prefix:  netip.MustParsePrefix("10.0.0.0/24"),
+		Ranges:  mustRanges(t, "10.0.0.100-10.0.0.109", "10.0.0.0/30"),
+		Exclude: mustRanges(t, "10.0.0.1", "10.0.0.105"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10.0.0.0/30 只有 .1 .2 .3 是主机地址，.1 被排除
+	if p.Size() != 11 {
+		t.Fatalf("expect 11 addresses, got %d", p.Size())
+	}
+
+	seen := map[netip.Addr]bool{}
+	for i := 0; i < p.Size(); i++ {
+		ip, err := p.Random(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := false
+		for _, r := range mustRanges(t, "10.0.0.2-10.0.0.3", "10.0.0.100-10.0.0.109") {
+			in = in || r.Contains(ip)
+		}
+		if !in || ip == netip.MustParseAddr("10.0.0.105") || seen[ip] {
+			t.Fatalf("unexpected address %s", ip)
+		}
+		seen[ip] = true
+	}
+	if _, err := p.Random(time.Hour); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("expect exhausted pool, got %v", err)
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.50", "10.0.0.105"} {
+		if _, err := p.RequestIP(netip.MustParseAddr(ip), time.Hour); !errors.Is(err, ErrExcluded) {
+			t.Fatalf("expect %s to be excluded, got %v", ip, err)
+		}
+		if err := p.Reserve(netip.MustParseAddr(ip)); !errors.Is(err, ErrExcluded) {
+			t.Fatalf("expect %s not to be reserved, got %v", ip, err)
+		}
+	}
+
+	p.CleanIP(netip.MustParseAddr("10.0.0.2"))
+	p.CleanIP(netip.MustParseAddr("10.0.0.100"))
+	stats := p.Stats()
+	want := []RangeStat{
+		{Range: "10.0.0.1-10.0.0.3", Size: 2, Used: 1},
+		{Range: "10.0.0.100-10.0.0.109", Size: 9, Used: 8},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Fatalf("expect %+v, got %+v", want[i], stats[i])
+		}
+	}
+	if p.Used() != 9 {
+		t.Fatalf("expect 9 used, got %d", p.Used())
+	}
+}
+
+func TestRangesInvalid(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+	configs := []Config{
+		{Prefix: prefix, Ranges: mustRanges(t, "10.0.1.0/28")},
+		{Prefix: prefix, Ranges: mustRanges(t, "10.0.0.10-10.0.0.20", "10.0.0.20-10.0.0.30")},
+		{Prefix: prefix, Exclude: mustRanges(t, "10.0.0.0/24")},
+		{Prefix: prefix, Ranges: mustRanges(t, "10.0.0.255")},
+	}
+	for _, cfg := range configs {
+		if _, err := NewWithConfig(cfg); err == nil {
+			t.Fatalf("expect %+v to fail", cfg)
+		}
+	}
+
+	// 没有配置范围时整个网段可分配
+	p, err := NewWithConfig(Config{Prefix: prefix, Exclude: mustRanges(t, "10.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); len(stats) != 1 || stats[0].Size != 253 || stats[0].Used != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
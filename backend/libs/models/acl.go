@@ -0,0 +1,32 @@
+package models
+
+// ACLAction 规则的动作
+type ACLAction string
+
+const (
+	ACLAccept ACLAction = "accept"
+	ACLDeny   ACLAction = "deny"
+)
+
+// ACLPolicy space 的访问控制策略，路由器按顺序使用第一条匹配的规则
+type ACLPolicy struct {
+	// 没有规则匹配时的动作，为空时为 accept
+	Default ACLAction `json:"default,omitempty" yaml:"default"`
+	// 标签 -> 选择器，标签中不能再引用标签
+	Tags  map[string][]string `json:"tags,omitempty" yaml:"tags"`
+	Rules []ACLRule           `json:"rules" yaml:"rules"`
+	// 被拒绝的包写入日志
+	LogDenied bool `json:"log_denied,omitempty" yaml:"log_denied"`
+}
+
+// ACLRule 一条规则，Src 和 Dst 为选择器:
+// * 任意地址，node:<NodeID>，app:<AppID>，type:app 或 type:client，tag:<标签>，或者 IP、CIDR
+type ACLRule struct {
+	Action ACLAction `json:"action" yaml:"action"`
+	Src    []string  `json:"src" yaml:"src"`
+	Dst    []string  `json:"dst" yaml:"dst"`
+	// tcp、udp、icmp 或协议号，为空时匹配任意协议
+	Proto string `json:"proto,omitempty" yaml:"proto"`
+	// 目的端口，例如 22、8000-8100，为空时匹配任意端口
+	Ports []string `json:"ports,omitempty" yaml:"ports"`
+}
@@ -1,33 +1,170 @@
 package models
 
-import "time"
+import (
+	"net/netip"
+	"time"
+)
 
 type RegisterRequest struct {
 	MoonServer string    `yaml:"moon_server" json:"moon_server"` // moon server的服务地址
 	NodeName   string    `yaml:"node_name" json:"node_name"`     // 客户端名称
 	SpaceNode  SpaceNode `yaml:"space_node" json:"space_node"`   // 注册请求的配置
 	NetConfig  NetConfig `yaml:"net_config" json:"net_config"`   //注册请求的配置
+	// 加入 space 的凭证，见 JoinToken
+	Token string `yaml:"token" json:"token,omitempty"`
+	// 客户端支持的能力，老版本客户端为空
+	Capabilities []string `yaml:"capabilities" json:"capabilities,omitempty"`
+	// 端到端加密的静态公钥和本次连接的临时公钥，base64
+	PublicKey    string `yaml:"public_key" json:"public_key,omitempty"`
+	EphemeralKey string `yaml:"ephemeral_key" json:"ephemeral_key,omitempty"`
+	// 上一次连接的会话票据，用来恢复原来的 IP
+	Ticket string `yaml:"ticket" json:"ticket,omitempty"`
+	// 可以经过这个结点到达的网段，CIDR，管理员批准之后生效
+	Routes []string `yaml:"routes" json:"routes,omitempty"`
+	// 愿意作为出口结点，替选择了它的结点转发发往 space 之外的流量
+	AdvertiseExit bool `yaml:"advertise_exit" json:"advertise_exit,omitempty"`
+	// 选择的出口结点，NodeID 或者 space DNS 中的名字，为空时不使用出口结点
+	ExitNode string `yaml:"exit_node" json:"exit_node,omitempty"`
 }
 
 // 请求
 type NetConfig struct {
-	Type     string `yaml:"type" json:"type"`       // ipv4,ipv6,ip
+	Type     string `yaml:"type" json:"type"`       // ipv4,ipv6,ip，ipv6 和 ip 在 space 配置了 IPv6 网段时分配 IPv6 地址
 	DHCPType string `yaml:"dhcptyp" json:"dhcptyp"` //auto,static
 	// 仅static有效
 	IPv4 string `yaml:"addr" json:"addr"`
-	// Alive seconds
+	// 请求的租期，小于 0 表示租约跟随会话，为 0 时使用 space 的默认租期
 	Alive time.Duration `yaml:"alive" json:"alive"`
 }
 
 // 申请的返回结果
 type RegisterResp struct {
 	// 仅static有效
-	IPv4  string        `yaml:"addr" json:"addr"`
+	IPv4 string `yaml:"addr" json:"addr"`
+	// 前缀长度、MTU、路由和 DNS
+	NetProfile `yaml:",inline"`
+	// space 配置了 IPv6 网段并且请求的 Type 为 ipv6 或 ip 时分配
+	IPv6     string `yaml:"addr6" json:"addr6,omitempty"`
+	IPv6Bits int    `yaml:"bits6" json:"bits6,omitempty"`
+	// 批准的租期，小于 0 表示租约跟随会话
 	Alive time.Duration `yaml:"alive" json:"alive"`
+	// 协商后双方都支持的能力
+	Capabilities []string `yaml:"capabilities" json:"capabilities,omitempty"`
+	// space 开启了端到端加密，数据包必须加密后发送
+	E2E bool `yaml:"e2e" json:"e2e,omitempty"`
+	// 断线重连时使用的会话票据
+	Ticket string `yaml:"ticket" json:"ticket,omitempty"`
+	// 用票据恢复了原来的 IP
+	Resumed bool `yaml:"resumed" json:"resumed,omitempty"`
+	// 结点在 space 内的域名，例如 laptop.space1
+	Domain string `yaml:"domain" json:"domain,omitempty"`
+}
+
+// NetProfile 服务端下发的网络配置，在注册回执中，space 的配置修改之后通过 FrameProfile 更新
+type NetProfile struct {
+	// IPv4 网段的前缀长度，老版本服务端为 0，按 24 处理
+	Bits int `yaml:"bits" json:"bits,omitempty"`
+	// TUN 网卡的 MTU，老版本服务端为 0，客户端使用默认值
+	MTU int `yaml:"mtu" json:"mtu,omitempty"`
+	// 除 space 网段之外经过 TUN 的网段，CIDR
+	Routes []string `yaml:"routes" json:"routes,omitempty"`
+	// space 内置 DNS 的地址和搜索域，老版本服务端为空
+	DNS    []string `yaml:"dns" json:"dns,omitempty"`
+	Search []string `yaml:"search" json:"search,omitempty"`
+	// 正在使用的出口结点的地址，为空时发往 space 之外的流量不经过 TUN
+	Exit string `yaml:"exit" json:"exit,omitempty"`
+}
+
+// Prefixes 分配的地址和所在网段的前缀长度，用来配置 TUN 网卡
+func (r *RegisterResp) Prefixes() []netip.Prefix {
+	arr := make([]netip.Prefix, 0, 2)
+	bits := r.Bits
+	if bits == 0 {
+		bits = 24
+	}
+	if addr, err := netip.ParseAddr(r.IPv4); err == nil {
+		arr = append(arr, netip.PrefixFrom(addr, bits))
+	}
+	if addr, err := netip.ParseAddr(r.IPv6); err == nil && r.IPv6Bits > 0 {
+		arr = append(arr, netip.PrefixFrom(addr, r.IPv6Bits))
+	}
+	return arr
+}
+
+// 注册被拒绝时的回复
+type ErrorResp struct {
+	Code    string `yaml:"code" json:"code"`
+	Message string `yaml:"message" json:"message"`
+}
+
+// 用 join token 申请结点证书
+type EnrollRequest struct {
+	NodeID string `yaml:"node_id" json:"node_id"`
+	Token  string `yaml:"token" json:"token"`
+	// pem 格式的证书签名请求
+	CSR string `yaml:"csr" json:"csr"`
+}
+
+type EnrollResp struct {
+	NodeID string `yaml:"node_id" json:"node_id"`
+	// pem 格式，CommonName 为 NodeID
+	Cert string `yaml:"cert" json:"cert"`
+	CA   string `yaml:"ca" json:"ca"`
+}
+
+// 在已注册的连接上轮换证书，NodeID 以连接的证书为准
+type RenewCertRequest struct {
+	CSR string `yaml:"csr" json:"csr"`
+}
+
+// 端到端加密的对端
+type Peer struct {
+	NodeID       string `yaml:"node_id" json:"node_id"`
+	IP           string `yaml:"ip" json:"ip"`
+	IPv6         string `yaml:"ip6" json:"ip6,omitempty"`
+	PublicKey    string `yaml:"public_key" json:"public_key"`
+	EphemeralKey string `yaml:"ephemeral_key" json:"ephemeral_key"`
+}
+
+// 服务端下发的在线结点列表，结点上下线时重新下发
+type PeerList struct {
+	Peers []Peer `yaml:"peers" json:"peers"`
+}
+
+// 注册之后服务端通过 tcp 下发的 UDP 会话，数据报用 Key 加密
+type UDPSession struct {
+	// hex
+	SessionID string `yaml:"session_id" json:"session_id"`
+	// base64
+	Key  string `yaml:"key" json:"key"`
+	Port int    `yaml:"port" json:"port"`
+}
+
+// 连接期间服务端定期下发的新票据
+type SessionTicket struct {
+	Ticket string `yaml:"ticket" json:"ticket"`
+}
+
+// 心跳，Time 为发送方的时间(UnixNano)，对端原样返回用来计算 RTT
+type Heartbeat struct {
+	Time int64 `yaml:"time" json:"time"`
 }
 
 // 给tun_setup使用的
 type TunSetupConfig struct {
 	IPv4 string `json:"ipv4"`
+	// 为空时不配置 IPv6，格式同 IPv4，带前缀长度
+	IPv6 string `json:"ipv6"`
 	Name string `json:"name"`
 }
+
+// 在连接上续期地址租约，Alive 的含义同 NetConfig.Alive
+type LeaseRenewRequest struct {
+	Alive time.Duration `yaml:"alive" json:"alive"`
+}
+
+// 续期结果，Alive 为服务端批准的租期，小于 0 表示租约跟随会话
+type LeaseRenewResp struct {
+	IPv4  string        `yaml:"addr" json:"addr"`
+	Alive time.Duration `yaml:"alive" json:"alive"`
+}
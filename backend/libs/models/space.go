@@ -41,6 +41,38 @@ type SpaceItemConfig struct {
 	ID      string `json:"id" yaml:"id" gorm:"primaryKey"`
 	NetAddr string `json:"net_addr" yaml:"net_addr"`
 	Mask    string `json:"mask" yaml:"mask"`
+	// 服务端 tls 证书的 SHA-256 指纹，客户端用来校验服务端
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint" gorm:"-"`
+	// 结点之间端到端加密，服务端只按外层头部转发
+	E2E bool `json:"e2e" yaml:"e2e"`
+	// 租约策略，结点请求的租期限制在 [LeaseMin, LeaseMax]，没有请求时为 LeaseDefault
+	// 为 0 时使用默认值
+	LeaseMin     time.Duration `json:"lease_min" yaml:"lease_min"`
+	LeaseMax     time.Duration `json:"lease_max" yaml:"lease_max"`
+	LeaseDefault time.Duration `json:"lease_default" yaml:"lease_default"`
+	// 可分配的地址范围，每项为单个地址、CIDR 或者 "起始-结束"，为空时整个网段都可以分配
+	Ranges []string `json:"ranges" yaml:"ranges" gorm:"serializer:json"`
+	// 不分配的地址，格式同 Ranges
+	Exclude []string `json:"exclude" yaml:"exclude" gorm:"serializer:json"`
+	// 网关地址，为空时使用网段的第一个主机地址，不分配给结点
+	Gateway string `json:"gateway" yaml:"gateway"`
+	// DNS 地址，不分配给结点
+	DNS []string `json:"dns" yaml:"dns" gorm:"serializer:json"`
+	// IPv6 网段，为空时不分配 IPv6 地址，必须是 ULA(fc00::/7)
+	// 结点的 IPv6 地址与 IPv4 地址在各自网段中的偏移相同
+	IPv6 string `json:"ipv6" yaml:"ipv6"`
+	// 允许使用非私有网段，默认拒绝
+	AllowPublic bool `json:"allow_public" yaml:"allow_public"`
+	// 内置 DNS 转发 space 之外的域名时使用的服务器，为空时使用 /etc/resolv.conf 中的
+	Upstream []string `json:"upstream" yaml:"upstream" gorm:"serializer:json"`
+	// 下发给结点的 MTU，为 0 时使用默认值
+	MTU int `json:"mtu" yaml:"mtu"`
+	// 下发给结点的其它网段，CIDR，结点把这些网段的流量发到 space
+	Routes []string `json:"routes" yaml:"routes" gorm:"serializer:json"`
+	// 下发给结点的其它搜索域，排在 space 自己的后缀之后
+	Search []string `json:"search" yaml:"search" gorm:"serializer:json"`
+	// 结点之间的访问控制策略，为空时结点之间可以互相访问
+	ACL *ACLPolicy `json:"acl,omitempty" yaml:"acl" gorm:"serializer:json"`
 }
 
 type SpaceNode struct {
@@ -56,4 +88,58 @@ type SpaceNode struct {
 type SpaceAppNodeConfig struct {
 	NodeConfig  SpaceNode       `json:"node_config" yaml:"node_config"`
 	SpaceConfig SpaceItemConfig `json:"space_config" yaml:"space_config"`
+	Token       string          `json:"token" yaml:"token"`
+	// 保存结点私钥和证书的目录
+	IdentityDir string `json:"identity_dir" yaml:"identity_dir"`
+}
+
+// IPLease space 分配给结点的地址，服务端重启之后恢复到地址池
+type IPLease struct {
+	SpaceID   string    `json:"space_id" gorm:"primaryKey"`
+	IP        string    `json:"ip" gorm:"primaryKey"`
+	NodeID    string    `json:"node_id" gorm:"index"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// 租约跟随会话，连接断开时释放
+	Session bool `json:"session"`
+	// 结点最后一次在线的时间
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// NodeRecord 加入过 space 的结点，结点离线之后仍然保留
+type NodeRecord struct {
+	SpaceID   string    `json:"space_id" gorm:"primaryKey"`
+	NodeID    string    `json:"node_id" gorm:"primaryKey"`
+	NodeType  NodeType  `json:"node_type"`
+	AppID     string    `json:"app_id"`
+	Service   string    `json:"service"`
+	Domain    string    `json:"domain"`
+	IP        string    `json:"ip"`
+	PublicKey string    `json:"public_key"`
+	LastSeen  time.Time `json:"last_seen"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SubnetRoute 结点注册时通告的可以经过它到达的网段，管理员批准之后 space 把发往这个网段的包转发给该结点
+type SubnetRoute struct {
+	SpaceID   string    `json:"space_id" gorm:"primaryKey"`
+	NodeID    string    `json:"node_id" gorm:"primaryKey"`
+	Prefix    string    `json:"prefix" gorm:"primaryKey"`
+	Approved  bool      `json:"approved"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExitNode 结点注册时表示愿意作为出口结点，管理员批准之后其它结点才能选择它
+type ExitNode struct {
+	SpaceID   string    `json:"space_id" gorm:"primaryKey"`
+	NodeID    string    `json:"node_id" gorm:"primaryKey"`
+	Approved  bool      `json:"approved"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IPReservation 管理员为结点固定的地址，auto 和 static 分配都以它为准
+type IPReservation struct {
+	SpaceID   string    `json:"space_id" gorm:"primaryKey"`
+	NodeID    string    `json:"node_id" gorm:"primaryKey"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
 }
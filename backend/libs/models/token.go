@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// JoinToken 结点加入 space 时需要携带的凭证
+type JoinToken struct {
+	Token   string `json:"token" gorm:"primaryKey"`
+	SpaceID string `json:"space_id" gorm:"index"`
+	// 可重复使用，否则使用一次后失效
+	Reusable bool `json:"reusable"`
+	// 为空表示不过期
+	ExpiresAt *time.Time `json:"expires_at"`
+	Used      int        `json:"used"`
+	Revoked   bool       `json:"revoked"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Valid 判断 token 在 now 时是否还能使用
+func (t *JoinToken) Valid(now time.Time) bool {
+	if t.Revoked {
+		return false
+	}
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return false
+	}
+	if !t.Reusable && t.Used > 0 {
+		return false
+	}
+	return true
+}
+
+// RevokedNode 被吊销的结点，不能再申请证书，也不能再注册
+type RevokedNode struct {
+	NodeID    string    `json:"node_id" gorm:"primaryKey"`
+	SpaceID   string    `json:"space_id" gorm:"index"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,195 @@
+package nodeclient
+
+import (
+	"math/rand"
+	"net"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+)
+
+// Conn 断线之后自动重连的连接，重连时出示会话票据恢复原来的 IP
+// 重连期间写入的数据包会被丢弃，由上层协议重传
+type Conn struct {
+	client *Client
+	req    *models.RegisterRequest
+
+	mu   sync.RWMutex
+	sess *Session
+	resp *models.RegisterResp
+	// 每次换成新的 Session 时关闭并替换
+	changed chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// OnReconnect 重连成功之后调用，resp 中的 IP 可能与之前不同
+	OnReconnect func(resp *models.RegisterResp)
+	// OnRenumber 服务端修改网段之后调用，resp 中为新的地址和前缀长度，返回之前需要换上新的地址
+	// 返回之后服务端在原来的连接上换地址，不支持 CapRenumberAck 的服务端随后断开，重连时恢复新的地址
+	OnRenumber func(resp *models.RegisterResp)
+	// OnProfile 服务端修改了 MTU、路由或 DNS 之后调用
+	OnProfile func(p *models.NetProfile)
+}
+
+// Dial 注册到 MoonServer，连接断开之后在后台重连，直到调用 Close
+func (c *Client) Dial(req *models.RegisterRequest) (*Conn, *models.RegisterResp, error) {
+	conn := &Conn{
+		client:  c,
+		req:     req,
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	c.onRenumber = conn.renumbered
+	c.onProfile = conn.profiled
+	sess, resp, err := c.Connect(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.sess, conn.resp = sess, resp
+	go conn.maintain()
+	return conn, resp, nil
+}
+
+// renumbered 服务端通过 FrameRenumber 下发了新的地址
+func (c *Conn) renumbered(resp *models.RegisterResp) {
+	c.mu.Lock()
+	c.resp = resp
+	c.mu.Unlock()
+	if c.OnRenumber != nil {
+		c.OnRenumber(resp)
+	}
+}
+
+// profiled 服务端通过 FrameProfile 下发了新的网络配置
+func (c *Conn) profiled(p *models.NetProfile) {
+	c.mu.Lock()
+	// Dial 返回之前 resp 还没有保存
+	if c.resp != nil {
+		resp := *c.resp
+		resp.NetProfile = *p
+		c.resp = &resp
+	}
+	c.mu.Unlock()
+	if c.OnProfile != nil {
+		c.OnProfile(p)
+	}
+}
+
+func (c *Conn) current() (*Session, chan struct{}) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sess, c.changed
+}
+
+// Session 当前的连接
+func (c *Conn) Session() *Session {
+	sess, _ := c.current()
+	return sess
+}
+
+// maintain 等待当前连接断开，然后按指数退避重连
+func (c *Conn) maintain() {
+	log := c.client.Log
+	for {
+		sess, _ := c.current()
+		select {
+		case <-c.closed:
+			return
+		case <-sess.dead:
+		}
+		log.Warnf("connection to MoonServer lost: %v, reconnecting", sess.err)
+
+		backoff := reconnectMinBackoff
+		for {
+			// 加一点随机，避免所有结点同时重连
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+			select {
+			case <-c.closed:
+				return
+			case <-time.After(wait):
+			}
+
+			c.req.Ticket = sess.Ticket()
+			next, resp, err := c.client.Connect(c.req)
+			if err != nil {
+				log.Warnf("reconnect failed: %v, retry in about %s", err, backoff)
+				backoff = min(backoff*2, reconnectMaxBackoff)
+				continue
+			}
+			if resp.Resumed {
+				log.Infof("session resumed with ip %s", resp.IPv4)
+			} else {
+				log.Warnf("session could not be resumed, new ip %s", resp.IPv4)
+			}
+
+			c.mu.Lock()
+			c.sess, c.resp = next, resp
+			close(c.changed)
+			c.changed = make(chan struct{})
+			c.mu.Unlock()
+
+			select {
+			case <-c.closed:
+				next.Close()
+				return
+			default:
+			}
+			if c.OnReconnect != nil {
+				c.OnReconnect(resp)
+			}
+			break
+		}
+	}
+}
+
+// ReadPacket 读取下一个 ip 包，连接断开时等待重连，只有 Close 之后才返回错误
+func (c *Conn) ReadPacket() ([]byte, error) {
+	for {
+		sess, changed := c.current()
+		pkt, err := sess.ReadPacket()
+		if err == nil {
+			return pkt, nil
+		}
+		select {
+		case <-changed:
+		case <-c.closed:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// WritePacket 发送一个 ip 包，重连期间丢弃
+func (c *Conn) WritePacket(pkt []byte) error {
+	sess, _ := c.current()
+	if err := sess.WritePacket(pkt); err != nil {
+		select {
+		case <-c.closed:
+			return net.ErrClosed
+		default:
+		}
+		c.client.Log.Debugf("drop packet while reconnecting: %v", err)
+	}
+	return nil
+}
+
+// Leave 通知服务端收回分配到的地址之后关闭连接，用于注册之后不再使用这个地址
+func (c *Conn) Leave() error {
+	sess, _ := c.current()
+	if err := sess.WriteFrame(protocol.FrameLeave, nil); err != nil {
+		c.client.Log.Debugf("write leave: %v", err)
+	}
+	return c.Close()
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	sess, _ := c.current()
+	return sess.Close()
+}
@@ -0,0 +1,47 @@
+package nodeclient
+
+import (
+	"encoding/json"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"time"
+)
+
+const (
+	heartbeatInterval = 10 * time.Second
+	// 超过这个时间没有收到服务端的任何数据，认为连接已经断开
+	heartbeatTimeout = 30 * time.Second
+)
+
+// heartbeat 定期发送心跳，服务端超时没有响应时关闭连接
+func (s *Session) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.dead:
+			return
+		case <-ticker.C:
+		}
+		last := time.Unix(0, s.lastRecv.Load())
+		if time.Since(last) > heartbeatTimeout {
+			s.log.Warnf("MoonServer missed heartbeats since %s, closing connection", last.Format(time.RFC3339))
+			s.Close()
+			return
+		}
+		if err := s.WriteJSON(protocol.FramePing, &models.Heartbeat{Time: time.Now().UnixNano()}); err != nil {
+			s.log.Debugf("write ping: %v", err)
+		}
+	}
+}
+
+func (s *Session) pong(payload []byte) {
+	hb := &models.Heartbeat{}
+	if err := json.Unmarshal(payload, hb); err != nil {
+		s.log.Debugf("decode pong: %v", err)
+		return
+	}
+	if rtt := time.Since(time.Unix(0, hb.Time)); rtt >= 0 {
+		s.rtt.Store(int64(rtt))
+	}
+}
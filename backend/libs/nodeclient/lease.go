@@ -0,0 +1,66 @@
+package nodeclient
+
+import (
+	"encoding/json"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"time"
+)
+
+// 续期没有回复时最短的重试间隔
+const minLeaseRetry = 100 * time.Millisecond
+
+// LeaseExpires 地址租约的过期时间，租约跟随会话时为零值
+func (s *Session) LeaseExpires() time.Time {
+	v := s.leaseExpires.Load()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+func (s *Session) setLease(ttl time.Duration) {
+	s.leaseExpires.Store(time.Now().Add(ttl).UnixNano())
+}
+
+// leaseLoop 租约过半时在连接上续期，没有回复时在剩余时间过半时重试
+// alive 为请求的租期，同 NetConfig.Alive
+func (s *Session) leaseLoop(alive time.Duration) {
+	for {
+		wait := time.Until(s.LeaseExpires()) / 2
+		if wait < minLeaseRetry {
+			wait = minLeaseRetry
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.dead:
+			timer.Stop()
+			return
+		case <-s.leaseRenewed:
+			// 续期成功，按新的过期时间重新计算
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		if err := s.WriteJSON(protocol.FrameRenewLease, &models.LeaseRenewRequest{Alive: alive}); err != nil {
+			s.log.Debugf("write renew lease: %v", err)
+		}
+	}
+}
+
+func (s *Session) leaseResp(payload []byte) {
+	resp := &models.LeaseRenewResp{}
+	if err := json.Unmarshal(payload, resp); err != nil {
+		s.log.Errorf("decode renew lease resp: %v", err)
+		return
+	}
+	if resp.Alive < 0 {
+		return
+	}
+	s.setLease(resp.Alive)
+	s.log.Debugf("Lease of %s renewed for %s", resp.IPv4, resp.Alive)
+	select {
+	case s.leaseRenewed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,340 @@
+package nodeclient
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"spacenode/libs/e2e"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"spacenode/libs/spaceca"
+	"spacenode/libs/spacetls"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// 检查证书是否需要轮换的间隔
+const renewCheckInterval = time.Hour
+
+// Client 负责结点与 MoonServer 之间的连接: 申请证书、注册、轮换证书
+// linux 和 windows 客户端共用
+type Client struct {
+	// MoonServer 的地址 host:port，或者 ws:// wss:// 开头的 WebSocket 地址
+	Server string
+	// 服务端证书指纹
+	Fingerprint string
+	// 没有证书时用来申请证书的 join token
+	Token    string
+	Identity *spaceca.Identity
+	// 要接入的 space，证书绑定的是其它 space 时用 join token 重新申请，为空时不检查
+	SpaceID string
+	// 端到端加密的静态密钥，为空时从 Identity 的目录读取或生成
+	E2EKey *e2e.KeyPair
+	// 不使用 UDP 数据通道，数据包只走 tcp
+	DisableUDP bool
+	Log        *logrus.Entry
+	// 收到 FrameRenumber 时调用，由 Dial 设置
+	onRenumber func(resp *models.RegisterResp)
+	// 收到 FrameProfile 时调用，由 Dial 设置
+	onProfile func(p *models.NetProfile)
+}
+
+func (c *Client) tlsConfig() (*tls.Config, error) {
+	cfg, err := spacetls.ClientConfig(c.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	cfg.GetClientCertificate = c.Identity.GetClientCertificate
+	return cfg, nil
+}
+
+func (c *Client) isWebSocket() bool {
+	return strings.HasPrefix(c.Server, "ws://") || strings.HasPrefix(c.Server, "wss://")
+}
+
+// host MoonServer 的主机名，用于 UDP 通道
+func (c *Client) host() string {
+	if c.isWebSocket() {
+		if u, err := url.Parse(c.Server); err == nil {
+			return u.Hostname()
+		}
+	}
+	host, _, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return c.Server
+	}
+	return host
+}
+
+// ServerAddrs 解析 MoonServer 的地址，客户端修改默认路由之前用来保留到服务端的路由
+func (c *Client) ServerAddrs() ([]netip.Addr, error) {
+	ips, err := net.LookupIP(c.host())
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs, nil
+}
+
+// dial 建立到 MoonServer 的 tls 连接
+// WebSocket 地址经过 https 入口，tls 在 ws 连接内部再做一次，服务端照样校验结点证书
+func (c *Client) dial(cfg *tls.Config) (*tls.Conn, error) {
+	if !c.isWebSocket() {
+		return tls.Dial("tcp", c.Server, cfg)
+	}
+	origin := "http://" + c.host()
+	if strings.HasPrefix(c.Server, "wss://") {
+		origin = "https://" + c.host()
+	}
+	wc, err := websocket.NewConfig(c.Server, origin)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.DialConfig(wc)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	conn := tls.Client(ws, cfg)
+	if err := conn.Handshake(); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Enroll 用 join token 申请证书，nodeID 为空时使用本地保存的
+func (c *Client) Enroll(nodeID string) error {
+	if nodeID == "" {
+		nodeID = c.Identity.NodeID()
+	}
+	if c.Token == "" {
+		if cur := c.Identity.SpaceID(); cur != "" && c.SpaceID != "" && cur != c.SpaceID {
+			return fmt.Errorf("certificate of node %s is for space %s, a join token of space %s is required", nodeID, cur, c.SpaceID)
+		}
+		return fmt.Errorf("node %s has no valid certificate, a join token is required", nodeID)
+	}
+	cfg, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	csr, err := c.Identity.CSR(nodeID)
+	if err != nil {
+		return err
+	}
+
+	c.Log.Infof("Enrolling node %s at %s", nodeID, c.Server)
+	conn, err := c.dial(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resp, err := protocol.Enroll(conn, &models.EnrollRequest{
+		NodeID: nodeID,
+		Token:  c.Token,
+		CSR:    string(csr),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Identity.SetCertificate([]byte(resp.Cert))
+}
+
+// Connect 注册到 MoonServer，没有有效证书时先申请证书
+// req 中的 NodeID 会被替换为证书绑定的 NodeID
+func (c *Client) Connect(req *models.RegisterRequest) (*Session, *models.RegisterResp, error) {
+	if !c.Identity.Enrolled(c.SpaceID) {
+		if err := c.Enroll(req.SpaceNode.NodeID); err != nil {
+			return nil, nil, fmt.Errorf("enroll: %w", err)
+		}
+	}
+	req.SpaceNode.NodeID = c.Identity.NodeID()
+
+	if c.E2EKey == nil {
+		key, err := e2e.LoadOrCreateKeyPair(filepath.Join(c.Identity.Dir(), e2e.KeyFile))
+		if err != nil {
+			return nil, nil, fmt.Errorf("load e2e key: %w", err)
+		}
+		c.E2EKey = key
+	}
+	tunnel, err := e2e.NewTunnel(c.E2EKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.PublicKey = tunnel.PublicKey()
+	req.EphemeralKey = tunnel.EphemeralKey()
+	if c.DisableUDP && req.Capabilities == nil {
+		for _, v := range protocol.Capabilities {
+			if v != protocol.CapUDP {
+				req.Capabilities = append(req.Capabilities, v)
+			}
+		}
+	}
+
+	cfg, err := c.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Log.Infof("Dialing MoonServer at %s", c.Server)
+	conn, err := c.dial(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	pc, resp, err := protocol.Handshake(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	sess := newSession(pc, c.Log)
+	sess.ticket.Store(resp.Ticket)
+	sess.setDNS(resp.DNS)
+	if resp.E2E {
+		if !pc.HasCap(protocol.CapE2E) {
+			pc.Close()
+			return nil, nil, fmt.Errorf("space requires e2e but it was not negotiated")
+		}
+		sess.tunnel = tunnel
+		c.Log.Info("End-to-end encryption enabled")
+	}
+	pc.OnControl = c.controlHandler(sess)
+	go sess.readTCP()
+	if pc.HasCap(protocol.CapHeartbeat) {
+		go sess.heartbeat()
+	}
+	if pc.HasCap(protocol.CapCertRenew) {
+		go c.renewLoop(pc)
+	}
+	if pc.HasCap(protocol.CapLease) && resp.Alive > 0 {
+		sess.setLease(resp.Alive)
+		go sess.leaseLoop(req.NetConfig.Alive)
+	}
+	return sess, resp, nil
+}
+
+func (c *Client) controlHandler(sess *Session) func(t protocol.FrameType, payload []byte) {
+	return func(t protocol.FrameType, payload []byte) {
+		sess.touch()
+		switch t {
+		case protocol.FramePing:
+			if err := sess.WriteFrame(protocol.FramePong, payload); err != nil {
+				c.Log.Debugf("write pong: %v", err)
+			}
+		case protocol.FramePong:
+			sess.pong(payload)
+		case protocol.FrameTicket:
+			t := &models.SessionTicket{}
+			if err := json.Unmarshal(payload, t); err != nil {
+				c.Log.Errorf("decode ticket: %v", err)
+				return
+			}
+			sess.ticket.Store(t.Ticket)
+		case protocol.FramePeers:
+			if sess.tunnel == nil {
+				return
+			}
+			list := &models.PeerList{}
+			if err := json.Unmarshal(payload, list); err != nil {
+				c.Log.Errorf("decode peers: %v", err)
+				return
+			}
+			if err := sess.tunnel.SetPeers(list.Peers); err != nil {
+				c.Log.Warnf("update peers: %v", err)
+			}
+			c.Log.Debugf("e2e peers updated, %d online", len(list.Peers))
+		case protocol.FrameUDPSession:
+			msg := &models.UDPSession{}
+			if err := json.Unmarshal(payload, msg); err != nil {
+				c.Log.Errorf("decode udp session: %v", err)
+				return
+			}
+			if err := sess.startUDP(c.host(), msg); err != nil {
+				c.Log.Warnf("udp data path unavailable, using TCP: %v", err)
+			}
+		case protocol.FrameRenewLeaseResp:
+			sess.leaseResp(payload)
+		case protocol.FrameRenumber:
+			resp := &models.RegisterResp{}
+			if err := json.Unmarshal(payload, resp); err != nil {
+				c.Log.Errorf("decode renumber: %v", err)
+				return
+			}
+			// 服务端不支持 CapRenumberAck 时地址变化之后断开连接，重连时用新的票据恢复新的地址
+			if resp.Ticket != "" {
+				sess.ticket.Store(resp.Ticket)
+			}
+			if len(resp.DNS) > 0 {
+				sess.setDNS(resp.DNS)
+			}
+			c.Log.Infof("Space renumbered, new ip %s/%d", resp.IPv4, resp.Bits)
+			if c.onRenumber != nil {
+				c.onRenumber(resp)
+			}
+			// 回调返回时新的地址已经生效，服务端随后在这个连接上换地址
+			if sess.HasCap(protocol.CapRenumberAck) {
+				if err := sess.WriteFrame(protocol.FrameRenumberAck, nil); err != nil {
+					c.Log.Debugf("write renumber ack: %v", err)
+				}
+			}
+		case protocol.FrameProfile:
+			p := &models.NetProfile{}
+			if err := json.Unmarshal(payload, p); err != nil {
+				c.Log.Errorf("decode profile: %v", err)
+				return
+			}
+			if len(p.DNS) > 0 {
+				sess.setDNS(p.DNS)
+			}
+			c.Log.Infof("Network profile updated, mtu %d, %d routes", p.MTU, len(p.Routes))
+			if c.onProfile != nil {
+				c.onProfile(p)
+			}
+		case protocol.FrameRenewCertResp:
+			resp := &models.EnrollResp{}
+			if err := json.Unmarshal(payload, resp); err != nil {
+				c.Log.Errorf("decode renew cert resp: %v", err)
+				return
+			}
+			if err := c.Identity.SetCertificate([]byte(resp.Cert)); err != nil {
+				c.Log.Errorf("save renewed certificate: %v", err)
+				return
+			}
+			c.Log.Info("Node certificate renewed")
+		default:
+			c.Log.Debugf("unknown control frame %d", t)
+		}
+	}
+}
+
+// renewLoop 证书快过期时在当前连接上申请新证书，连接关闭后退出
+func (c *Client) renewLoop(pc *protocol.Conn) {
+	ticker := time.NewTicker(renewCheckInterval)
+	defer ticker.Stop()
+	for {
+		if c.Identity.NeedsRenew() {
+			csr, err := c.Identity.CSR(c.Identity.NodeID())
+			if err != nil {
+				c.Log.Errorf("create csr: %v", err)
+			} else if err := pc.WriteJSON(protocol.FrameRenewCert, &models.RenewCertRequest{CSR: string(csr)}); err != nil {
+				return
+			}
+		}
+		select {
+		case <-pc.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package nodeclient
+
+import (
+	"errors"
+	"net/netip"
+	"spacenode/libs/e2e"
+	"spacenode/libs/protocol"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type frame struct {
+	t       protocol.FrameType
+	payload []byte
+}
+
+// Session 注册之后的连接，space 开启端到端加密时透明地加解密数据包
+// 服务端下发 UDP 会话之后数据包优先走 UDP，UDP 不通时回退到 tcp
+// 连接上的帧由 Session 在后台读取，不要再直接读 Conn
+type Session struct {
+	*protocol.Conn
+	// space 没有开启端到端加密时为空
+	tunnel *e2e.Tunnel
+	// space 内置 DNS 的地址，开启端到端加密时与它之间的包不加密
+	dns atomic.Pointer[[]netip.Addr]
+	udp atomic.Pointer[udpPath]
+	// tcp 和 UDP 收到的数据帧
+	in   chan frame
+	dead chan struct{}
+	err  error
+	log  *logrus.Entry
+	// 最后一次收到服务端数据的时间，UnixNano
+	lastRecv atomic.Int64
+	rtt      atomic.Int64
+	// 最新的会话票据
+	ticket atomic.Value
+	// 地址租约的过期时间，UnixNano，租约跟随会话时为 0
+	leaseExpires atomic.Int64
+	leaseRenewed chan struct{}
+}
+
+func newSession(pc *protocol.Conn, log *logrus.Entry) *Session {
+	s := &Session{
+		Conn:         pc,
+		in:           make(chan frame, 64),
+		dead:         make(chan struct{}),
+		log:          log,
+		leaseRenewed: make(chan struct{}, 1),
+	}
+	s.touch()
+	return s
+}
+
+func (s *Session) touch() {
+	s.lastRecv.Store(time.Now().UnixNano())
+}
+
+// Ticket 用于断线重连的会话票据，服务端不支持时为空
+func (s *Session) Ticket() string {
+	t, _ := s.ticket.Load().(string)
+	return t
+}
+
+// RTT 最近一次心跳的往返时间，没有测量过时为 0
+func (s *Session) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+// readTCP 读取 tcp 上的帧，控制帧由 Conn.OnControl 处理
+func (s *Session) readTCP() {
+	for {
+		t, payload, err := s.Conn.ReadData()
+		if err != nil {
+			s.err = err
+			close(s.dead)
+			return
+		}
+		s.touch()
+		s.deliver(t, payload)
+	}
+}
+
+func (s *Session) deliver(t protocol.FrameType, payload []byte) {
+	select {
+	case s.in <- frame{t: t, payload: payload}:
+	case <-s.dead:
+	}
+}
+
+// setDNS 记录服务端下发的 DNS 地址
+func (s *Session) setDNS(servers []string) {
+	addrs := make([]netip.Addr, 0, len(servers))
+	for _, server := range servers {
+		if addr, err := netip.ParseAddr(server); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	s.dns.Store(&addrs)
+}
+
+// isDNS 包的地址是否为 space 内置 DNS，off4 和 off6 为 IPv4 和 IPv6 头部中地址的偏移
+// DNS 由服务端应答，开启端到端加密时也用明文
+func (s *Session) isDNS(pkt []byte, off4, off6 int) bool {
+	dns := s.dns.Load()
+	if dns == nil || len(pkt) == 0 {
+		return false
+	}
+	var addr netip.Addr
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return false
+		}
+		addr = netip.AddrFrom4([4]byte(pkt[off4 : off4+4]))
+	case 6:
+		if len(pkt) < 40 {
+			return false
+		}
+		addr = netip.AddrFrom16([16]byte(pkt[off6 : off6+16]))
+	default:
+		return false
+	}
+	for _, a := range *dns {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// E2E 是否开启了端到端加密
+func (s *Session) E2E() bool {
+	return s.tunnel != nil
+}
+
+// HasPeer 是否收到了 ip 的公钥，没有开启端到端加密时总是 true
+func (s *Session) HasPeer(ip string) bool {
+	return s.tunnel == nil || s.tunnel.HasPeer(ip)
+}
+
+// UDPActive 数据包当前是否走 UDP
+func (s *Session) UDPActive() bool {
+	u := s.udp.Load()
+	return u != nil && u.active()
+}
+
+// ReadPacket 读取下一个 ip 包，加密的包解密之后返回
+// 开启端到端加密之后丢弃明文包和无法解密的包，内置 DNS 的回复除外
+func (s *Session) ReadPacket() ([]byte, error) {
+	for {
+		var f frame
+		select {
+		case f = <-s.in:
+		case <-s.dead:
+			return nil, s.err
+		}
+		if s.tunnel == nil {
+			if f.t == protocol.FramePacket {
+				return f.payload, nil
+			}
+			continue
+		}
+		if f.t == protocol.FramePacket && s.isDNS(f.payload, 12, 8) {
+			return f.payload, nil
+		}
+		if f.t != protocol.FrameSealed {
+			continue
+		}
+		pkt, err := s.tunnel.Open(f.payload)
+		if err != nil {
+			s.log.Debugf("drop sealed packet: %v", err)
+			continue
+		}
+		return pkt, nil
+	}
+}
+
+// WritePacket 发送一个 ip 包，开启端到端加密时没有对端密钥的包会被丢弃，发给内置 DNS 的包不加密
+func (s *Session) WritePacket(pkt []byte) error {
+	t, payload := protocol.FramePacket, pkt
+	if s.tunnel != nil && !s.isDNS(pkt, 16, 24) {
+		sealed, err := s.tunnel.Seal(pkt)
+		if err != nil {
+			if errors.Is(err, e2e.ErrNoPeer) || errors.Is(err, e2e.ErrBadPacket) {
+				s.log.Debugf("drop packet: %v", err)
+				return nil
+			}
+			return err
+		}
+		t, payload = protocol.FrameSealed, sealed
+	}
+	if u := s.udp.Load(); u != nil && u.active() {
+		// UDP 写失败时走 tcp
+		if err := u.write(t, payload); err == nil {
+			return nil
+		}
+	}
+	return s.Conn.WriteFrame(t, payload)
+}
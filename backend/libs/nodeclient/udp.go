@@ -0,0 +1,159 @@
+package nodeclient
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 探测 UDP 是否可达的间隔和次数
+	udpProbeInterval = time.Second
+	udpProbes        = 5
+	// 可达之后的保活间隔，用来维持 NAT 映射
+	udpKeepalive = 10 * time.Second
+	// 超过这个时间没有收到服务端的回复，回退到 tcp
+	udpTimeout = 30 * time.Second
+)
+
+// udpPath 到 MoonServer 的 UDP 数据通道
+type udpPath struct {
+	conn     *net.UDPConn
+	dg       *protocol.Datagram
+	lastPong atomic.Int64
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (u *udpPath) active() bool {
+	last := u.lastPong.Load()
+	return last != 0 && time.Since(time.Unix(0, last)) < udpTimeout
+}
+
+func (u *udpPath) write(t protocol.FrameType, payload []byte) error {
+	data, err := u.dg.Seal(t, payload)
+	if err != nil {
+		return err
+	}
+	_, err = u.conn.Write(data)
+	return err
+}
+
+func (u *udpPath) close() {
+	u.once.Do(func() {
+		close(u.done)
+		u.conn.Close()
+	})
+}
+
+// startUDP 用服务端下发的会话建立 UDP 通道，host 为 MoonServer 的主机名
+func (s *Session) startUDP(host string, msg *models.UDPSession) error {
+	sidBytes, err := hex.DecodeString(msg.SessionID)
+	if err != nil || len(sidBytes) != protocol.SessionIDSize {
+		return fmt.Errorf("invalid udp session id %q", msg.SessionID)
+	}
+	key, err := base64.StdEncoding.DecodeString(msg.Key)
+	if err != nil {
+		return fmt.Errorf("invalid udp session key: %w", err)
+	}
+	dg, err := protocol.NewDatagram(protocol.SessionID(sidBytes), key, false)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(msg.Port)))
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	u := &udpPath{conn: conn, dg: dg, done: make(chan struct{})}
+	if old := s.udp.Swap(u); old != nil {
+		old.close()
+	}
+	go s.readUDP(u)
+	go s.keepaliveUDP(u)
+	return nil
+}
+
+func (s *Session) readUDP(u *udpPath) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-u.done:
+				return
+			default:
+			}
+			// 服务端端口不可达时会收到 ICMP 错误，继续等待
+			continue
+		}
+		t, payload, err := u.dg.Open(buf[:n])
+		if err != nil {
+			s.log.Debugf("drop datagram: %v", err)
+			continue
+		}
+		s.touch()
+		switch t {
+		case protocol.FrameUDPPong:
+			if !u.active() {
+				s.log.Info("UDP data path enabled")
+			}
+			u.lastPong.Store(time.Now().UnixNano())
+		case protocol.FramePacket, protocol.FrameSealed:
+			s.deliver(t, payload)
+		}
+	}
+}
+
+// keepaliveUDP 探测并保活 UDP 通道，tcp 连接断开时关闭
+func (s *Session) keepaliveUDP(u *udpPath) {
+	defer u.close()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	probes := 0
+	wasActive := false
+	for {
+		select {
+		case <-s.dead:
+			return
+		case <-u.done:
+			return
+		case <-timer.C:
+		}
+
+		active := u.active()
+		if wasActive && !active {
+			s.log.Warn("UDP data path timed out, falling back to TCP")
+		}
+		wasActive = active
+		if err := u.write(protocol.FrameUDPPing, nil); err != nil {
+			s.log.Debugf("write udp ping: %v", err)
+		}
+
+		if active {
+			probes = 0
+			timer.Reset(udpKeepalive)
+			continue
+		}
+		probes++
+		if probes == udpProbes {
+			s.log.Warn("UDP data path is not reachable, using TCP")
+		}
+		if probes < udpProbes {
+			timer.Reset(udpProbeInterval)
+		} else {
+			timer.Reset(udpKeepalive)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"spacenode/libs/replay"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// UDP 数据报:
+//
+//	SessionID(8) | Counter(8) | ChaCha20-Poly1305(Frame)
+//
+// Frame 与 tcp 上的格式相同，SessionID 和 Counter 作为附加数据
+// 会话和密钥在注册之后通过 FrameUDPSession 下发，每次连接都不同
+const (
+	SessionIDSize   = 8
+	DatagramKeySize = chacha20poly1305.KeySize
+
+	datagramHeader = SessionIDSize + 8
+)
+
+var ErrBadDatagram = errors.New("malformed datagram")
+
+type SessionID [SessionIDSize]byte
+
+// DatagramSessionID 读取数据报的会话，用来查找密钥
+func DatagramSessionID(b []byte) (SessionID, error) {
+	var sid SessionID
+	if len(b) < datagramHeader {
+		return sid, ErrBadDatagram
+	}
+	copy(sid[:], b)
+	return sid, nil
+}
+
+// Datagram 一个 UDP 会话的加解密，两个方向共用密钥，nonce 中区分方向
+type Datagram struct {
+	sid     SessionID
+	aead    cipher.AEAD
+	send    byte
+	counter atomic.Uint64
+	replay  replay.Window
+}
+
+// NewDatagram server 为 true 时是服务端
+func NewDatagram(sid SessionID, key []byte, server bool) (*Datagram, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	d := &Datagram{sid: sid, aead: aead}
+	if server {
+		d.send = 1
+	}
+	return d, nil
+}
+
+func (d *Datagram) SessionID() SessionID {
+	return d.sid
+}
+
+func (d *Datagram) nonce(dir byte, counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	nonce[0] = dir
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// Seal 把一个帧封装成数据报
+func (d *Datagram) Seal(t FrameType, payload []byte) ([]byte, error) {
+	if len(payload) > MaxPayload {
+		return nil, fmt.Errorf("frame too large: %d", len(payload))
+	}
+	frame := make([]byte, 3+len(payload))
+	frame[0] = byte(t)
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	copy(frame[3:], payload)
+
+	out := make([]byte, datagramHeader, datagramHeader+len(frame)+d.aead.Overhead())
+	copy(out, d.sid[:])
+	counter := d.counter.Add(1)
+	binary.BigEndian.PutUint64(out[SessionIDSize:], counter)
+	return d.aead.Seal(out, d.nonce(d.send, counter), frame, out[:datagramHeader]), nil
+}
+
+// Open 解密对端发来的数据报，重放的数据报返回错误
+func (d *Datagram) Open(b []byte) (FrameType, []byte, error) {
+	sid, err := DatagramSessionID(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if sid != d.sid {
+		return 0, nil, ErrBadDatagram
+	}
+	counter := binary.BigEndian.Uint64(b[SessionIDSize:])
+	frame, err := d.aead.Open(nil, d.nonce(1-d.send, counter), b[datagramHeader:], b[:datagramHeader])
+	if err != nil {
+		return 0, nil, ErrBadDatagram
+	}
+	if !d.replay.Accept(counter) {
+		return 0, nil, errors.New("replayed datagram")
+	}
+	if len(frame) < 3 || int(binary.BigEndian.Uint16(frame[1:])) != len(frame)-3 {
+		return 0, nil, ErrBadDatagram
+	}
+	return FrameType(frame[0]), frame[3:], nil
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestDatagram(t *testing.T) {
+	var sid SessionID
+	rand.Read(sid[:])
+	key := make([]byte, DatagramKeySize)
+	rand.Read(key)
+	client, _ := NewDatagram(sid, key, false)
+	server, _ := NewDatagram(sid, key, true)
+
+	data, err := client.Seal(FramePacket, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := DatagramSessionID(data); got != sid {
+		t.Fatalf("unexpected session id")
+	}
+	ft, payload, err := server.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft != FramePacket || string(payload) != string([]byte{1, 2, 3}) {
+		t.Fatalf("unexpected frame %d %v", ft, payload)
+	}
+	if _, _, err := server.Open(data); err == nil {
+		t.Fatalf("expect replayed datagram to be rejected")
+	}
+	// 客户端发出的数据报不能被反射回客户端
+	if _, _, err := client.Open(data); err == nil {
+		t.Fatalf("expect reflected datagram to be rejected")
+	}
+
+	reply, _ := server.Seal(FrameUDPPong, nil)
+	if ft, _, err := client.Open(reply); err != nil || ft != FrameUDPPong {
+		t.Fatalf("open reply: %d %v", ft, err)
+	}
+}
@@ -0,0 +1,415 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"spacenode/libs/models"
+	"sync"
+)
+
+// 握手:
+//
+//	client -> server: Magic(4) | Version(1) | Frame(FrameRegister)
+//	server -> client: Magic(4) | Version(1) | Frame(FrameRegisterResp / FrameError)
+//
+// 握手之后的数据流全部是 Frame: Type(1) | Length(2, BigEndian) | Payload
+// 老版本客户端没有 Magic，直接发送一行 json，服务端通过 Magic 区分
+var Magic = [4]byte{'S', 'P', 'N', 'D'}
+
+const (
+	// Version 当前实现的协议版本
+	Version byte = 1
+	// MinVersion 服务端能接受的最低版本
+	MinVersion byte = 1
+
+	// MaxPayload 单个 Frame 的最大负载
+	MaxPayload = 0xffff
+)
+
+type FrameType byte
+
+const (
+	FramePacket       FrameType = 0x00 // IP 数据包
+	FrameRegister     FrameType = 0x01 // models.RegisterRequest
+	FrameRegisterResp FrameType = 0x02 // models.RegisterResp
+	FrameError        FrameType = 0x03 // models.ErrorResp
+	FrameEnroll       FrameType = 0x04 // models.EnrollRequest，没有客户端证书时只能发送这个
+	FrameEnrollResp   FrameType = 0x05 // models.EnrollResp
+	FrameSealed       FrameType = 0x06 // 端到端加密的数据包，见 libs/e2e
+	FrameUDPPing      FrameType = 0x07 // UDP 通道的探测和保活，只在 UDP 上使用
+	FrameUDPPong      FrameType = 0x08
+
+	// 注册之后的控制帧
+	FrameRenewCert      FrameType = 0x10 // models.RenewCertRequest
+	FrameRenewCertResp  FrameType = 0x11 // models.EnrollResp
+	FramePeers          FrameType = 0x12 // models.PeerList
+	FrameUDPSession     FrameType = 0x13 // models.UDPSession
+	FramePing           FrameType = 0x14 // models.Heartbeat，双向，收到后原样回复 FramePong
+	FramePong           FrameType = 0x15 // models.Heartbeat
+	FrameTicket         FrameType = 0x16 // models.SessionTicket，替换之前的会话票据
+	FrameRenewLease     FrameType = 0x17 // models.LeaseRenewRequest
+	FrameRenewLeaseResp FrameType = 0x18 // models.LeaseRenewResp
+	FrameRenumber       FrameType = 0x19 // models.RegisterResp，space 的网段修改之后结点的新地址
+	FrameProfile        FrameType = 0x1a // models.NetProfile，space 的网络配置修改之后下发
+	FrameLeave          FrameType = 0x1b // 没有 payload，结点放弃分配到的地址，服务端收回租约
+	FrameRenumberAck    FrameType = 0x1c // 没有 payload，结点已经换上 FrameRenumber 中的地址
+)
+
+// 能力，握手时双方取交集
+const (
+	// CapControl 注册之后可以接收控制帧
+	CapControl = "control"
+	// CapCertRenew 可以在连接上轮换结点证书
+	CapCertRenew = "cert-renew"
+	// CapE2E 可以收发 FrameSealed 和 FramePeers
+	CapE2E = "e2e"
+	// CapUDP 数据包可以走 UDP，见 Datagram
+	CapUDP = "udp"
+	// CapHeartbeat 双向心跳，超时没有收到数据时断开连接
+	CapHeartbeat = "heartbeat"
+	// CapResume 断线之后用会话票据恢复原来的 IP
+	CapResume = "resume"
+	// CapLease 在连接上续期地址租约，租约过期时服务端断开连接
+	CapLease = "lease"
+	// CapRenumber 在连接上接收新的地址，地址变化时服务端随后断开，结点带着新的票据重连
+	CapRenumber = "renumber"
+	// CapRenumberAck 换上新的地址之后回复 FrameRenumberAck，服务端在原来的连接上换地址，不再断开
+	CapRenumberAck = "renumber-ack"
+	// CapProfile 在连接上接收 FrameProfile，更新 MTU、路由和 DNS
+	CapProfile = "profile"
+)
+
+// Capabilities 本端实现支持的能力
+var Capabilities = []string{CapControl, CapCertRenew, CapE2E, CapUDP, CapHeartbeat, CapResume, CapLease, CapRenumber, CapRenumberAck, CapProfile}
+
+// 注册被拒绝时的错误码
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeAssignFailed       = "assign_failed"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeE2ERequired        = "e2e_required"
+)
+
+var ErrRefused = errors.New("registration refused")
+
+// RefusedError 服务端拒绝注册时返回给客户端的错误
+type RefusedError struct {
+	models.ErrorResp
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("%v: %s (%s)", ErrRefused, e.Message, e.Code)
+}
+
+func (e *RefusedError) Unwrap() error {
+	return ErrRefused
+}
+
+// Negotiate 返回两端都支持的能力
+func Negotiate(local, remote []string) []string {
+	caps := make([]string, 0)
+	for _, l := range local {
+		for _, r := range remote {
+			if l == r {
+				caps = append(caps, l)
+				break
+			}
+		}
+	}
+	return caps
+}
+
+// HasCap 判断 caps 中是否有 c
+func HasCap(caps []string, c string) bool {
+	for _, v := range caps {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn 是握手之后的帧连接，写是并发安全的
+type Conn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	wmu     sync.Mutex
+	version byte
+	caps    []string
+	closed  chan struct{}
+	once    sync.Once
+	// OnControl 读数据包时遇到的非数据帧交给它处理，为空则丢弃
+	OnControl func(t FrameType, payload []byte)
+}
+
+// NewConn 包装一个连接，r 为已经读过握手头的 reader，可以为空
+func NewConn(conn net.Conn, r *bufio.Reader) *Conn {
+	if r == nil {
+		r = bufio.NewReader(conn)
+	}
+	return &Conn{conn: conn, r: r, version: Version, closed: make(chan struct{})}
+}
+
+func (c *Conn) Version() byte {
+	return c.version
+}
+
+func (c *Conn) Capabilities() []string {
+	return c.caps
+}
+
+func (c *Conn) HasCap(cap string) bool {
+	return HasCap(c.caps, cap)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.conn.Close()
+}
+
+// Done 在 Close 之后关闭
+func (c *Conn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// ReadFrame 读取一个完整的帧
+func (c *Conn) ReadFrame() (FrameType, []byte, error) {
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return FrameType(hdr[0]), payload, nil
+}
+
+// WriteFrame 写一个帧，一次 Write 调用完成，避免与其它写交错
+func (c *Conn) WriteFrame(t FrameType, payload []byte) error {
+	if len(payload) > MaxPayload {
+		return fmt.Errorf("frame too large: %d", len(payload))
+	}
+	buf := make([]byte, 3+len(payload))
+	buf[0] = byte(t)
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(payload)))
+	copy(buf[3:], payload)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *Conn) WriteJSON(t FrameType, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteFrame(t, data)
+}
+
+// ReadPacket 读取下一个明文数据包，期间收到的控制帧交给 OnControl
+func (c *Conn) ReadPacket() ([]byte, error) {
+	for {
+		t, payload, err := c.ReadData()
+		if err != nil {
+			return nil, err
+		}
+		if t == FramePacket {
+			return payload, nil
+		}
+	}
+}
+
+// ReadData 读取下一个 FramePacket 或 FrameSealed，期间收到的控制帧交给 OnControl
+func (c *Conn) ReadData() (FrameType, []byte, error) {
+	for {
+		t, payload, err := c.ReadFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if t == FramePacket || t == FrameSealed {
+			return t, payload, nil
+		}
+		if c.OnControl != nil {
+			c.OnControl(t, payload)
+		}
+	}
+}
+
+func (c *Conn) WritePacket(pkt []byte) error {
+	return c.WriteFrame(FramePacket, pkt)
+}
+
+func writeHeader(w io.Writer, version byte) error {
+	hdr := append(Magic[:], version)
+	_, err := w.Write(hdr)
+	return err
+}
+
+func readHeader(r io.Reader) (byte, error) {
+	hdr := make([]byte, len(Magic)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, err
+	}
+	if [4]byte(hdr[:4]) != Magic {
+		return 0, errors.New("bad magic")
+	}
+	return hdr[4], nil
+}
+
+// IsHandshake 判断连接开头是否为新协议的握手头，不消费数据
+func IsHandshake(r *bufio.Reader) bool {
+	hdr, err := r.Peek(len(Magic))
+	if err != nil {
+		return false
+	}
+	return [4]byte(hdr) == Magic
+}
+
+// request 客户端发送握手头和第一个请求，返回服务端回复的帧
+func request(conn net.Conn, t FrameType, v any) (*Conn, FrameType, []byte, error) {
+	c := NewConn(conn, nil)
+	if err := writeHeader(conn, Version); err != nil {
+		return nil, 0, nil, err
+	}
+	if err := c.WriteJSON(t, v); err != nil {
+		return nil, 0, nil, err
+	}
+
+	version, err := readHeader(c.r)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("read handshake header: %w", err)
+	}
+	c.version = version
+
+	rt, payload, err := c.ReadFrame()
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("read response: %w", err)
+	}
+	if rt == FrameError {
+		re := &RefusedError{}
+		if err := json.Unmarshal(payload, &re.ErrorResp); err != nil {
+			return nil, 0, nil, err
+		}
+		return nil, 0, nil, re
+	}
+	return c, rt, payload, nil
+}
+
+// Handshake 客户端握手，注册被拒绝时返回 *RefusedError
+func Handshake(conn net.Conn, req *models.RegisterRequest) (*Conn, *models.RegisterResp, error) {
+	if req.Capabilities == nil {
+		req.Capabilities = Capabilities
+	}
+	c, t, payload, err := request(conn, FrameRegister, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t != FrameRegisterResp {
+		return nil, nil, fmt.Errorf("unexpected frame %d", t)
+	}
+	resp := &models.RegisterResp{}
+	if err := json.Unmarshal(payload, resp); err != nil {
+		return nil, nil, err
+	}
+	c.caps = resp.Capabilities
+	return c, resp, nil
+}
+
+// Enroll 用 join token 申请结点证书，连接只用于这一次请求
+func Enroll(conn net.Conn, req *models.EnrollRequest) (*models.EnrollResp, error) {
+	_, t, payload, err := request(conn, FrameEnroll, req)
+	if err != nil {
+		return nil, err
+	}
+	if t != FrameEnrollResp {
+		return nil, fmt.Errorf("unexpected frame %d", t)
+	}
+	resp := &models.EnrollResp{}
+	if err := json.Unmarshal(payload, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Request 客户端握手之后的第一个请求，Register 和 Enroll 只有一个不为空
+type Request struct {
+	Type     FrameType
+	Register *models.RegisterRequest
+	Enroll   *models.EnrollRequest
+}
+
+// ServerHandshake 服务端读取握手头和第一个请求
+// 返回的 Conn 在调用 Accept 或 Refuse 之前不能用于收发数据
+func ServerHandshake(conn net.Conn, r *bufio.Reader) (*Conn, *Request, error) {
+	c := NewConn(conn, r)
+	version, err := readHeader(c.r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version < MinVersion {
+		c.version = Version
+		c.Refuse(ErrCodeUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported, minimum is %d", version, MinVersion))
+		return nil, nil, fmt.Errorf("unsupported version %d", version)
+	}
+	c.version = min(version, Version)
+
+	t, payload, err := c.ReadFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &Request{Type: t}
+	switch t {
+	case FrameRegister:
+		req.Register = &models.RegisterRequest{}
+		err = json.Unmarshal(payload, req.Register)
+		if err == nil {
+			c.caps = Negotiate(Capabilities, req.Register.Capabilities)
+		}
+	case FrameEnroll:
+		req.Enroll = &models.EnrollRequest{}
+		err = json.Unmarshal(payload, req.Enroll)
+	default:
+		c.Refuse(ErrCodeBadRequest, fmt.Sprintf("unexpected frame %d", t))
+		return nil, nil, fmt.Errorf("unexpected frame %d", t)
+	}
+	if err != nil {
+		c.Refuse(ErrCodeBadRequest, "invalid request")
+		return nil, nil, err
+	}
+	return c, req, nil
+}
+
+// Reply 回复客户端的第一个请求
+func (c *Conn) Reply(t FrameType, v any) error {
+	if err := writeHeader(c.conn, c.version); err != nil {
+		return err
+	}
+	return c.WriteJSON(t, v)
+}
+
+// Accept 回复注册成功
+func (c *Conn) Accept(resp *models.RegisterResp) error {
+	resp.Capabilities = c.caps
+	return c.Reply(FrameRegisterResp, resp)
+}
+
+// Refuse 回复请求失败，调用方负责关闭连接
+func (c *Conn) Refuse(code, message string) error {
+	return c.Reply(FrameError, &models.ErrorResp{
+		Code:    code,
+		Message: message,
+	})
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"spacenode/libs/models"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		r := bufio.NewReader(server)
+		if !IsHandshake(r) {
+			t.Errorf("expect handshake header")
+			return
+		}
+		pc, req, err := ServerHandshake(server, r)
+		if err != nil {
+			t.Errorf("server handshake: %v", err)
+			return
+		}
+		if req.Type != FrameRegister || req.Register.SpaceNode.NodeID != "node1" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		pc.Accept(&models.RegisterResp{IPv4: "10.0.0.2"})
+		pkt, err := pc.ReadPacket()
+		if err != nil {
+			t.Errorf("read packet: %v", err)
+			return
+		}
+		pc.WritePacket(pkt)
+	}()
+
+	pc, resp, err := Handshake(client, &models.RegisterRequest{
+		SpaceNode:    models.SpaceNode{NodeID: "node1"},
+		Capabilities: []string{CapControl, "unknown"},
+	})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if resp.IPv4 != "10.0.0.2" {
+		t.Fatalf("unexpected ip %s", resp.IPv4)
+	}
+	if !pc.HasCap(CapControl) || pc.HasCap("unknown") {
+		t.Fatalf("unexpected capabilities %v", pc.Capabilities())
+	}
+
+	if err := pc.WritePacket([]byte{1, 2, 3}); err != nil {
+		t.Fatalf("write packet: %v", err)
+	}
+	pkt, err := pc.ReadPacket()
+	if err != nil {
+		t.Fatalf("read packet: %v", err)
+	}
+	if string(pkt) != string([]byte{1, 2, 3}) {
+		t.Fatalf("unexpected packet %v", pkt)
+	}
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		pc, _, err := ServerHandshake(server, nil)
+		if err != nil {
+			t.Errorf("server handshake: %v", err)
+			return
+		}
+		pc.Refuse(ErrCodeAssignFailed, "no available IP addresses")
+	}()
+
+	_, _, err := Handshake(client, &models.RegisterRequest{})
+	var refused *RefusedError
+	if !errors.As(err, &refused) {
+		t.Fatalf("expect RefusedError, got %v", err)
+	}
+	if !errors.Is(err, ErrRefused) {
+		t.Fatalf("expect ErrRefused, got %v", err)
+	}
+	if refused.Code != ErrCodeAssignFailed {
+		t.Fatalf("unexpected code %s", refused.Code)
+	}
+}
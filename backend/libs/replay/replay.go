@@ -0,0 +1,41 @@
+package replay
+
+import "sync"
+
+// Size 窗口能容忍的乱序范围
+const Size = 64
+
+// Window 滑动窗口防重放，计数器由发送方单调递增
+type Window struct {
+	mu   sync.Mutex
+	last uint64 // 收到的最大计数器
+	bits uint64 // last 之前的 Size 个计数器是否已收到
+}
+
+// Accept 计数器没有收到过并且在窗口内时返回 true，并记录下来
+// 调用方需要先校验包的完整性
+func (w *Window) Accept(counter uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case counter > w.last:
+		shift := counter - w.last
+		if shift >= Size {
+			w.bits = 0
+		} else {
+			w.bits <<= shift
+		}
+		w.bits |= 1
+		w.last = counter
+		return true
+	case w.last-counter >= Size:
+		return false
+	default:
+		bit := uint64(1) << (w.last - counter)
+		if w.bits&bit != 0 {
+			return false
+		}
+		w.bits |= bit
+		return true
+	}
+}
@@ -3,25 +3,197 @@ package router
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"sort"
+	"spacenode/libs/e2e"
+	"spacenode/libs/protocol"
 	"spacenode/libs/syncmap"
+	"sync"
+	"sync/atomic"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/sirupsen/logrus"
 )
 
+type PacketType byte
+
+const (
+	// PacketIP 明文 ip 包
+	PacketIP PacketType = iota
+	// PacketSealed 端到端加密的包，只能看到外层头部
+	PacketSealed
+)
+
+// DropReason 路由器丢弃结点发来的包的原因
+type DropReason string
+
+const (
+	// 解析不出目的地址
+	DropMalformed DropReason = "malformed"
+	// 只转发加密的包时收到的明文
+	DropPlaintext DropReason = "plaintext"
+	// 访问控制拒绝
+	DropDenied DropReason = "denied"
+	// 目的地址没有结点、子网路由或出口结点
+	DropNoRoute DropReason = "no_route"
+	// 会发回给发送的结点
+	DropLoop DropReason = "loop"
+	// 加密的包外层源地址不是发送结点的
+	DropSpoofed DropReason = "spoofed"
+	// 写给目的结点失败
+	DropWrite DropReason = "write_error"
+)
+
+// ErrUnsupported 链路不支持该类型的数据包
+var ErrUnsupported = errors.New("packet type not supported by link")
+
+// Link 是路由器与一个结点之间的数据通道
+type Link interface {
+	ReadPacket() (PacketType, []byte, error)
+	WritePacket(t PacketType, pkt []byte) error
+	Close() error
+}
+
+// streamLink 老版本客户端使用的格式: Length(2, BigEndian) | Packet
+type streamLink struct {
+	conn net.Conn
+}
+
+// NewStreamLink 用 2 字节长度头直接在连接上收发数据包
+func NewStreamLink(conn net.Conn) Link {
+	return &streamLink{conn: conn}
+}
+
+func (l *streamLink) ReadPacket() (PacketType, []byte, error) {
+	lengthBuf := make([]byte, 2)
+	if _, err := io.ReadFull(l.conn, lengthBuf); err != nil {
+		return 0, nil, err
+	}
+	pktLength := binary.BigEndian.Uint16(lengthBuf)
+	// 读取实际数据
+	packetData := make([]byte, pktLength)
+	if _, err := io.ReadFull(l.conn, packetData); err != nil {
+		return 0, nil, err
+	}
+	return PacketIP, packetData, nil
+}
+
+func (l *streamLink) WritePacket(t PacketType, pkt []byte) error {
+	if t != PacketIP {
+		return ErrUnsupported
+	}
+	lengthBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lengthBuf, uint16(len(pkt)))
+	dataToSend := append(lengthBuf, pkt...)
+	_, err := l.conn.Write(dataToSend)
+	return err
+}
+
+func (l *streamLink) Close() error {
+	return l.conn.Close()
+}
+
+// frameLink 握手之后的帧连接
+type frameLink struct {
+	pc *protocol.Conn
+}
+
+// NewFrameLink 在 protocol.Conn 上收发数据包，控制帧由 pc.OnControl 处理
+func NewFrameLink(pc *protocol.Conn) Link {
+	return &frameLink{pc: pc}
+}
+
+func (l *frameLink) ReadPacket() (PacketType, []byte, error) {
+	t, payload, err := l.pc.ReadData()
+	if err != nil {
+		return 0, nil, err
+	}
+	if t == protocol.FrameSealed {
+		return PacketSealed, payload, nil
+	}
+	return PacketIP, payload, nil
+}
+
+func (l *frameLink) WritePacket(t PacketType, pkt []byte) error {
+	switch t {
+	case PacketSealed:
+		if !l.pc.HasCap(protocol.CapE2E) {
+			return ErrUnsupported
+		}
+		return l.pc.WriteFrame(protocol.FrameSealed, pkt)
+	default:
+		return l.pc.WritePacket(pkt)
+	}
+}
+
+func (l *frameLink) Close() error {
+	return l.pc.Close()
+}
+
+// Filter 按访问控制策略决定是否转发结点发出的包，发往服务端本地地址的包不经过 Filter
+type Filter interface {
+	Allow(pkt []byte) bool
+	// 加密的包只有外层头部的地址
+	AllowSealed(src, dst netip.Addr) bool
+}
+
+// Tap 抓包，from 为发出数据包的结点的 ip，服务端生成的包为空
+type Tap interface {
+	Packet(from string, pkt []byte)
+}
+
 type routerItem struct {
-	IP     string
-	cancel func()
-	ctx    context.Context
+	// 结点当前的地址，Move 之后变化
+	ip   atomic.Pointer[string]
+	link Link
+	// 同一个结点的其它地址，比如 IPv6 地址，由 Router.mu 保护
+	aliases []string
+	cancel  func()
+	ctx     context.Context
+}
+
+func (it *routerItem) addr() string {
+	return *it.ip.Load()
+}
+
+// prefixRoute 发往 prefix 的包写给 via 所在的结点
+type prefixRoute struct {
+	prefix netip.Prefix
+	via    string
+}
+
+// exitTable 结点 ip -> 出口结点 ip，except 中的地址不经过出口结点
+type exitTable struct {
+	via    map[string]string
+	except []netip.Prefix
+	// 正在被使用的出口结点，可以发出源地址在 space 之外的包
+	exits map[string]bool
 }
 
 type Router struct {
-	routerMap syncmap.SyncMap[string, net.Conn]
+	// 注册、移除和换地址互斥，转发只读 map
+	mu        sync.Mutex
+	routerMap syncmap.SyncMap[string, Link]
 	items     syncmap.SyncMap[string, *routerItem]
+	// 链接 -> 注册的结点，换过地址之后按链接找到当前的地址
+	links syncmap.SyncMap[Link, *routerItem]
+	// 服务端本地的地址，比如网关上的 DNS
+	local syncmap.SyncMap[string, bool]
+	// 按前缀转发的路由，前缀长的在前
+	routes atomic.Pointer[[]prefixRoute]
+	// 选择了出口结点的结点发往 space 之外的包
+	exits atomic.Pointer[exitTable]
+	// 只转发加密的包，丢弃明文
+	sealedOnly atomic.Bool
+	filter     atomic.Pointer[Filter]
+	onDrop     func(ip string, reason DropReason)
+	// 没有抓包时为 nil，转发路径上只多一次原子读
+	tap atomic.Pointer[Tap]
 }
 
 func NewRouter() *Router {
@@ -29,31 +201,223 @@ func NewRouter() *Router {
 	return &r
 }
 
-func (r *Router) Register(ip string, conn net.Conn) {
-	logrus.Info("register ip: ", ip)
-	r.routerMap.Store(ip, conn)
+// SetSealedOnly 开启后路由器不再解析明文 ip 包
+func (r *Router) SetSealedOnly(b bool) {
+	r.sealedOnly.Store(b)
+}
+
+// SetFilter 设置转发之前检查的 Filter，为 nil 时转发所有的包
+func (r *Router) SetFilter(f Filter) {
+	if f == nil {
+		r.filter.Store(nil)
+		return
+	}
+	r.filter.Store(&f)
+}
+
+// SetTap 设置抓包，为 nil 时停止，只抓明文的包，包括之后被丢弃的
+func (r *Router) SetTap(t Tap) {
+	if t == nil {
+		r.tap.Store(nil)
+		return
+	}
+	r.tap.Store(&t)
+}
+
+// SetDropHandler 丢弃 ip 结点发来的包时调用 h，需要在开始转发之前设置
+func (r *Router) SetDropHandler(h func(ip string, reason DropReason)) {
+	r.onDrop = h
+}
+
+func (r *Router) drop(ip string, reason DropReason) {
+	if r.onDrop != nil {
+		r.onDrop(ip, reason)
+	}
+}
+
+// Register 注册结点的链接，发往 ip 和 aliases 的包都写入 link
+func (r *Router) Register(ip string, link Link, aliases ...string) {
+	logrus.Info("register ip: ", ip, aliases)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routerMap.Store(ip, link)
+	for _, a := range aliases {
+		r.routerMap.Store(a, link)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	r.items.Store(ip, &routerItem{
-		IP:     ip,
-		cancel: cancel,
-		ctx:    ctx,
+	item := &routerItem{
+		link:    link,
+		aliases: aliases,
+		cancel:  cancel,
+		ctx:     ctx,
+	}
+	item.ip.Store(&ip)
+	r.items.Store(ip, item)
+	r.links.Store(link, item)
+}
+
+// Move 把注册在 from 的结点换到 to，链接不断开，aliases 替换原来的别名
+// 换地址期间旧地址可以放在 aliases 中继续收发，之后用 Move(to, to, ...) 去掉
+func (r *Router) Move(from, to string, aliases ...string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	item, ok := r.items.Load(from)
+	if !ok {
+		return false
+	}
+	link, ok := r.routerMap.Load(from)
+	if !ok || link != item.link {
+		return false
+	}
+	keep := map[string]bool{to: true}
+	r.routerMap.Store(to, link)
+	for _, a := range aliases {
+		keep[a] = true
+		r.routerMap.Store(a, link)
+	}
+	for _, a := range append([]string{from}, item.aliases...) {
+		if !keep[a] {
+			r.routerMap.CompareAndDelete(a, link)
+		}
+	}
+	item.aliases = aliases
+	item.ip.Store(&to)
+	if from != to {
+		r.items.Delete(from)
+		r.items.Store(to, item)
+	}
+	logrus.Info("move ip: ", from, " -> ", to, aliases)
+	return true
+}
+
+// RegisterLocal 注册服务端本地的地址，只转发加密包时也接受发往这些地址的明文包
+func (r *Router) RegisterLocal(ip string, link Link, aliases ...string) {
+	r.local.Store(ip, true)
+	for _, a := range aliases {
+		r.local.Store(a, true)
+	}
+	r.Register(ip, link, aliases...)
+}
+
+// SetRoutes 替换按前缀转发的路由，key 为网段，value 为转发到的结点 ip
+// 目的地址没有注册时按最长前缀匹配，via 不在线的路由跳过
+func (r *Router) SetRoutes(routes map[netip.Prefix]string) {
+	arr := make([]prefixRoute, 0, len(routes))
+	for prefix, via := range routes {
+		arr = append(arr, prefixRoute{prefix: prefix.Masked(), via: via})
+	}
+	sort.Slice(arr, func(i, j int) bool {
+		if arr[i].prefix.Bits() != arr[j].prefix.Bits() {
+			return arr[i].prefix.Bits() > arr[j].prefix.Bits()
+		}
+		return arr[i].prefix.Addr().Less(arr[j].prefix.Addr())
 	})
+	r.routes.Store(&arr)
+}
+
+// SetExits 替换出口结点，key 为结点 ip，value 为出口结点 ip
+// 结点发出的包目的地址既没有结点也没有子网路由时转发给出口结点，except 中的地址仍然丢弃
+func (r *Router) SetExits(exits map[string]string, except ...netip.Prefix) {
+	t := exitTable{via: make(map[string]string, len(exits)), except: except, exits: make(map[string]bool)}
+	for ip, via := range exits {
+		t.via[ip] = via
+		t.exits[via] = true
+	}
+	r.exits.Store(&t)
+}
+
+// exitFor ip 结点发往 dst 的包在 lookup 找不到时转发到的出口结点
+func (r *Router) exitFor(ip string, dst net.IP) (link Link, via string, ok bool) {
+	t := r.exits.Load()
+	if t == nil {
+		return nil, "", false
+	}
+	via, ok = t.via[ip]
+	if !ok {
+		return nil, "", false
+	}
+	addr, ok := netip.AddrFromSlice(dst)
+	if !ok {
+		return nil, "", false
+	}
+	addr = addr.Unmap()
+	for _, p := range t.except {
+		if p.Contains(addr) {
+			return nil, "", false
+		}
+	}
+	link, ok = r.routerMap.Load(via)
+	return link, via, ok
+}
 
+// lookup 目的地址所在的结点，先找结点自己的地址，再按前缀，按前缀找到时 via 为转发到的结点 ip
+func (r *Router) lookup(dst net.IP) (link Link, via string, ok bool) {
+	if link, ok := r.routerMap.Load(dst.String()); ok {
+		return link, "", true
+	}
+	routes := r.routes.Load()
+	if routes == nil {
+		return nil, "", false
+	}
+	addr, ok := netip.AddrFromSlice(dst)
+	if !ok {
+		return nil, "", false
+	}
+	addr = addr.Unmap()
+	for _, rt := range *routes {
+		if !rt.prefix.Contains(addr) {
+			continue
+		}
+		if link, ok := r.routerMap.Load(rt.via); ok {
+			return link, rt.via, true
+		}
+	}
+	return nil, "", false
 }
 
 func (r *Router) Remove(ip string) {
-	if conn, ok := r.routerMap.Load(ip); ok {
-		if err := conn.Close(); err != nil {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remove(ip)
+}
+
+func (r *Router) remove(ip string) {
+	r.local.Delete(ip)
+	link, ok := r.routerMap.Load(ip)
+	if ok {
+		if err := link.Close(); err != nil {
 			logrus.Warnf("close conn error: %v", err)
 		}
 		r.routerMap.Delete(ip)
 	}
-	item, ok := r.items.Load(ip)
-	if ok {
+	item, exist := r.items.Load(ip)
+	if exist {
 		item.cancel()
 		r.items.Delete(ip)
+		r.links.CompareAndDelete(item.link, item)
+		// 别名可能已经注册给了其它结点
+		for _, a := range item.aliases {
+			if ok && r.routerMap.CompareAndDelete(a, link) {
+				r.local.Delete(a)
+			}
+		}
 	}
+}
 
+// Unregister 只有 ip 当前注册的还是 link 时才移除，结点重连之后旧连接退出时不影响新连接
+// link 换过地址时按现在的地址移除
+func (r *Router) Unregister(ip string, link Link) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if item, ok := r.links.Load(link); ok {
+		ip = item.addr()
+	}
+	if current, ok := r.routerMap.Load(ip); !ok || current != link {
+		r.links.Delete(link)
+		link.Close()
+		return
+	}
+	r.remove(ip)
 }
 
 func (r *Router) Serve(ip string) error {
@@ -61,68 +425,203 @@ func (r *Router) Serve(ip string) error {
 	if !ok {
 		return fmt.Errorf("ip %s not found", ip)
 	}
-	conn, ok := r.routerMap.Load(ip)
+	link, ok := r.routerMap.Load(ip)
 	if !ok {
 		return fmt.Errorf("ip %s not found", ip)
 	}
-	defer conn.Close()
+	defer link.Close()
 
 	for {
 		select {
 		case <-item.ctx.Done():
-			logrus.Infof("ip %s router closed", ip)
+			logrus.Infof("ip %s router closed", item.addr())
 			return nil
 		default:
 		}
-		lengthBuf := make([]byte, 2)
-		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
-			if err == io.EOF {
-				r.routerMap.Delete(ip)
-				logrus.Infof("connection closed for ip %s", ip)
+		pt, packetData, err := link.ReadPacket()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				r.routerMap.CompareAndDelete(item.addr(), link)
+				logrus.Infof("connection closed for ip %s", item.addr())
 				return nil
 			}
-			logrus.Errorf("读取长度头失败: %v", err)
+			logrus.Errorf("读取数据包失败: %v", err)
 			return err
 		}
 
-		pktLength := binary.BigEndian.Uint16(lengthBuf)
-		// 读取实际数据
-		packetData := make([]byte, pktLength)
-		if _, err := io.ReadFull(conn, packetData); err != nil {
-			if err == io.EOF {
-				r.routerMap.Delete(ip)
-				logrus.Infof("connection closed for ip %s", ip)
-				return nil
-			}
-			logrus.Errorf("读取数据体失败: %v", err)
-			return err
+		// 结点可能在连接上换了地址
+		r.Route(item.addr(), pt, packetData)
+	}
+}
+
+// Route 转发 ip 结点发来的一个数据包，tcp 和 UDP 收到的包都从这里进入
+func (r *Router) Route(ip string, pt PacketType, packetData []byte) {
+	if pt == PacketSealed {
+		r.forwardSealed(ip, packetData)
+		return
+	}
+	if t := r.tap.Load(); t != nil {
+		(*t).Packet(ip, packetData)
+	}
+	src, dst, ok := packetAddrs(packetData)
+	if !ok {
+		logrus.Debugf("drop malformed packet from %s", ip)
+		r.drop(ip, DropMalformed)
+		return
+	}
+	_, local := r.local.Load(dst.String())
+	if r.sealedOnly.Load() && !local {
+		logrus.Debugf("drop plaintext packet from %s", ip)
+		r.drop(ip, DropPlaintext)
+		return
+	}
+	// 访问控制按源地址匹配，伪造的源地址可以冒充其它结点
+	if !r.maySend(ip, src) {
+		logrus.Debugf("drop packet from %s with spoofed source %s", ip, src)
+		r.drop(ip, DropSpoofed)
+		return
+	}
+	if f := r.filter.Load(); f != nil && !local && !(*f).Allow(packetData) {
+		r.drop(ip, DropDenied)
+		return
+	}
+
+	target, via, exist := r.lookup(dst)
+	if !exist {
+		target, via, exist = r.exitFor(ip, dst)
+	}
+	r.write(ip, PacketIP, packetData, target, via, exist)
+}
+
+// forwardSealed 按外层头部转发加密的包，源地址必须是发送结点自己的 ip
+func (r *Router) forwardSealed(ip string, data []byte) {
+	src, dst, err := e2e.Header(data)
+	if err != nil {
+		logrus.Debugf("drop sealed packet from %s: %v", ip, err)
+		r.drop(ip, DropMalformed)
+		return
+	}
+	if !r.owns(ip, src.String()) {
+		logrus.Warnf("drop sealed packet from %s with spoofed source %s", ip, src)
+		r.drop(ip, DropSpoofed)
+		return
+	}
+	if f := r.filter.Load(); f != nil {
+		s, _ := netip.AddrFromSlice(src)
+		d, _ := netip.AddrFromSlice(dst)
+		if !(*f).AllowSealed(s, d) {
+			r.drop(ip, DropDenied)
+			return
 		}
+	}
+	target, via, exist := r.lookup(dst)
+	r.write(ip, PacketSealed, data, target, via, exist)
+}
 
-		packet := gopacket.NewPacket(packetData, layers.LayerTypeIPv4, gopacket.Default)
-		ipLayer := packet.Layer(layers.LayerTypeIPv4)
-		if ipLayer == nil {
-			logrus.Errorln("skip ")
-			continue
+// write 把 ip 结点发来的包写给查到的目的结点，不发回给发送的结点，避免子网路由和出口结点成环
+func (r *Router) write(ip string, pt PacketType, pkt []byte, target Link, via string, exist bool) {
+	if !exist {
+		r.drop(ip, DropNoRoute)
+		return
+	}
+	if via != "" && r.owns(ip, via) {
+		r.drop(ip, DropLoop)
+		return
+	}
+	if err := target.WritePacket(pt, pkt); err != nil {
+		logrus.Errorf("write error: %v", err)
+		r.drop(ip, DropWrite)
+	}
+}
+
+// Deliver 把服务端生成的包写给目的地址所在的结点，比如 DNS 的回复
+func (r *Router) Deliver(pkt []byte) error {
+	if t := r.tap.Load(); t != nil {
+		(*t).Packet("", pkt)
+	}
+	dst, ok := DstIP(pkt)
+	if !ok {
+		return errors.New("malformed packet")
+	}
+	target, _, ok := r.lookup(dst)
+	if !ok {
+		return fmt.Errorf("no route to %s", dst)
+	}
+	return target.WritePacket(PacketIP, pkt)
+}
+
+// DstIP 解析 IPv4 或 IPv6 包的目的地址
+func DstIP(pkt []byte) (net.IP, bool) {
+	_, dst, ok := packetAddrs(pkt)
+	return dst, ok
+}
+
+// packetAddrs 解析 IPv4 或 IPv6 包的源地址和目的地址
+func packetAddrs(pkt []byte) (src, dst net.IP, ok bool) {
+	if len(pkt) == 0 {
+		return nil, nil, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		packet := gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.Lazy)
+		if ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+			return ipv4.SrcIP, ipv4.DstIP, true
 		}
-		ipv4, _ := ipLayer.(*layers.IPv4)
+	case 6:
+		packet := gopacket.NewPacket(pkt, layers.LayerTypeIPv6, gopacket.Lazy)
+		if ipv6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+			return ipv6.SrcIP, ipv6.DstIP, true
+		}
+	}
+	return nil, nil, false
+}
 
-		// 转发逻辑
-		targetConn, exist := r.routerMap.Load(ipv4.DstIP.String())
-		if exist {
-			lengthBuf := make([]byte, 2)
-			binary.BigEndian.PutUint16(lengthBuf, uint16(len(packetData)))
-			dataToSend := append(lengthBuf, packetData...)
-			if _, err := targetConn.Write(dataToSend); err != nil {
-				logrus.Errorf("write error: %v", err)
+// maySend ip 结点是否可以发出源地址为 src 的明文包: 结点自己的地址，
+// 最长前缀匹配到它的子网路由的地址，或者它是出口结点时 space 之外的地址
+func (r *Router) maySend(ip string, src net.IP) bool {
+	if r.owns(ip, src.String()) {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(src)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	if routes := r.routes.Load(); routes != nil {
+		for _, rt := range *routes {
+			if rt.prefix.Contains(addr) {
+				return r.owns(ip, rt.via)
 			}
 		}
+	}
+	t := r.exits.Load()
+	if t == nil || !t.exits[ip] {
+		return false
+	}
+	for _, p := range t.except {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
 
+// owns addr 是否为 ip 所在结点的地址
+func (r *Router) owns(ip, addr string) bool {
+	if addr == ip {
+		return true
+	}
+	link, ok := r.routerMap.Load(ip)
+	if !ok {
+		return false
 	}
+	other, ok := r.routerMap.Load(addr)
+	return ok && other == link
 }
 
 func (r *Router) Stop() {
-	r.routerMap.Range(func(ip string, conn net.Conn) bool {
-		if err := conn.Close(); err != nil {
+	r.routerMap.Range(func(ip string, link Link) bool {
+		if err := link.Close(); err != nil {
 			logrus.Errorf("failed to close connection for ip %s: %v", ip, err)
 		}
 		r.routerMap.Delete(ip)
@@ -0,0 +1,285 @@
+package router
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testLink 记录写入的包，ReadPacket 一直阻塞到 Close
+type testLink struct {
+	mu      sync.Mutex
+	written [][]byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newTestLink() *testLink {
+	return &testLink{closed: make(chan struct{})}
+}
+
+func (l *testLink) ReadPacket() (PacketType, []byte, error) {
+	<-l.closed
+	return 0, nil, io.EOF
+}
+
+func (l *testLink) WritePacket(t PacketType, pkt []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.written = append(l.written, pkt)
+	return nil
+}
+
+func (l *testLink) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *testLink) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.written)
+}
+
+func (l *testLink) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// packet 从 src 发往 dst 的 UDP 包，按地址生成 IPv4 或 IPv6 包
+func packet(t *testing.T, src, dst string) []byte {
+	t.Helper()
+	udp := &layers.UDP{SrcPort: 1000, DstPort: 2000}
+	var ip gopacket.SerializableLayer
+	if netip.MustParseAddr(src).Is4() {
+		v4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+		udp.SetNetworkLayerForChecksum(v4)
+		ip = v4
+	} else {
+		v6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+		udp.SetNetworkLayerForChecksum(v6)
+		ip = v6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testNet 四个结点: a 10.0.0.2/fd00::2，b 10.0.0.3/fd00::3 通告 192.168.0.0/16，
+// c 10.0.0.4 通告 192.168.1.0/24，e 10.0.0.5，192.168.3.0/24 经过不在线的 10.0.0.9
+type testNet struct {
+	r     *Router
+	links map[string]*testLink
+	drops []DropReason
+}
+
+func newTestNet() *testNet {
+	n := &testNet{r: NewRouter(), links: make(map[string]*testLink)}
+	n.r.SetDropHandler(func(ip string, reason DropReason) {
+		n.drops = append(n.drops, reason)
+	})
+	for name, addrs := range map[string][]string{
+		"a": {"10.0.0.2", "fd00::2"},
+		"b": {"10.0.0.3", "fd00::3"},
+		"c": {"10.0.0.4"},
+		"e": {"10.0.0.5"},
+	} {
+		l := newTestLink()
+		n.links[name] = l
+		n.r.Register(addrs[0], l, addrs[1:]...)
+	}
+	n.r.SetRoutes(map[netip.Prefix]string{
+		netip.MustParsePrefix("192.168.0.0/16"): "10.0.0.3",
+		netip.MustParsePrefix("192.168.1.0/24"): "10.0.0.4",
+		netip.MustParsePrefix("192.168.3.0/24"): "10.0.0.9",
+	})
+	return n
+}
+
+// route 转发 from 结点发出的 src -> dst 的包，返回收到的结点，或者丢弃的原因
+func (n *testNet) route(t *testing.T, from, src, dst string) string {
+	t.Helper()
+	before := make(map[string]int)
+	for name, l := range n.links {
+		before[name] = l.count()
+	}
+	drops := len(n.drops)
+	n.r.Route(from, PacketIP, packet(t, src, dst))
+	for name, l := range n.links {
+		if l.count() > before[name] {
+			return name
+		}
+	}
+	if len(n.drops) > drops {
+		return string(n.drops[len(n.drops)-1])
+	}
+	return ""
+}
+
+type routeCase struct {
+	name           string
+	from, src, dst string
+	want           string
+}
+
+func (n *testNet) check(t *testing.T, cases []routeCase) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := n.route(t, c.from, c.src, c.dst); got != c.want {
+				t.Fatalf("%s -> %s from %s: expect %q, got %q", c.src, c.dst, c.from, c.want, got)
+			}
+		})
+	}
+}
+
+func TestRouteSelection(t *testing.T) {
+	n := newTestNet()
+	n.check(t, []routeCase{
+		{"node address", "10.0.0.2", "10.0.0.2", "10.0.0.3", "b"},
+		{"ipv6 alias", "10.0.0.2", "fd00::2", "fd00::3", "b"},
+		{"longest prefix", "10.0.0.2", "10.0.0.2", "192.168.1.9", "c"},
+		{"shorter prefix", "10.0.0.2", "10.0.0.2", "192.168.2.9", "b"},
+		{"offline via falls back to shorter prefix", "10.0.0.2", "10.0.0.2", "192.168.3.9", "b"},
+		{"subnet router reaches other prefixes", "10.0.0.4", "10.0.0.4", "192.168.2.9", "b"},
+		{"loop back to the subnet router", "10.0.0.4", "10.0.0.4", "192.168.1.9", string(DropLoop)},
+		{"loop through an alias", "10.0.0.3", "fd00::3", "192.168.2.9", string(DropLoop)},
+		{"unassigned space address", "10.0.0.2", "10.0.0.2", "10.0.0.200", string(DropNoRoute)},
+		{"outside without exit node", "10.0.0.2", "10.0.0.2", "1.1.1.1", string(DropNoRoute)},
+	})
+}
+
+func TestExitRoute(t *testing.T) {
+	n := newTestNet()
+	space := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("fd00::/64"), netip.MustParsePrefix("224.0.0.0/4")}
+	n.r.SetExits(map[string]string{"10.0.0.2": "10.0.0.5"}, space...)
+	n.check(t, []routeCase{
+		{"internet through the exit node", "10.0.0.2", "10.0.0.2", "1.1.1.1", "e"},
+		{"node address before exit", "10.0.0.2", "10.0.0.2", "10.0.0.3", "b"},
+		{"subnet route before exit", "10.0.0.2", "10.0.0.2", "192.168.1.9", "c"},
+		{"space subnet is not sent to the exit", "10.0.0.2", "10.0.0.2", "10.0.0.200", string(DropNoRoute)},
+		{"multicast is not sent to the exit", "10.0.0.2", "10.0.0.2", "224.0.0.251", string(DropNoRoute)},
+		{"node without exit", "10.0.0.3", "10.0.0.3", "1.1.1.1", string(DropNoRoute)},
+		{"exit node replies from the internet", "10.0.0.5", "1.1.1.1", "10.0.0.2", "a"},
+		{"exit node cannot use a space address", "10.0.0.5", "10.0.0.200", "10.0.0.2", string(DropSpoofed)},
+		{"other nodes cannot use outside addresses", "10.0.0.3", "1.1.1.1", "10.0.0.2", string(DropSpoofed)},
+	})
+
+	// 出口结点不在线时丢弃，结点不再被当作出口结点
+	n.r.SetExits(map[string]string{"10.0.0.2": "10.0.0.9"}, space...)
+	n.check(t, []routeCase{
+		{"offline exit node", "10.0.0.2", "10.0.0.2", "1.1.1.1", string(DropNoRoute)},
+		{"former exit node", "10.0.0.5", "1.1.1.1", "10.0.0.2", string(DropSpoofed)},
+	})
+	// 选择自己作为出口结点时成环
+	n.r.SetExits(map[string]string{"10.0.0.5": "10.0.0.5"}, space...)
+	n.check(t, []routeCase{
+		{"exit through itself", "10.0.0.5", "10.0.0.5", "1.1.1.1", string(DropLoop)},
+	})
+}
+
+// denyFilter 拒绝发往 dst 的包
+type denyFilter struct{ dst netip.Addr }
+
+func (f denyFilter) Allow(pkt []byte) bool {
+	_, dst, ok := packetAddrs(pkt)
+	return ok && !dst.Equal(net.IP(f.dst.AsSlice()))
+}
+
+func (f denyFilter) AllowSealed(src, dst netip.Addr) bool {
+	return dst != f.dst
+}
+
+func TestSourceValidation(t *testing.T) {
+	n := newTestNet()
+	n.check(t, []routeCase{
+		{"own address", "10.0.0.2", "10.0.0.2", "10.0.0.3", "b"},
+		{"own ipv6 alias", "10.0.0.2", "fd00::2", "fd00::3", "b"},
+		{"address of another node", "10.0.0.2", "10.0.0.4", "10.0.0.3", string(DropSpoofed)},
+		{"unassigned space address", "10.0.0.2", "10.0.0.200", "10.0.0.3", string(DropSpoofed)},
+		{"address behind the subnet router", "10.0.0.3", "192.168.2.9", "10.0.0.2", "a"},
+		{"longer prefix belongs to another router", "10.0.0.3", "192.168.1.9", "10.0.0.2", string(DropSpoofed)},
+		{"address behind the longer prefix", "10.0.0.4", "192.168.1.9", "10.0.0.2", "a"},
+		{"outside address", "10.0.0.2", "1.1.1.1", "10.0.0.3", string(DropSpoofed)},
+	})
+
+	// 源地址检查在访问控制之前，伪造的包不会被当作其它结点的包匹配规则
+	n.r.SetFilter(denyFilter{dst: netip.MustParseAddr("10.0.0.3")})
+	n.check(t, []routeCase{
+		{"denied by filter", "10.0.0.2", "10.0.0.2", "10.0.0.3", string(DropDenied)},
+		{"allowed by filter", "10.0.0.2", "10.0.0.2", "10.0.0.4", "c"},
+		{"spoofed before filter", "10.0.0.2", "10.0.0.4", "10.0.0.3", string(DropSpoofed)},
+	})
+	n.r.SetFilter(nil)
+
+	n.r.SetSealedOnly(true)
+	n.check(t, []routeCase{
+		{"plaintext refused", "10.0.0.2", "10.0.0.2", "10.0.0.3", string(DropPlaintext)},
+	})
+}
+
+func TestMove(t *testing.T) {
+	r := NewRouter()
+	a, b := newTestLink(), newTestLink()
+	r.Register("10.0.0.2", a, "fd00::2")
+	r.Register("10.0.0.3", b)
+
+	// 换地址期间旧地址作为别名继续收发
+	if !r.Move("10.0.0.2", "10.1.0.2", "fd01::2", "10.0.0.2", "fd00::2") {
+		t.Fatalf("expect move to succeed")
+	}
+	for _, dst := range []string{"10.1.0.2", "10.0.0.2"} {
+		if err := r.Deliver(packet(t, "10.0.0.3", dst)); err != nil {
+			t.Fatalf("deliver to %s: %v", dst, err)
+		}
+	}
+	if a.count() != 2 || a.isClosed() {
+		t.Fatalf("expect both addresses to reach the same open link")
+	}
+	r.Route("10.0.0.3", PacketIP, packet(t, "10.0.0.3", "10.1.0.2"))
+	r.Route("10.1.0.2", PacketIP, packet(t, "10.0.0.2", "10.0.0.3"))
+	if a.count() != 3 || b.count() != 1 {
+		t.Fatalf("expect packets from and to the moved node, got %d %d", a.count(), b.count())
+	}
+
+	// 确认之后去掉旧地址
+	if !r.Move("10.1.0.2", "10.1.0.2", "fd01::2") {
+		t.Fatalf("expect dropping old addresses to succeed")
+	}
+	if err := r.Deliver(packet(t, "10.0.0.3", "10.0.0.2")); err == nil {
+		t.Fatalf("expect old address to be removed")
+	}
+	r.Route("10.1.0.2", PacketIP, packet(t, "10.0.0.2", "10.0.0.3"))
+	if b.count() != 1 {
+		t.Fatalf("expect old source address to be refused")
+	}
+	if r.Move("10.0.0.2", "10.2.0.2") {
+		t.Fatalf("expect moving an unknown address to fail")
+	}
+
+	// 按注册时的地址注销，移除的是换过之后的地址
+	r.Unregister("10.0.0.2", a)
+	if !a.isClosed() {
+		t.Fatalf("expect link to be closed")
+	}
+	for _, dst := range []string{"10.1.0.2", "10.0.0.2"} {
+		if err := r.Deliver(packet(t, "10.0.0.3", dst)); err == nil {
+			t.Fatalf("expect %s to be unregistered", dst)
+		}
+	}
+	if _, ok := r.routerMap.Load("fd01::2"); ok {
+		t.Fatalf("expect alias to be unregistered")
+	}
+}
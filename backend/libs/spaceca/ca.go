@@ -0,0 +1,184 @@
+package spaceca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"spacenode/libs/spacetls"
+	"spacenode/libs/utils"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CACertFile = "ca.crt"
+	CAKeyFile  = "ca.key"
+
+	caLifetime = 10 * 365 * 24 * time.Hour
+	// NodeCertLifetime 结点证书的有效期，结点在剩余 1/3 时轮换
+	NodeCertLifetime = 30 * 24 * time.Hour
+)
+
+// CA 给结点签发客户端证书，证书的 CommonName 为结点的 NodeID，OrganizationalUnit 为 space 的 ID
+type CA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	pool    *x509.CertPool
+}
+
+// LoadOrCreate 从 dir 读取 CA，不存在时生成并保存
+func LoadOrCreate(dir string) (*CA, error) {
+	certPath := filepath.Join(dir, CACertFile)
+	keyPath := filepath.Join(dir, CAKeyFile)
+	if !utils.FileExists(certPath) || !utils.FileExists(keyPath) {
+		if err := create(dir, certPath, keyPath); err != nil {
+			return nil, err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("ca key is not a signer")
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &CA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		pool:    pool,
+	}, nil
+}
+
+func create(dir, certPath, keyPath string) error {
+	logrus.Infoln("generate space node ca in", dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := spacetls.RandomSerial()
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "spacenode node ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := spacetls.WritePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	return spacetls.WritePEM(keyPath, "EC PRIVATE KEY", keyDer, 0600)
+}
+
+// CertPEM CA 证书
+func (c *CA) CertPEM() []byte {
+	return c.certPEM
+}
+
+// Pool 用于校验结点证书
+func (c *CA) Pool() *x509.CertPool {
+	return c.pool
+}
+
+// Sign 校验 csr 并签发 nodeID 在 spaceID 中的客户端证书，返回 pem
+// csr 中的 subject 会被忽略，证书只绑定 nodeID 和 spaceID
+func (c *CA) Sign(csrPEM []byte, nodeID, spaceID string) ([]byte, error) {
+	if nodeID == "" {
+		return nil, errors.New("node id is required")
+	}
+	if spaceID == "" {
+		return nil, errors.New("space id is required")
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("invalid csr")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("csr signature: %w", err)
+	}
+	serial, err := spacetls.RandomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nodeID, OrganizationalUnit: []string{spaceID}},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(NodeCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, csr.PublicKey, c.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// PeerNodeID 返回 tls 连接中已校验的客户端证书绑定的 NodeID
+func PeerNodeID(state tls.ConnectionState) (string, bool) {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+	return state.PeerCertificates[0].Subject.CommonName, true
+}
+
+// PeerSpaceID 返回已校验的客户端证书绑定的 space，旧的证书没有时为空
+func PeerSpaceID(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	if ou := state.PeerCertificates[0].Subject.OrganizationalUnit; len(ou) == 1 {
+		return ou[0]
+	}
+	return ""
+}
+
+// ServerConfig 在 spacetls.ServerConfig 的基础上校验结点证书
+// 没有证书的连接也允许建立，只能用来申请证书
+func (c *CA) ServerConfig(cert tls.Certificate) *tls.Config {
+	cfg := spacetls.ServerConfig(cert)
+	cfg.ClientCAs = c.pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg
+}
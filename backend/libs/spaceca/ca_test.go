@@ -0,0 +1,71 @@
+package spaceca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestEnrollIdentity(t *testing.T) {
+	ca, err := LoadOrCreate(t.TempDir())
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+
+	dir := t.TempDir()
+	id, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatalf("load identity: %v", err)
+	}
+	if id.Enrolled("") {
+		t.Fatalf("new identity should not be enrolled")
+	}
+
+	// csr 中的 subject 不影响签发结果
+	csr, _ := id.CSR("someone-else")
+	cert, err := ca.Sign(csr, "node1", "space1")
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := id.SetCertificate(cert); err != nil {
+		t.Fatalf("set certificate: %v", err)
+	}
+	if !id.Enrolled("") || !id.Enrolled("space1") || id.NeedsRenew() || id.NodeID() != "node1" || id.SpaceID() != "space1" {
+		t.Fatalf("unexpected identity state, node id %s", id.NodeID())
+	}
+	// 绑定其它 space 的证书需要重新申请
+	if id.Enrolled("space2") {
+		t.Fatalf("expect certificate of space1 not to be enrolled in space2")
+	}
+
+	// 重新加载之后证书和 NodeID 都还在
+	reloaded, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatalf("reload identity: %v", err)
+	}
+	if !reloaded.Enrolled("space1") || reloaded.NodeID() != "node1" {
+		t.Fatalf("identity not persisted")
+	}
+
+	// 其它私钥签发的证书不能被接受
+	other, _ := LoadIdentity(t.TempDir())
+	if err := other.SetCertificate(cert); err == nil {
+		t.Fatalf("expect certificate of another key to be rejected")
+	}
+
+	tc, _ := reloaded.GetClientCertificate(&tls.CertificateRequestInfo{})
+	chains, err := tc.Leaf.Verify(x509.VerifyOptions{
+		Roots:     ca.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatalf("verify node certificate: %v", err)
+	}
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.Leaf}, VerifiedChains: chains}
+	if id, ok := PeerNodeID(state); !ok || id != "node1" || PeerSpaceID(state) != "space1" {
+		t.Fatalf("unexpected peer identity %s %s", id, PeerSpaceID(state))
+	}
+	if _, err := ca.Sign(csr, "node1", ""); err == nil {
+		t.Fatalf("expect certificate without space to be refused")
+	}
+}
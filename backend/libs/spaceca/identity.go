@@ -0,0 +1,184 @@
+package spaceca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"spacenode/libs/spacetls"
+	"spacenode/libs/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IdentityKeyFile  = "node.key"
+	IdentityCertFile = "node.crt"
+	IdentityIDFile   = "node_id"
+)
+
+// Identity 结点本地保存的身份: 私钥、CA 签发的证书和 NodeID
+type Identity struct {
+	dir    string
+	mu     sync.RWMutex
+	nodeID string
+	key    *ecdsa.PrivateKey
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+}
+
+// LoadIdentity 读取 dir 中的身份，私钥不存在时生成
+func LoadIdentity(dir string) (*Identity, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	id := &Identity{dir: dir}
+
+	keyPath := filepath.Join(dir, IdentityKeyFile)
+	if utils.FileExists(keyPath) {
+		data, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid key file %s", keyPath)
+		}
+		if id.key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := spacetls.WritePEM(keyPath, "EC PRIVATE KEY", der, 0600); err != nil {
+			return nil, err
+		}
+		id.key = key
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, IdentityIDFile)); err == nil {
+		id.nodeID = strings.TrimSpace(string(data))
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, IdentityCertFile)); err == nil {
+		// 证书和私钥不匹配时当作没有证书，重新申请
+		id.setCertificate(data)
+	}
+	return id, nil
+}
+
+// Dir 身份文件所在的目录
+func (i *Identity) Dir() string {
+	return i.dir
+}
+
+// NodeID 证书绑定的 NodeID，还没有申请过证书时为空
+func (i *Identity) NodeID() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.nodeID
+}
+
+// Enrolled 是否有一个还在有效期内、绑定到 spaceID 的证书，spaceID 为空时只要求证书绑定了 space
+// 旧版本签发的证书没有 space，需要重新申请
+func (i *Identity) Enrolled(spaceID string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.leaf == nil || !time.Now().Before(i.leaf.NotAfter) {
+		return false
+	}
+	ou := i.leaf.Subject.OrganizationalUnit
+	return len(ou) == 1 && (spaceID == "" || ou[0] == spaceID)
+}
+
+// SpaceID 证书绑定的 space，没有证书或者旧的证书为空
+func (i *Identity) SpaceID() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.leaf == nil || len(i.leaf.Subject.OrganizationalUnit) != 1 {
+		return ""
+	}
+	return i.leaf.Subject.OrganizationalUnit[0]
+}
+
+// NeedsRenew 证书剩余有效期不足 1/3 时需要轮换
+func (i *Identity) NeedsRenew() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.leaf == nil {
+		return true
+	}
+	lifetime := i.leaf.NotAfter.Sub(i.leaf.NotBefore)
+	return time.Until(i.leaf.NotAfter) < lifetime/3
+}
+
+// CSR 用本地私钥生成证书签名请求
+func (i *Identity) CSR(nodeID string) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: nodeID},
+	}, i.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// SetCertificate 保存 CA 签发的证书，NodeID 以证书为准
+func (i *Identity) SetCertificate(certPEM []byte) error {
+	if err := i.setCertificate(certPEM); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(i.dir, IdentityCertFile), certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(i.dir, IdentityIDFile), []byte(i.NodeID()), 0644)
+}
+
+func (i *Identity) setCertificate(certPEM []byte) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return errors.New("invalid certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(&i.key.PublicKey) {
+		return errors.New("certificate does not match the node key")
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.leaf = leaf
+	i.nodeID = leaf.Subject.CommonName
+	i.cert = &tls.Certificate{
+		Certificate: [][]byte{block.Bytes},
+		PrivateKey:  i.key,
+		Leaf:        leaf,
+	}
+	return nil
+}
+
+// GetClientCertificate 给 tls.Config 使用，轮换之后新的连接会使用新证书
+func (i *Identity) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cert == nil {
+		// 没有证书时发送空证书，服务端只允许申请证书
+		return &tls.Certificate{}, nil
+	}
+	return i.cert, nil
+}
@@ -0,0 +1,150 @@
+package spacetls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"spacenode/libs/utils"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ServerCertFile = "server.crt"
+	ServerKeyFile  = "server.key"
+
+	// 自签证书，客户端按指纹校验，有效期给长一些
+	serverCertLifetime = 10 * 365 * 24 * time.Hour
+)
+
+// LoadOrCreateServerCert 从 dir 读取服务端证书，不存在时生成一个自签证书并保存
+func LoadOrCreateServerCert(dir string, hosts []string) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, ServerCertFile)
+	keyPath := filepath.Join(dir, ServerKeyFile)
+	if utils.FileExists(certPath) && utils.FileExists(keyPath) {
+		return tls.LoadX509KeyPair(certPath, keyPath)
+	}
+
+	logrus.Infoln("generate space server certificate in", dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := RandomSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "spacenode server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(serverCertLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := WritePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := WritePEM(keyPath, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// WritePEM 将 der 以 pem 格式写入文件
+func WritePEM(path string, typ string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func RandomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Fingerprint 证书 DER 的 SHA-256，小写十六进制
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertFingerprint 返回 tls 证书中叶子证书的指纹
+func CertFingerprint(cert tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("empty certificate")
+	}
+	return Fingerprint(cert.Certificate[0]), nil
+}
+
+// ServerConfig space 监听端使用的 tls 配置
+func ServerConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// ClientConfig 结点使用的 tls 配置，不走 CA 校验，只接受指纹匹配的服务端证书
+func ClientConfig(fingerprint string) (*tls.Config, error) {
+	fingerprint = normalizeFingerprint(fingerprint)
+	if fingerprint == "" {
+		return nil, errors.New("server fingerprint is required")
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true, // 由 VerifyPeerCertificate 做指纹校验
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server did not present a certificate")
+			}
+			if got := Fingerprint(rawCerts[0]); got != fingerprint {
+				return fmt.Errorf("server fingerprint mismatch: got %s, want %s", got, fingerprint)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// 允许用户带冒号或者大写的写法
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(strings.TrimSpace(fp))
+	return strings.ReplaceAll(fp, ":", "")
+}
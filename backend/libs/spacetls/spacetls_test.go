@@ -0,0 +1,74 @@
+package spacetls
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestLoadOrCreateServerCert(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := LoadOrCreateServerCert(dir, []string{"host.lzcapp", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	fp, _ := CertFingerprint(cert)
+
+	// 第二次应当读取已保存的证书
+	again, err := LoadOrCreateServerCert(dir, nil)
+	if err != nil {
+		t.Fatalf("load cert: %v", err)
+	}
+	if fp2, _ := CertFingerprint(again); fp2 != fp {
+		t.Fatalf("fingerprint changed after reload: %s != %s", fp2, fp)
+	}
+}
+
+func TestClientConfigPinning(t *testing.T) {
+	cert, err := LoadOrCreateServerCert(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	fp, _ := CertFingerprint(cert)
+
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", ServerConfig(cert))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	dial := func(pin string) error {
+		cfg, err := ClientConfig(pin)
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", lis.Addr().String(), cfg)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	if err := dial(fp); err != nil {
+		t.Fatalf("expect pinned handshake to succeed: %v", err)
+	}
+	bad := []byte(fp)
+	bad[0] ^= 1
+	if err := dial(string(bad)); err == nil {
+		t.Fatalf("expect mismatched fingerprint to fail")
+	}
+	if _, err := ClientConfig(""); err == nil {
+		t.Fatalf("expect empty fingerprint to be rejected")
+	}
+}
@@ -0,0 +1,74 @@
+package spacetun
+
+import (
+	"net/netip"
+	"spacenode/libs/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// forwardRule 一条 iptables 规则
+type forwardRule struct {
+	table string
+	chain string
+	args  []string
+}
+
+// forwardRules 把 space 网段 src 从网卡 name 进来、发往 routes 的包转发出去并做源地址转换
+// 只包括与 src 同一地址族的网段
+func forwardRules(name string, src netip.Prefix, routes []netip.Prefix) []forwardRule {
+	rules := []forwardRule{{
+		table: "filter",
+		chain: "FORWARD",
+		args:  []string{"-o", name, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}}
+	for _, r := range routes {
+		if r.Addr().Is4() != src.Addr().Is4() {
+			continue
+		}
+		rules = append(rules,
+			forwardRule{table: "filter", chain: "FORWARD", args: []string{"-i", name, "-d", r.String(), "-j", "ACCEPT"}},
+			forwardRule{table: "nat", chain: "POSTROUTING", args: []string{"-s", src.String(), "-d", r.String(), "!", "-o", name, "-j", "MASQUERADE"}},
+		)
+	}
+	return rules
+}
+
+func iptables(src netip.Prefix) string {
+	if src.Addr().Is4() {
+		return "iptables"
+	}
+	return "ip6tables"
+}
+
+// Masquerade 打开内核转发，让 space 中的结点经过本机访问 routes，src 为 space 的网段
+// 规则已经存在时不重复添加
+func Masquerade(name string, src netip.Prefix, routes []netip.Prefix) error {
+	key := "net.ipv4.ip_forward=1"
+	if src.Addr().Is6() {
+		key = "net.ipv6.conf.all.forwarding=1"
+	}
+	if _, err := utils.Run("sysctl", "-w", key); err != nil {
+		return err
+	}
+	ipt := iptables(src)
+	for _, r := range forwardRules(name, src.Masked(), routes) {
+		if _, err := utils.Run(ipt, append([]string{"-t", r.table, "-C", r.chain}, r.args...)...); err == nil {
+			continue
+		}
+		if _, err := utils.Run(ipt, append([]string{"-t", r.table, "-I", r.chain}, r.args...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unmasquerade 删除 Masquerade 添加的规则，内核转发保持打开
+func Unmasquerade(name string, src netip.Prefix, routes []netip.Prefix) {
+	ipt := iptables(src)
+	for _, r := range forwardRules(name, src.Masked(), routes) {
+		if _, err := utils.Run(ipt, append([]string{"-t", r.table, "-D", r.chain}, r.args...)...); err != nil {
+			logrus.Warnln("delete forward rule", r.args, err)
+		}
+	}
+}
@@ -2,9 +2,13 @@ package spacetun
 
 import (
 	"fmt"
+	"net/netip"
 	"os/exec"
+	"slices"
 	"spacenode/libs/models"
 	"spacenode/libs/utils"
+	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/songgao/water"
@@ -25,12 +29,15 @@ func SetupTUN(tsc *models.TunSetupConfig) (*water.Interface, error) {
 		return nil, fmt.Errorf("failed to create TUN device: %w", err)
 	}
 
-	if tsc.IPv4 != "" {
-		// 配置IP地址
-		cmd := exec.Command("ip", "addr", "add", tsc.IPv4, "dev", ifce.Name())
+	// 配置IP地址，双栈时两个地址族都配置
+	for _, addr := range []string{tsc.IPv4, tsc.IPv6} {
+		if addr == "" {
+			continue
+		}
+		cmd := exec.Command("ip", "addr", "add", addr, "dev", ifce.Name())
 		if err := cmd.Run(); err != nil {
 			ifce.Close()
-			return nil, fmt.Errorf("failed to configure IP: %w", err)
+			return nil, fmt.Errorf("failed to configure IP %s: %w", addr, err)
 		}
 	}
 
@@ -64,3 +71,82 @@ func closeTun(tsc *models.TunSetupConfig) error {
 
 	return nil
 }
+
+// ReplaceAddr 替换网卡的地址，用于重连之后分配到了新的 IP，IPv4 和 IPv6 都适用
+// oldAddr 为空时只添加 newAddr，newAddr 为空时只删除 oldAddr
+func ReplaceAddr(name string, oldAddr string, newAddr string) error {
+	if oldAddr != "" {
+		if _, err := utils.Run("ip", "addr", "del", oldAddr, "dev", name); err != nil {
+			logrus.Warnln("delete old address", oldAddr, err)
+		}
+	}
+	if newAddr == "" {
+		return nil
+	}
+	_, err := utils.Run("ip", "addr", "add", newAddr, "dev", name)
+	return err
+}
+
+// SetMTU 修改网卡的 MTU
+func SetMTU(name string, mtu int) error {
+	_, err := utils.Run("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
+	return err
+}
+
+// ReplaceRoutes 把经过网卡的路由从 oldRoutes 换成 newRoutes，都是 CIDR
+func ReplaceRoutes(name string, oldRoutes []string, newRoutes []string) error {
+	for _, r := range oldRoutes {
+		if slices.Contains(newRoutes, r) {
+			continue
+		}
+		if _, err := utils.Run("ip", "route", "del", r, "dev", name); err != nil {
+			logrus.Warnln("delete route", r, err)
+		}
+	}
+	for _, r := range newRoutes {
+		if _, err := utils.Run("ip", "route", "replace", r, "dev", name); err != nil {
+			return fmt.Errorf("failed to add route %s: %w", r, err)
+		}
+	}
+	return nil
+}
+
+// PinRoute 让发往 addr 的包继续走当前的物理路由，不受经过网卡 name 的默认路由影响
+// 当前的路由已经经过 name 时不做修改
+func PinRoute(name string, addr netip.Addr) error {
+	out, err := utils.Run("ip", "route", "get", addr.String())
+	if err != nil {
+		return err
+	}
+	var via, dev string
+	fields := strings.Fields(out)
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			via = fields[i+1]
+		case "dev":
+			dev = fields[i+1]
+		}
+	}
+	if dev == "" {
+		return fmt.Errorf("no route to %s", addr)
+	}
+	if dev == name {
+		return nil
+	}
+	args := []string{"route", "replace", netip.PrefixFrom(addr, addr.BitLen()).String()}
+	if via != "" {
+		args = append(args, "via", via)
+	}
+	_, err = utils.Run("ip", append(args, "dev", dev)...)
+	return err
+}
+
+// SetDNS 用 systemd-resolved 把网卡的 DNS 设为 space 内置的 DNS，search 为搜索域
+func SetDNS(name string, servers []string, search []string) error {
+	if _, err := utils.Run("resolvectl", append([]string{"dns", name}, servers...)...); err != nil {
+		return err
+	}
+	_, err := utils.Run("resolvectl", append([]string{"domain", name}, search...)...)
+	return err
+}
@@ -0,0 +1,228 @@
+// Package subnet 检查 space 网段是否为私有地址，以及是否与本机的网卡和路由冲突
+package subnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrPublic   = errors.New("subnet is not a private range")
+	ErrConflict = errors.New("subnet overlaps a local network")
+	ErrNoFree   = errors.New("no free private subnet")
+)
+
+// Default space 的默认网段，也是 Suggest 查找的起点
+var Default = netip.MustParsePrefix("10.144.0.0/24")
+
+// 私有网段: RFC1918 和 RFC6598 共享地址
+var privateRanges = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// IsPrivate 网段是否完全在私有地址范围内
+func IsPrivate(prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	for _, r := range privateRanges {
+		if r.Bits() <= prefix.Bits() && r.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Network 本机的一个网段，来自网卡地址或者路由表
+type Network struct {
+	Prefix netip.Prefix
+	// 网卡名
+	Iface string
+	// 来自路由表
+	Route bool
+}
+
+func (n Network) String() string {
+	if n.Route {
+		return fmt.Sprintf("route %s dev %s", n.Prefix, n.Iface)
+	}
+	return fmt.Sprintf("%s on %s", n.Prefix, n.Iface)
+}
+
+// Local 本机网卡上的 IPv4 网段和路由，skip 中的网卡不计入
+// 路由表只在 linux 上读取，默认路由不计入
+func Local(skip ...string) ([]Network, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	arr := make([]Network, 0)
+	for _, ifce := range ifaces {
+		if ifce.Flags&net.FlagLoopback != 0 || slices.Contains(skip, ifce.Name) {
+			continue
+		}
+		addrs, err := ifce.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			prefix, ok := toPrefix(ipnet)
+			if !ok {
+				continue
+			}
+			arr = append(arr, Network{Prefix: prefix, Iface: ifce.Name})
+		}
+	}
+	routes, err := readRoutes("/proc/net/route")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return arr, nil
+		}
+		return nil, err
+	}
+	for _, r := range routes {
+		if !slices.Contains(skip, r.Iface) {
+			arr = append(arr, r)
+		}
+	}
+	return arr, nil
+}
+
+// Conflicts 与 prefix 重叠的网段
+func Conflicts(prefix netip.Prefix, local []Network) []Network {
+	arr := make([]Network, 0)
+	for _, n := range local {
+		if n.Prefix.Overlaps(prefix) {
+			arr = append(arr, n)
+		}
+	}
+	return arr
+}
+
+// Check 网段必须是私有地址并且不与本机网络重叠，skip 中的网卡不计入
+func Check(prefix netip.Prefix, skip ...string) error {
+	if !IsPrivate(prefix) {
+		return fmt.Errorf("%s: %w", prefix, ErrPublic)
+	}
+	local, err := Local(skip...)
+	if err != nil {
+		return err
+	}
+	if c := Conflicts(prefix, local); len(c) > 0 {
+		return fmt.Errorf("%s: %w: %s", prefix, ErrConflict, c[0])
+	}
+	return nil
+}
+
+// Suggest 从 10.0.0.0/8 中找一个不与 used 重叠的 /24
+// 从 Default 开始按顺序查找，本机网络不变时结果不变
+func Suggest(used []Network) (netip.Prefix, error) {
+	start := binary.BigEndian.Uint32(Default.Addr().AsSlice())
+	for i := uint32(0); i < 1<<16; i++ {
+		// 在 10.0.0.0/8 的 65536 个 /24 中回绕
+		v := 10<<24 | (start+i<<8)&0x00ffff00
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], v)
+		prefix := netip.PrefixFrom(netip.AddrFrom4(b), 24)
+		if len(Conflicts(prefix, used)) == 0 {
+			return prefix, nil
+		}
+	}
+	return netip.Prefix{}, ErrNoFree
+}
+
+// SuggestLocal 一个不与本机网络重叠的私有 /24
+func SuggestLocal() (netip.Prefix, error) {
+	local, err := Local()
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return Suggest(local)
+}
+
+// readRoutes 解析 /proc/net/route，地址为小端序的十六进制
+func readRoutes(path string) ([]Network, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	arr := make([]Network, 0)
+	sc := bufio.NewScanner(f)
+	sc.Scan() // 表头
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dst, err1 := strconv.ParseUint(fields[1], 16, 32)
+		mask, err2 := strconv.ParseUint(fields[7], 16, 32)
+		if err1 != nil || err2 != nil || mask == 0 {
+			continue
+		}
+		var d, m [4]byte
+		binary.LittleEndian.PutUint32(d[:], uint32(dst))
+		binary.LittleEndian.PutUint32(m[:], uint32(mask))
+		ones, bits := net.IPMask(m[:]).Size()
+		if bits == 0 {
+			continue
+		}
+		arr = append(arr, Network{
+			Prefix: netip.PrefixFrom(netip.AddrFrom4(d), ones).Masked(),
+			Iface:  fields[0],
+			Route:  true,
+		})
+	}
+	return arr, sc.Err()
+}
+
+func toPrefix(ipnet *net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ipnet.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return netip.Prefix{}, false
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits == 0 {
+		return netip.Prefix{}, false
+	}
+	if bits == 128 {
+		ones -= 96
+	}
+	return netip.PrefixFrom(addr, ones).Masked(), true
+}
+
+// Pick 解析 s 为网段，s 为空时使用 Default
+// 默认网段固定不变，重启之后结点的租约仍然有效，与本机网络重叠时由调用方提示 Suggest 的结果
+func Pick(s string) (netip.Prefix, error) {
+	if s == "" {
+		return Default, nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil || !prefix.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("invalid subnet %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// Mask 网段的点分十进制掩码，比如 255.255.255.0
+func Mask(prefix netip.Prefix) string {
+	return net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+}
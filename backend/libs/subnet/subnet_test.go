@@ -0,0 +1,78 @@
+package subnet
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsPrivate(t *testing.T) {
+	cases := map[string]bool{
+		"10.10.0.0/24":   true,
+		"172.16.5.0/24":  true,
+		"172.168.1.0/24": false,
+		"192.168.0.0/16": true,
+		"192.0.0.0/8":    false,
+		"100.100.1.0/24": true,
+		"8.8.8.0/24":     false,
+	}
+	for s, want := range cases {
+		if got := IsPrivate(netip.MustParsePrefix(s)); got != want {
+			t.Fatalf("%s: expect %v, got %v", s, want, got)
+		}
+	}
+	if err := Check(netip.MustParsePrefix("172.168.1.0/24")); !errors.Is(err, ErrPublic) {
+		t.Fatalf("expect public range to fail, got %v", err)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	used := []Network{
+		{Prefix: netip.MustParsePrefix("10.144.0.0/23"), Iface: "eth0"},
+		{Prefix: netip.MustParsePrefix("10.144.2.128/25"), Iface: "eth1"},
+	}
+	prefix, err := Suggest(used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != netip.MustParsePrefix("10.144.3.0/24") {
+		t.Fatalf("unexpected suggestion %s", prefix)
+	}
+	if c := Conflicts(netip.MustParsePrefix("10.144.1.0/24"), used); len(c) != 1 || c[0].Iface != "eth0" {
+		t.Fatalf("unexpected conflicts %v", c)
+	}
+
+	// 整个 10.0.0.0/8 被占用
+	if _, err := Suggest([]Network{{Prefix: netip.MustParsePrefix("10.0.0.0/8")}}); !errors.Is(err, ErrNoFree) {
+		t.Fatalf("expect no free subnet, got %v", err)
+	}
+}
+
+func TestReadRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "route")
+	table := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t00000000\t0100A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n" +
+		"eth0\t0000A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"docker0\t000011AC\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n"
+	if err := os.WriteFile(path, []byte(table), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := readRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Network{
+		{Prefix: netip.MustParsePrefix("192.168.0.0/24"), Iface: "eth0", Route: true},
+		{Prefix: netip.MustParsePrefix("172.17.0.0/16"), Iface: "docker0", Route: true},
+	}
+	if len(routes) != len(want) {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+	for i := range want {
+		if routes[i] != want[i] {
+			t.Fatalf("expect %v, got %v", want[i], routes[i])
+		}
+	}
+}
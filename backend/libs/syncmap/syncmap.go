@@ -35,3 +35,17 @@ func (s *SyncMap[K, V]) Range(f func(key K, value V) bool) {
 		return f(k.(K), v.(V))
 	})
 }
+
+// CompareAndDelete 只有当前值为 old 时才删除
+func (s *SyncMap[K, V]) CompareAndDelete(key K, old V) bool {
+	return s.m.CompareAndDelete(key, old)
+}
+
+// LoadAndDelete 删除 key 并返回原来的值
+func (s *SyncMap[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	val, loaded := s.m.LoadAndDelete(key)
+	if loaded {
+		value = val.(V)
+	}
+	return
+}
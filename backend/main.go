@@ -11,6 +11,9 @@ import (
 var (
 	httpPort = flag.Int("http-port", 58083, "HTTP server port")
 	dbpath   = flag.String("dbpath", "/lzcapp/var/space.db", "db path")
+	tlsDir   = flag.String("tls-dir", "/lzcapp/var/tls", "space listener certificate dir")
+	e2e      = flag.Bool("e2e", false, "require end-to-end encryption between nodes")
+	network  = flag.String("subnet", "", "space subnet, e.g. 10.144.0.0/24; default 10.144.0.0/24")
 )
 
 func main() {
@@ -20,7 +23,7 @@ func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 	db.InitDB(*dbpath)
 
-	s, err := spacehttp.NewServer(*httpPort)
+	s, err := spacehttp.NewServer(*httpPort, *tlsDir, *e2e, *network)
 	if err != nil {
 		panic(err)
 	}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+	"path/filepath"
 	"spacenode/libs/models"
 	"spacenode/libs/syncmap"
+	"spacenode/modules/jointoken"
 	"spacenode/modules/lzcapp"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -20,6 +23,12 @@ type AppAider interface {
 	// TODO: 未来的功能，应由未来实现
 }
 
+// app 结点生成配置后马上就会启动，token 不需要太长的有效期
+const appTokenTTL = time.Hour
+
+// SpaceConfigFunc 查询 space 的配置，生成 app 结点配置时使用
+type SpaceConfigFunc func(spaceID string) (models.SpaceItemConfig, error)
+
 type appAider struct {
 	db        *gorm.DB
 	apps      syncmap.SyncMap[string, *models.AppNode]
@@ -27,10 +36,12 @@ type appAider struct {
 	lam       lzcapp.LzcAppManager
 	hooker    LzcAppHooker
 	lzcdocker LzcDockerHolder
+	spaceCfg  SpaceConfigFunc
+	tokens    jointoken.Manager
 }
 
 // 实现AppAider
-func NewAppAider(db *gorm.DB, lzcAppManager lzcapp.LzcAppManager) (AppAider, error) {
+func NewAppAider(db *gorm.DB, lzcAppManager lzcapp.LzcAppManager, spaceCfg SpaceConfigFunc, tokens jointoken.Manager) (AppAider, error) {
 	holder, err := NewLzcDockerHolder()
 	if err != nil {
 		return nil, err
@@ -40,6 +51,8 @@ func NewAppAider(db *gorm.DB, lzcAppManager lzcapp.LzcAppManager) (AppAider, err
 		lam:       lzcAppManager,
 		hooker:    NewLzcAppHooker(),
 		lzcdocker: holder,
+		spaceCfg:  spaceCfg,
+		tokens:    tokens,
 	}
 	if err := ai.loadRecord(); err != nil {
 		return nil, err
@@ -79,6 +92,11 @@ func (a *appAider) Add(ctx context.Context, an *models.AppNode) error {
 		return err
 	}
 
+	sc, err := a.spaceCfg(an.SpaceID)
+	if err != nil {
+		return err
+	}
+
 	if len(dks) == 0 {
 		logrus.Errorln("no container found for app ", an.AppID)
 		return fmt.Errorf("no container found for app %s", an.AppID)
@@ -86,6 +104,11 @@ func (a *appAider) Add(ctx context.Context, an *models.AppNode) error {
 
 	for _, container := range dks {
 		ak := appKey(container.Name, an.AppID)
+		// 每个容器的结点用一次性的 token 加入 space
+		tk, err := a.tokens.Create(an.SpaceID, false, appTokenTTL)
+		if err != nil {
+			return err
+		}
 		a.hooker.GenerateConfig(an.AppID, container.Name, &models.SpaceAppNodeConfig{
 			NodeConfig: models.SpaceNode{
 				SpaceID:   an.SpaceID,
@@ -94,14 +117,19 @@ func (a *appAider) Add(ctx context.Context, an *models.AppNode) error {
 				DockerPid: container.Pid,
 				AppID:     an.AppID,
 				Service:   container.Name,
+				// 其它结点通过 space 内置 DNS 解析这个名字
+				Domain: ak,
 			},
 			SpaceConfig: models.SpaceItemConfig{
-				Port:    59393, // FIXME: 待后面优化的时候将这个写死的端口去掉
-				ID:      ak,
-				Host:    "host.lzcapp",
-				Mask:    "255.255.255.0",
-				NetAddr: "172.168.1.0",
+				Port:        sc.Port,
+				ID:          ak,
+				Host:        "host.lzcapp",
+				Mask:        sc.Mask,
+				NetAddr:     sc.NetAddr,
+				Fingerprint: sc.Fingerprint,
 			},
+			Token:       tk.Token,
+			IdentityDir: filepath.Join("/lzcapp/var", fmt.Sprintf("lzcspace_%s", container.Name)),
 		})
 		c, err := a.hooker.RunNode(container.Pid, an.AppID, container.Name)
 		if err != nil {
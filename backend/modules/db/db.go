@@ -16,7 +16,7 @@ func InitDB(path string) {
 	if err != nil {
 		logrus.Fatalf("failed to connect database: %v", err)
 	}
-	db.AutoMigrate(&models.AppNode{})
+	db.AutoMigrate(&models.AppNode{}, &models.JoinToken{}, &models.RevokedNode{}, &models.IPLease{}, &models.NodeRecord{}, &models.IPReservation{}, &models.SubnetRoute{}, &models.ExitNode{}, &models.SpaceItemConfig{})
 	logrus.Infoln("Database connection established")
 }
 
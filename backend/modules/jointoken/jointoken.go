@@ -0,0 +1,99 @@
+package jointoken
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"spacenode/libs/models"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidToken = errors.New("invalid join token")
+
+type Manager interface {
+	// ttl 为 0 表示不过期
+	Create(spaceID string, reusable bool, ttl time.Duration) (*models.JoinToken, error)
+	List(spaceID string) ([]*models.JoinToken, error)
+	// Revoke 只吊销属于 spaceID 的 token，不存在时返回 ErrInvalidToken
+	Revoke(spaceID string, token string) error
+	// Consume 校验 token 并记录一次使用，不可用时返回 ErrInvalidToken
+	Consume(spaceID string, token string) error
+}
+
+type manager struct {
+	db *gorm.DB
+	// 保证单次 token 的校验和计数是原子的
+	mu sync.Mutex
+}
+
+func NewManager(db *gorm.DB) Manager {
+	return &manager{db: db}
+}
+
+func (m *manager) Create(spaceID string, reusable bool, ttl time.Duration) (*models.JoinToken, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	t := &models.JoinToken{
+		Token:    hex.EncodeToString(buf),
+		SpaceID:  spaceID,
+		Reusable: reusable,
+	}
+	if ttl > 0 {
+		exp := time.Now().Add(ttl)
+		t.ExpiresAt = &exp
+	}
+	if err := m.db.Create(t).Error; err != nil {
+		return nil, err
+	}
+	logrus.Infof("create join token for space %s, reusable: %v, ttl: %v", spaceID, reusable, ttl)
+	return t, nil
+}
+
+func (m *manager) List(spaceID string) ([]*models.JoinToken, error) {
+	var tokens []*models.JoinToken
+	q := m.db.Order("created_at")
+	if spaceID != "" {
+		q = q.Where("space_id = ?", spaceID)
+	}
+	if err := q.Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (m *manager) Revoke(spaceID string, token string) error {
+	res := m.db.Model(&models.JoinToken{}).Where("token = ? AND space_id = ?", token, spaceID).Update("revoked", true)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (m *manager) Consume(spaceID string, token string) error {
+	if token == "" {
+		return ErrInvalidToken
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := &models.JoinToken{}
+	if err := m.db.Where("token = ? AND space_id = ?", token, spaceID).First(t).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidToken
+		}
+		return err
+	}
+	if !t.Valid(time.Now()) {
+		return ErrInvalidToken
+	}
+	return m.db.Model(t).Update("used", t.Used+1).Error
+}
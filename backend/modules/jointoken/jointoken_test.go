@@ -0,0 +1,67 @@
+package jointoken
+
+import (
+	"errors"
+	"spacenode/libs/models"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestManager(t *testing.T) Manager {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&models.JoinToken{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return NewManager(db)
+}
+
+func TestConsume(t *testing.T) {
+	m := newTestManager(t)
+
+	once, _ := m.Create("space1", false, 0)
+	if err := m.Consume("space1", once.Token); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := m.Consume("space1", once.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("single-use token reused: %v", err)
+	}
+
+	reusable, _ := m.Create("space1", true, 0)
+	for i := 0; i < 3; i++ {
+		if err := m.Consume("space1", reusable.Token); err != nil {
+			t.Fatalf("reusable token use %d: %v", i, err)
+		}
+	}
+	if err := m.Consume("space2", reusable.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token accepted by another space: %v", err)
+	}
+
+	if err := m.Revoke("space2", reusable.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token revoked by another space: %v", err)
+	}
+	if err := m.Consume("space1", reusable.Token); err != nil {
+		t.Fatalf("token revoked by another space: %v", err)
+	}
+	if err := m.Revoke("space1", reusable.Token); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := m.Consume("space1", reusable.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("revoked token accepted: %v", err)
+	}
+
+	expired, _ := m.Create("space1", true, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if err := m.Consume("space1", expired.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expired token accepted: %v", err)
+	}
+
+	if err := m.Consume("space1", ""); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("empty token accepted: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package nodeca
+
+import (
+	"errors"
+	"fmt"
+	"spacenode/libs/models"
+	"spacenode/libs/spaceca"
+	"spacenode/libs/syncmap"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var ErrRevoked = errors.New("node is revoked")
+
+// Authority 结点证书的签发和吊销，吊销记录保存在数据库中
+type Authority interface {
+	CA() *spaceca.CA
+	// Issue 签发的证书只能用来注册到 spaceID
+	Issue(spaceID string, nodeID string, csrPEM []byte) (*models.EnrollResp, error)
+	Revoke(spaceID string, nodeID string, reason string) error
+	IsRevoked(nodeID string) bool
+	ListRevoked(spaceID string) ([]*models.RevokedNode, error)
+	// Forget space 删除之后丢掉它的吊销记录，数据库中的记录随 space 一起删除
+	Forget(spaceID string)
+}
+
+type authority struct {
+	db      *gorm.DB
+	ca      *spaceca.CA
+	revoked syncmap.SyncMap[string, *models.RevokedNode]
+}
+
+func NewAuthority(db *gorm.DB, ca *spaceca.CA) (Authority, error) {
+	a := &authority{
+		db: db,
+		ca: ca,
+	}
+	if err := a.loadRecord(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *authority) CA() *spaceca.CA {
+	return a.ca
+}
+
+func (a *authority) Issue(spaceID string, nodeID string, csrPEM []byte) (*models.EnrollResp, error) {
+	if a.IsRevoked(nodeID) {
+		return nil, fmt.Errorf("%w: %s", ErrRevoked, nodeID)
+	}
+	cert, err := a.ca.Sign(csrPEM, nodeID, spaceID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.EnrollResp{
+		NodeID: nodeID,
+		Cert:   string(cert),
+		CA:     string(a.ca.CertPEM()),
+	}, nil
+}
+
+func (a *authority) Revoke(spaceID string, nodeID string, reason string) error {
+	rn := &models.RevokedNode{
+		NodeID:  nodeID,
+		SpaceID: spaceID,
+		Reason:  reason,
+	}
+	if err := a.db.Save(rn).Error; err != nil {
+		return err
+	}
+	a.revoked.Store(nodeID, rn)
+	logrus.Infof("node %s revoked: %s", nodeID, reason)
+	return nil
+}
+
+func (a *authority) IsRevoked(nodeID string) bool {
+	_, ok := a.revoked.Load(nodeID)
+	return ok
+}
+
+func (a *authority) ListRevoked(spaceID string) ([]*models.RevokedNode, error) {
+	arr := make([]*models.RevokedNode, 0)
+	a.revoked.Range(func(key string, value *models.RevokedNode) bool {
+		if spaceID == "" || value.SpaceID == spaceID {
+			arr = append(arr, value)
+		}
+		return true
+	})
+	return arr, nil
+}
+
+func (a *authority) Forget(spaceID string) {
+	a.revoked.Range(func(key string, value *models.RevokedNode) bool {
+		if value.SpaceID == spaceID {
+			a.revoked.Delete(key)
+		}
+		return true
+	})
+}
+
+func (a *authority) loadRecord() error {
+	var nodes []*models.RevokedNode
+	if err := a.db.Find(&nodes).Error; err != nil {
+		logrus.Errorln("failed to find revoked nodes: ", err)
+		return err
+	}
+	for _, v := range nodes {
+		a.revoked.Store(v.NodeID, v)
+	}
+	return nil
+}
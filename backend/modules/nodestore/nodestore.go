@@ -0,0 +1,132 @@
+package nodestore
+
+import (
+	"spacenode/libs/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Store 保存 space 的 IP 租约和结点记录
+type Store interface {
+	Leases(spaceID string) ([]*models.IPLease, error)
+	SaveLease(l *models.IPLease) error
+	DeleteLease(spaceID string, ip string) error
+	Nodes(spaceID string) ([]*models.NodeRecord, error)
+	SaveNode(n *models.NodeRecord) error
+	DeleteNode(spaceID string, nodeID string) error
+	Reservations(spaceID string) ([]*models.IPReservation, error)
+	SaveReservation(r *models.IPReservation) error
+	DeleteReservation(spaceID string, nodeID string) error
+	Routes(spaceID string) ([]*models.SubnetRoute, error)
+	SaveRoute(r *models.SubnetRoute) error
+	DeleteRoute(spaceID string, nodeID string, prefix string) error
+	ExitNodes(spaceID string) ([]*models.ExitNode, error)
+	SaveExitNode(e *models.ExitNode) error
+	DeleteExitNode(spaceID string, nodeID string) error
+	// DeleteSpace 删除 space 的所有租约、结点记录、保留地址、子网路由、出口结点、join token 和吊销记录
+	// 同一个 ID 重新创建的 space 不会继承这些数据
+	DeleteSpace(spaceID string) error
+}
+
+type store struct {
+	db *gorm.DB
+}
+
+func NewStore(db *gorm.DB) Store {
+	return &store{db: db}
+}
+
+func (s *store) Leases(spaceID string) ([]*models.IPLease, error) {
+	var leases []*models.IPLease
+	if err := s.db.Where("space_id = ?", spaceID).Find(&leases).Error; err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// SaveLease 保存副本，gorm 会回写传入的结构体，space 中的租约可能正在被其它连接读取
+func (s *store) SaveLease(l *models.IPLease) error {
+	rec := *l
+	return s.db.Save(&rec).Error
+}
+
+func (s *store) DeleteLease(spaceID string, ip string) error {
+	return s.db.Where("space_id = ? AND ip = ?", spaceID, ip).Delete(&models.IPLease{}).Error
+}
+
+func (s *store) Nodes(spaceID string) ([]*models.NodeRecord, error) {
+	var nodes []*models.NodeRecord
+	if err := s.db.Where("space_id = ?", spaceID).Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// SaveNode 新增或更新结点，保留第一次加入的时间
+func (s *store) SaveNode(n *models.NodeRecord) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(n).Error
+}
+
+func (s *store) DeleteNode(spaceID string, nodeID string) error {
+	return s.db.Where("space_id = ? AND node_id = ?", spaceID, nodeID).Delete(&models.NodeRecord{}).Error
+}
+
+func (s *store) Reservations(spaceID string) ([]*models.IPReservation, error) {
+	var arr []*models.IPReservation
+	if err := s.db.Where("space_id = ?", spaceID).Find(&arr).Error; err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+func (s *store) SaveReservation(r *models.IPReservation) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(r).Error
+}
+
+func (s *store) DeleteReservation(spaceID string, nodeID string) error {
+	return s.db.Where("space_id = ? AND node_id = ?", spaceID, nodeID).Delete(&models.IPReservation{}).Error
+}
+
+func (s *store) Routes(spaceID string) ([]*models.SubnetRoute, error) {
+	var arr []*models.SubnetRoute
+	if err := s.db.Where("space_id = ?", spaceID).Find(&arr).Error; err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+func (s *store) SaveRoute(r *models.SubnetRoute) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(r).Error
+}
+
+func (s *store) DeleteRoute(spaceID string, nodeID string, prefix string) error {
+	return s.db.Where("space_id = ? AND node_id = ? AND prefix = ?", spaceID, nodeID, prefix).Delete(&models.SubnetRoute{}).Error
+}
+
+func (s *store) ExitNodes(spaceID string) ([]*models.ExitNode, error) {
+	var arr []*models.ExitNode
+	if err := s.db.Where("space_id = ?", spaceID).Find(&arr).Error; err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+func (s *store) SaveExitNode(e *models.ExitNode) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(e).Error
+}
+
+func (s *store) DeleteExitNode(spaceID string, nodeID string) error {
+	return s.db.Where("space_id = ? AND node_id = ?", spaceID, nodeID).Delete(&models.ExitNode{}).Error
+}
+
+func (s *store) DeleteSpace(spaceID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, m := range []any{&models.IPLease{}, &models.NodeRecord{}, &models.IPReservation{}, &models.SubnetRoute{}, &models.ExitNode{}, &models.JoinToken{}, &models.RevokedNode{}} {
+			if err := tx.Where("space_id = ?", spaceID).Delete(m).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,182 @@
+package nodestore
+
+import (
+	"spacenode/libs/models"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&models.IPLease{}, &models.NodeRecord{}, &models.IPReservation{}, &models.SubnetRoute{}, &models.ExitNode{}, &models.JoinToken{}, &models.RevokedNode{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func newTestStore(t *testing.T) Store {
+	return NewStore(newTestDB(t))
+}
+
+func TestLeases(t *testing.T) {
+	s := newTestStore(t)
+	expires := time.Now().Add(time.Hour)
+	if err := s.SaveLease(&models.IPLease{SpaceID: "space1", IP: "10.0.0.2", NodeID: "a", ExpiresAt: expires}); err != nil {
+		t.Fatal(err)
+	}
+	s.SaveLease(&models.IPLease{SpaceID: "space2", IP: "10.0.0.2", NodeID: "b", ExpiresAt: expires})
+	// 同一个地址换了主人
+	s.SaveLease(&models.IPLease{SpaceID: "space1", IP: "10.0.0.2", NodeID: "c", ExpiresAt: expires})
+
+	leases, err := s.Leases("space1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 || leases[0].NodeID != "c" {
+		t.Fatalf("unexpected leases: %+v", leases)
+	}
+
+	if err := s.DeleteLease("space1", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if leases, _ := s.Leases("space1"); len(leases) != 0 {
+		t.Fatalf("expect lease to be deleted, got %+v", leases)
+	}
+	if leases, _ := s.Leases("space2"); len(leases) != 1 {
+		t.Fatalf("expect lease of another space to be kept, got %+v", leases)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.SaveNode(&models.NodeRecord{SpaceID: "space1", NodeID: "a", IP: "10.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	nodes, _ := s.Nodes("space1")
+	if len(nodes) != 1 {
+		t.Fatalf("expect 1 node, got %d", len(nodes))
+	}
+	created := nodes[0].CreatedAt
+
+	seen := time.Now().Add(time.Minute)
+	if err := s.SaveNode(&models.NodeRecord{SpaceID: "space1", NodeID: "a", IP: "10.0.0.3", LastSeen: seen}); err != nil {
+		t.Fatal(err)
+	}
+	nodes, _ = s.Nodes("space1")
+	if len(nodes) != 1 || nodes[0].IP != "10.0.0.3" || !nodes[0].LastSeen.Equal(seen) {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+	if !nodes[0].CreatedAt.Equal(created) {
+		t.Fatalf("created_at changed from %v to %v", created, nodes[0].CreatedAt)
+	}
+
+	s.DeleteNode("space1", "a")
+	if nodes, _ := s.Nodes("space1"); len(nodes) != 0 {
+		t.Fatalf("expect node to be deleted, got %+v", nodes)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	s := newTestStore(t)
+	s.SaveReservation(&models.IPReservation{SpaceID: "space1", NodeID: "a", IP: "10.0.0.2"})
+	if err := s.SaveReservation(&models.IPReservation{SpaceID: "space1", NodeID: "a", IP: "10.0.0.9"}); err != nil {
+		t.Fatal(err)
+	}
+	arr, _ := s.Reservations("space1")
+	if len(arr) != 1 || arr[0].IP != "10.0.0.9" {
+		t.Fatalf("unexpected reservations: %+v", arr)
+	}
+	s.DeleteReservation("space1", "a")
+	if arr, _ := s.Reservations("space1"); len(arr) != 0 {
+		t.Fatalf("expect reservation to be deleted, got %+v", arr)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	s := newTestStore(t)
+	s.SaveRoute(&models.SubnetRoute{SpaceID: "space1", NodeID: "a", Prefix: "192.168.1.0/24"})
+	s.SaveRoute(&models.SubnetRoute{SpaceID: "space1", NodeID: "a", Prefix: "192.168.2.0/24"})
+	if err := s.SaveRoute(&models.SubnetRoute{SpaceID: "space1", NodeID: "a", Prefix: "192.168.1.0/24", Approved: true}); err != nil {
+		t.Fatal(err)
+	}
+	arr, _ := s.Routes("space1")
+	if len(arr) != 2 {
+		t.Fatalf("unexpected routes: %+v", arr)
+	}
+	for _, r := range arr {
+		if r.Approved != (r.Prefix == "192.168.1.0/24") {
+			t.Fatalf("unexpected approval: %+v", r)
+		}
+	}
+	s.DeleteRoute("space1", "a", "192.168.2.0/24")
+	if arr, _ := s.Routes("space1"); len(arr) != 1 {
+		t.Fatalf("expect route to be deleted, got %+v", arr)
+	}
+}
+
+func TestExitNodes(t *testing.T) {
+	s := newTestStore(t)
+	s.SaveExitNode(&models.ExitNode{SpaceID: "space1", NodeID: "a"})
+	s.SaveExitNode(&models.ExitNode{SpaceID: "space1", NodeID: "b"})
+	if err := s.SaveExitNode(&models.ExitNode{SpaceID: "space1", NodeID: "a", Approved: true}); err != nil {
+		t.Fatal(err)
+	}
+	arr, _ := s.ExitNodes("space1")
+	if len(arr) != 2 {
+		t.Fatalf("unexpected exit nodes: %+v", arr)
+	}
+	for _, e := range arr {
+		if e.Approved != (e.NodeID == "a") {
+			t.Fatalf("unexpected approval: %+v", e)
+		}
+	}
+	s.DeleteExitNode("space1", "b")
+	if arr, _ := s.ExitNodes("space1"); len(arr) != 1 {
+		t.Fatalf("expect exit node to be deleted, got %+v", arr)
+	}
+}
+
+func TestDeleteSpace(t *testing.T) {
+	db := newTestDB(t)
+	s := NewStore(db)
+	expires := time.Now().Add(time.Hour)
+	for _, id := range []string{"space1", "space2"} {
+		s.SaveLease(&models.IPLease{SpaceID: id, IP: "10.0.0.2", NodeID: "a", ExpiresAt: expires})
+		s.SaveNode(&models.NodeRecord{SpaceID: id, NodeID: "a", IP: "10.0.0.2"})
+		s.SaveReservation(&models.IPReservation{SpaceID: id, NodeID: "a", IP: "10.0.0.2"})
+		s.SaveRoute(&models.SubnetRoute{SpaceID: id, NodeID: "a", Prefix: "192.168.1.0/24", Approved: true})
+		s.SaveExitNode(&models.ExitNode{SpaceID: id, NodeID: "a", Approved: true})
+		db.Create(&models.JoinToken{Token: "token-" + id, SpaceID: id})
+		db.Create(&models.RevokedNode{NodeID: "revoked-" + id, SpaceID: id})
+	}
+	if err := s.DeleteSpace("space1"); err != nil {
+		t.Fatal(err)
+	}
+	leases, _ := s.Leases("space1")
+	nodes, _ := s.Nodes("space1")
+	arr, _ := s.Reservations("space1")
+	routes, _ := s.Routes("space1")
+	exits, _ := s.ExitNodes("space1")
+	var tokens, revoked int64
+	db.Model(&models.JoinToken{}).Where("space_id = ?", "space1").Count(&tokens)
+	db.Model(&models.RevokedNode{}).Where("space_id = ?", "space1").Count(&revoked)
+	if len(leases)+len(nodes)+len(arr)+len(routes)+len(exits) != 0 || tokens+revoked != 0 {
+		t.Fatalf("expect space1 to be empty, got %+v %+v %+v %+v %+v, %d tokens %d revoked", leases, nodes, arr, routes, exits, tokens, revoked)
+	}
+	leases, _ = s.Leases("space2")
+	nodes, _ = s.Nodes("space2")
+	arr, _ = s.Reservations("space2")
+	routes, _ = s.Routes("space2")
+	exits, _ = s.ExitNodes("space2")
+	db.Model(&models.JoinToken{}).Count(&tokens)
+	db.Model(&models.RevokedNode{}).Count(&revoked)
+	if len(leases) != 1 || len(nodes) != 1 || len(arr) != 1 || len(routes) != 1 || len(exits) != 1 || tokens != 1 || revoked != 1 {
+		t.Fatalf("expect space2 to be kept")
+	}
+}
@@ -0,0 +1,164 @@
+package space
+
+import (
+	"fmt"
+	"net/netip"
+	"spacenode/libs/acl"
+	"spacenode/libs/models"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkACL 检查策略中的动作、选择器、协议和端口
+func checkACL(p *models.ACLPolicy) error {
+	if p == nil {
+		return nil
+	}
+	_, err := compileACL(p, nil)
+	return err
+}
+
+// compileACL 把策略中的选择器换成 nodes 当前的地址
+func compileACL(p *models.ACLPolicy, nodes []*NodeItem) (*acl.Table, error) {
+	t := &acl.Table{LogDenied: p.LogDenied}
+	switch p.Default {
+	case "", models.ACLAccept:
+		t.DefaultAccept = true
+	case models.ACLDeny:
+	default:
+		return nil, fmt.Errorf("invalid default action %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		var r acl.Rule
+		switch rule.Action {
+		case models.ACLAccept:
+			r.Accept = true
+		case models.ACLDeny:
+		default:
+			return nil, fmt.Errorf("rule %d: invalid action %q", i, rule.Action)
+		}
+		var err error
+		if r.Src, err = resolveAddrs(p, rule.Src, nodes, true); err != nil {
+			return nil, fmt.Errorf("rule %d: src: %w", i, err)
+		}
+		if r.Dst, err = resolveAddrs(p, rule.Dst, nodes, true); err != nil {
+			return nil, fmt.Errorf("rule %d: dst: %w", i, err)
+		}
+		if r.Proto, err = acl.ParseProto(rule.Proto); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if r.Ports, err = acl.ParsePorts(rule.Ports); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if len(r.Ports) > 0 && rule.Proto != "" && rule.Proto != "tcp" && rule.Proto != "udp" {
+			return nil, fmt.Errorf("rule %d: ports require tcp or udp", i)
+		}
+		t.Rules = append(t.Rules, r)
+	}
+	return t, nil
+}
+
+// resolveAddrs 选择器对应的地址，没有匹配的结点时为空，规则不会匹配
+func resolveAddrs(p *models.ACLPolicy, sels []string, nodes []*NodeItem, tags bool) (acl.Addrs, error) {
+	var addrs acl.Addrs
+	if len(sels) == 0 {
+		return addrs, fmt.Errorf("no selector")
+	}
+	for _, sel := range sels {
+		if sel == "*" {
+			addrs.Any = true
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(sel); err == nil {
+			addrs.Prefixes = append(addrs.Prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(sel); err == nil {
+			addrs.Prefixes = append(addrs.Prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		kind, value, _ := strings.Cut(sel, ":")
+		var match func(n *NodeItem) bool
+		switch kind {
+		case "node":
+			match = func(n *NodeItem) bool { return n.Node.NodeID == value }
+		case "app":
+			match = func(n *NodeItem) bool { return n.Node.AppID == value }
+		case "type":
+			if value != string(models.NodeTypeApp) && value != string(models.NodeTypeClient) {
+				return addrs, fmt.Errorf("invalid node type %q", value)
+			}
+			match = func(n *NodeItem) bool { return n.Node.NodeType == models.NodeType(value) }
+		case "tag":
+			if !tags {
+				return addrs, fmt.Errorf("tag %q references another tag", sel)
+			}
+			members, ok := p.Tags[value]
+			if !ok {
+				return addrs, fmt.Errorf("unknown tag %q", value)
+			}
+			tagged, err := resolveAddrs(p, members, nodes, false)
+			if err != nil {
+				return addrs, fmt.Errorf("tag %s: %w", value, err)
+			}
+			addrs.Any = addrs.Any || tagged.Any
+			addrs.Prefixes = append(addrs.Prefixes, tagged.Prefixes...)
+			continue
+		default:
+			return addrs, fmt.Errorf("invalid selector %q", sel)
+		}
+		if value == "" {
+			return addrs, fmt.Errorf("invalid selector %q", sel)
+		}
+		for _, n := range nodes {
+			if match(n) {
+				addrs.Prefixes = append(addrs.Prefixes, nodePrefixes(n)...)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// nodePrefixes 结点的 IPv4 和 IPv6 地址
+func nodePrefixes(n *NodeItem) []netip.Prefix {
+	var arr []netip.Prefix
+	for _, ip := range []string{n.IP(), n.IPv6()} {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			arr = append(arr, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return arr
+}
+
+// reloadACL 按当前的结点重新编译策略并热加载到路由器，结点注册、移除和重新编址之后调用
+// reset 为 true 时清空跟踪的连接和计数，用于修改了策略
+func (s *Space) reloadACL(reset bool) {
+	s.aclMu.Lock()
+	defer s.aclMu.Unlock()
+	p := s.conf().ACL
+	if p == nil {
+		s.filter.Load(nil)
+	} else {
+		var nodes []*NodeItem
+		s.nodes.Range(func(key string, value *NodeItem) bool {
+			nodes = append(nodes, value)
+			return true
+		})
+		t, err := compileACL(p, nodes)
+		if err != nil {
+			// 保存之前已经检查过
+			logrus.Errorf("%s: compile acl: %v", s.conf().ID, err)
+			return
+		}
+		s.filter.Load(t)
+	}
+	if reset {
+		s.filter.Reset()
+	}
+}
+
+// ACLStats 访问控制拒绝的包的计数
+func (s *Space) ACLStats() acl.Stats {
+	return s.filter.Stats()
+}
@@ -0,0 +1,97 @@
+package space
+
+import (
+	"spacenode/libs/models"
+	"spacenode/libs/router"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+	s := env.space
+
+	a, respA, err := env.client(t, "secret").Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("connect a: %v", err)
+	}
+	defer a.Close()
+	reqB := registerRequest("b")
+	reqB.SpaceNode.NodeType = models.NodeTypeApp
+	reqB.SpaceNode.AppID = "web"
+	b, respB, err := env.client(t, "secret").Connect(reqB)
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+
+	sc := *s.GetConifg()
+	sc.ACL = &models.ACLPolicy{
+		Default: models.ACLDeny,
+		Tags:    map[string][]string{"web": {"app:web"}},
+		Rules: []models.ACLRule{
+			{Action: models.ACLAccept, Src: []string{"type:client"}, Dst: []string{"tag:web"}, Proto: "udp", Ports: []string{"2000"}},
+		},
+	}
+	bad := sc
+	bad.ACL = &models.ACLPolicy{Rules: []models.ACLRule{{Action: "allow", Src: []string{"*"}, Dst: []string{"*"}}}}
+	if err := s.SetConifg(bad); err == nil {
+		t.Fatalf("expect invalid action to fail")
+	}
+	if err := s.SetConifg(sc); err != nil {
+		t.Fatalf("set acl: %v", err)
+	}
+
+	// 后注册的结点也按策略匹配
+	c, respC, err := env.client(t, "secret").Connect(registerRequest("c"))
+	if err != nil {
+		t.Fatalf("connect c: %v", err)
+	}
+	defer c.Close()
+	waitOnline(t, s, "a", "b", "c")
+	request := ipv4Packet(t, respC.IPv4, respB.IPv4)
+	if err := c.WritePacket(request); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPacket(t, b); err != nil || string(got) != string(request) {
+		t.Fatalf("expect client to reach the app: %v", err)
+	}
+	// 回程的包属于已经允许的连接，其它方向和端口拒绝
+	if err := b.WritePacket(udpPacket(t, respB.IPv4, respA.IPv4, 2000, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WritePacket(udpPacket(t, respA.IPv4, respB.IPv4, 1000, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	reply := udpPacket(t, respB.IPv4, respC.IPv4, 2000, 1000)
+	if err := b.WritePacket(reply); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPacket(t, c); err != nil || string(got) != string(reply) {
+		t.Fatalf("expect reply to reach the client: %v", err)
+	}
+	// 冒充 b 的回程包在访问控制之前丢弃
+	if err := a.WritePacket(udpPacket(t, respB.IPv4, respC.IPv4, 2000, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	itemA, _ := s.nodes.Load("a")
+	eventually(t, "spoofed packet to be counted", func() bool { return itemA.Traffic().Drops[router.DropSpoofed] == 1 })
+	if st := s.ACLStats(); st.Denied != 2 || st.DefaultDenied != 2 || len(st.Rules) != 1 || st.Flows != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	// 删除策略之后立刻放行，计数清零
+	sc.ACL = nil
+	if err := s.SetConifg(sc); err != nil {
+		t.Fatalf("delete acl: %v", err)
+	}
+	other := ipv4Packet(t, respB.IPv4, respA.IPv4)
+	if err := b.WritePacket(other); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPacket(t, a); err != nil || string(got) != string(other) {
+		t.Fatalf("expect packet allowed without acl: %v", err)
+	}
+	if st := s.ACLStats(); st.Denied != 0 {
+		t.Fatalf("expect stats reset, got %+v", st)
+	}
+}
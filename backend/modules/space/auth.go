@@ -0,0 +1,172 @@
+package space
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"spacenode/libs/spaceca"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertAuthority 给结点签发证书，维护吊销列表
+// 所有 space 共用一个 CA，证书中带有 space 的 ID，只能注册到申请证书的 space
+type CertAuthority interface {
+	Issue(spaceID string, nodeID string, csrPEM []byte) (*models.EnrollResp, error)
+	IsRevoked(nodeID string) bool
+}
+
+// WithCertAuthority 注册时要求 CA 签发的客户端证书，join token 只用于申请证书
+// 监听端的 tls 配置需要校验客户端证书
+func WithCertAuthority(ca CertAuthority) Option {
+	return func(s *Space) {
+		s.ca = ca
+	}
+}
+
+// authorize 校验注册请求，启用 CA 时 NodeID 以客户端证书为准
+func (s *Space) authorize(conn net.Conn, req *models.RegisterRequest) error {
+	if s.ca == nil {
+		if s.tokens == nil {
+			return nil
+		}
+		// 断线重连的结点用会话票据代替 join token
+		if req.Ticket != "" {
+			if _, err := s.parseTicket(req.Ticket, req.SpaceNode.NodeID); err == nil {
+				return nil
+			}
+		}
+		if err := s.tokens.Consume(s.conf().ID, req.Token); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
+		return nil
+	}
+
+	nodeID, ok := s.peerNodeID(conn)
+	if !ok {
+		return fmt.Errorf("%w: client certificate of space %s is required", ErrUnauthorized, s.conf().ID)
+	}
+	if req.SpaceNode.NodeID != "" && req.SpaceNode.NodeID != nodeID {
+		return fmt.Errorf("%w: node id %s does not match certificate %s", ErrUnauthorized, req.SpaceNode.NodeID, nodeID)
+	}
+	if s.ca.IsRevoked(nodeID) {
+		return fmt.Errorf("%w: node %s is revoked", ErrUnauthorized, nodeID)
+	}
+	req.SpaceNode.NodeID = nodeID
+	return nil
+}
+
+// peerNodeID 客户端证书绑定的 NodeID，其它 space 的证书不被接受
+func (s *Space) peerNodeID(conn net.Conn) (string, bool) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+	state := tc.ConnectionState()
+	if spaceca.PeerSpaceID(state) != s.conf().ID {
+		return "", false
+	}
+	return spaceca.PeerNodeID(state)
+}
+
+// nodeKnown space 中是否已经有这个 NodeID 的结点、租约、保留或者正在申请的证书
+func (s *Space) nodeKnown(nodeID string) bool {
+	if _, ok := s.nodes.Load(nodeID); ok {
+		return true
+	}
+	if _, ok := s.reservations.Load(nodeID); ok {
+		return true
+	}
+	_, ok := s.leaseOf(nodeID)
+	return ok
+}
+
+// claimNodeID 申请证书之前占用 NodeID，已经存在的 NodeID 只能由持有它当前证书的结点申请
+// 否则拿到 join token 的人可以冒充已有的结点，接管它的地址、子网路由和出口
+// 返回的 release 在申请失败时释放占用
+func (s *Space) claimNodeID(conn net.Conn, nodeID string) (release func(), err error) {
+	if owner, ok := s.peerNodeID(conn); ok && owner == nodeID {
+		return func() {}, nil
+	}
+	if s.legacyOwner(conn, nodeID) {
+		return func() {}, nil
+	}
+	if s.nodeKnown(nodeID) {
+		return nil, fmt.Errorf("%w: node %s already exists", ErrUnauthorized, nodeID)
+	}
+	if _, loaded := s.enrolling.LoadOrStore(nodeID, struct{}{}); loaded {
+		return nil, fmt.Errorf("%w: node %s already exists", ErrUnauthorized, nodeID)
+	}
+	return func() { s.enrolling.Delete(nodeID) }, nil
+}
+
+// legacyOwner 旧版本签发的证书没有绑定 space，持有它的结点可以在已经有这个 NodeID 的 space 中重新申请
+func (s *Space) legacyOwner(conn net.Conn, nodeID string) bool {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	state := tc.ConnectionState()
+	if spaceca.PeerSpaceID(state) != "" {
+		return false
+	}
+	owner, ok := spaceca.PeerNodeID(state)
+	return ok && owner == nodeID && s.nodeKnown(nodeID) && !s.ca.IsRevoked(nodeID)
+}
+
+// enroll 用 join token 换取结点证书
+func (s *Space) enroll(conn net.Conn, pc *protocol.Conn, req *models.EnrollRequest) {
+	if s.ca == nil {
+		pc.Refuse(protocol.ErrCodeBadRequest, "enrollment is not enabled")
+		return
+	}
+	release, err := s.claimNodeID(conn, req.NodeID)
+	if err != nil {
+		logrus.Warnln("enroll", req.NodeID, err)
+		pc.Refuse(protocol.ErrCodeUnauthorized, err.Error())
+		return
+	}
+	if s.tokens != nil {
+		if err := s.tokens.Consume(s.conf().ID, req.Token); err != nil {
+			release()
+			logrus.Warnln("enroll", req.NodeID, err)
+			pc.Refuse(protocol.ErrCodeUnauthorized, err.Error())
+			return
+		}
+	}
+	resp, err := s.ca.Issue(s.conf().ID, req.NodeID, []byte(req.CSR))
+	if err != nil {
+		release()
+		logrus.Warnln("enroll", req.NodeID, err)
+		pc.Refuse(protocol.ErrCodeUnauthorized, err.Error())
+		return
+	}
+	logrus.Infof("node %s enrolled into space %s", req.NodeID, s.conf().ID)
+	if err := pc.Reply(protocol.FrameEnrollResp, resp); err != nil {
+		logrus.Errorln("write enroll resp", err)
+	}
+}
+
+// renewCert 在已注册的连接上轮换证书，不影响当前的隧道
+func (s *Space) renewCert(nodeID string, pc *protocol.Conn, payload []byte) {
+	if s.ca == nil {
+		return
+	}
+	req := &models.RenewCertRequest{}
+	if err := json.Unmarshal(payload, req); err != nil {
+		logrus.Warnln("renew cert", nodeID, err)
+		return
+	}
+	resp, err := s.ca.Issue(s.conf().ID, nodeID, []byte(req.CSR))
+	if err != nil {
+		logrus.Warnln("renew cert", nodeID, err)
+		return
+	}
+	logrus.Infof("node %s certificate renewed", nodeID)
+	if err := pc.WriteJSON(protocol.FrameRenewCertResp, resp); err != nil {
+		logrus.Errorln("write renew cert resp", err)
+	}
+}
@@ -0,0 +1,106 @@
+package space
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"path/filepath"
+	"spacenode/libs/models"
+	"spacenode/libs/spaceca"
+	"spacenode/libs/spacetls"
+	"strings"
+	"testing"
+	"time"
+)
+
+// legacyCert 用 dir 中的 CA 签发没有绑定 space 的旧证书
+func legacyCert(t *testing.T, dir string, id *spaceca.Identity, nodeID string) []byte {
+	t.Helper()
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, spaceca.CACertFile), filepath.Join(dir, spaceca.CAKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM, err := id.CSR(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(csrPEM)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := spacetls.RandomSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nodeID},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, csr.PublicKey, pair.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestReenrollInAnotherSpace(t *testing.T) {
+	dir := t.TempDir()
+	env1 := newTestEnvIn(t, dir, models.SpaceItemConfig{})
+	env2 := newTestEnvIn(t, dir, models.SpaceItemConfig{ID: "space2"})
+
+	client := env1.client(t, "secret")
+	client.SpaceID = "space1"
+	a, _, err := client.Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	// 证书绑定的是 space1，接入 space2 时用 join token 重新申请
+	client.Server, client.SpaceID = env2.addr, "space2"
+	a, _, err = client.Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("connect space2: %v", err)
+	}
+	a.Close()
+	if client.Identity.SpaceID() != "space2" {
+		t.Fatalf("expect certificate of space2, got %q", client.Identity.SpaceID())
+	}
+	// 没有 join token 时返回明确的错误
+	client.Server, client.SpaceID, client.Token = env1.addr, "space1", ""
+	if _, _, err := client.Connect(registerRequest("a")); err == nil || !strings.Contains(err.Error(), "is for space space2") {
+		t.Fatalf("expect certificate of another space to be reported, got %v", err)
+	}
+
+	// 旧版本签发的证书没有 space，持有它的结点重新申请之后沿用原来的 NodeID
+	b := env1.client(t, "secret")
+	sess, _, err := b.Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+	if err := b.Identity.SetCertificate(legacyCert(t, dir, b.Identity, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if b.Identity.Enrolled("") {
+		t.Fatalf("expect certificate without space to need enrollment")
+	}
+	sess, resp, err := b.Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatalf("reenroll legacy certificate: %v", err)
+	}
+	sess.Close()
+	if b.Identity.NodeID() != "b" || b.Identity.SpaceID() != "space1" || resp.IPv4 == "" {
+		t.Fatalf("unexpected identity %s of space %q", b.Identity.NodeID(), b.Identity.SpaceID())
+	}
+}
@@ -0,0 +1,230 @@
+package space
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"spacenode/libs/capture"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrCaptureNotFound 没有这个抓包
+	ErrCaptureNotFound = errors.New("capture not found")
+	// ErrCaptureRunning 抓包还没有结束，不能下载
+	ErrCaptureRunning = errors.New("capture is still running")
+	// ErrTooManyCaptures 同时进行的抓包太多
+	ErrTooManyCaptures = errors.New("too many captures running")
+)
+
+const (
+	// 同时进行的抓包，包括流式下载的
+	maxCaptures = 4
+	// 结束之后保留的抓包文件，超过时删除最早的
+	maxKeptCaptures = 16
+)
+
+// captureTap 把路由器收到的包分给正在进行的抓包
+type captureTap struct {
+	list []*capture.Capture
+}
+
+func (t *captureTap) Packet(from string, pkt []byte) {
+	for _, c := range t.list {
+		c.Packet(from, pkt)
+	}
+}
+
+type captureItem struct {
+	c *capture.Capture
+	// 写入的临时文件，流式下载时为空
+	path string
+}
+
+func (ci *captureItem) running() bool {
+	select {
+	case <-ci.c.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// StartCapture 开始抓包并写入临时文件，结束之后通过 CaptureFile 下载
+// nodeID 不为空时只抓这个结点收发的包
+func (s *Space) StartCapture(nodeID string, opts capture.Options) (capture.Info, error) {
+	f, err := os.CreateTemp("", "spacenode-*.pcapng")
+	if err != nil {
+		return capture.Info{}, err
+	}
+	item, err := s.startCapture(f, nodeID, opts, f.Name())
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return capture.Info{}, err
+	}
+	go func() {
+		<-item.c.Done()
+		f.Close()
+	}()
+	return item.c.Info(), nil
+}
+
+// StreamCapture 抓包并直接写入 w，结束或者 ctx 取消之前阻塞
+func (s *Space) StreamCapture(ctx context.Context, w io.Writer, nodeID string, opts capture.Options) error {
+	item, err := s.startCapture(w, nodeID, opts, "")
+	if err != nil {
+		return err
+	}
+	defer s.captures.Delete(item.c.ID())
+	select {
+	case <-item.c.Done():
+	case <-ctx.Done():
+		item.c.Stop()
+		<-item.c.Done()
+	}
+	return nil
+}
+
+func (s *Space) startCapture(w io.Writer, nodeID string, opts capture.Options, path string) (*captureItem, error) {
+	if nodeID != "" {
+		item, ok := s.nodes.Load(nodeID)
+		if !ok {
+			return nil, fmt.Errorf("%w: node %s", ErrCaptureNotFound, nodeID)
+		}
+		opts.Node = nodeID
+		opts.Addrs = nil
+		for _, p := range nodePrefixes(item) {
+			opts.Addrs = append(opts.Addrs, p.Addr())
+		}
+	}
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	running := 0
+	s.captures.Range(func(key string, value *captureItem) bool {
+		if value.running() {
+			running++
+		}
+		return true
+	})
+	if running >= maxCaptures {
+		return nil, ErrTooManyCaptures
+	}
+	c, err := capture.Start(w, opts)
+	if err != nil {
+		return nil, err
+	}
+	item := &captureItem{c: c, path: path}
+	s.captures.Store(c.ID(), item)
+	s.retap()
+	s.pruneCaptures()
+	logrus.Infof("%s: capture %s started, node %q filter %q", s.conf().ID, c.ID(), nodeID, opts.Filter)
+	go func() {
+		<-c.Done()
+		s.captureMu.Lock()
+		s.retap()
+		s.captureMu.Unlock()
+		info := c.Info()
+		logrus.Infof("%s: capture %s finished, %d packets, %d dropped", s.conf().ID, c.ID(), info.Packets, info.Dropped)
+	}()
+	return item, nil
+}
+
+// retap 按正在进行的抓包设置路由器，没有时路由器不再调用
+func (s *Space) retap() {
+	var list []*capture.Capture
+	s.captures.Range(func(key string, value *captureItem) bool {
+		if value.running() {
+			list = append(list, value.c)
+		}
+		return true
+	})
+	if len(list) == 0 {
+		s.router.SetTap(nil)
+		return
+	}
+	s.router.SetTap(&captureTap{list: list})
+}
+
+// pruneCaptures 删除超出数量的已经结束的抓包文件，最早的先删除
+func (s *Space) pruneCaptures() {
+	var done []*captureItem
+	s.captures.Range(func(key string, value *captureItem) bool {
+		if !value.running() && value.path != "" {
+			done = append(done, value)
+		}
+		return true
+	})
+	if len(done) <= maxKeptCaptures {
+		return
+	}
+	sort.Slice(done, func(i, j int) bool { return done[i].c.Info().Started.Before(done[j].c.Info().Started) })
+	for _, item := range done[:len(done)-maxKeptCaptures] {
+		s.captures.Delete(item.c.ID())
+		os.Remove(item.path)
+	}
+}
+
+// Captures 正在进行和已经结束的抓包，按开始时间排序
+func (s *Space) Captures() []capture.Info {
+	arr := make([]capture.Info, 0)
+	s.captures.Range(func(key string, value *captureItem) bool {
+		arr = append(arr, value.c.Info())
+		return true
+	})
+	sort.Slice(arr, func(i, j int) bool { return arr[i].Started.Before(arr[j].Started) })
+	return arr
+}
+
+// StopCapture 提前结束抓包，已经写入的包可以下载
+func (s *Space) StopCapture(id string) error {
+	item, ok := s.captures.Load(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrCaptureNotFound, id)
+	}
+	item.c.Stop()
+	<-item.c.Done()
+	return nil
+}
+
+// CaptureFile 已经结束的抓包文件的路径
+func (s *Space) CaptureFile(id string) (string, error) {
+	item, ok := s.captures.Load(id)
+	if !ok || item.path == "" {
+		return "", fmt.Errorf("%w: %s", ErrCaptureNotFound, id)
+	}
+	if item.running() {
+		return "", ErrCaptureRunning
+	}
+	return item.path, nil
+}
+
+// DeleteCapture 结束抓包并删除文件
+func (s *Space) DeleteCapture(id string) error {
+	item, ok := s.captures.LoadAndDelete(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrCaptureNotFound, id)
+	}
+	item.c.Stop()
+	<-item.c.Done()
+	if item.path != "" {
+		return os.Remove(item.path)
+	}
+	return nil
+}
+
+// stopCaptures space 停止时结束所有抓包并删除文件
+func (s *Space) stopCaptures() {
+	s.captures.Range(func(key string, value *captureItem) bool {
+		if value.path != "" {
+			s.DeleteCapture(key)
+		} else {
+			value.c.Stop()
+		}
+		return true
+	})
+}
@@ -0,0 +1,122 @@
+package space
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"spacenode/libs/capture"
+	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestCapture(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+	s := env.space
+
+	conns := map[string]*nodeclient.Session{}
+	ips := map[string]string{}
+	for _, id := range []string{"a", "b", "c"} {
+		pc, resp, err := env.client(t, "secret").Connect(registerRequest(id))
+		if err != nil {
+			t.Fatalf("connect %s: %v", id, err)
+		}
+		defer pc.Close()
+		conns[id], ips[id] = pc, resp.IPv4
+	}
+	waitOnline(t, s, "a", "b", "c")
+
+	if _, err := s.StartCapture("x", capture.Options{}); !errors.Is(err, ErrCaptureNotFound) {
+		t.Fatalf("expect unknown node to fail, got %v", err)
+	}
+	info, err := s.StartCapture("a", capture.Options{Filter: "udp dst port 53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CaptureFile(info.ID); !errors.Is(err, ErrCaptureRunning) {
+		t.Fatalf("expect running capture not downloadable, got %v", err)
+	}
+
+	// 只有 a 收发的 dns 包被抓到
+	send := []struct {
+		from, to string
+		pkt      []byte
+	}{
+		{"a", "b", udpPacket(t, ips["a"], ips["b"], 1000, 53)},
+		{"b", "c", udpPacket(t, ips["b"], ips["c"], 1001, 53)},
+		{"a", "b", ipv4Packet(t, ips["a"], ips["b"])},
+		{"c", "a", udpPacket(t, ips["c"], ips["a"], 1002, 53)},
+	}
+	for _, p := range send {
+		if err := conns[p.from].WritePacket(p.pkt); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPacket(t, conns[p.to]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.StopCapture(info.ID); err != nil {
+		t.Fatal(err)
+	}
+	list := s.Captures()
+	if len(list) != 1 || list[0].Running || list[0].Node != "a" || list[0].Packets != 2 {
+		t.Fatalf("unexpected captures %+v", list)
+	}
+
+	path, err := s.CaptureFile(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ports []layers.UDPPort
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		p := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+			ports = append(ports, udp.SrcPort)
+		}
+	}
+	if len(ports) != 2 || ports[0] != 1000 || ports[1] != 1002 {
+		t.Fatalf("unexpected packets %v", ports)
+	}
+
+	// 流式抓包在 ctx 取消时结束
+	ctx, cancel := context.WithCancel(context.Background())
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- s.StreamCapture(ctx, &buf, "", capture.Options{}) }()
+	eventually(t, "stream capture to start", func() bool { return len(s.Captures()) == 2 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pcapgo.NewNgReader(&buf, pcapgo.DefaultNgReaderOptions); err != nil {
+		t.Fatalf("expect streamed capture readable, got %v", err)
+	}
+
+	if err := s.DeleteCapture(info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expect capture file removed, got %v", err)
+	}
+	if len(s.Captures()) != 0 {
+		t.Fatalf("expect no captures left")
+	}
+}
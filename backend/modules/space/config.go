@@ -0,0 +1,452 @@
+package space
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sort"
+	"spacenode/libs/ippool"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotLive 修改不能在运行中生效，需要重启 space
+var ErrNotLive = errors.New("change cannot be applied to a running space")
+
+// renumberAckTimeout 在连接上换地址时等待结点确认的时间
+const renumberAckTimeout = 10 * time.Second
+
+// SetConifg 在运行中修改配置
+// 端口和监听地址换到新的监听上，已经建立的连接不受影响
+// 网段变大时原来的租约不变，其它网段的修改会重新编址，地址变化的在线结点收到 FrameRenumber 之后换地址
+// MTU、路由和 DNS 有变化时在线结点收到 FrameProfile
+// 修改 ID 和 e2e 返回 ErrNotLive，新的配置无效时返回错误，原来的配置不变
+func (s *Space) SetConifg(sc models.SpaceItemConfig) error {
+	old := s.conf()
+	if sc.ID != old.ID {
+		return fmt.Errorf("%w: id", ErrNotLive)
+	}
+	if sc.E2E != old.E2E {
+		return fmt.Errorf("%w: e2e", ErrNotLive)
+	}
+	if sc.Fingerprint == "" {
+		sc.Fingerprint = old.Fingerprint
+	}
+	// 端口为 0 时沿用系统已经分配的端口
+	if sc.Port == 0 {
+		sc.Port = old.Port
+	}
+	if _, _, _, err := leasePolicy(sc); err != nil {
+		return err
+	}
+	if err := checkProfile(sc); err != nil {
+		return err
+	}
+	if err := checkACL(sc.ACL); err != nil {
+		return err
+	}
+
+	s.renumberMu.Lock()
+	defer s.renumberMu.Unlock()
+	profile := s.profile("")
+
+	var plan *renumberPlan
+	if poolChanged(old, sc) {
+		pl, gateway, dns, err := newPool(sc)
+		if err != nil {
+			return err
+		}
+		prefix6, err := parsePrefix6(sc, pl.Prefix())
+		if err != nil {
+			return err
+		}
+		if plan, err = s.planRenumber(pl, prefix6); err != nil {
+			return err
+		}
+		plan.gateway, plan.dns = gateway, dns
+	}
+	if sc.Host != old.Host || sc.Port != old.Port {
+		port, err := s.rebind(sc)
+		if err != nil {
+			return err
+		}
+		sc.Port = port
+	}
+
+	oldDNS := s.dnsAddrs()
+	s.mu.Lock()
+	s.config = sc
+	if plan != nil {
+		s.ipPool, s.gateway, s.dns, s.prefix6 = plan.pool, plan.gateway, plan.dns, plan.prefix6
+	}
+	s.mu.Unlock()
+	if plan != nil {
+		s.netGen.Add(1)
+		s.applyRenumber(plan)
+		// 网关可能换了地址，结点的旧地址都已经移除
+		if len(oldDNS) > 0 {
+			s.router.Remove(oldDNS[0])
+		}
+		s.registerDNS()
+		// 出口结点不转发 space 自己的网段
+		s.syncExits()
+	}
+	// 结点换了地址或者修改了策略时重新编译
+	if aclChanged := !reflect.DeepEqual(old.ACL, sc.ACL); plan != nil || aclChanged {
+		s.reloadACL(aclChanged)
+	}
+	// 地址变化的结点在 FrameRenumber 中已经拿到新的配置，再发一次也没有影响
+	if !reflect.DeepEqual(profile, s.profile("")) {
+		s.broadcastProfile()
+	}
+	logrus.Infof("%s: config updated", sc.ID)
+	return nil
+}
+
+// poolChanged 地址池相关的配置是否有变化
+func poolChanged(a, b models.SpaceItemConfig) bool {
+	return a.NetAddr != b.NetAddr || a.Mask != b.Mask || a.Gateway != b.Gateway ||
+		a.IPv6 != b.IPv6 || a.AllowPublic != b.AllowPublic ||
+		!slices.Equal(a.Ranges, b.Ranges) || !slices.Equal(a.Exclude, b.Exclude) || !slices.Equal(a.DNS, b.DNS)
+}
+
+// rebind 在新的地址上监听，成功之后关闭原来的监听，返回实际监听的端口
+// 还没有 Listen 时只修改配置，原来的 UDP 会话在超时之后回退到 tcp
+func (s *Space) rebind(sc models.SpaceItemConfig) (int, error) {
+	s.mu.RLock()
+	lis, udpConn := s.lis, s.udpConn
+	s.mu.RUnlock()
+	if lis == nil {
+		return sc.Port, nil
+	}
+	nl, nu, port, err := s.listen(sc.Host, sc.Port)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.lis, s.udpConn = nl, nu
+	s.mu.Unlock()
+	lis.Close()
+	if udpConn != nil {
+		udpConn.Close()
+	}
+	logrus.Infof("%s: listening on %s", sc.ID, nl.Addr())
+	return port, nil
+}
+
+// renumberPlan 新的地址池，以及现有的租约和保留在其中的地址
+type renumberPlan struct {
+	pool    *ippool.IPPool
+	gateway netip.Addr
+	dns     []netip.Addr
+	prefix6 netip.Prefix
+	// 前缀长度有变化，在线结点需要更新网卡
+	bitsChanged bool
+	// 旧地址 -> 新地址，只包括地址变化的租约
+	leases map[string]string
+	// NodeID -> 新地址，只包括地址变化的保留
+	reservations map[string]string
+}
+
+// addrClaim 一个租约或者保留
+type addrClaim struct {
+	nodeID   string
+	addr     netip.Addr
+	lease    *models.IPLease
+	reserved bool
+	to       netip.Addr
+}
+
+// planRenumber 把现有的租约和保留放进新的地址池
+// 地址仍然可用时不变，否则换到偏移相同的地址，还是不可用时租约按 NodeID 重新分配
+// 放不下时返回错误，只修改 pl
+func (s *Space) planRenumber(pl *ippool.IPPool, prefix6 netip.Prefix) (*renumberPlan, error) {
+	s.mu.RLock()
+	oldPrefix, oldPrefix6 := s.ipPool.Prefix(), s.prefix6
+	s.mu.RUnlock()
+
+	now := time.Now()
+	claims := make([]*addrClaim, 0)
+	s.leases.Range(func(key string, value *models.IPLease) bool {
+		addr, err := netip.ParseAddr(key)
+		if err == nil && now.Before(value.ExpiresAt) {
+			claims = append(claims, &addrClaim{nodeID: value.NodeID, addr: addr, lease: value})
+		}
+		return true
+	})
+	s.reservations.Range(func(key string, value *models.IPReservation) bool {
+		addr, err := netip.ParseAddr(value.IP)
+		if err != nil {
+			return true
+		}
+		for _, c := range claims {
+			if c.addr == addr && c.nodeID == key {
+				c.reserved = true
+				return true
+			}
+		}
+		claims = append(claims, &addrClaim{nodeID: key, addr: addr, reserved: true})
+		return true
+	})
+	sort.Slice(claims, func(i, j int) bool { return claims[i].addr.Less(claims[j].addr) })
+
+	taken := make(map[netip.Addr]bool)
+	take := func(c *addrClaim, addr netip.Addr) bool {
+		if !addr.IsValid() || taken[addr] {
+			return false
+		}
+		if c.lease != nil {
+			if err := pl.Restore(addr, c.lease.ExpiresAt); err != nil {
+				return false
+			}
+		}
+		if c.reserved {
+			if err := pl.Reserve(addr); err != nil {
+				return false
+			}
+		}
+		taken[addr] = true
+		c.to = addr
+		return true
+	}
+	for _, c := range claims {
+		take(c, c.addr)
+	}
+	for _, c := range claims {
+		if c.to.IsValid() || take(c, shiftAddr(oldPrefix, pl.Prefix(), c.addr)) {
+			continue
+		}
+		if c.lease == nil {
+			return nil, fmt.Errorf("reserved ip %s of node %s does not fit in %s", c.addr, c.nodeID, pl.Prefix())
+		}
+		addr, err := pl.Preferred(c.nodeID, time.Until(c.lease.ExpiresAt))
+		if err != nil {
+			return nil, fmt.Errorf("no address for node %s in %s: %w", c.nodeID, pl.Prefix(), err)
+		}
+		if c.reserved {
+			pl.Reserve(addr)
+		}
+		taken[addr] = true
+		c.to = addr
+	}
+
+	plan := &renumberPlan{
+		pool:         pl,
+		prefix6:      prefix6,
+		bitsChanged:  oldPrefix.Bits() != pl.Prefix().Bits() || oldPrefix6.Bits() != prefix6.Bits(),
+		leases:       make(map[string]string),
+		reservations: make(map[string]string),
+	}
+	for _, c := range claims {
+		if c.to == c.addr {
+			continue
+		}
+		if c.lease != nil {
+			plan.leases[c.addr.String()] = c.to.String()
+		}
+		if c.reserved {
+			plan.reservations[c.nodeID] = c.to.String()
+		}
+	}
+	return plan, nil
+}
+
+// shiftAddr addr 在 from 中的偏移对应的 to 中的地址，超出 to 时返回空
+func shiftAddr(from, to netip.Prefix, addr netip.Addr) netip.Addr {
+	if !from.Contains(addr) || !addr.Is4() {
+		return netip.Addr{}
+	}
+	off := binary.BigEndian.Uint32(addr.AsSlice()) - binary.BigEndian.Uint32(from.Addr().AsSlice())
+	if uint64(off) >= 1<<(32-to.Bits()) {
+		return netip.Addr{}
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(to.Addr().AsSlice())+off)
+	return netip.AddrFrom4(b)
+}
+
+// applyRenumber 按 plan 更新租约、保留和结点的地址
+func (s *Space) applyRenumber(plan *renumberPlan) {
+	// 先删除全部旧地址，新地址可能是另一个租约的旧地址
+	moved := make([]*models.IPLease, 0, len(plan.leases))
+	for from, to := range plan.leases {
+		l, ok := s.leases.Load(from)
+		if !ok {
+			continue
+		}
+		next := *l
+		next.IP = to
+		moved = append(moved, &next)
+		s.deleteLease(from)
+	}
+	for _, l := range moved {
+		s.leases.Store(l.IP, l)
+		if s.store == nil {
+			continue
+		}
+		if err := s.store.SaveLease(l); err != nil {
+			logrus.Warnf("save lease %s of node %s: %v", l.IP, l.NodeID, err)
+		}
+	}
+	for nodeID, to := range plan.reservations {
+		r, ok := s.reservations.Load(nodeID)
+		if !ok {
+			continue
+		}
+		next := *r
+		next.IP = to
+		s.reservations.Store(nodeID, &next)
+		if s.store == nil {
+			continue
+		}
+		if err := s.store.SaveReservation(&next); err != nil {
+			logrus.Warnf("save reservation %s of node %s: %v", to, nodeID, err)
+		}
+	}
+	logrus.Infof("%s: renumbered into %s, %d leases moved", s.conf().ID, plan.pool.Prefix(), len(moved))
+
+	s.nodes.Range(func(key string, value *NodeItem) bool {
+		s.renumberNode(value, plan)
+		return true
+	})
+}
+
+// renumberNode 地址变化的结点换上新的地址，在线结点收到 FrameRenumber
+// 支持 CapRenumberAck 的结点在原来的连接上换地址，其它在线结点随后被断开，重连时拿到新的地址
+// 只有前缀长度变化的在线结点在连接上更新网卡，不断开
+func (s *Space) renumberNode(item *NodeItem, plan *renumberPlan) {
+	nodeID := item.Node.NodeID
+	old := item.IP()
+	ip := old
+	if to, ok := plan.leases[ip]; ok {
+		if l, ok := s.leases.Load(to); ok && l.NodeID == nodeID {
+			ip = to
+		}
+	}
+	var ip6 string
+	if item.IPv6() != "" {
+		ip6 = ipv6In(plan.pool.Prefix(), plan.prefix6, ip)
+	}
+	moved := ip != old || ip6 != item.IPv6()
+	if !moved && !plan.bitsChanged {
+		return
+	}
+	pc, live := s.sessions.Load(nodeID)
+	live = live && item.Status() == NodeOnline && pc.HasCap(protocol.CapRenumber)
+	inPlace := moved && live && pc.HasCap(protocol.CapRenumberAck)
+	if moved {
+		logrus.Infof("node %s: renumbered from %s to %s", nodeID, old, ip)
+		if inPlace {
+			s.moveNode(item, ip, ip6)
+		} else {
+			next := item.moveTo(ip, ip6)
+			s.nodes.Store(nodeID, next)
+			s.saveNode(next)
+		}
+	}
+	if live {
+		resp := &models.RegisterResp{
+			IPv4:       ip,
+			NetProfile: s.profile(nodeID),
+			IPv6:       ip6,
+			Domain:     item.Node.Domain,
+		}
+		if ip6 != "" {
+			resp.IPv6Bits = plan.prefix6.Bits()
+		}
+		if moved && pc.HasCap(protocol.CapResume) {
+			t, err := s.issueTicket(nodeID, ip)
+			if err != nil {
+				logrus.Errorln("issue ticket", err)
+			}
+			resp.Ticket = t
+		}
+		var acked chan bool
+		if inPlace {
+			acked = make(chan bool, 1)
+			// 上一次换地址还没有确认时不再等待
+			if prev, ok := s.renumberAcks.LoadAndDelete(pc); ok {
+				prev <- false
+			}
+			s.renumberAcks.Store(pc, acked)
+		}
+		if err := pc.WriteJSON(protocol.FrameRenumber, resp); err != nil {
+			logrus.Debugf("node %s: write renumber: %v", nodeID, err)
+		}
+		if acked != nil {
+			go s.awaitRenumber(item, pc, acked)
+		}
+	}
+	if moved && !inPlace {
+		// 路由按地址注册，断开之后结点用新的地址重新注册
+		s.router.Remove(old)
+	}
+}
+
+// moveNode 在线结点在原来的连接上换到新的地址，结点确认之前旧地址仍然可以收发，调用方持有 renumberMu
+func (s *Space) moveNode(item *NodeItem, ip, ip6 string) {
+	old, old6 := item.IP(), item.IPv6()
+	item.setAddr(ip, ip6)
+	aliases := []string{old}
+	for _, a := range []string{ip6, old6} {
+		if a != "" {
+			aliases = append(aliases, a)
+		}
+	}
+	s.router.Move(old, ip, aliases...)
+	s.addrs.Store(ip, item)
+	s.addrs.CompareAndDelete(old, item)
+	s.saveNode(item)
+}
+
+// awaitRenumber 结点确认换上新的地址之后去掉旧地址，超时没有确认时断开连接，重连时拿到新的地址
+func (s *Space) awaitRenumber(item *NodeItem, pc *protocol.Conn, acked chan bool) {
+	defer s.renumberAcks.CompareAndDelete(pc, acked)
+	timer := time.NewTimer(renumberAckTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-acked:
+		if !ok {
+			return
+		}
+	case <-pc.Done():
+		return
+	case <-s.ctx.Done():
+		return
+	case <-timer.C:
+		logrus.Warnf("node %s: renumber not acknowledged in %s, disconnecting", item.Node.NodeID, renumberAckTimeout)
+		pc.Close()
+		return
+	}
+	s.renumberMu.RLock()
+	defer s.renumberMu.RUnlock()
+	ip := item.IP()
+	var aliases []string
+	if item.IPv6() != "" {
+		aliases = append(aliases, item.IPv6())
+	}
+	if s.router.Move(ip, ip, aliases...) {
+		logrus.Infof("node %s: moved to %s", item.Node.NodeID, ip)
+	}
+}
+
+// moveTo 地址变化之后的离线结点
+func (n *NodeItem) moveTo(ip, ip6 string) *NodeItem {
+	next := &NodeItem{
+		Node:         n.Node,
+		PublicKey:    n.PublicKey,
+		ephemeralKey: n.ephemeralKey,
+		traffic:      n.traffic,
+	}
+	next.setAddr(ip, ip6)
+	next.status.Store(NodeOffline)
+	next.lastSeen.Store(n.lastSeen.Load())
+	next.leaseExpires.Store(n.leaseExpires.Load())
+	return next
+}
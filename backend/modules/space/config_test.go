@@ -0,0 +1,239 @@
+package space
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"spacenode/libs/protocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetConfig(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+	s := env.space
+
+	connect := func(req *models.RegisterRequest) (*nodeclient.Conn, *models.RegisterResp, chan *models.RegisterResp, chan *models.RegisterResp) {
+		nodeID := req.SpaceNode.NodeID
+		c, resp, err := env.client(t, "secret").Dial(req)
+		if err != nil {
+			t.Fatalf("dial %s: %v", nodeID, err)
+		}
+		t.Cleanup(func() { c.Close() })
+		renumbered := make(chan *models.RegisterResp, 4)
+		reconnected := make(chan *models.RegisterResp, 4)
+		c.OnRenumber = func(resp *models.RegisterResp) { renumbered <- resp }
+		c.OnReconnect = func(resp *models.RegisterResp) { reconnected <- resp }
+		return c, resp, renumbered, reconnected
+	}
+	wait := func(ch chan *models.RegisterResp, what string) *models.RegisterResp {
+		t.Helper()
+		select {
+		case resp := <-ch:
+			return resp
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", what)
+			return nil
+		}
+	}
+	a, respA, renumberedA, reconnectedA := connect(registerRequest("a"))
+	// b 是不会确认换地址的老版本客户端
+	reqB := registerRequest("b")
+	reqB.Capabilities = slices.DeleteFunc(slices.Clone(protocol.Capabilities), func(c string) bool { return c == protocol.CapRenumberAck })
+	b, respB, _, reconnectedB := connect(reqB)
+	waitOnline(t, s, "a", "b")
+
+	// 扩大网段，租约不变，结点在连接上更新前缀长度
+	cfg := *s.GetConifg()
+	cfg.Mask = "255.255.254.0"
+	if err := s.SetConifg(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if resp := wait(renumberedA, "renumber"); resp.IPv4 != respA.IPv4 || resp.Bits != 23 || resp.Ticket != "" {
+		t.Fatalf("expect only the prefix length to change, got %+v", resp)
+	}
+	if s.PoolStats().Prefix != "10.10.0.0/23" || !leaseOwners(s)["a"] || !leaseOwners(s)["b"] {
+		t.Fatalf("unexpected pool after growing %+v", s.PoolStats())
+	}
+	if ip := nodeIDs(t, s, "online")["a"]; ip == nil || ip.IP() != respA.IPv4 {
+		t.Fatalf("expect a to stay online with %s", respA.IPv4)
+	}
+	select {
+	case <-reconnectedA:
+		t.Fatalf("growing the subnet should not reconnect nodes")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// 换网段，结点换到偏移相同的地址，a 在原来的连接上换地址，b 重连
+	sessA := a.Session()
+	cfg.NetAddr = "10.20.0.0"
+	cfg.Mask = "255.255.255.0"
+	if err := s.SetConifg(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(respA.IPv4, "10.10.", "10.20.", 1)
+	if resp := wait(renumberedA, "renumber"); resp.IPv4 != want || resp.Bits != 24 || resp.Ticket == "" {
+		t.Fatalf("expect a to move to %s, got %+v", want, resp)
+	}
+	newB := wait(reconnectedB, "reconnect").IPv4
+	if newB == respB.IPv4 || !strings.HasPrefix(newB, "10.20.0.") {
+		t.Fatalf("expect b to move into the new subnet, got %s", newB)
+	}
+	// a 确认之后旧地址不再路由
+	eventually(t, "a to acknowledge the new address", func() bool {
+		pending := false
+		s.renumberAcks.Range(func(*protocol.Conn, chan bool) bool {
+			pending = true
+			return false
+		})
+		return !pending
+	})
+	if err := s.router.Deliver(ipv4Packet(t, newB, respA.IPv4)); err == nil {
+		t.Fatalf("expect old address of a to be removed")
+	}
+	eventually(t, "b to register", func() bool {
+		item := nodeIDs(t, s, "online")["b"]
+		return item != nil && item.IP() == newB
+	})
+	if a.Session() != sessA {
+		t.Fatalf("expect a to keep its connection")
+	}
+	if item := nodeIDs(t, s, "online")["a"]; item == nil || item.IP() != want {
+		t.Fatalf("expect a to stay online with %s", want)
+	}
+	pkt := ipv4Packet(t, newB, want)
+	if err := b.WritePacket(pkt); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got, err := a.ReadPacket(); err != nil || string(got) != string(pkt) {
+		t.Fatalf("read after renumber: %v", err)
+	}
+	pkt = ipv4Packet(t, want, newB)
+	if err := a.WritePacket(pkt); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got, err := b.ReadPacket(); err != nil || string(got) != string(pkt) {
+		t.Fatalf("read from the new address: %v", err)
+	}
+	select {
+	case <-reconnectedA:
+		t.Fatalf("expect a to be renumbered without reconnecting")
+	default:
+	}
+
+	// 不能在运行中生效或者无效的修改返回错误，配置不变
+	bad := cfg
+	bad.E2E = true
+	if err := s.SetConifg(bad); !errors.Is(err, ErrNotLive) {
+		t.Fatalf("expect e2e change to need a restart, got %v", err)
+	}
+	bad = cfg
+	bad.NetAddr = "8.8.8.0"
+	if err := s.SetConifg(bad); err == nil {
+		t.Fatalf("expect public subnet to fail")
+	}
+	if err := s.Reserve("c", "10.20.0.200"); err != nil {
+		t.Fatal(err)
+	}
+	bad = cfg
+	bad.Mask = "255.255.255.128"
+	if err := s.SetConifg(bad); err == nil {
+		t.Fatalf("expect reservation outside the new subnet to fail")
+	}
+	if s.PoolStats().Prefix != "10.20.0.0/24" || s.GetConifg().Mask != "255.255.255.0" {
+		t.Fatalf("expect config to be unchanged, got %+v", s.GetConifg())
+	}
+}
+
+func TestSetConfigPort(t *testing.T) {
+	port := func() int {
+		lis, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+		return lis.Addr().(*net.TCPAddr).Port
+	}
+	cfg := models.SpaceItemConfig{ID: "space1", Host: "127.0.0.1", Port: port(), NetAddr: "10.10.0.0", Mask: "255.255.255.0"}
+	s, err := NewSpace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+
+	old := cfg.Port
+	cfg.Port = port()
+	if err := s.SetConifg(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", old)); err == nil {
+		t.Fatalf("expect old port to be closed")
+	}
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", cfg.Port))
+	if err != nil {
+		t.Fatalf("dial new port: %v", err)
+	}
+	conn.Close()
+
+	// 端口为 0 时由系统分配，UDP 与 tcp 使用同一个端口，再次修改时沿用
+	auto := cfg
+	auto.ID, auto.Port = "space2", 0
+	s2, err := NewSpace(auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+	if err := s2.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	assigned := s2.conf().Port
+	if assigned == 0 || s2.udp() == nil || s2.udp().LocalAddr().(*net.UDPAddr).Port != assigned {
+		t.Fatalf("expect tcp and udp on the assigned port %d", assigned)
+	}
+	if err := s2.SetConifg(auto); err != nil || s2.conf().Port != assigned {
+		t.Fatalf("expect assigned port %d to be kept, got %d %v", assigned, s2.conf().Port, err)
+	}
+
+	s.Stop()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("serve did not return after stop")
+	}
+}
+
+func TestSetConfigWithoutDNS(t *testing.T) {
+	cfg := models.SpaceItemConfig{ID: "space1", NetAddr: "10.10.0.0", Mask: "255.255.255.0"}
+	s, err := NewSpace(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	// 没有内置 DNS 地址时修改网段不再取第一个地址
+	s.mu.Lock()
+	s.gateway = netip.Addr{}
+	s.mu.Unlock()
+	if len(s.dnsAddrs()) != 0 || s.registerDNS() != "" {
+		t.Fatalf("expect no dns address without a gateway")
+	}
+	cfg.NetAddr = "10.20.0.0"
+	if err := s.SetConifg(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if dns := s.dnsAddrs(); len(dns) == 0 || dns[0] != "10.20.0.1" {
+		t.Fatalf("expect dns on the new gateway, got %v", dns)
+	}
+}
@@ -0,0 +1,437 @@
+package space
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"spacenode/libs/models"
+	"spacenode/libs/router"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// 应答 space 内的名字时的 TTL，结点重新编址之后很快生效
+	dnsTTL = 30
+	// 转发给上游的超时
+	dnsTimeout = 2 * time.Second
+	// appaider 生成的应用域名的后缀
+	appZone = "lzcapp"
+)
+
+var errNoUpstream = errors.New("no upstream dns server")
+
+// dnsLink 网关上的 DNS，注册在路由器中，收到的包由 space 应答
+type dnsLink struct {
+	s      *Space
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newDNSLink(s *Space) *dnsLink {
+	return &dnsLink{s: s, closed: make(chan struct{})}
+}
+
+// ReadPacket DNS 不主动发包，阻塞到关闭
+func (l *dnsLink) ReadPacket() (router.PacketType, []byte, error) {
+	<-l.closed
+	return 0, nil, io.EOF
+}
+
+func (l *dnsLink) WritePacket(t router.PacketType, pkt []byte) error {
+	if t != router.PacketIP {
+		return router.ErrUnsupported
+	}
+	go l.s.serveDNSPacket(pkt)
+	return nil
+}
+
+func (l *dnsLink) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// dnsAddrs 内置 DNS 的地址，即网关地址，有 IPv6 时加上网关对应的 IPv6 地址
+// 还没有网关时返回空
+func (s *Space) dnsAddrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.gateway.IsValid() {
+		return nil
+	}
+	addrs := []string{s.gateway.String()}
+	if ip6 := ipv6In(s.ipPool.Prefix(), s.prefix6, s.gateway.String()); ip6 != "" {
+		addrs = append(addrs, ip6)
+	}
+	return addrs
+}
+
+// registerDNS 在网关地址上注册 DNS，返回注册的地址
+func (s *Space) registerDNS() string {
+	addrs := s.dnsAddrs()
+	if len(addrs) == 0 {
+		return ""
+	}
+	s.router.RegisterLocal(addrs[0], newDNSLink(s), addrs[1:]...)
+	return addrs[0]
+}
+
+// zone space 内结点的域名后缀
+func (s *Space) zone() string {
+	return dnsLabel(s.conf().ID)
+}
+
+// nodeDomain 结点在 space 内的域名
+// 应用保留 appaider 生成的 <container>.<appid>.lzcapp，其它结点为 <Domain 或 NodeID 的第一段>.<spaceid>
+// 名字已经被其它结点使用时加上 -2、-3 后缀
+func (s *Space) nodeDomain(node models.SpaceNode) string {
+	base := strings.TrimSuffix(strings.ToLower(node.Domain), ".")
+	if node.NodeType == models.NodeTypeApp && strings.HasSuffix(base, "."+appZone) {
+		labels := strings.Split(base, ".")
+		for i, l := range labels {
+			labels[i] = dnsLabel(l)
+		}
+		base = strings.Join(labels, ".")
+	} else {
+		name := node.NodeID
+		if base != "" {
+			name, _, _ = strings.Cut(base, ".")
+		}
+		base = dnsLabel(name) + "." + s.zone()
+	}
+	name := base
+	for i := 2; s.domainTaken(name, node.NodeID); i++ {
+		first, rest, _ := strings.Cut(base, ".")
+		suffix := fmt.Sprintf("-%d", i)
+		if len(first)+len(suffix) > 63 {
+			first = first[:63-len(suffix)]
+		}
+		name = first + suffix + "." + rest
+	}
+	return name
+}
+
+// domainTaken 域名是否已经属于其它结点
+func (s *Space) domainTaken(name, nodeID string) bool {
+	taken := false
+	s.nodes.Range(func(key string, value *NodeItem) bool {
+		if key != nodeID && strings.EqualFold(value.Node.Domain, name) {
+			taken = true
+			return false
+		}
+		return true
+	})
+	return taken
+}
+
+// dnsLabel 把名字转成合法的域名标签: 小写字母、数字和 -，最长 63 个字符
+func dnsLabel(name string) string {
+	b := make([]byte, 0, len(name))
+	for _, c := range []byte(strings.ToLower(name)) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			b = append(b, c)
+		case len(b) > 0 && b[len(b)-1] != '-':
+			b = append(b, '-')
+		}
+		if len(b) == 63 {
+			break
+		}
+	}
+	label := strings.Trim(string(b), "-")
+	if label == "" {
+		return "node"
+	}
+	return label
+}
+
+// serveDNSPacket 应答结点发给网关 53 端口的 UDP 包，其它包丢弃
+func (s *Space) serveDNSPacket(pkt []byte) {
+	if len(pkt) == 0 {
+		return
+	}
+	first := layers.LayerTypeIPv4
+	if pkt[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+	packet := gopacket.NewPacket(pkt, first, gopacket.Default)
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || udp.DstPort != 53 {
+		return
+	}
+	answer, err := s.resolveDNS(udp.Payload)
+	if err != nil {
+		logrus.Debugln("dns", err)
+		return
+	}
+
+	reply := &layers.UDP{SrcPort: udp.DstPort, DstPort: udp.SrcPort}
+	var ip gopacket.SerializableLayer
+	switch n := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		v4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: n.DstIP, DstIP: n.SrcIP}
+		reply.SetNetworkLayerForChecksum(v4)
+		ip = v4
+	case *layers.IPv6:
+		v6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: n.DstIP, DstIP: n.SrcIP}
+		reply.SetNetworkLayerForChecksum(v6)
+		ip = v6
+	default:
+		return
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, reply, gopacket.Payload(answer)); err != nil {
+		logrus.Debugln("dns serialize", err)
+		return
+	}
+	if err := s.router.Deliver(buf.Bytes()); err != nil {
+		logrus.Debugln("dns reply", err)
+	}
+}
+
+// resolveDNS 应答一个 DNS 请求
+// space 内的结点和应用返回 A、AAAA 和 PTR 记录，space 后缀下不存在的名字返回 NXDOMAIN，其它转发给上游
+func (s *Space) resolveDNS(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(q.Name.String())
+
+	var answers []dnsmessage.Resource
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa."):
+		addr, ok := ptrAddr(name)
+		if !ok || !s.inSpace(addr) {
+			return s.forwardDNS(query, h, q)
+		}
+		item := s.lookupAddr(addr)
+		if item == nil {
+			return dnsReply(h, q, dnsmessage.RCodeNameError, nil)
+		}
+		if q.Type == dnsmessage.TypePTR {
+			target, err := dnsmessage.NewName(item.Node.Domain + ".")
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL},
+				Body:   &dnsmessage.PTRResource{PTR: target},
+			})
+		}
+	default:
+		item := s.lookupName(strings.TrimSuffix(name, "."))
+		if item == nil {
+			if strings.HasSuffix(name, "."+s.zone()+".") || name == s.zone()+"." {
+				return dnsReply(h, q, dnsmessage.RCodeNameError, nil)
+			}
+			return s.forwardDNS(query, h, q)
+		}
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		switch q.Type {
+		case dnsmessage.TypeA:
+			if addr, err := netip.ParseAddr(item.IP()); err == nil && addr.Is4() {
+				answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: addr.As4()}})
+			}
+		case dnsmessage.TypeAAAA:
+			if addr, err := netip.ParseAddr(item.IPv6()); err == nil {
+				answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+			}
+		}
+	}
+	// 名字存在但没有该类型的记录时返回空的应答
+	return dnsReply(h, q, dnsmessage.RCodeSuccess, answers)
+}
+
+// dnsReply 构造只有 answers 的应答
+func dnsReply(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, answers []dnsmessage.Resource) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, a := range answers {
+		var err error
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			err = b.AResource(a.Header, *body)
+		case *dnsmessage.AAAAResource:
+			err = b.AAAAResource(a.Header, *body)
+		case *dnsmessage.PTRResource:
+			err = b.PTRResource(a.Header, *body)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// lookupName 按域名查找结点，在线的优先
+func (s *Space) lookupName(name string) *NodeItem {
+	return s.lookupNode(func(item *NodeItem) bool {
+		return item.Node.Domain != "" && strings.EqualFold(item.Node.Domain, name)
+	})
+}
+
+// lookupAddr 按地址查找结点，在线的优先
+func (s *Space) lookupAddr(addr netip.Addr) *NodeItem {
+	ip := addr.String()
+	return s.lookupNode(func(item *NodeItem) bool {
+		return item.Node.Domain != "" && (item.IP() == ip || item.IPv6() == ip)
+	})
+}
+
+func (s *Space) lookupNode(match func(*NodeItem) bool) *NodeItem {
+	var found *NodeItem
+	s.nodes.Range(func(key string, value *NodeItem) bool {
+		if !match(value) {
+			return true
+		}
+		found = value
+		return value.Status() != NodeOnline
+	})
+	return found
+}
+
+// inSpace addr 是否在 space 的网段内
+func (s *Space) inSpace(addr netip.Addr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ipPool.Prefix().Contains(addr) || (s.prefix6.IsValid() && s.prefix6.Contains(addr))
+}
+
+// ptrAddr 解析反向解析的名字，例如 5.0.168.192.in-addr.arpa.
+func ptrAddr(name string) (netip.Addr, bool) {
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		addr, err := netip.ParseAddr(strings.Join(labels, "."))
+		return addr, err == nil && addr.Is4()
+	}
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		nibbles := strings.Split(rest, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var hex strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return netip.Addr{}, false
+			}
+			hex.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				hex.WriteByte(':')
+			}
+		}
+		addr, err := netip.ParseAddr(hex.String())
+		return addr, err == nil && addr.Is6()
+	}
+	return netip.Addr{}, false
+}
+
+// forwardDNS 把请求转发给上游，全部失败时返回 SERVFAIL
+func (s *Space) forwardDNS(query []byte, h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	var lastErr error = errNoUpstream
+	for _, server := range s.upstreams() {
+		answer, err := exchangeDNS(server, query)
+		if err == nil {
+			return answer, nil
+		}
+		lastErr = err
+	}
+	logrus.Debugln("dns forward", lastErr)
+	return dnsReply(h, q, dnsmessage.RCodeServerFailure, nil)
+}
+
+// exchangeDNS 通过 UDP 向 server 发送一个请求
+func exchangeDNS(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// upstreams 上游 DNS，没有配置时使用系统的
+func (s *Space) upstreams() []string {
+	servers := s.conf().Upstream
+	if len(servers) == 0 {
+		servers = systemResolvers()
+	}
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs = append(addrs, server)
+	}
+	return addrs
+}
+
+var systemResolvers = sync.OnceValue(func() []string {
+	return readResolvConf("/etc/resolv.conf")
+})
+
+// readResolvConf 读取 resolv.conf 中的 nameserver
+func readResolvConf(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
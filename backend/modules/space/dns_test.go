@@ -0,0 +1,183 @@
+package space
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"spacenode/libs/models"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsQuery 构造一个 DNS 请求
+func dnsQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// parseDNS 解析应答，返回 rcode 和第一个答案
+func parseDNS(t *testing.T, msg []byte) (dnsmessage.RCode, dnsmessage.ResourceBody) {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		t.Fatalf("unpack dns: %v", err)
+	}
+	if len(m.Answers) == 0 {
+		return m.RCode, nil
+	}
+	return m.RCode, m.Answers[0].Body
+}
+
+// fakeUpstream 对所有请求返回 1.2.3.4 的上游 DNS
+func fakeUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var m dnsmessage.Message
+			if err := m.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			m.Response = true
+			m.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+			}}
+			reply, _ := m.Pack()
+			conn.WriteTo(reply, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDNS(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{E2E: true, Upstream: []string{fakeUpstream(t)}})
+
+	reqA := registerRequest("a")
+	reqA.SpaceNode.Domain = "Laptop.local"
+	a, respA, err := env.client(t, "secret").Connect(reqA)
+	if err != nil {
+		t.Fatalf("connect a: %v", err)
+	}
+	defer a.Close()
+	reqB := registerRequest("b")
+	reqB.SpaceNode.Domain = "laptop"
+	b, respB, err := env.client(t, "secret").Connect(reqB)
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+	reqApp := registerRequest("app")
+	reqApp.SpaceNode.NodeType = models.NodeTypeApp
+	reqApp.SpaceNode.Domain = "web.my_app.lzcapp"
+	app, respApp, err := env.client(t, "secret").Connect(reqApp)
+	if err != nil {
+		t.Fatalf("connect app: %v", err)
+	}
+	defer app.Close()
+
+	if respA.Domain != "laptop.space1" || respB.Domain != "laptop-2.space1" || respApp.Domain != "web.my-app.lzcapp" {
+		t.Fatalf("unexpected domains %q %q %q", respA.Domain, respB.Domain, respApp.Domain)
+	}
+	if len(respA.DNS) != 1 || respA.DNS[0] != "10.10.0.1" || len(respA.Search) != 1 || respA.Search[0] != "space1" {
+		t.Fatalf("unexpected dns %v search %v", respA.DNS, respA.Search)
+	}
+	waitOnline(t, env.space, "a", "b", "app")
+
+	// 开启 e2e 时 DNS 也走明文，由服务端应答
+	query := dnsQuery(t, "laptop-2.space1.", dnsmessage.TypeA)
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(respA.IPv4), DstIP: net.ParseIP(respA.DNS[0])}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(query)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WritePacket(buf.Bytes()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got, err := readPacket(t, a)
+	if err != nil {
+		t.Fatalf("read dns reply: %v", err)
+	}
+	reply := gopacket.NewPacket(got, layers.LayerTypeIPv4, gopacket.Default)
+	ru, ok := reply.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || ru.SrcPort != 53 || ru.DstPort != 5353 {
+		t.Fatalf("unexpected dns reply packet")
+	}
+	if rcode, body := parseDNS(t, ru.Payload); rcode != dnsmessage.RCodeSuccess || body == nil ||
+		netip.AddrFrom4(body.(*dnsmessage.AResource).A).String() != respB.IPv4 {
+		t.Fatalf("unexpected answer %v %v", rcode, body)
+	}
+
+	cases := []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+		want  string
+	}{
+		{"WEB.my-app.lzcapp.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, respApp.IPv4},
+		{"laptop.space1.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, ""},
+		{"nobody.space1.", dnsmessage.TypeA, dnsmessage.RCodeNameError, ""},
+		{reverseName(respB.IPv4), dnsmessage.TypePTR, dnsmessage.RCodeSuccess, "laptop-2.space1."},
+		{"200.0.10.10.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, ""},
+		{"example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "1.2.3.4"},
+		{"other.lzcapp.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "1.2.3.4"},
+	}
+	for _, c := range cases {
+		msg, err := env.space.resolveDNS(dnsQuery(t, c.name, c.qtype))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		rcode, body := parseDNS(t, msg)
+		var answer string
+		switch body := body.(type) {
+		case *dnsmessage.AResource:
+			answer = netip.AddrFrom4(body.A).String()
+		case *dnsmessage.PTRResource:
+			answer = body.PTR.String()
+		}
+		if rcode != c.rcode || answer != c.want {
+			t.Fatalf("%s: got %v %q, want %v %q", c.name, rcode, answer, c.rcode, c.want)
+		}
+	}
+
+	// 上游不可用时返回 SERVFAIL
+	cfg := env.space.conf()
+	cfg.Upstream = []string{"127.0.0.1:1"}
+	if err := env.space.SetConifg(cfg); err != nil {
+		t.Fatalf("set config: %v", err)
+	}
+	msg, err := env.space.resolveDNS(dnsQuery(t, "example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode, _ := parseDNS(t, msg); rcode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("expect SERVFAIL, got %v", rcode)
+	}
+}
+
+func reverseName(ip string) string {
+	b := netip.MustParseAddr(ip).As4()
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", b[3], b[2], b[1], b[0])
+}
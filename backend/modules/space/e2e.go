@@ -0,0 +1,64 @@
+package space
+
+import (
+	"fmt"
+	"spacenode/libs/e2e"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkE2E 开启端到端加密的 space 要求结点支持 e2e 并提供公钥
+func (s *Space) checkE2E(pc *protocol.Conn, req *models.RegisterRequest) error {
+	if !s.conf().E2E {
+		return nil
+	}
+	if !pc.HasCap(protocol.CapE2E) {
+		return fmt.Errorf("space %s requires end-to-end encryption", s.conf().ID)
+	}
+	if _, err := e2e.ParseKey(req.PublicKey); err != nil {
+		return err
+	}
+	if _, err := e2e.ParseKey(req.EphemeralKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// peers 在线并且提供了公钥的结点
+func (s *Space) peers() *models.PeerList {
+	list := &models.PeerList{Peers: make([]models.Peer, 0)}
+	s.sessions.Range(func(nodeID string, _ *protocol.Conn) bool {
+		item, ok := s.nodes.Load(nodeID)
+		if !ok || item.PublicKey == "" {
+			return true
+		}
+		list.Peers = append(list.Peers, models.Peer{
+			NodeID:       nodeID,
+			IP:           item.IP(),
+			IPv6:         item.IPv6(),
+			PublicKey:    item.PublicKey,
+			EphemeralKey: item.ephemeralKey,
+		})
+		return true
+	})
+	return list
+}
+
+// broadcastPeers 结点上下线之后给所有在线结点下发最新的公钥列表
+func (s *Space) broadcastPeers() {
+	if !s.conf().E2E {
+		return
+	}
+	list := s.peers()
+	s.sessions.Range(func(nodeID string, pc *protocol.Conn) bool {
+		if !pc.HasCap(protocol.CapE2E) {
+			return true
+		}
+		if err := pc.WriteJSON(protocol.FramePeers, list); err != nil {
+			logrus.Warnf("send peers to %s: %v", nodeID, err)
+		}
+		return true
+	})
+}
@@ -0,0 +1,56 @@
+package space
+
+import (
+	"errors"
+	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"spacenode/libs/protocol"
+	"testing"
+)
+
+func TestE2EForward(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{E2E: true})
+
+	a, respA, err := env.client(t, "secret").Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("connect a: %v", err)
+	}
+	defer a.Close()
+	b, respB, err := env.client(t, "secret").Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+	if !a.E2E() || !b.E2E() {
+		t.Fatalf("expect e2e to be enabled")
+	}
+
+	waitOnline(t, env.space, "a", "b")
+	waitPeers(t, map[string]*nodeclient.Session{respA.IPv4: a, respB.IPv4: b})
+	// 明文包会被路由器丢弃
+	plain := ipv4Packet(t, respA.IPv4, respB.IPv4)
+	if err := a.Conn.WritePacket(plain); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pkt := ipv4Packet(t, respA.IPv4, respB.IPv4)
+	pkt[len(pkt)-1] = '!'
+	if err := a.WritePacket(pkt); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got, err := readPacket(t, b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(pkt) {
+		t.Fatalf("expect the sealed packet only")
+	}
+
+	// 不支持 e2e 的客户端被拒绝
+	req := registerRequest("c")
+	req.Capabilities = []string{protocol.CapControl}
+	_, _, err = env.client(t, "secret").Connect(req)
+	var refused *protocol.RefusedError
+	if !errors.As(err, &refused) || refused.Code != protocol.ErrCodeE2ERequired {
+		t.Fatalf("expect client without e2e to be refused, got %v", err)
+	}
+}
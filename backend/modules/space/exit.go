@@ -0,0 +1,187 @@
+package space
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"sort"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrExitNotFound 结点没有表示愿意作为出口结点
+var ErrExitNotFound = errors.New("exit node not found")
+
+// 组播、链路本地和广播地址不发给出口结点
+var noExit = []netip.Prefix{
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("ff00::/8"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// usesExit 结点的上下线会影响出口结点的选择
+func (n *NodeItem) usesExit() bool {
+	return n.advertiseExit || n.exitNode != ""
+}
+
+// exitOf 结点选择的出口结点，只按 NodeID 匹配，只返回在线、愿意作为出口并且已经批准的结点
+// 域名由结点自己上报，不能用来选择出口结点
+func (s *Space) exitOf(item *NodeItem) *NodeItem {
+	want := item.exitNode
+	if want == "" || want == item.Node.NodeID {
+		return nil
+	}
+	n, ok := s.nodes.Load(want)
+	if !ok || !n.advertiseExit || n.Status() != NodeOnline || !s.exitApproved(want) {
+		return nil
+	}
+	return n
+}
+
+// advertiseExit 结点注册时愿意作为出口结点的等待管理员批准，不再愿意时删除记录
+func (s *Space) advertiseExit(nodeID string, exit bool) {
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	_, ok := s.exitNodes.Load(nodeID)
+	switch {
+	case exit && !ok:
+		e := &models.ExitNode{
+			SpaceID:   s.conf().ID,
+			NodeID:    nodeID,
+			CreatedAt: time.Now(),
+		}
+		s.exitNodes.Store(nodeID, e)
+		s.saveExitNode(e)
+		logrus.Infof("node %s advertised exit node, waiting for approval", nodeID)
+	case !exit && ok:
+		s.deleteExitNode(nodeID)
+	}
+}
+
+// ApproveExit 批准或者撤销结点作为出口结点，可以批准多个，由其它结点按 NodeID 选择
+func (s *Space) ApproveExit(nodeID string, approved bool) error {
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	old, ok := s.exitNodes.Load(nodeID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrExitNotFound, nodeID)
+	}
+	if old.Approved == approved {
+		return nil
+	}
+	e := *old
+	e.Approved = approved
+	s.exitNodes.Store(nodeID, &e)
+	s.saveExitNode(&e)
+	s.syncExits()
+	logrus.Infof("%s: exit node %s approved=%v", s.conf().ID, nodeID, approved)
+	return nil
+}
+
+// ExitNodes 愿意作为出口结点的结点，包括没有批准的
+func (s *Space) ExitNodes() []*models.ExitNode {
+	arr := make([]*models.ExitNode, 0)
+	s.exitNodes.Range(func(key string, value *models.ExitNode) bool {
+		arr = append(arr, value)
+		return true
+	})
+	sort.Slice(arr, func(i, j int) bool { return arr[i].NodeID < arr[j].NodeID })
+	return arr
+}
+
+// exitApproved 结点是否被批准作为出口结点
+func (s *Space) exitApproved(nodeID string) bool {
+	e, ok := s.exitNodes.Load(nodeID)
+	return ok && e.Approved
+}
+
+func (s *Space) saveExitNode(e *models.ExitNode) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.SaveExitNode(e); err != nil {
+		logrus.Warnf("save exit node %s: %v", e.NodeID, err)
+	}
+}
+
+func (s *Space) deleteExitNode(nodeID string) {
+	s.exitNodes.Delete(nodeID)
+	if s.store == nil {
+		return
+	}
+	if err := s.store.DeleteExitNode(s.conf().ID, nodeID); err != nil {
+		logrus.Warnf("delete exit node %s: %v", nodeID, err)
+	}
+}
+
+// exitAddr 结点正在使用的出口结点的地址，没有时为空
+func (s *Space) exitAddr(nodeID string) string {
+	s.exitMu.Lock()
+	defer s.exitMu.Unlock()
+	return s.exits[nodeID]
+}
+
+// syncExits 按在线结点当前的选择写入路由器，出口结点有变化的结点重新下发网络配置
+func (s *Space) syncExits() {
+	s.exitMu.Lock()
+	table := make(map[string]string)
+	via := make(map[string]string)
+	s.nodes.Range(func(key string, item *NodeItem) bool {
+		if item.Status() != NodeOnline {
+			return true
+		}
+		if exit := s.exitOf(item); exit != nil {
+			table[key] = exit.IP()
+			via[item.IP()] = exit.IP()
+		}
+		return true
+	})
+	s.router.SetExits(via, append(s.spacePrefixes(), noExit...)...)
+	var changed []string
+	for id, ip := range table {
+		if s.exits[id] != ip {
+			changed = append(changed, id)
+		}
+	}
+	for id := range s.exits {
+		if _, ok := table[id]; !ok {
+			changed = append(changed, id)
+		}
+	}
+	if !maps.Equal(s.exits, table) {
+		logrus.Infof("%s: exit nodes %v", s.conf().ID, table)
+	}
+	s.exits = table
+	s.exitMu.Unlock()
+	for _, id := range changed {
+		s.sendProfile(id)
+	}
+}
+
+// spacePrefixes space 自己的网段，发往这些地址的包不经过出口结点
+func (s *Space) spacePrefixes() []netip.Prefix {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	arr := []netip.Prefix{s.ipPool.Prefix()}
+	if s.prefix6.IsValid() {
+		arr = append(arr, s.prefix6)
+	}
+	return arr
+}
+
+// sendProfile 把网络配置发给一个结点，不支持 CapProfile 的结点跳过
+func (s *Space) sendProfile(nodeID string) {
+	pc, ok := s.sessions.Load(nodeID)
+	if !ok || !pc.HasCap(protocol.CapProfile) {
+		return
+	}
+	if err := pc.WriteJSON(protocol.FrameProfile, s.profile(nodeID)); err != nil {
+		logrus.Debugf("node %s: write profile: %v", nodeID, err)
+	}
+}
@@ -0,0 +1,142 @@
+package space
+
+import (
+	"errors"
+	"slices"
+	"spacenode/libs/models"
+	"spacenode/libs/router"
+	"testing"
+	"time"
+)
+
+func TestExitNode(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+	s := env.space
+
+	reqA := registerRequest("a")
+	reqA.ExitNode = "e"
+	a, respA, err := env.client(t, "secret").Dial(reqA)
+	if err != nil {
+		t.Fatalf("dial a: %v", err)
+	}
+	defer a.Close()
+	if respA.Exit != "" {
+		t.Fatalf("exit node is not online yet, got %q", respA.Exit)
+	}
+	profiles := make(chan *models.NetProfile, 4)
+	a.OnProfile = func(p *models.NetProfile) { profiles <- p }
+
+	// 按 NodeID 选择出口结点，域名与选择相同的结点不能冒充
+	reqR := registerRequest("r")
+	reqR.SpaceNode.Domain = "e"
+	reqR.AdvertiseExit = true
+	r, _, err := env.client(t, "secret").Connect(reqR)
+	if err != nil {
+		t.Fatalf("connect r: %v", err)
+	}
+	defer r.Close()
+	if err := s.ApproveExit("r", true); err != nil {
+		t.Fatal(err)
+	}
+	// 出口结点和子网路由分开批准，通告为子网路由的默认路由被忽略
+	reqE := registerRequest("e")
+	reqE.AdvertiseExit = true
+	reqE.Routes = []string{"0.0.0.0/0"}
+	e, respE, err := env.client(t, "secret").Connect(reqE)
+	if err != nil {
+		t.Fatalf("connect e: %v", err)
+	}
+	eventually(t, "e to advertise exit node", func() bool { return len(s.ExitNodes()) == 2 })
+	if exits := s.ExitNodes(); exits[0].NodeID != "e" || exits[0].Approved || !exits[1].Approved {
+		t.Fatalf("expect exit node e waiting for approval, got %+v", exits)
+	}
+	if p := s.profile("a"); p.Exit != "" || slices.Contains(p.Routes, "0.0.0.0/0") {
+		t.Fatalf("exit node is not approved yet, got %+v", p)
+	}
+	if routes := s.Routes(); len(routes) != 0 {
+		t.Fatalf("expect no subnet routes, got %+v", routes)
+	}
+	if err := s.ApproveRoute("e", "0.0.0.0/0", true); !errors.Is(err, ErrRouteNotFound) {
+		t.Fatalf("expect default route not to be approvable as a subnet route, got %v", err)
+	}
+	if err := s.ApproveExit("b", true); !errors.Is(err, ErrExitNotFound) {
+		t.Fatalf("expect unknown exit node, got %v", err)
+	}
+	if err := s.ApproveExit("e", true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-profiles:
+		if p.Exit != respE.IPv4 {
+			t.Fatalf("expect exit %s, got %q", respE.IPv4, p.Exit)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expect profile update")
+	}
+	if p := s.profile("e"); p.Exit != "" {
+		t.Fatalf("exit node should not use an exit, got %q", p.Exit)
+	}
+
+	internet := ipv4Packet(t, respA.IPv4, "1.1.1.1")
+	if err := a.Session().WritePacket(internet); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPacket(t, e); err != nil || string(got) != string(internet) {
+		t.Fatalf("expect packet forwarded to the exit node: %v", err)
+	}
+	// 出口结点转发回来的包的源地址在 space 之外
+	fromInternet := ipv4Packet(t, "1.1.1.1", respA.IPv4)
+	if err := e.WritePacket(fromInternet); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.Session().ReadPacket(); err != nil || string(got) != string(fromInternet) {
+		t.Fatalf("expect packet from the exit node to reach a: %v", err)
+	}
+
+	// 没有选择出口结点的结点、space 网段内没有分配的地址和组播仍然丢弃
+	b, respB, err := env.client(t, "secret").Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+	if err := b.WritePacket(ipv4Packet(t, respB.IPv4, "1.1.1.1")); err != nil {
+		t.Fatal(err)
+	}
+	// 不是出口结点的结点不能使用 space 之外的源地址
+	if err := b.WritePacket(ipv4Packet(t, "1.1.1.1", respA.IPv4)); err != nil {
+		t.Fatal(err)
+	}
+	unused := s.pool().Prefix().Addr()
+	for range 200 {
+		unused = unused.Next()
+	}
+	for _, dst := range []string{unused.String(), "224.0.0.251"} {
+		if err := a.Session().WritePacket(ipv4Packet(t, respA.IPv4, dst)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	itemA, _ := s.nodes.Load("a")
+	eventually(t, "packets outside the exit to be dropped", func() bool { return itemA.Traffic().Drops[router.DropNoRoute] == 2 })
+	internet[len(internet)-1] = '!'
+	if err := a.Session().WritePacket(internet); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPacket(t, e); err != nil || string(got) != string(internet) {
+		t.Fatalf("expect only the marked packet at the exit node: %v", err)
+	}
+	itemB, _ := s.nodes.Load("b")
+	if drops := itemB.Traffic().Drops; drops[router.DropSpoofed] != 1 || drops[router.DropNoRoute] != 1 {
+		t.Fatalf("unexpected drops of b %v", drops)
+	}
+
+	// 出口结点下线之后通知结点
+	e.Close()
+	select {
+	case p := <-profiles:
+		if p.Exit != "" {
+			t.Fatalf("expect exit cleared, got %q", p.Exit)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expect profile update after the exit node left")
+	}
+}
@@ -0,0 +1,86 @@
+package space
+
+import (
+	"encoding/json"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"spacenode/libs/router"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHeartbeatInterval = 10 * time.Second
+	// 连续 3 次心跳没有回应
+	defaultHeartbeatTimeout = 30 * time.Second
+)
+
+// WithHeartbeat 设置心跳间隔和超时时间
+func WithHeartbeat(interval, timeout time.Duration) Option {
+	return func(s *Space) {
+		s.heartbeatInterval = interval
+		s.heartbeatTimeout = timeout
+	}
+}
+
+// heartbeat 定期给结点发送心跳，超时没有收到结点的任何数据时断开结点，连接关闭后退出
+func (s *Space) heartbeat(item *NodeItem, pc *protocol.Conn) {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pc.Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(item.LastSeen()) > s.heartbeatTimeout {
+			logrus.Warnf("node %s missed heartbeats since %s, disconnecting", item.Node.NodeID, item.LastSeen().Format(time.RFC3339))
+			item.status.Store(NodeOffline)
+			pc.Close()
+			return
+		}
+		if err := pc.WriteJSON(protocol.FramePing, &models.Heartbeat{Time: time.Now().UnixNano()}); err != nil {
+			logrus.Debugf("node %s: write ping: %v", item.Node.NodeID, err)
+		}
+	}
+}
+
+// pong 用结点回复的心跳计算 RTT
+func (s *Space) pong(item *NodeItem, payload []byte) {
+	hb := &models.Heartbeat{}
+	if err := json.Unmarshal(payload, hb); err != nil {
+		logrus.Debugf("node %s: decode pong: %v", item.Node.NodeID, err)
+		return
+	}
+	rtt := time.Since(time.Unix(0, hb.Time))
+	if rtt < 0 {
+		return
+	}
+	item.rtt.Store(int64(rtt))
+}
+
+// liveLink 从结点读到数据包时更新存活时间，并统计结点的流量
+type liveLink struct {
+	router.Link
+	item *NodeItem
+}
+
+func (l *liveLink) ReadPacket() (router.PacketType, []byte, error) {
+	t, pkt, err := l.Link.ReadPacket()
+	if err == nil {
+		l.item.touch()
+		l.item.traffic.received(len(pkt))
+	}
+	return t, pkt, err
+}
+
+func (l *liveLink) WritePacket(t router.PacketType, pkt []byte) error {
+	err := l.Link.WritePacket(t, pkt)
+	if err == nil {
+		l.item.traffic.sent(len(pkt))
+	}
+	return err
+}
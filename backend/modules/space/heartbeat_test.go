@@ -0,0 +1,37 @@
+package space
+
+import (
+	"spacenode/libs/models"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{}, WithHeartbeat(50*time.Millisecond, 300*time.Millisecond))
+
+	a, _, err := env.client(t, "secret").Connect(registerRequest("alive"))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer a.Close()
+	env.rawConnect(t, "silent")
+
+	eventually(t, "silent node to time out", func() bool {
+		alive := nodeIDs(t, env.space, "online")["alive"]
+		return alive != nil && alive.RTT() > 0 && nodeIDs(t, env.space, "offline")["silent"] != nil
+	})
+	online := nodeIDs(t, env.space, "online")
+	offline := nodeIDs(t, env.space, "offline")
+	if item, ok := online["alive"]; !ok || item.RTT() <= 0 {
+		t.Fatalf("expect alive node to be online with rtt, got %v", online)
+	}
+	if _, ok := offline["silent"]; !ok || len(offline) != 1 {
+		t.Fatalf("expect silent node to be offline, got %v", offline)
+	}
+	if len(nodeIDs(t, env.space, "all")) != 2 {
+		t.Fatalf("expect both nodes in the list")
+	}
+	if _, err := env.space.Nodelist("unknown"); err == nil {
+		t.Fatalf("expect unknown condition to fail")
+	}
+}
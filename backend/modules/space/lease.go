@@ -0,0 +1,139 @@
+package space
+
+import (
+	"encoding/json"
+	"fmt"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"spacenode/libs/router"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 默认的租约策略
+const (
+	defaultLease    = 24 * 30 * time.Hour
+	defaultLeaseMin = time.Hour
+	defaultLeaseMax = 24 * 30 * time.Hour
+	// 跟随会话的租约在地址池中的期限，会话结束时释放
+	sessionLeaseTTL = 10 * 365 * 24 * time.Hour
+)
+
+// SessionLease 租约跟随会话
+const SessionLease time.Duration = -1
+
+// leasePolicy space 的租约策略，没有配置的项使用默认值
+func leasePolicy(config models.SpaceItemConfig) (lo, hi, def time.Duration, err error) {
+	lo, hi, def = config.LeaseMin, config.LeaseMax, config.LeaseDefault
+	if lo == 0 {
+		lo = defaultLeaseMin
+	}
+	if hi == 0 {
+		hi = defaultLeaseMax
+	}
+	if def == 0 {
+		def = defaultLease
+	}
+	if lo < 0 || lo > hi {
+		return 0, 0, 0, fmt.Errorf("invalid lease range [%s, %s]", lo, hi)
+	}
+	def = clampLease(def, lo, hi)
+	return lo, hi, def, nil
+}
+
+func clampLease(ttl, lo, hi time.Duration) time.Duration {
+	if ttl < lo {
+		return lo
+	}
+	if ttl > hi {
+		return hi
+	}
+	return ttl
+}
+
+// leaseTTL 按租约策略计算结点的租期，alive 小于 0 时返回 SessionLease
+func (s *Space) leaseTTL(alive time.Duration) time.Duration {
+	if alive < 0 {
+		return SessionLease
+	}
+	lo, hi, def, _ := leasePolicy(s.conf())
+	if alive == 0 {
+		return def
+	}
+	return clampLease(alive, lo, hi)
+}
+
+// poolTTL 租约在地址池中的期限
+func poolTTL(ttl time.Duration) time.Duration {
+	if ttl < 0 {
+		return sessionLeaseTTL
+	}
+	return ttl
+}
+
+// releaseLease 删除结点的租约并归还地址，地址已经属于其它结点时不处理
+func (s *Space) releaseLease(nodeID, ip string) {
+	if l, ok := s.leases.Load(ip); ok && l.NodeID == nodeID {
+		s.deleteLease(ip)
+		s.releaseIP(ip)
+	}
+}
+
+// renewLease 结点在连接上续期租约，跟随会话的租约不需要续期
+func (s *Space) renewLease(item *NodeItem, pc *protocol.Conn, payload []byte) {
+	nodeID := item.Node.NodeID
+	req := &models.LeaseRenewRequest{}
+	if err := json.Unmarshal(payload, req); err != nil {
+		logrus.Warnln("renew lease", nodeID, err)
+		return
+	}
+	resp := &models.LeaseRenewResp{IPv4: item.IP(), Alive: SessionLease}
+	if !item.sessionLease() {
+		ttl := s.leaseTTL(req.Alive)
+		if ttl < 0 {
+			ttl = s.leaseTTL(0)
+		}
+		s.renumberMu.RLock()
+		err := s.renewIP(item.IP(), ttl)
+		if err == nil {
+			s.saveLease(nodeID, item.IP(), ttl)
+		}
+		s.renumberMu.RUnlock()
+		if err != nil {
+			logrus.Warnln("renew lease", nodeID, err)
+			return
+		}
+		item.setLease(ttl)
+		resp.Alive = ttl
+		logrus.Debugf("node %s: lease of %s renewed for %s", nodeID, item.IP(), ttl)
+	}
+	if err := pc.WriteJSON(protocol.FrameRenewLeaseResp, resp); err != nil {
+		logrus.Debugf("node %s: write renew lease resp: %v", nodeID, err)
+	}
+}
+
+// leaseLoop 租约过期时收回地址并断开结点，续期之后顺延
+func (s *Space) leaseLoop(item *NodeItem, link router.Link, done <-chan struct{}) {
+	timer := time.NewTimer(time.Until(item.LeaseExpires()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if left := time.Until(item.LeaseExpires()); left > 0 {
+			timer.Reset(left)
+			continue
+		}
+		logrus.Warnf("node %s: lease of %s expired, disconnecting", item.Node.NodeID, item.IP())
+		s.renumberMu.RLock()
+		s.releaseLease(item.Node.NodeID, item.IP())
+		s.renumberMu.RUnlock()
+		link.Close()
+		return
+	}
+}
@@ -0,0 +1,89 @@
+package space
+
+import (
+	"spacenode/libs/models"
+	"testing"
+	"time"
+)
+
+func TestLeasePolicy(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{
+		LeaseMin: 100 * time.Millisecond,
+		LeaseMax: 400 * time.Millisecond,
+	})
+
+	a, resp, err := env.client(t, "secret").Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if resp.Alive != 400*time.Millisecond {
+		t.Fatalf("expect lease to be clamped to 400ms, got %s", resp.Alive)
+	}
+	env.rawConnect(t, "silent")
+
+	req := registerRequest("session")
+	req.NetConfig.Alive = -1
+	sess, resp, err := env.client(t, "secret").Connect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Alive >= 0 {
+		t.Fatalf("expect session lease, got %s", resp.Alive)
+	}
+
+	// silent 的租约比 a 晚开始，过期时 a 已经续期过
+	eventually(t, "lease of silent to expire", func() bool {
+		return nodeIDs(t, env.space, "online")["silent"] == nil && !leaseOwners(env.space)["silent"]
+	})
+	// a 续期之后仍然在线，没有续期的结点被断开
+	online := nodeIDs(t, env.space, "online")
+	if _, ok := online["a"]; !ok {
+		t.Fatalf("expect renewed node to stay online, got %v", online)
+	}
+	if _, ok := online["silent"]; ok {
+		t.Fatalf("expect node with expired lease to be disconnected")
+	}
+	if !a.LeaseExpires().After(time.Now()) {
+		t.Fatalf("expect client lease to be renewed")
+	}
+	owners := leaseOwners(env.space)
+	if !owners["a"] || !owners["session"] || owners["silent"] {
+		t.Fatalf("unexpected leases: %v", owners)
+	}
+
+	// 跟随会话的租约在断开时释放
+	sess.Close()
+	eventually(t, "session lease to be released", func() bool { return !leaseOwners(env.space)["session"] })
+
+	if _, err := NewSpace(models.SpaceItemConfig{
+		NetAddr:  "10.10.0.0",
+		Mask:     "255.255.255.0",
+		LeaseMin: time.Hour,
+		LeaseMax: time.Minute,
+	}); err == nil {
+		t.Fatalf("expect invalid lease policy to fail")
+	}
+}
+
+func TestLeave(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+	s := env.space
+
+	req := registerRequest("a")
+	req.NetConfig.Alive = time.Hour
+	a, resp, err := env.client(t, "secret").Dial(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Alive != time.Hour || !leaseOwners(s)["a"] {
+		t.Fatalf("expect a timed lease, got %s", resp.Alive)
+	}
+	// 放弃分配到的地址之后租约立刻收回，不等过期
+	if err := a.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "lease released and node offline", func() bool {
+		return !leaseOwners(s)["a"] && nodeIDs(t, s, "online")["a"] == nil
+	})
+}
@@ -0,0 +1,123 @@
+package space
+
+import (
+	"sort"
+	"spacenode/libs/router"
+	"spacenode/libs/syncmap"
+	"sync/atomic"
+)
+
+// traffic 结点的流量计数，结点重连之后沿用，移除之后清零
+type traffic struct {
+	// rx 为结点发给 space 的，tx 为 space 写给结点的
+	rxPackets, rxBytes atomic.Uint64
+	txPackets, txBytes atomic.Uint64
+	drops              syncmap.SyncMap[router.DropReason, *atomic.Uint64]
+}
+
+func (t *traffic) received(n int) {
+	t.rxPackets.Add(1)
+	t.rxBytes.Add(uint64(n))
+}
+
+func (t *traffic) sent(n int) {
+	t.txPackets.Add(1)
+	t.txBytes.Add(uint64(n))
+}
+
+func (t *traffic) drop(reason router.DropReason) {
+	c, ok := t.drops.Load(reason)
+	if !ok {
+		c, _ = t.drops.LoadOrStore(reason, &atomic.Uint64{})
+	}
+	c.Add(1)
+}
+
+// TrafficStats 结点的流量计数
+type TrafficStats struct {
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	// 路由器丢弃的结点发来的包，key 为原因
+	Drops map[router.DropReason]uint64 `json:"drops"`
+}
+
+func (t *traffic) stats() TrafficStats {
+	st := TrafficStats{
+		RxPackets: t.rxPackets.Load(),
+		RxBytes:   t.rxBytes.Load(),
+		TxPackets: t.txPackets.Load(),
+		TxBytes:   t.txBytes.Load(),
+		Drops:     make(map[router.DropReason]uint64),
+	}
+	t.drops.Range(func(key router.DropReason, value *atomic.Uint64) bool {
+		st.Drops[key] = value.Load()
+		return true
+	})
+	return st
+}
+
+// Traffic 结点的流量计数
+func (n *NodeItem) Traffic() TrafficStats {
+	return n.traffic.stats()
+}
+
+// dropped 路由器丢弃了 ip 结点发来的包
+func (s *Space) dropped(ip string, reason router.DropReason) {
+	if item, ok := s.addrs.Load(ip); ok {
+		item.traffic.drop(reason)
+	}
+}
+
+// NodeMetrics 一个结点的指标
+type NodeMetrics struct {
+	NodeID   string       `json:"node_id"`
+	NodeType string       `json:"node_type"`
+	Status   NodeStatus   `json:"status"`
+	Traffic  TrafficStats `json:"traffic"`
+}
+
+// Metrics space 的指标
+type Metrics struct {
+	ID string `json:"id"`
+	// 注册成功和被拒绝的次数，包括重连
+	Registrations uint64 `json:"registrations"`
+	Refused       uint64 `json:"refused"`
+	// 在线的结点
+	Sessions int `json:"sessions"`
+	// 地址池的大小和已经分配的地址
+	PoolSize  int           `json:"pool_size"`
+	PoolUsed  int           `json:"pool_used"`
+	ACLDenied uint64        `json:"acl_denied"`
+	Nodes     []NodeMetrics `json:"nodes"`
+}
+
+// Metrics 当前的指标，结点按 NodeID 排序
+func (s *Space) Metrics() Metrics {
+	pool := s.PoolStats()
+	m := Metrics{
+		ID:            s.conf().ID,
+		Registrations: s.registered.Load(),
+		Refused:       s.refused.Load(),
+		PoolSize:      pool.Size,
+		PoolUsed:      pool.Used,
+		ACLDenied:     s.filter.Stats().Denied,
+		Nodes:         make([]NodeMetrics, 0),
+	}
+	s.nodes.Range(func(key string, value *NodeItem) bool {
+		status := value.Status()
+		if status == NodeOnline {
+			m.Sessions++
+		}
+		m.Nodes = append(m.Nodes, NodeMetrics{
+			NodeID:   key,
+			NodeType: string(value.Node.NodeType),
+			Status:   status,
+			Traffic:  value.Traffic(),
+		})
+		return true
+	})
+	sort.Slice(m.Nodes, func(i, j int) bool { return m.Nodes[i].NodeID < m.Nodes[j].NodeID })
+	return m
+}
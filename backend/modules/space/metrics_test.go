@@ -0,0 +1,80 @@
+package space
+
+import (
+	"encoding/json"
+	"spacenode/libs/models"
+	"spacenode/libs/router"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+	s := env.space
+
+	clientA := env.client(t, "secret")
+	a, respA, err := clientA.Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("connect a: %v", err)
+	}
+	defer a.Close()
+	b, respB, err := env.client(t, "secret").Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+	// 静态地址不在地址池中
+	reqC := registerRequest("c")
+	reqC.NetConfig.DHCPType = "static"
+	reqC.NetConfig.IPv4 = "203.0.113.5"
+	if _, _, err := env.client(t, "secret").Connect(reqC); err == nil {
+		t.Fatalf("expect static address outside the pool to be refused")
+	}
+	waitOnline(t, s, "a", "b")
+
+	if err := a.WritePacket(ipv4Packet(t, respA.IPv4, "203.0.113.1")); err != nil {
+		t.Fatal(err)
+	}
+	pkt := ipv4Packet(t, respA.IPv4, respB.IPv4)
+	if err := a.WritePacket(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPacket(t, b); err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.Metrics()
+	if m.Registrations != 2 || m.Refused != 1 || m.Sessions != 2 || m.PoolUsed < 2 || len(m.Nodes) != 2 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+	ta, tb := m.Nodes[0].Traffic, m.Nodes[1].Traffic
+	if ta.RxPackets != 2 || ta.RxBytes != uint64(2*len(pkt)) || ta.Drops[router.DropNoRoute] != 1 {
+		t.Fatalf("unexpected traffic of a %+v", ta)
+	}
+	if tb.TxPackets != 1 || tb.TxBytes != uint64(len(pkt)) {
+		t.Fatalf("unexpected traffic of b %+v", tb)
+	}
+
+	// 结点列表中也有计数，重连之后沿用
+	old, _ := s.nodes.Load("a")
+	a.Close()
+	a, _, err = clientA.Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("reconnect a: %v", err)
+	}
+	defer a.Close()
+	eventually(t, "a to reconnect", func() bool {
+		item, _ := s.nodes.Load("a")
+		return item != old
+	})
+	item, _ := s.nodes.Load("a")
+	data, _ := json.Marshal(item)
+	var got struct {
+		Traffic TrafficStats `json:"traffic"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil || got.Traffic.RxPackets != 2 {
+		t.Fatalf("expect traffic kept after reconnect, got %s", data)
+	}
+	if s.Metrics().Registrations != 3 {
+		t.Fatalf("expect reconnect to count as a registration")
+	}
+}
@@ -0,0 +1,212 @@
+package space
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"spacenode/libs/ippool"
+	"spacenode/libs/models"
+	"spacenode/libs/subnet"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PoolStats 地址池的配置和每个范围的使用情况
+type PoolStats struct {
+	Prefix string `json:"prefix"`
+	// 没有配置 IPv6 时为空
+	Prefix6 string             `json:"prefix6,omitempty"`
+	Gateway string             `json:"gateway"`
+	DNS     []string           `json:"dns"`
+	Size    int                `json:"size"`
+	Used    int                `json:"used"`
+	Ranges  []ippool.RangeStat `json:"ranges"`
+}
+
+// newPool 按配置创建地址池，网关和 DNS 地址从分配中排除
+func newPool(config models.SpaceItemConfig) (*ippool.IPPool, netip.Addr, []netip.Addr, error) {
+	base, err := ippool.NewIPPool(config.NetAddr, config.Mask)
+	if err != nil {
+		return nil, netip.Addr{}, nil, err
+	}
+	prefix := base.Prefix()
+	if err := checkSubnet(config, prefix); err != nil {
+		return nil, netip.Addr{}, nil, err
+	}
+
+	cfg := ippool.Config{Prefix: prefix}
+	for _, s := range config.Ranges {
+		r, err := ippool.ParseRange(s)
+		if err != nil {
+			return nil, netip.Addr{}, nil, err
+		}
+		cfg.Ranges = append(cfg.Ranges, r)
+	}
+	for _, s := range config.Exclude {
+		r, err := ippool.ParseRange(s)
+		if err != nil {
+			return nil, netip.Addr{}, nil, err
+		}
+		cfg.Exclude = append(cfg.Exclude, r)
+	}
+
+	gateway := prefix.Addr().Next()
+	if config.Gateway != "" {
+		gateway, err = parseHost(prefix, config.Gateway)
+		if err != nil {
+			return nil, netip.Addr{}, nil, fmt.Errorf("gateway: %w", err)
+		}
+	}
+	cfg.Exclude = append(cfg.Exclude, ippool.Range{Start: gateway, End: gateway})
+
+	dns := make([]netip.Addr, 0, len(config.DNS))
+	for _, s := range config.DNS {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, netip.Addr{}, nil, fmt.Errorf("dns: %w", err)
+		}
+		addr = addr.Unmap()
+		// 网段外的 DNS 不占用地址，网段内的必须是主机地址
+		if prefix.Contains(addr) {
+			if addr, err = parseHost(prefix, s); err != nil {
+				return nil, netip.Addr{}, nil, fmt.Errorf("dns: %w", err)
+			}
+			cfg.Exclude = append(cfg.Exclude, ippool.Range{Start: addr, End: addr})
+		}
+		dns = append(dns, addr)
+	}
+
+	pl, err := ippool.NewWithConfig(cfg)
+	if err != nil {
+		return nil, netip.Addr{}, nil, err
+	}
+	return pl, gateway, dns, nil
+}
+
+// checkSubnet 拒绝公网网段，与本机网络重叠时只告警
+// 服务端和结点通常不在同一个网络命名空间，本机的路由不一定影响结点
+func checkSubnet(config models.SpaceItemConfig, prefix netip.Prefix) error {
+	if !subnet.IsPrivate(prefix) && !config.AllowPublic {
+		suggest, err := subnet.SuggestLocal()
+		if err != nil {
+			return fmt.Errorf("%s: %w", prefix, subnet.ErrPublic)
+		}
+		return fmt.Errorf("%s: %w, try %s", prefix, subnet.ErrPublic, suggest)
+	}
+	local, err := subnet.Local()
+	if err != nil {
+		logrus.Warnf("%s: list local networks: %v", config.ID, err)
+		return nil
+	}
+	conflicts := subnet.Conflicts(prefix, local)
+	for _, n := range conflicts {
+		logrus.Warnf("%s: subnet %s overlaps %s", config.ID, prefix, n)
+	}
+	if len(conflicts) > 0 {
+		if suggest, err := subnet.Suggest(local); err == nil {
+			logrus.Warnf("%s: %s is free on this host", config.ID, suggest)
+		}
+	}
+	return nil
+}
+
+// ula IPv6 的私有地址
+var ula = netip.MustParsePrefix("fc00::/7")
+
+// parsePrefix6 解析 IPv6 网段，主机位不能比 IPv4 少，结点的 IPv6 地址按 IPv4 的偏移计算
+func parsePrefix6(config models.SpaceItemConfig, prefix4 netip.Prefix) (netip.Prefix, error) {
+	if config.IPv6 == "" {
+		return netip.Prefix{}, nil
+	}
+	prefix, err := netip.ParsePrefix(config.IPv6)
+	if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("invalid IPv6 prefix %q", config.IPv6)
+	}
+	prefix = prefix.Masked()
+	if 128-prefix.Bits() < 32-prefix4.Bits() {
+		return netip.Prefix{}, fmt.Errorf("IPv6 prefix %s is smaller than %s", prefix, prefix4)
+	}
+	if !ula.Contains(prefix.Addr()) && !config.AllowPublic {
+		return netip.Prefix{}, fmt.Errorf("%s: %w, use a ULA prefix in fc00::/7", prefix, subnet.ErrPublic)
+	}
+	return prefix, nil
+}
+
+// ipv6For 与 ip 偏移相同的 IPv6 地址，没有配置 IPv6 时为空
+func (s *Space) ipv6For(ip string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return ipv6In(s.ipPool.Prefix(), s.prefix6, ip)
+}
+
+// ipv6In ip 在 prefix4 中的偏移对应的 prefix6 中的地址
+func ipv6In(prefix4, prefix6 netip.Prefix, ip string) string {
+	if !prefix6.IsValid() {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !prefix4.Contains(addr) {
+		return ""
+	}
+	off := binary.BigEndian.Uint32(addr.AsSlice()) - binary.BigEndian.Uint32(prefix4.Addr().AsSlice())
+	b := prefix6.Addr().As16()
+	// 主机位至少与 IPv4 一样多，加上偏移不会进位到网络位
+	binary.BigEndian.PutUint32(b[12:], binary.BigEndian.Uint32(b[12:])+off)
+	return netip.AddrFrom16(b).String()
+}
+
+// wantIPv6 请求的地址类型是否包括 IPv6
+func wantIPv6(req *models.RegisterRequest) bool {
+	return req.NetConfig.Type == "ipv6" || req.NetConfig.Type == "ip"
+}
+
+// parseHost 解析网段内的主机地址，网络地址和广播地址不是主机地址
+func parseHost(prefix netip.Prefix, s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr = addr.Unmap()
+	if !prefix.Contains(addr) || addr == prefix.Addr() || addr == lastAddr(prefix) {
+		return netip.Addr{}, fmt.Errorf("%s is not a host in %s", addr, prefix)
+	}
+	return addr, nil
+}
+
+// lastAddr IPv4 网段的广播地址
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	last := binary.BigEndian.Uint32(prefix.Addr().AsSlice()) | uint32(1<<(32-prefix.Bits())-1)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], last)
+	return netip.AddrFrom4(b)
+}
+
+// Gateway 网关地址
+func (s *Space) Gateway() netip.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gateway
+}
+
+// PoolStats 地址池的使用情况
+func (s *Space) PoolStats() PoolStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dns := make([]string, 0, len(s.dns))
+	for _, addr := range s.dns {
+		dns = append(dns, addr.String())
+	}
+	var prefix6 string
+	if s.prefix6.IsValid() {
+		prefix6 = s.prefix6.String()
+	}
+	return PoolStats{
+		Prefix:  s.ipPool.Prefix().String(),
+		Prefix6: prefix6,
+		Gateway: s.gateway.String(),
+		DNS:     dns,
+		Size:    s.ipPool.Size(),
+		Used:    s.ipPool.Used(),
+		Ranges:  s.ipPool.Stats(),
+	}
+}
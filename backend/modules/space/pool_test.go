@@ -0,0 +1,168 @@
+package space
+
+import (
+	"fmt"
+	"net/netip"
+	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"strconv"
+	"testing"
+)
+
+func TestDeterministicIP(t *testing.T) {
+	s1 := newTestEnv(t, models.SpaceItemConfig{}).space
+	s2 := newTestEnv(t, models.SpaceItemConfig{}).space
+	for _, id := range []string{"a", "b", "c"} {
+		ip1, err := s1.AssignIP(registerRequest(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip2, _ := s2.AssignIP(registerRequest(id))
+		if ip1 != ip2 {
+			t.Fatalf("node %s: %s != %s", id, ip1, ip2)
+		}
+	}
+	// 不认识的分配方式拒绝，不返回空地址
+	req := registerRequest("d")
+	req.NetConfig.DHCPType = "dhcp"
+	if ip, err := s1.AssignIP(req); err == nil || ip != "" {
+		t.Fatalf("expect unsupported dhcp type to fail, got %q", ip)
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	s, err := NewSpace(models.SpaceItemConfig{
+		ID:      "space1",
+		NetAddr: "10.10.0.0",
+		Mask:    "255.255.255.0",
+		Ranges:  []string{"10.10.0.0/29", "10.10.0.100-10.10.0.103"},
+		Exclude: []string{"10.10.0.102"},
+		DNS:     []string{"10.10.0.2", "1.1.1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if s.Gateway() != netip.MustParseAddr("10.10.0.1") {
+		t.Fatalf("expect default gateway 10.10.0.1, got %s", s.Gateway())
+	}
+
+	// .1 网关 .2 DNS .102 排除之后剩下 .3-.7 .100 .101 .103
+	allowed := map[string]bool{}
+	for _, ip := range []string{"10.10.0.3", "10.10.0.4", "10.10.0.5", "10.10.0.6", "10.10.0.7", "10.10.0.100", "10.10.0.101", "10.10.0.103"} {
+		allowed[ip] = true
+	}
+	n := len(allowed)
+	for i := 0; i < n; i++ {
+		ip, err := s.AssignIP(&models.RegisterRequest{
+			SpaceNode: models.SpaceNode{NodeID: fmt.Sprintf("node%d", i)},
+			NetConfig: models.NetConfig{Type: "ipv4", DHCPType: "auto"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allowed[ip] {
+			t.Fatalf("unexpected address %s", ip)
+		}
+		delete(allowed, ip)
+	}
+	if _, err := s.AssignIP(&models.RegisterRequest{
+		SpaceNode: models.SpaceNode{NodeID: "extra"},
+		NetConfig: models.NetConfig{Type: "ipv4", DHCPType: "auto"},
+	}); err == nil {
+		t.Fatalf("expect exhausted pool to fail")
+	}
+	for _, ip := range []string{"10.10.0.1", "10.10.0.2", "10.10.0.50"} {
+		if err := s.Reserve("b", ip); err == nil {
+			t.Fatalf("expect %s not to be reserved", ip)
+		}
+	}
+
+	stats := s.PoolStats()
+	if stats.Prefix != "10.10.0.0/24" || stats.Size != 8 || stats.Used != 8 || len(stats.Ranges) != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if r := stats.Ranges[1]; r.Range != "10.10.0.100-10.10.0.103" || r.Size != 3 || r.Used != 3 {
+		t.Fatalf("unexpected range stats %+v", r)
+	}
+
+	for _, config := range []models.SpaceItemConfig{
+		{NetAddr: "10.10.0.0", Mask: "255.255.255.0", Ranges: []string{"10.10.1.0/24"}},
+		{NetAddr: "10.10.0.0", Mask: "255.255.255.0", Gateway: "10.20.0.1"},
+		{NetAddr: "10.10.0.0", Mask: "255.255.255.0", Gateway: "10.10.0.255"},
+		{NetAddr: "10.10.0.0", Mask: "255.255.255.0", DNS: []string{"10.10.0.255"}},
+		{NetAddr: "10.10.0.0", Mask: "255.255.255.0", DNS: []string{"10.10.0.0"}},
+		{NetAddr: "10.10.0.0", Mask: "255.255.255.0", Exclude: []string{"bad"}},
+		{NetAddr: "172.168.1.0", Mask: "255.255.255.0"},
+	} {
+		if _, err := NewSpace(config); err == nil {
+			t.Fatalf("expect %+v to fail", config)
+		}
+	}
+	pub, err := NewSpace(models.SpaceItemConfig{NetAddr: "172.168.1.0", Mask: "255.255.255.0", AllowPublic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub.Stop()
+}
+
+func TestDualStack(t *testing.T) {
+	for _, e2e := range []bool{false, true} {
+		t.Run(fmt.Sprintf("e2e=%v", e2e), func(t *testing.T) {
+			env := newTestEnv(t, models.SpaceItemConfig{IPv6: "fd12:3456:789a::/64", E2E: e2e})
+
+			connect := func(nodeID, typ string) (*nodeclient.Session, *models.RegisterResp) {
+				req := registerRequest(nodeID)
+				req.NetConfig.Type = typ
+				pc, resp, err := env.client(t, "secret").Connect(req)
+				if err != nil {
+					t.Fatalf("connect %s: %v", nodeID, err)
+				}
+				t.Cleanup(func() { pc.Close() })
+				return pc, resp
+			}
+			a, respA := connect("a", "ip")
+			b, respB := connect("b", "ip")
+			_, respC := connect("c", "ipv4")
+
+			// IPv6 地址与 IPv4 地址的偏移相同
+			for _, resp := range []*models.RegisterResp{respA, respB} {
+				v4 := netip.MustParseAddr(resp.IPv4)
+				want := "fd12:3456:789a::" + strconv.FormatInt(int64(v4.As4()[3]), 16)
+				if resp.Bits != 24 || resp.IPv6Bits != 64 || resp.IPv6 != netip.MustParseAddr(want).String() {
+					t.Fatalf("unexpected addresses %+v", resp)
+				}
+			}
+			if respC.IPv6 != "" {
+				t.Fatalf("expect ipv4 only node without IPv6, got %s", respC.IPv6)
+			}
+			if len(respA.Prefixes()) != 2 || len(respC.Prefixes()) != 1 {
+				t.Fatalf("unexpected prefixes %v %v", respA.Prefixes(), respC.Prefixes())
+			}
+
+			waitOnline(t, env.space, "a", "b", "c")
+			waitPeers(t, map[string]*nodeclient.Session{respA.IPv4: a, respB.IPv4: b})
+			for _, pkt := range [][]byte{
+				ipv6Packet(t, respA.IPv6, respB.IPv6),
+				ipv4Packet(t, respA.IPv4, respB.IPv4),
+			} {
+				if err := a.WritePacket(pkt); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				got, err := readPacket(t, b)
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if string(got) != string(pkt) {
+					t.Fatalf("forwarded packet differs")
+				}
+			}
+		})
+	}
+
+	for _, v6 := range []string{"2001:db8::/64", "fd00::/121", "10.0.0.0/8"} {
+		if _, err := NewSpace(models.SpaceItemConfig{NetAddr: "10.10.0.0", Mask: "255.255.255.0", IPv6: v6}); err == nil {
+			t.Fatalf("expect IPv6 prefix %s to fail", v6)
+		}
+	}
+}
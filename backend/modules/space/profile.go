@@ -0,0 +1,91 @@
+package space
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"strings"
+)
+
+const (
+	// 没有配置 MTU 时下发的值，给 UDP 和加密的头部留出余量
+	defaultMTU = 1400
+	minMTU     = 576
+	// 配置了 IPv6 时 MTU 不能小于 1280
+	minMTU6 = 1280
+	maxMTU  = 9000
+)
+
+// checkProfile 检查下发给结点的 MTU、路由和搜索域
+func checkProfile(sc models.SpaceItemConfig) error {
+	if sc.MTU != 0 {
+		low := minMTU
+		if sc.IPv6 != "" {
+			low = minMTU6
+		}
+		if sc.MTU < low || sc.MTU > maxMTU {
+			return fmt.Errorf("mtu %d out of range [%d, %d]", sc.MTU, low, maxMTU)
+		}
+	}
+	for _, r := range sc.Routes {
+		if _, err := netip.ParsePrefix(r); err != nil {
+			return fmt.Errorf("invalid route %q: %w", r, err)
+		}
+	}
+	for _, d := range sc.Search {
+		for _, l := range strings.Split(strings.Trim(d, "."), ".") {
+			if l == "" || dnsLabel(l) != strings.ToLower(l) {
+				return fmt.Errorf("invalid search domain %q", d)
+			}
+		}
+	}
+	return nil
+}
+
+// profile 当前下发给结点的网络配置，路由包括其它结点的子网路由
+func (s *Space) profile(nodeID string) models.NetProfile {
+	sc := s.conf()
+	p := models.NetProfile{
+		Bits:   s.pool().Prefix().Bits(),
+		MTU:    sc.MTU,
+		DNS:    s.dnsAddrs(),
+		Search: []string{s.zone()},
+		Exit:   s.exitAddr(nodeID),
+	}
+	if p.MTU == 0 {
+		p.MTU = defaultMTU
+	}
+	for _, r := range sc.Routes {
+		if prefix, err := netip.ParsePrefix(r); err == nil {
+			p.Routes = append(p.Routes, prefix.Masked().String())
+		}
+	}
+	// 结点自己通告的网段不经过 space
+	var subnets []string
+	for id, prefixes := range s.approvedRoutes() {
+		if id != nodeID {
+			subnets = append(subnets, prefixes...)
+		}
+	}
+	sort.Strings(subnets)
+	for _, r := range subnets {
+		if !slices.Contains(p.Routes, r) {
+			p.Routes = append(p.Routes, r)
+		}
+	}
+	for _, d := range sc.Search {
+		p.Search = append(p.Search, strings.ToLower(strings.Trim(d, ".")))
+	}
+	return p
+}
+
+// broadcastProfile 把新的网络配置发给所有支持 CapProfile 的在线结点
+func (s *Space) broadcastProfile() {
+	s.sessions.Range(func(key string, value *protocol.Conn) bool {
+		s.sendProfile(key)
+		return true
+	})
+}
@@ -0,0 +1,79 @@
+package space
+
+import (
+	"reflect"
+	"slices"
+	"spacenode/libs/models"
+	"testing"
+	"time"
+)
+
+func TestProfile(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{
+		MTU:    1300,
+		Routes: []string{"192.168.50.1/24"},
+		Search: []string{"Corp.Example."},
+	})
+	s := env.space
+
+	c, resp, err := env.client(t, "secret").Dial(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	profiles := make(chan *models.NetProfile, 4)
+	c.OnProfile = func(p *models.NetProfile) { profiles <- p }
+
+	want := models.NetProfile{
+		Bits:   24,
+		MTU:    1300,
+		Routes: []string{"192.168.50.0/24"},
+		DNS:    []string{"10.10.0.1"},
+		Search: []string{"space1", "corp.example"},
+	}
+	if !reflect.DeepEqual(resp.NetProfile, want) {
+		t.Fatalf("unexpected profile %+v", resp.NetProfile)
+	}
+	waitOnline(t, s, "a")
+
+	cfg := s.conf()
+	cfg.MTU = 0
+	cfg.Routes = []string{"192.168.50.0/24", "172.30.0.0/16"}
+	if err := s.SetConifg(cfg); err != nil {
+		t.Fatalf("set config: %v", err)
+	}
+	select {
+	case p := <-profiles:
+		if p.MTU != defaultMTU || !slices.Equal(p.Routes, cfg.Routes) || p.Bits != 24 {
+			t.Fatalf("unexpected pushed profile %+v", p)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expect profile update")
+	}
+
+	// 没有变化时不下发
+	if err := s.SetConifg(cfg); err != nil {
+		t.Fatalf("set config: %v", err)
+	}
+	select {
+	case p := <-profiles:
+		t.Fatalf("unexpected profile update %+v", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	for _, bad := range []func(*models.SpaceItemConfig){
+		func(c *models.SpaceItemConfig) { c.MTU = 100 },
+		func(c *models.SpaceItemConfig) { c.MTU = 1000; c.IPv6 = "fd00:1::/64" },
+		func(c *models.SpaceItemConfig) { c.Routes = []string{"192.168.1.0"} },
+		func(c *models.SpaceItemConfig) { c.Search = []string{"bad_domain"} },
+	} {
+		next := s.conf()
+		bad(&next)
+		if err := s.SetConifg(next); err == nil {
+			t.Fatalf("expect invalid profile %+v to be rejected", next)
+		}
+	}
+	if s.conf().MTU != 0 {
+		t.Fatalf("config changed by a rejected update")
+	}
+}
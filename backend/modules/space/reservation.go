@@ -0,0 +1,129 @@
+package space
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"spacenode/libs/models"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrIPConflict 地址已经保留给或者租给了其它结点
+var ErrIPConflict = errors.New("ip is used by another node")
+
+// Reserve 为结点固定地址，结点已有的保留会被替换
+// 地址被其它结点保留或租用时返回 ErrIPConflict，需要先移除那个结点
+func (s *Space) Reserve(nodeID, ip string) error {
+	if nodeID == "" {
+		return errors.New("node id is required")
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Unmap().Is4() {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	addr = addr.Unmap()
+	ip = addr.String()
+
+	s.renumberMu.RLock()
+	defer s.renumberMu.RUnlock()
+	s.reserveMu.Lock()
+	defer s.reserveMu.Unlock()
+	var conflict error
+	s.reservations.Range(func(key string, value *models.IPReservation) bool {
+		if key != nodeID && value.IP == ip {
+			conflict = fmt.Errorf("%w: %s is reserved for node %s", ErrIPConflict, ip, key)
+			return false
+		}
+		return true
+	})
+	if conflict != nil {
+		return conflict
+	}
+	if l, ok := s.leases.Load(ip); ok && l.NodeID != nodeID && time.Now().Before(l.ExpiresAt) {
+		return fmt.Errorf("%w: %s is leased to node %s", ErrIPConflict, ip, l.NodeID)
+	}
+	if s.ipInUse(nodeID, ip) {
+		return fmt.Errorf("%w: %s is used by an online node", ErrIPConflict, ip)
+	}
+	if err := s.pool().Reserve(addr); err != nil {
+		return err
+	}
+
+	r := &models.IPReservation{
+		SpaceID:   s.conf().ID,
+		NodeID:    nodeID,
+		IP:        ip,
+		CreatedAt: time.Now(),
+	}
+	if old, ok := s.reservations.Load(nodeID); ok && old.IP != ip {
+		s.releaseReservation(old.IP)
+	}
+	s.reservations.Store(nodeID, r)
+	// 不在线的结点原来的租约不再使用，在线的结点在下次分配地址时归还
+	if item, ok := s.nodes.Load(nodeID); !ok || item.Status() != NodeOnline {
+		s.releaseOtherLeases(nodeID, ip)
+	}
+	if s.store != nil {
+		if err := s.store.SaveReservation(r); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("%s: reserved %s for node %s", s.conf().ID, ip, nodeID)
+	return nil
+}
+
+// Unreserve 取消结点的固定地址，结点正在使用的租约不受影响
+func (s *Space) Unreserve(nodeID string) error {
+	s.renumberMu.RLock()
+	defer s.renumberMu.RUnlock()
+	s.reserveMu.Lock()
+	defer s.reserveMu.Unlock()
+	r, ok := s.reservations.Load(nodeID)
+	if !ok {
+		return fmt.Errorf("node %s has no reservation", nodeID)
+	}
+	s.reservations.Delete(nodeID)
+	s.releaseReservation(r.IP)
+	if s.store != nil {
+		if err := s.store.DeleteReservation(s.conf().ID, nodeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Space) Reservations() []*models.IPReservation {
+	arr := make([]*models.IPReservation, 0)
+	s.reservations.Range(func(key string, value *models.IPReservation) bool {
+		arr = append(arr, value)
+		return true
+	})
+	return arr
+}
+
+func (s *Space) releaseReservation(ip string) {
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		s.pool().Unreserve(addr)
+	}
+}
+
+// releaseOtherLeases 归还结点除 keep 之外的租约，调用方持有 renumberMu
+func (s *Space) releaseOtherLeases(nodeID, keep string) {
+	s.leases.Range(func(key string, value *models.IPLease) bool {
+		if value.NodeID == nodeID && key != keep {
+			s.releaseLease(nodeID, key)
+		}
+		return true
+	})
+}
+
+// reservedIP 结点的固定地址
+func (s *Space) reservedIP(nodeID string) (string, bool) {
+	r, ok := s.reservations.Load(nodeID)
+	if !ok {
+		return "", false
+	}
+	return r.IP, true
+}
@@ -0,0 +1,138 @@
+package space
+
+import (
+	"errors"
+	"spacenode/libs/models"
+	"testing"
+	"time"
+)
+
+func TestReservation(t *testing.T) {
+	store := newTestStore(t)
+	env := newTestEnv(t, models.SpaceItemConfig{}, WithStore(store))
+	s := env.space
+
+	// 已经存在的 NodeID 只能由它自己申请证书，先申请再保留
+	clientA := env.client(t, "secret")
+	if err := clientA.Enroll("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reserve("a", "10.10.0.77"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reserve("b", "10.10.0.77"); !errors.Is(err, ErrIPConflict) {
+		t.Fatalf("expect conflict, got %v", err)
+	}
+	if err := s.Reserve("b", "10.10.1.1"); err == nil {
+		t.Fatalf("expect ip out of range to fail")
+	}
+	taken, _ := s.AssignIP(registerRequest("c"))
+	if err := s.Reserve("b", taken); !errors.Is(err, ErrIPConflict) {
+		t.Fatalf("expect leased ip to conflict, got %v", err)
+	}
+
+	// static 请求别的结点的固定地址
+	static := registerRequest("b")
+	static.NetConfig = models.NetConfig{Type: "ipv4", DHCPType: "static", IPv4: "10.10.0.77"}
+	if _, err := s.AssignIP(static); err == nil {
+		t.Fatalf("expect reserved ip not to be assigned to another node")
+	}
+	// static 请求了其它地址时仍然分配固定地址
+	static = registerRequest("a")
+	static.NetConfig = models.NetConfig{Type: "ipv4", DHCPType: "static", IPv4: "10.10.0.5"}
+	if ip, err := s.AssignIP(static); err != nil || ip != "10.10.0.77" {
+		t.Fatalf("expect reserved ip, got %s %v", ip, err)
+	}
+
+	a, resp, err := clientA.Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if resp.IPv4 != "10.10.0.77" {
+		t.Fatalf("expect reserved ip, got %s", resp.IPv4)
+	}
+
+	if arr, _ := store.Reservations("space1"); len(arr) != 1 {
+		t.Fatalf("expect reservation to be saved, got %+v", arr)
+	}
+	if err := s.Unreserve("a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Reservations()) != 0 {
+		t.Fatalf("expect reservation to be deleted")
+	}
+}
+
+func TestReserveReleasesLease(t *testing.T) {
+	store := newTestStore(t)
+	env := newTestEnv(t, models.SpaceItemConfig{}, WithStore(store))
+	s := env.space
+	leasesOf := func(nodeID string) []string {
+		var arr []string
+		for _, l := range s.Leases() {
+			if l.NodeID == nodeID {
+				arr = append(arr, l.IP)
+			}
+		}
+		return arr
+	}
+	waitOffline := func(nodeID string) {
+		t.Helper()
+		eventually(t, nodeID+" to go offline", func() bool { return nodeIDs(t, s, "offline")[nodeID] != nil })
+	}
+	req := func(nodeID string) *models.RegisterRequest {
+		r := registerRequest(nodeID)
+		r.NetConfig.Alive = time.Hour
+		return r
+	}
+
+	// 不在线的结点原来的租约立刻归还
+	clientA := env.client(t, "secret")
+	a, respA, err := clientA.Connect(req("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	waitOffline("a")
+	if err := s.Reserve("a", "10.10.0.90"); err != nil {
+		t.Fatal(err)
+	}
+	if arr := leasesOf("a"); len(arr) != 0 {
+		t.Fatalf("expect old lease to be released, got %v", arr)
+	}
+	if arr, _ := store.Leases("space1"); len(arr) != 0 {
+		t.Fatalf("expect old lease to be deleted from the store, got %+v", arr)
+	}
+	other := registerRequest("x")
+	other.NetConfig = models.NetConfig{Type: "ipv4", DHCPType: "static", IPv4: respA.IPv4}
+	if ip, err := s.AssignIP(other); err != nil || ip != respA.IPv4 {
+		t.Fatalf("expect old ip to be free, got %s %v", ip, err)
+	}
+
+	// 在线的结点继续使用原来的地址，重连拿到保留的地址时归还
+	clientB := env.client(t, "secret")
+	b, respB, err := clientB.Connect(req("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reserve("b", "10.10.0.91"); err != nil {
+		t.Fatal(err)
+	}
+	if arr := leasesOf("b"); len(arr) != 1 || arr[0] != respB.IPv4 {
+		t.Fatalf("expect lease of online node to be kept, got %v", arr)
+	}
+	b.Close()
+	waitOffline("b")
+	b, resp, err := clientB.Connect(req("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if resp.IPv4 != "10.10.0.91" {
+		t.Fatalf("expect reserved ip, got %s", resp.IPv4)
+	}
+	if arr := leasesOf("b"); len(arr) != 1 || arr[0] != "10.10.0.91" {
+		t.Fatalf("expect only the reserved lease, got %v", arr)
+	}
+}
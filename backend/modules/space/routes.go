@@ -0,0 +1,215 @@
+package space
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"spacenode/libs/models"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrRouteNotFound 结点没有通告这个网段
+	ErrRouteNotFound = errors.New("route not found")
+	// ErrRouteConflict 同一个网段已经批准给了其它结点
+	ErrRouteConflict = errors.New("route is approved for another node")
+)
+
+type routeKey struct {
+	nodeID string
+	prefix string
+}
+
+// checkRoute 检查结点通告的网段，不能与 space 自己的网段重叠，默认路由由出口结点提供
+func (s *Space) checkRoute(route string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(route)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	prefix = prefix.Masked()
+	if prefix.Bits() == 0 {
+		return netip.Prefix{}, errors.New("default route is not a subnet")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if prefix.Overlaps(s.ipPool.Prefix()) || (s.prefix6.IsValid() && prefix.Overlaps(s.prefix6)) {
+		return netip.Prefix{}, errors.New("overlaps the space subnet")
+	}
+	return prefix, nil
+}
+
+// advertise 记录结点注册时通告的网段，新的网段等待管理员批准，不再通告的网段删除
+func (s *Space) advertise(nodeID string, routes []string) {
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	want := make(map[string]bool)
+	for _, route := range routes {
+		prefix, err := s.checkRoute(route)
+		if err != nil {
+			logrus.Warnf("node %s: ignore route %s: %v", nodeID, route, err)
+			continue
+		}
+		want[prefix.String()] = true
+	}
+	changed := false
+	s.routes.Range(func(key routeKey, value *models.SubnetRoute) bool {
+		if key.nodeID == nodeID && !want[key.prefix] {
+			s.deleteRoute(key)
+			changed = changed || value.Approved
+		}
+		return true
+	})
+	for prefix := range want {
+		key := routeKey{nodeID: nodeID, prefix: prefix}
+		if _, ok := s.routes.Load(key); ok {
+			continue
+		}
+		r := &models.SubnetRoute{
+			SpaceID:   s.conf().ID,
+			NodeID:    nodeID,
+			Prefix:    prefix,
+			CreatedAt: time.Now(),
+		}
+		s.routes.Store(key, r)
+		s.saveRoute(r)
+		logrus.Infof("node %s advertised route %s, waiting for approval", nodeID, prefix)
+	}
+	if changed {
+		s.syncRoutes()
+		s.broadcastProfile()
+	}
+}
+
+// ApproveRoute 批准或者撤销结点通告的网段，批准之后发往这个网段的包转发给该结点
+// 同一个网段只能批准给一个结点，否则返回 ErrRouteConflict
+func (s *Space) ApproveRoute(nodeID, route string, approved bool) error {
+	prefix, err := netip.ParsePrefix(route)
+	if err != nil {
+		return fmt.Errorf("invalid route %q: %w", route, err)
+	}
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	key := routeKey{nodeID: nodeID, prefix: prefix.Masked().String()}
+	old, ok := s.routes.Load(key)
+	if !ok {
+		return fmt.Errorf("%w: %s of node %s", ErrRouteNotFound, key.prefix, nodeID)
+	}
+	if old.Approved == approved {
+		return nil
+	}
+	if approved {
+		var conflict error
+		s.routes.Range(func(k routeKey, value *models.SubnetRoute) bool {
+			if k.prefix == key.prefix && k.nodeID != nodeID && value.Approved {
+				conflict = fmt.Errorf("%w: %s via %s", ErrRouteConflict, k.prefix, k.nodeID)
+				return false
+			}
+			return true
+		})
+		if conflict != nil {
+			return conflict
+		}
+	}
+	r := *old
+	r.Approved = approved
+	s.routes.Store(key, &r)
+	s.saveRoute(&r)
+	s.syncRoutes()
+	s.broadcastProfile()
+	logrus.Infof("%s: route %s via node %s approved=%v", s.conf().ID, key.prefix, nodeID, approved)
+	return nil
+}
+
+// Routes 结点通告的全部网段，包括没有批准的
+func (s *Space) Routes() []*models.SubnetRoute {
+	arr := make([]*models.SubnetRoute, 0)
+	s.routes.Range(func(key routeKey, value *models.SubnetRoute) bool {
+		arr = append(arr, value)
+		return true
+	})
+	sort.Slice(arr, func(i, j int) bool {
+		if arr[i].NodeID != arr[j].NodeID {
+			return arr[i].NodeID < arr[j].NodeID
+		}
+		return arr[i].Prefix < arr[j].Prefix
+	})
+	return arr
+}
+
+// removeRoutes 结点被移除时删除它通告的网段和出口结点的记录
+func (s *Space) removeRoutes(nodeID string) {
+	s.routeMu.Lock()
+	defer s.routeMu.Unlock()
+	if _, ok := s.exitNodes.Load(nodeID); ok {
+		s.deleteExitNode(nodeID)
+	}
+	changed := false
+	s.routes.Range(func(key routeKey, value *models.SubnetRoute) bool {
+		if key.nodeID == nodeID {
+			s.deleteRoute(key)
+			changed = changed || value.Approved
+		}
+		return true
+	})
+	if changed {
+		s.syncRoutes()
+		s.broadcastProfile()
+	}
+}
+
+// approvedRoutes 批准的网段，key 为 NodeID
+func (s *Space) approvedRoutes() map[string][]string {
+	m := make(map[string][]string)
+	s.routes.Range(func(key routeKey, value *models.SubnetRoute) bool {
+		if value.Approved {
+			m[key.nodeID] = append(m[key.nodeID], key.prefix)
+		}
+		return true
+	})
+	return m
+}
+
+// hasRoutes 结点是否有批准的网段
+func (s *Space) hasRoutes(nodeID string) bool {
+	_, ok := s.approvedRoutes()[nodeID]
+	return ok
+}
+
+// syncRoutes 把批准的网段按在线结点当前的地址写入路由器
+func (s *Space) syncRoutes() {
+	table := make(map[netip.Prefix]string)
+	for nodeID, prefixes := range s.approvedRoutes() {
+		item, ok := s.nodes.Load(nodeID)
+		if !ok || item.Status() != NodeOnline {
+			continue
+		}
+		for _, p := range prefixes {
+			if prefix, err := netip.ParsePrefix(p); err == nil {
+				table[prefix] = item.IP()
+			}
+		}
+	}
+	s.router.SetRoutes(table)
+}
+
+func (s *Space) saveRoute(r *models.SubnetRoute) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.SaveRoute(r); err != nil {
+		logrus.Warnf("save route %s of node %s: %v", r.Prefix, r.NodeID, err)
+	}
+}
+
+func (s *Space) deleteRoute(key routeKey) {
+	s.routes.Delete(key)
+	if s.store == nil {
+		return
+	}
+	if err := s.store.DeleteRoute(s.conf().ID, key.nodeID, key.prefix); err != nil {
+		logrus.Warnf("delete route %s of node %s: %v", key.prefix, key.nodeID, err)
+	}
+}
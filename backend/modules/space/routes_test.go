@@ -0,0 +1,144 @@
+package space
+
+import (
+	"errors"
+	"slices"
+	"spacenode/libs/models"
+	"spacenode/libs/router"
+	"testing"
+	"time"
+)
+
+func TestSubnetRoute(t *testing.T) {
+	store := newTestStore(t)
+	env := newTestEnv(t, models.SpaceItemConfig{}, WithStore(store))
+	s := env.space
+
+	a, respA, err := env.client(t, "secret").Dial(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("dial a: %v", err)
+	}
+	defer a.Close()
+	profiles := make(chan *models.NetProfile, 4)
+	a.OnProfile = func(p *models.NetProfile) { profiles <- p }
+	reqB := registerRequest("b")
+	reqB.Routes = []string{"192.168.77.1/24", "10.10.0.128/25", "0.0.0.0/0"}
+	b, _, err := env.client(t, "secret").Connect(reqB)
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+	waitOnline(t, s, "a", "b")
+
+	// 与 space 网段重叠的和默认路由被忽略
+	routes := s.Routes()
+	if len(routes) != 1 || routes[0].Prefix != "192.168.77.0/24" || routes[0].Approved {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+	// 没有批准时丢弃
+	lan := ipv4Packet(t, respA.IPv4, "192.168.77.5")
+	if err := a.Session().WritePacket(lan); err != nil {
+		t.Fatal(err)
+	}
+	itemA, _ := s.nodes.Load("a")
+	eventually(t, "unapproved packet to be dropped", func() bool { return itemA.Traffic().Drops[router.DropNoRoute] == 1 })
+	lan[len(lan)-1] = '!'
+
+	if err := s.ApproveRoute("b", "192.168.77.0/24", true); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	select {
+	case p := <-profiles:
+		if !slices.Contains(p.Routes, "192.168.77.0/24") {
+			t.Fatalf("expect route in pushed profile, got %v", p.Routes)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expect profile update")
+	}
+	if p := s.profile("b"); slices.Contains(p.Routes, "192.168.77.0/24") {
+		t.Fatalf("advertising node should not route its own subnet")
+	}
+	if err := a.Session().WritePacket(lan); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPacket(t, b)
+	if err != nil || string(got) != string(lan) {
+		t.Fatalf("expect only the packet sent after approval to be forwarded: %v", err)
+	}
+	// 子网路由器可以转发网段内的地址发出的包
+	fromLAN := ipv4Packet(t, "192.168.77.5", respA.IPv4)
+	if err := b.WritePacket(fromLAN); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.Session().ReadPacket(); err != nil || string(got) != string(fromLAN) {
+		t.Fatalf("expect packet from the lan to reach a: %v", err)
+	}
+
+	// 同一个网段只能批准给一个结点
+	reqC := registerRequest("c")
+	reqC.Routes = []string{"192.168.77.0/24", "192.168.0.0/16"}
+	c, _, err := env.client(t, "secret").Connect(reqC)
+	if err != nil {
+		t.Fatalf("connect c: %v", err)
+	}
+	defer c.Close()
+	waitOnline(t, s, "c")
+	if err := s.ApproveRoute("c", "192.168.77.0/24", true); !errors.Is(err, ErrRouteConflict) {
+		t.Fatalf("expect conflict, got %v", err)
+	}
+	if err := s.ApproveRoute("c", "192.168.9.0/24", true); !errors.Is(err, ErrRouteNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	// 最长前缀优先
+	if err := s.ApproveRoute("c", "192.168.0.0/16", true); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if err := a.Session().WritePacket(lan); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPacket(t, b); err != nil || string(got) != string(lan) {
+		t.Fatalf("expect the longest prefix to win: %v", err)
+	}
+	other := ipv4Packet(t, respA.IPv4, "192.168.3.3")
+	if err := a.Session().WritePacket(other); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPacket(t, c); err != nil || string(got) != string(other) {
+		t.Fatalf("expect packet forwarded via the /16: %v", err)
+	}
+	// 源地址同样按最长前缀匹配，c 不能使用 b 的网段中的地址
+	if err := c.WritePacket(ipv4Packet(t, "192.168.77.9", respA.IPv4)); err != nil {
+		t.Fatal(err)
+	}
+	itemC, _ := s.nodes.Load("c")
+	eventually(t, "spoofed packet to be counted", func() bool { return itemC.Traffic().Drops[router.DropSpoofed] == 1 })
+
+	// 批准保存在 store 中
+	arr, _ := store.Routes("space1")
+	approved := 0
+	for _, r := range arr {
+		if r.Approved {
+			approved++
+		}
+	}
+	if len(arr) != 3 || approved != 2 {
+		t.Fatalf("unexpected stored routes %+v", arr)
+	}
+
+	// 撤销之后不再转发，移除结点时删除它的网段
+	if err := s.ApproveRoute("b", "192.168.77.0/24", false); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := a.Session().WritePacket(lan); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPacket(t, c); err != nil || string(got) != string(lan) {
+		t.Fatalf("expect the /16 to take over: %v", err)
+	}
+	if err := s.Remove(models.SpaceNode{NodeID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if arr, _ := store.Routes("space1"); len(arr) != 1 {
+		t.Fatalf("expect routes of removed node to be deleted, got %+v", arr)
+	}
+}
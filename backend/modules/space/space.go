@@ -4,46 +4,311 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"spacenode/libs/acl"
 	"spacenode/libs/ippool"
 	"spacenode/libs/models"
+	"spacenode/libs/protocol"
 	"spacenode/libs/router"
 	"spacenode/libs/syncmap"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const handshakeTimeout = 10 * time.Second
+
+// ErrUnauthorized 注册请求没有携带有效的凭证
+var ErrUnauthorized = errors.New("unauthorized")
+
+// TokenValidator 校验并消费 join token
+type TokenValidator interface {
+	Consume(spaceID string, token string) error
+}
+
+type NodeStatus string
+
+const (
+	NodeOnline  NodeStatus = "online"
+	NodeOffline NodeStatus = "offline"
+)
+
 type NodeItem struct {
 	Node models.SpaceNode `json:"node"`
-	IP   string           `json:"ip"`
+	// 分配到的地址，重新编址时可能在连接上换掉
+	addr atomic.Pointer[nodeAddr]
+	// 端到端加密的静态公钥
+	PublicKey    string `json:"public_key,omitempty"`
+	ephemeralKey string
+
+	// 连接断开或心跳超时之后为 offline
+	status atomic.Value
+	// 最后一次收到结点数据的时间，UnixNano
+	lastSeen atomic.Int64
+	rtt      atomic.Int64
+	// 租约的过期时间，UnixNano，跟随会话的租约为 0
+	leaseExpires atomic.Int64
+	// 分配地址时 space 的编址代数，注册期间重新编址过时断开结点
+	gen uint64
+	// 愿意作为出口结点，以及选择的出口结点
+	advertiseExit bool
+	exitNode      string
+	traffic       *traffic
+	// 结点发来了 FrameLeave，断开之后收回租约
+	left atomic.Bool
+}
+
+// nodeAddr 结点的 IPv4 和 IPv6 地址，没有分配 IPv6 时为空
+type nodeAddr struct {
+	ip, ip6 string
+}
+
+func newNodeItem(req *models.RegisterRequest, ip, ip6 string) *NodeItem {
+	item := &NodeItem{
+		Node:          req.SpaceNode,
+		PublicKey:     req.PublicKey,
+		ephemeralKey:  req.EphemeralKey,
+		advertiseExit: req.AdvertiseExit,
+		exitNode:      req.ExitNode,
+		traffic:       &traffic{},
+	}
+	item.setAddr(ip, ip6)
+	item.status.Store(NodeOnline)
+	item.touch()
+	return item
+}
+
+func (n *NodeItem) IP() string {
+	return n.addr.Load().ip
+}
+
+// IPv6 没有分配 IPv6 时为空
+func (n *NodeItem) IPv6() string {
+	return n.addr.Load().ip6
+}
+
+func (n *NodeItem) setAddr(ip, ip6 string) {
+	n.addr.Store(&nodeAddr{ip: ip, ip6: ip6})
+}
+
+// touch 收到结点的任何数据都算作存活
+func (n *NodeItem) touch() {
+	n.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (n *NodeItem) Status() NodeStatus {
+	return n.status.Load().(NodeStatus)
+}
+
+func (n *NodeItem) LastSeen() time.Time {
+	return time.Unix(0, n.lastSeen.Load())
+}
+
+// RTT 最近一次心跳的往返时间，没有测量过时为 0
+func (n *NodeItem) RTT() time.Duration {
+	return time.Duration(n.rtt.Load())
+}
+
+// setLease ttl 小于 0 时租约跟随会话
+func (n *NodeItem) setLease(ttl time.Duration) {
+	if ttl < 0 {
+		n.leaseExpires.Store(0)
+		return
+	}
+	n.leaseExpires.Store(time.Now().Add(ttl).UnixNano())
+}
+
+func (n *NodeItem) sessionLease() bool {
+	return n.leaseExpires.Load() == 0
+}
+
+// LeaseExpires 租约的过期时间，跟随会话的租约为零值
+func (n *NodeItem) LeaseExpires() time.Time {
+	v := n.leaseExpires.Load()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+func (n *NodeItem) MarshalJSON() ([]byte, error) {
+	type nodeItem struct {
+		Node      models.SpaceNode `json:"node"`
+		IP        string           `json:"ip"`
+		IPv6      string           `json:"ipv6,omitempty"`
+		PublicKey string           `json:"public_key,omitempty"`
+		Status    NodeStatus       `json:"status"`
+		LastSeen  time.Time        `json:"last_seen"`
+		// 毫秒
+		RTT float64 `json:"rtt"`
+		// 跟随会话的租约为空
+		LeaseExpires  *time.Time   `json:"lease_expires,omitempty"`
+		AdvertiseExit bool         `json:"advertise_exit,omitempty"`
+		ExitNode      string       `json:"exit_node,omitempty"`
+		Traffic       TrafficStats `json:"traffic"`
+	}
+	var leaseExpires *time.Time
+	if t := n.LeaseExpires(); !t.IsZero() {
+		leaseExpires = &t
+	}
+	return json.Marshal(&nodeItem{
+		Node:          n.Node,
+		IP:            n.IP(),
+		IPv6:          n.IPv6(),
+		PublicKey:     n.PublicKey,
+		Status:        n.Status(),
+		LastSeen:      n.LastSeen(),
+		RTT:           float64(n.RTT().Microseconds()) / 1000,
+		LeaseExpires:  leaseExpires,
+		AdvertiseExit: n.advertiseExit,
+		ExitNode:      n.exitNode,
+		Traffic:       n.Traffic(),
+	})
 }
 
 type Space struct {
+	// 保护运行时可以修改的配置、地址池和监听
+	mu     sync.RWMutex
 	config models.SpaceItemConfig
 	ipPool *ippool.IPPool
-	router *router.Router
-	nodes  syncmap.SyncMap[string, *NodeItem]
-	close  func()
-	ctx    context.Context
+	// 网关和 DNS 地址不分配给结点
+	gateway netip.Addr
+	dns     []netip.Addr
+	// 为空时不分配 IPv6 地址
+	prefix6 netip.Prefix
+	router  *router.Router
+	nodes   syncmap.SyncMap[string, *NodeItem]
+	// 在线结点的连接，key 为 NodeID
+	sessions syncmap.SyncMap[string, *protocol.Conn]
+	// 分配、续期和释放地址时持有读锁，SetConifg 迁移地址池时持有写锁
+	renumberMu sync.RWMutex
+	// 在连接上换地址、等待结点确认的连接
+	renumberAcks syncmap.SyncMap[*protocol.Conn, chan bool]
+	// 每次重新编址加一
+	netGen atomic.Uint64
+	// Listen 之后的 tcp 监听
+	lis net.Listener
+	// 为空时不提供 UDP 通道
+	udpConn     *net.UDPConn
+	udpSessions syncmap.SyncMap[protocol.SessionID, *udpSession]
+	close       func()
+	ctx         context.Context
+	// 为空时监听明文 tcp
+	tlsConfig *tls.Config
+	// 为空时不校验 join token
+	tokens TokenValidator
+	// 为空时不要求客户端证书
+	ca CertAuthority
+	// 心跳间隔，超过 heartbeatTimeout 没有收到结点的数据时断开
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	// 会话票据的签名密钥
+	ticketKey []byte
+	// 为空时租约和结点只保存在内存中
+	store Store
+	// key 为 IP
+	leases syncmap.SyncMap[string, *models.IPLease]
+	// key 为 NodeID
+	reservations syncmap.SyncMap[string, *models.IPReservation]
+	reserveMu    sync.Mutex
+	// 结点通告的网段
+	routes syncmap.SyncMap[routeKey, *models.SubnetRoute]
+	// 愿意作为出口结点的结点，key 为 NodeID
+	exitNodes syncmap.SyncMap[string, *models.ExitNode]
+	// 修改子网路由和出口结点的批准时持有
+	routeMu sync.Mutex
+	// NodeID -> 正在使用的出口结点的 ip
+	exits  map[string]string
+	exitMu sync.Mutex
+	// 访问控制，结点变化时重新编译
+	filter *acl.Filter
+	aclMu  sync.Mutex
+	// 在线结点的 ip -> 结点，用来统计路由器丢弃的包
+	addrs syncmap.SyncMap[string, *NodeItem]
+	// 注册成功和被拒绝的次数
+	registered atomic.Uint64
+	refused    atomic.Uint64
+	// 已经签发了证书但还没有注册的 NodeID
+	enrolling syncmap.SyncMap[string, struct{}]
+	// 抓包，key 为抓包的 ID
+	captures  syncmap.SyncMap[string, *captureItem]
+	captureMu sync.Mutex
 }
 
-func NewSpace(config models.SpaceItemConfig) (*Space, error) {
-	pl, err := ippool.NewIPPool(config.NetAddr, config.Mask)
+type Option func(*Space)
+
+// WithTLS 监听端使用 tls
+func WithTLS(cfg *tls.Config) Option {
+	return func(s *Space) {
+		s.tlsConfig = cfg
+	}
+}
+
+// WithTokenValidator 注册时要求有效的 join token
+func WithTokenValidator(v TokenValidator) Option {
+	return func(s *Space) {
+		s.tokens = v
+	}
+}
+
+func NewSpace(config models.SpaceItemConfig, opts ...Option) (*Space, error) {
+	if _, _, _, err := leasePolicy(config); err != nil {
+		return nil, err
+	}
+	if err := checkACL(config.ACL); err != nil {
+		return nil, err
+	}
+	if err := checkProfile(config); err != nil {
+		return nil, err
+	}
+	pl, gateway, dns, err := newPool(config)
+	if err != nil {
+		return nil, err
+	}
+	prefix6, err := parsePrefix6(config, pl.Prefix())
 	if err != nil {
 		return nil, err
 	}
 
+	ticketKey := make([]byte, 32)
+	if _, err := rand.Read(ticketKey); err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	sm := &Space{
-		config: config,
-		router: router.NewRouter(),
-		ipPool: pl,
-		ctx:    ctx,
-		close:  cancel,
+		config:            config,
+		router:            router.NewRouter(),
+		filter:            acl.NewFilter(),
+		ipPool:            pl,
+		gateway:           gateway,
+		dns:               dns,
+		prefix6:           prefix6,
+		ctx:               ctx,
+		close:             cancel,
+		heartbeatInterval: defaultHeartbeatInterval,
+		heartbeatTimeout:  defaultHeartbeatTimeout,
+		ticketKey:         ticketKey,
 	}
+	for _, opt := range opts {
+		opt(sm)
+	}
+	sm.router.SetSealedOnly(config.E2E)
+	if err := sm.restore(); err != nil {
+		return nil, fmt.Errorf("restore leases: %w", err)
+	}
+	sm.registerDNS()
+	sm.router.SetFilter(sm.filter)
+	sm.router.SetDropHandler(sm.dropped)
+	sm.reloadACL(false)
 	return sm, nil
 }
 
@@ -53,133 +318,538 @@ func (s *Space) Remove(r models.SpaceNode) error {
 	if !ok {
 		return fmt.Errorf("node %s not found", r.NodeID)
 	}
-	s.router.Remove(ni.IP)
+	s.router.Remove(ni.IP())
 	s.nodes.Delete(r.NodeID)
+	s.reloadACL(false)
+	// 移除的结点不再保留地址
+	s.renumberMu.RLock()
+	s.releaseLease(r.NodeID, ni.IP())
+	s.renumberMu.RUnlock()
+	s.deleteNode(r.NodeID)
+	s.removeRoutes(r.NodeID)
+	if ni.usesExit() {
+		s.syncExits()
+	}
 	return nil
 }
 
-// condition: {offline, online, all}
-func (s *Space) Nodelist() []*NodeItem {
+// condition: {offline, online, all}，为空时等同于 all
+func (s *Space) Nodelist(condition string) ([]*NodeItem, error) {
+	switch condition {
+	case "", "all", string(NodeOnline), string(NodeOffline):
+	default:
+		return nil, fmt.Errorf("unknown condition %q", condition)
+	}
 	arr := make([]*NodeItem, 0)
 	s.nodes.Range(func(key string, value *NodeItem) bool {
-		arr = append(arr, value)
+		if condition == "" || condition == "all" || string(value.Status()) == condition {
+			arr = append(arr, value)
+		}
 		return true
 	})
-	return arr
+	return arr, nil
 }
 
+// GetConifg 当前配置的副本
 func (s *Space) GetConifg() *models.SpaceItemConfig {
-	return &s.config
+	c := s.conf()
+	return &c
 }
 
-func (s *Space) SetConifg(sc models.SpaceItemConfig) {
-	// unimplemented
-	logrus.Fatalln("set config not implemented")
+func (s *Space) conf() models.SpaceItemConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+func (s *Space) pool() *ippool.IPPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ipPool
 }
 
 func (s *Space) Start() error {
-	logrus.Infoln("space manager start", "host:", s.config.Host, "port:", s.config.Port, "id:", s.config.ID)
-	lis, err := net.Listen("tcp4", fmt.Sprintf("%s:%d", s.config.Host, s.config.Port))
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen 监听 tcp 和 UDP 端口，之后由 Serve 接收连接
+// 端口为 0 时由系统分配，分配到的端口写回配置
+func (s *Space) Listen() error {
+	logrus.Infoln("space manager start", "host:", s.conf().Host, "port:", s.conf().Port, "id:", s.conf().ID)
+	lis, udpConn, port, err := s.listen(s.conf().Host, s.conf().Port)
 	if err != nil {
 		return err
 	}
-	defer lis.Close()
+	s.mu.Lock()
+	s.lis, s.udpConn = lis, udpConn
+	s.config.Port = port
+	s.mu.Unlock()
+	return nil
+}
+
+// listen 监听 tcp，UDP 使用与 tcp 相同的端口，返回实际监听的端口
+func (s *Space) listen(host string, port int) (net.Listener, *net.UDPConn, int, error) {
+	lis, err := net.Listen("tcp4", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	port = lis.Addr().(*net.TCPAddr).Port
+	// UDP 不可用时结点只走 tcp
+	udpConn, err := s.listenUDP(fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		logrus.Warnln("udp data path disabled:", err)
+	}
+	return lis, udpConn, port, nil
+}
 
+func (s *Space) listener() net.Listener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lis
+}
+
+// Serve 接收结点连接，直到 Stop，SetConifg 修改端口之后在新的监听上继续
+func (s *Space) Serve() error {
 	for {
-		select {
-		case <-s.ctx.Done():
-			logrus.Warnln("space manager stopped")
-			return nil
-		default:
+		lis := s.listener()
+		if lis == nil {
+			return errors.New("space is not listening")
 		}
 		conn, err := lis.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if s.listener() != lis {
+					continue
+				}
+				logrus.Warnln("space manager stopped")
+				return nil
+			}
 			logrus.Errorln("accpet", err)
 			continue
 		}
 
-		go func(conn net.Conn) {
-			// 1. 读配置
-			req := &models.RegisterRequest{}
-			reader := bufio.NewReader(conn)
-			writer := bufio.NewWriter(conn)
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				logrus.Errorln("read", err)
-				return
-			}
-			if err := json.NewDecoder(bytes.NewReader(line)).Decode(req); err != nil {
-				logrus.Errorln("json decode", err)
-				return
-			}
-			// 2. 处理客户端ip
-			ip, err := s.AssignIP(req)
-			if err != nil {
-				logrus.Errorln("assign ip", err)
-				return
-			}
-			respBf := bytes.NewBuffer(nil)
-			resp := &models.RegisterResp{
-				IPv4:  ip,
-				Alive: 30 * 24 * time.Hour,
-			}
-			if err := json.NewEncoder(respBf).Encode(resp); err != nil {
-				logrus.Errorln("json encode", err)
-				return
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn 处理一个结点连接，直到连接断开
+// conn 为原始连接，配置了 tls 时在上面做 tls 握手
+func (s *Space) ServeConn(conn net.Conn) {
+	if s.tlsConfig != nil {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	s.handleConn(conn)
+}
+
+func (s *Space) handleConn(conn net.Conn) {
+	defer conn.Close()
+	// tls 握手和注册需要在限定时间内完成
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+	if !protocol.IsHandshake(reader) {
+		s.serveLegacy(conn, reader)
+		return
+	}
+
+	// 1. 读握手和注册请求
+	pc, hreq, err := protocol.ServerHandshake(conn, reader)
+	if err != nil {
+		logrus.Errorln("handshake", conn.RemoteAddr(), err)
+		return
+	}
+	if hreq.Type == protocol.FrameEnroll {
+		s.enroll(conn, pc, hreq.Enroll)
+		return
+	}
+	req := hreq.Register
+	gen := s.netGen.Load()
+	if err := s.authorize(conn, req); err != nil {
+		logrus.Warnln("authorize", conn.RemoteAddr(), err)
+		s.refused.Add(1)
+		pc.Refuse(protocol.ErrCodeUnauthorized, err.Error())
+		return
+	}
+	if err := s.checkE2E(pc, req); err != nil {
+		logrus.Warnln("e2e", req.SpaceNode.NodeID, err)
+		s.refused.Add(1)
+		pc.Refuse(protocol.ErrCodeE2ERequired, err.Error())
+		return
+	}
+	// 2. 处理客户端ip，有票据时恢复原来的ip
+	ip, resumed := s.resume(req)
+	if !resumed {
+		ip, err = s.AssignIP(req)
+		if err != nil {
+			logrus.Errorln("assign ip", req.SpaceNode.NodeID, err)
+			s.refused.Add(1)
+			pc.Refuse(protocol.ErrCodeAssignFailed, err.Error())
+			return
+		}
+	}
+	req.SpaceNode.Domain = s.nodeDomain(req.SpaceNode)
+	// 3. 写回执
+	ttl := s.leaseTTL(req.NetConfig.Alive)
+	resp := &models.RegisterResp{
+		IPv4:    ip,
+		Alive:   ttl,
+		E2E:     s.conf().E2E,
+		Resumed: resumed,
+	}
+	s.setAddrs(resp, req)
+	if pc.HasCap(protocol.CapResume) {
+		if resp.Ticket, err = s.issueTicket(req.SpaceNode.NodeID, ip); err != nil {
+			logrus.Errorln("issue ticket", err)
+		}
+	}
+	if err := pc.Accept(resp); err != nil {
+		logrus.Errorln("write register resp", err)
+		s.renumberMu.RLock()
+		s.releaseIP(ip)
+		s.renumberMu.RUnlock()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.advertise(req.SpaceNode.NodeID, req.Routes)
+	s.advertiseExit(req.SpaceNode.NodeID, req.AdvertiseExit)
+	item := newNodeItem(req, ip, resp.IPv6)
+	item.gen = gen
+	item.setLease(ttl)
+	pc.OnControl = s.controlHandler(item, pc)
+
+	link := router.NewFrameLink(pc)
+	if pc.HasCap(protocol.CapUDP) && s.udp() != nil {
+		sess, err := s.newUDPSession(pc, item)
+		if err != nil {
+			logrus.Warnln("udp session", req.SpaceNode.NodeID, err)
+		} else {
+			defer s.udpSessions.Delete(sess.dg.SessionID())
+			link = &udpLink{Link: link, s: s, pc: pc, sess: sess}
+		}
+	}
+	s.serveNode(item, link, pc)
+}
+
+// controlHandler 处理结点在连接上发来的控制帧
+func (s *Space) controlHandler(item *NodeItem, pc *protocol.Conn) func(t protocol.FrameType, payload []byte) {
+	nodeID := item.Node.NodeID
+	return func(t protocol.FrameType, payload []byte) {
+		item.touch()
+		switch t {
+		case protocol.FramePing:
+			if err := pc.WriteFrame(protocol.FramePong, payload); err != nil {
+				logrus.Debugf("node %s: write pong: %v", nodeID, err)
 			}
-			respBf.WriteByte('\n')
-			_, err = conn.Write(respBf.Bytes())
-			if err != nil {
-				logrus.Errorln("write", err)
-				return
+		case protocol.FramePong:
+			s.pong(item, payload)
+		case protocol.FrameRenewCert:
+			s.renewCert(nodeID, pc, payload)
+		case protocol.FrameRenewLease:
+			s.renewLease(item, pc, payload)
+		case protocol.FrameLeave:
+			logrus.Infof("node %s: leaving, release %s", nodeID, item.IP())
+			item.left.Store(true)
+			pc.Close()
+		case protocol.FrameRenumberAck:
+			// 换完地址之后 awaitRenumber 再删除
+			if acked, ok := s.renumberAcks.Load(pc); ok {
+				select {
+				case acked <- true:
+				default:
+				}
 			}
-			// 4. 注册链接
-			s.router.Register(resp.IPv4, conn)
-			defer s.router.Remove(resp.IPv4)
-			// TODO: 心跳检测
-			// 3. 写回执
-			writer.Write(respBf.Bytes())
-			writer.WriteByte('\n')
-
-			s.nodes.Store(req.SpaceNode.NodeID, &NodeItem{
-				Node: req.SpaceNode,
-				IP:   resp.IPv4,
-			})
-			// 6: 路由
-			if err := s.router.Serve(resp.IPv4); err != nil {
-				logrus.Errorln("s router serve", req, " ", err)
-				return
+		default:
+			logrus.Debugf("node %s: unknown control frame %d", nodeID, t)
+		}
+	}
+}
+
+// serveLegacy 处理没有握手头的老版本客户端: 一行 json 请求，一行 json 回执
+func (s *Space) serveLegacy(conn net.Conn, reader *bufio.Reader) {
+	req := &models.RegisterRequest{}
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		logrus.Errorln("read", err)
+		return
+	}
+	if err := json.NewDecoder(bytes.NewReader(line)).Decode(req); err != nil {
+		logrus.Errorln("json decode", err)
+		return
+	}
+	if s.conf().E2E {
+		logrus.Warnln("legacy client", conn.RemoteAddr(), "refused: space requires e2e")
+		s.refused.Add(1)
+		return
+	}
+	if err := s.authorize(conn, req); err != nil {
+		logrus.Warnln("authorize", conn.RemoteAddr(), err)
+		s.refused.Add(1)
+		return
+	}
+	gen := s.netGen.Load()
+	ip, err := s.AssignIP(req)
+	if err != nil {
+		logrus.Errorln("assign ip", err)
+		s.refused.Add(1)
+		return
+	}
+	req.SpaceNode.Domain = s.nodeDomain(req.SpaceNode)
+	respBf := bytes.NewBuffer(nil)
+	ttl := s.leaseTTL(req.NetConfig.Alive)
+	resp := &models.RegisterResp{
+		IPv4:  ip,
+		Alive: ttl,
+	}
+	s.setAddrs(resp, req)
+	// Encode 自带换行
+	if err := json.NewEncoder(respBf).Encode(resp); err != nil {
+		logrus.Errorln("json encode", err)
+		return
+	}
+	if _, err := conn.Write(respBf.Bytes()); err != nil {
+		logrus.Errorln("write", err)
+		s.renumberMu.RLock()
+		s.releaseIP(ip)
+		s.renumberMu.RUnlock()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	item := newNodeItem(req, ip, resp.IPv6)
+	item.gen = gen
+	item.setLease(ttl)
+	s.serveNode(item, router.NewStreamLink(conn), nil)
+}
+
+// serveNode 注册链接并开始路由，直到连接断开
+// pc 为握手之后的连接，老版本客户端为空，老版本客户端没有心跳，只在连接断开时下线
+func (s *Space) serveNode(item *NodeItem, link router.Link, pc *protocol.Conn) {
+	ip := item.IP()
+	nodeID := item.Node.NodeID
+	// 同一个结点重连时旧连接可能还没有断开
+	if old, ok := s.sessions.Load(nodeID); ok && old != pc {
+		logrus.Infof("node %s reconnected, closing previous connection", nodeID)
+		old.Close()
+	}
+	// 重连之后沿用原来的计数
+	if old, ok := s.nodes.Load(nodeID); ok {
+		item.traffic = old.traffic
+	}
+	s.registered.Add(1)
+	link = &liveLink{Link: link, item: item}
+	var aliases []string
+	if item.IPv6() != "" {
+		aliases = append(aliases, item.IPv6())
+	}
+	s.router.Register(ip, link, aliases...)
+	defer s.router.Unregister(ip, link)
+	s.addrs.Store(ip, item)
+	defer func() {
+		// 结点可能在连接上换过地址
+		s.renumberMu.RLock()
+		s.addrs.CompareAndDelete(item.IP(), item)
+		s.renumberMu.RUnlock()
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	defer func() {
+		item.status.Store(NodeOffline)
+		if s.hasRoutes(nodeID) {
+			s.syncRoutes()
+		}
+		if item.usesExit() {
+			s.syncExits()
+		}
+		// 结点已被移除或者已经重连时不再写回
+		if cur, ok := s.nodes.Load(nodeID); !ok || cur != item {
+			return
+		}
+		s.renumberMu.RLock()
+		if item.sessionLease() || item.left.Load() {
+			s.releaseLease(nodeID, item.IP())
+		} else {
+			s.touchLease(nodeID, item.IP(), item.LastSeen())
+		}
+		s.renumberMu.RUnlock()
+		s.saveNode(item)
+	}()
+
+	s.nodes.Store(nodeID, item)
+	s.enrolling.Delete(nodeID)
+	s.reloadACL(false)
+	if s.hasRoutes(nodeID) {
+		s.syncRoutes()
+	}
+	// 分配地址之后 space 重新编址过，结点重连之后拿到新的地址
+	if s.netGen.Load() != item.gen {
+		logrus.Infof("node %s: space renumbered during registration, disconnecting", nodeID)
+		return
+	}
+	s.saveNode(item)
+	if pc != nil && pc.HasCap(protocol.CapHeartbeat) {
+		go s.heartbeat(item, pc)
+	}
+	if pc != nil && pc.HasCap(protocol.CapResume) {
+		go s.ticketLoop(item, pc)
+	}
+	if !item.sessionLease() {
+		go s.leaseLoop(item, link, done)
+	}
+	if pc != nil {
+		s.sessions.Store(nodeID, pc)
+		defer func() {
+			// 同一个结点重连之后旧连接才断开时，不能删掉新连接
+			if s.sessions.CompareAndDelete(nodeID, pc) {
+				s.broadcastPeers()
 			}
-		}(conn)
+		}()
+		s.broadcastPeers()
+	}
+	// 会话保存之后才能下发出口结点
+	if item.usesExit() {
+		s.syncExits()
 	}
+	// 路由
+	if err := s.router.Serve(item.IP()); err != nil {
+		logrus.Errorln("s router serve", item.Node, " ", err)
+		return
+	}
+}
 
+// setAddrs 在回执中填上网络配置、域名和 IPv6 地址
+func (s *Space) setAddrs(resp *models.RegisterResp, req *models.RegisterRequest) {
+	resp.NetProfile = s.profile(req.SpaceNode.NodeID)
+	resp.Domain = req.SpaceNode.Domain
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if wantIPv6(req) && s.prefix6.IsValid() {
+		resp.IPv6 = ipv6In(s.ipPool.Prefix(), s.prefix6, resp.IPv4)
+		resp.IPv6Bits = s.prefix6.Bits()
+	}
 }
 
 func (s *Space) AssignIP(req *models.RegisterRequest) (string, error) {
+	s.renumberMu.RLock()
+	defer s.renumberMu.RUnlock()
+	nodeID := req.SpaceNode.NodeID
+	ttl := s.leaseTTL(req.NetConfig.Alive)
+	// 管理员固定的地址优先于 auto 和 static
+	if ip, ok := s.reservedIP(nodeID); ok {
+		if s.ipInUse(nodeID, ip) {
+			return "", fmt.Errorf("reserved ip %s is used by another node", ip)
+		}
+		if err := s.renewIP(ip, ttl); err != nil {
+			return "", err
+		}
+		// 保留地址之前拿到的租约不再使用
+		s.releaseOtherLeases(nodeID, ip)
+		s.saveLease(nodeID, ip, ttl)
+		return ip, nil
+	}
 	if req.NetConfig.DHCPType == "auto" {
-		// 分配随机IP
-		ip, err := s.ipPool.Random(24 * 30 * time.Hour)
+		// 结点还有租约时沿用原来的IP
+		if ip, ok := s.leaseOf(nodeID); ok && nodeID != "" && !s.ipInUse(nodeID, ip) {
+			if err := s.renewIP(ip, ttl); err == nil {
+				s.saveLease(nodeID, ip, ttl)
+				return ip, nil
+			}
+		}
+		// 按 NodeID 的哈希分配，同一个结点总是优先拿到同一个IP
+		// 没有 NodeID 的老版本客户端分配随机IP
+		var ip netip.Addr
+		var err error
+		if nodeID != "" {
+			ip, err = s.pool().Preferred(nodeID, poolTTL(ttl))
+		} else {
+			ip, err = s.pool().Random(poolTTL(ttl))
+		}
 		if err != nil {
 			return "", err
 		}
+		s.saveLease(nodeID, ip.String(), ttl)
 		return ip.String(), nil
 	} else if req.NetConfig.DHCPType == "static" {
-		// 分配随机IP
-		bl, err := s.ipPool.RequestIP(req.NetConfig.IPv4, 24*30*time.Hour)
+		// 分配指定的IP
+		addr, err := netip.ParseAddr(req.NetConfig.IPv4)
+		if err != nil {
+			return "", fmt.Errorf("invalid ip %q", req.NetConfig.IPv4)
+		}
+		// 断开之后租约还在，同一个结点重连时续期
+		if ip, ok := s.leaseOf(nodeID); ok && nodeID != "" && ip == addr.String() && !s.ipInUse(nodeID, ip) {
+			if err := s.renewIP(ip, ttl); err != nil {
+				return "", err
+			}
+			s.saveLease(nodeID, ip, ttl)
+			return ip, nil
+		}
+		bl, err := s.pool().RequestIP(addr, poolTTL(ttl))
 		if err != nil {
 			return "", err
 		}
 		if !bl {
 			return "", fmt.Errorf("ip %s is already used", req.NetConfig.IPv4)
 		}
+		s.saveLease(nodeID, req.NetConfig.IPv4, ttl)
 		return req.NetConfig.IPv4, nil
 	}
-	return "", nil
+	return "", fmt.Errorf("unsupported dhcp type %q", req.NetConfig.DHCPType)
+}
+
+// renewIP 续期或者重新分配 ip，调用方负责确认 ip 属于该结点
+// ttl 小于 0 时租约跟随会话
+func (s *Space) renewIP(ip string, ttl time.Duration) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return err
+	}
+	return s.pool().Renew(addr, poolTTL(ttl))
+}
+
+// releaseIP 归还地址，保留的地址仍然保留
+func (s *Space) releaseIP(ip string) {
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		s.pool().CleanIP(addr)
+	}
+}
+
+// ipInUse ip 是否被 nodeID 之外的在线结点使用，或者保留给了其它结点
+func (s *Space) ipInUse(nodeID, ip string) bool {
+	used := false
+	s.reservations.Range(func(key string, value *models.IPReservation) bool {
+		if key != nodeID && value.IP == ip {
+			used = true
+			return false
+		}
+		return true
+	})
+	if used {
+		return true
+	}
+	s.nodes.Range(func(key string, value *NodeItem) bool {
+		if key != nodeID && value.IP() == ip && value.Status() == NodeOnline {
+			used = true
+			return false
+		}
+		return true
+	})
+	return used
 }
 
 func (s *Space) Stop() error {
+	// 关闭监听之后端口可以马上被新的 space 使用
+	s.mu.RLock()
+	lis, udpConn := s.lis, s.udpConn
+	s.mu.RUnlock()
+	if lis != nil {
+		lis.Close()
+	}
 	s.router.Stop()
+	s.stopCaptures()
+	if udpConn != nil {
+		udpConn.Close()
+	}
 	s.close()
-	logrus.Infof("%s: server stopped", s.config.ID)
+	logrus.Infof("%s: server stopped", s.conf().ID)
 	return nil
 }
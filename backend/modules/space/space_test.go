@@ -0,0 +1,447 @@
+package space
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"spacenode/libs/protocol"
+	"spacenode/libs/spaceca"
+	"spacenode/libs/spacetls"
+	"spacenode/modules/nodestore"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type testTokens struct{}
+
+func (testTokens) Consume(spaceID string, token string) error {
+	if token != "secret" {
+		return errors.New("bad token")
+	}
+	return nil
+}
+
+type testAuthority struct {
+	ca      *spaceca.CA
+	mu      sync.Mutex
+	revoked map[string]bool
+}
+
+func (a *testAuthority) Issue(spaceID string, nodeID string, csrPEM []byte) (*models.EnrollResp, error) {
+	if a.IsRevoked(nodeID) {
+		return nil, errors.New("revoked")
+	}
+	cert, err := a.ca.Sign(csrPEM, nodeID, spaceID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.EnrollResp{NodeID: nodeID, Cert: string(cert)}, nil
+}
+
+func (a *testAuthority) IsRevoked(nodeID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.revoked[nodeID]
+}
+
+func (a *testAuthority) revoke(nodeID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.revoked[nodeID] = true
+}
+
+type testEnv struct {
+	space       *Space
+	authority   *testAuthority
+	addr        string
+	wsURL       string
+	fingerprint string
+}
+
+// newTestEnv 启动一个带 tls、CA 和 join token 的 space
+func newTestEnv(t *testing.T, config models.SpaceItemConfig, opts ...Option) *testEnv {
+	t.Helper()
+	return newTestEnvIn(t, t.TempDir(), config, opts...)
+}
+
+// newTestEnvIn 证书和 CA 保存在 dir 中，用来模拟服务端重启
+func newTestEnvIn(t *testing.T, dir string, config models.SpaceItemConfig, opts ...Option) *testEnv {
+	t.Helper()
+	cert, err := spacetls.LoadOrCreateServerCert(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, _ := spacetls.CertFingerprint(cert)
+	ca, err := spaceca.LoadOrCreate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority := &testAuthority{ca: ca, revoked: map[string]bool{}}
+
+	if config.ID == "" {
+		config.ID = "space1"
+	}
+	if config.NetAddr == "" {
+		config.NetAddr = "10.10.0.0"
+		config.Mask = "255.255.255.0"
+	}
+	opts = append([]Option{
+		WithTLS(ca.ServerConfig(cert)),
+		WithTokenValidator(testTokens{}),
+		WithCertAuthority(authority),
+	}, opts...)
+	s, err := NewSpace(config, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeConn(conn)
+		}
+	}()
+	ws := httptest.NewServer(s.WebSocketHandler())
+	t.Cleanup(func() {
+		lis.Close()
+		ws.Close()
+		s.Stop()
+	})
+	return &testEnv{
+		space:       s,
+		authority:   authority,
+		addr:        lis.Addr().String(),
+		wsURL:       "ws" + strings.TrimPrefix(ws.URL, "http"),
+		fingerprint: fp,
+	}
+}
+
+func (e *testEnv) client(t *testing.T, token string) *nodeclient.Client {
+	t.Helper()
+	id, err := spaceca.LoadIdentity(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &nodeclient.Client{
+		Server:      e.addr,
+		Fingerprint: e.fingerprint,
+		Token:       token,
+		Identity:    id,
+		Log:         logrus.WithField("test", t.Name()),
+	}
+}
+
+func registerRequest(nodeID string) *models.RegisterRequest {
+	return &models.RegisterRequest{
+		SpaceNode: models.SpaceNode{NodeID: nodeID, NodeType: models.NodeTypeClient},
+		NetConfig: models.NetConfig{Type: "ipv4", DHCPType: "auto"},
+	}
+}
+
+func ipv4Packet(t *testing.T, src, dst string) []byte {
+	t.Helper()
+	return udpPacket(t, src, dst, 1000, 2000)
+}
+
+func udpPacket(t *testing.T, src, dst string, sport, dport layers.UDPPort) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP(dst),
+	}
+	udp := &layers.UDP{SrcPort: sport, DstPort: dport}
+	udp.SetNetworkLayerForChecksum(ip)
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func ipv6Packet(t *testing.T, src, dst string) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP(src),
+		DstIP:      net.ParseIP(dst),
+	}
+	udp := &layers.UDP{SrcPort: 1000, DstPort: 2000}
+	udp.SetNetworkLayerForChecksum(ip)
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readPacket 在超时之前读到一个数据包
+func readPacket(t *testing.T, pc *nodeclient.Session) ([]byte, error) {
+	t.Helper()
+	type result struct {
+		pkt []byte
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		pkt, err := pc.ReadPacket()
+		ch <- result{pkt, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.pkt, r.err
+	case <-time.After(3 * time.Second):
+		return nil, errors.New("timeout")
+	}
+}
+
+// rawConnect 用已申请证书的身份直接握手，不回复心跳
+func (e *testEnv) rawConnect(t *testing.T, nodeID string) (*protocol.Conn, *models.RegisterResp) {
+	t.Helper()
+	client := e.client(t, "secret")
+	if err := client.Enroll(nodeID); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	cfg, err := spacetls.ClientConfig(e.fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.GetClientCertificate = client.Identity.GetClientCertificate
+	conn, err := tls.Dial("tcp", e.addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, resp, err := protocol.Handshake(conn, registerRequest(nodeID))
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc, resp
+}
+
+// eventually 等待 cond 成立
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitOnline 等待结点上线，注册了路由并且可以下发控制消息
+func waitOnline(t *testing.T, s *Space, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		eventually(t, id+" to be online", func() bool {
+			item, ok := s.nodes.Load(id)
+			if !ok || item.Status() != NodeOnline {
+				return false
+			}
+			cur, ok := s.addrs.Load(item.IP())
+			_, connected := s.sessions.Load(id)
+			return ok && cur == item && connected
+		})
+	}
+}
+
+// waitPeers 等待每个结点都收到了其它结点的公钥
+func waitPeers(t *testing.T, sessions map[string]*nodeclient.Session) {
+	t.Helper()
+	for from, sess := range sessions {
+		for ip := range sessions {
+			if ip != from {
+				eventually(t, "public key of "+ip, func() bool { return sess.HasPeer(ip) })
+			}
+		}
+	}
+}
+
+func nodeIDs(t *testing.T, s *Space, condition string) map[string]*NodeItem {
+	t.Helper()
+	list, err := s.Nodelist(condition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]*NodeItem)
+	for _, v := range list {
+		ids[v.Node.NodeID] = v
+	}
+	return ids
+}
+
+func newTestStore(t *testing.T) Store {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "space.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&models.IPLease{}, &models.NodeRecord{}, &models.IPReservation{}, &models.SubnetRoute{}, &models.ExitNode{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return nodestore.NewStore(db)
+}
+
+func leaseOwners(s *Space) map[string]bool {
+	owners := make(map[string]bool)
+	for _, l := range s.Leases() {
+		owners[l.NodeID] = true
+	}
+	return owners
+}
+
+func TestRegisterAndForward(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+
+	if _, _, err := env.client(t, "wrong").Connect(registerRequest("a")); err == nil {
+		t.Fatalf("expect enrollment with a wrong token to fail")
+	}
+
+	a, respA, err := env.client(t, "secret").Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("connect a: %v", err)
+	}
+	defer a.Close()
+	b, respB, err := env.client(t, "secret").Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+
+	waitOnline(t, env.space, "a", "b")
+	pkt := ipv4Packet(t, respA.IPv4, respB.IPv4)
+	if err := a.WritePacket(pkt); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got, err := readPacket(t, b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(pkt) {
+		t.Fatalf("forwarded packet differs")
+	}
+}
+
+func TestRevokedNodeIsDisconnected(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+
+	client := env.client(t, "secret")
+	pc, _, err := client.Connect(registerRequest("laptop"))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer pc.Close()
+	waitOnline(t, env.space, "laptop")
+
+	env.authority.revoke("laptop")
+	if err := env.space.Remove(models.SpaceNode{NodeID: "laptop"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := readPacket(t, pc); err == nil {
+		t.Fatalf("expect revoked node to be disconnected")
+	}
+
+	_, _, err = client.Connect(registerRequest("laptop"))
+	var refused *protocol.RefusedError
+	if !errors.As(err, &refused) || refused.Code != protocol.ErrCodeUnauthorized {
+		t.Fatalf("expect revoked node to be refused, got %v", err)
+	}
+}
+
+func TestEnrollExistingNode(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+
+	owner := env.client(t, "secret")
+	pc, resp, err := owner.Connect(registerRequest("laptop"))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer pc.Close()
+
+	// 拿到 join token 也不能冒充已有的结点
+	var refused *protocol.RefusedError
+	_, _, err = env.client(t, "secret").Connect(registerRequest("laptop"))
+	if !errors.As(err, &refused) || refused.Code != protocol.ErrCodeUnauthorized {
+		t.Fatalf("expect enrollment of an existing node id to be refused, got %v", err)
+	}
+	if item := nodeIDs(t, env.space, "online")["laptop"]; item == nil || item.IP() != resp.IPv4 {
+		t.Fatalf("expect the owner to stay online, got %v", item)
+	}
+	// 持有当前证书的结点可以重新申请
+	if err := owner.Enroll("laptop"); err != nil {
+		t.Fatalf("expect the owner to re-enroll, got %v", err)
+	}
+
+	// 申请了证书还没有注册的 NodeID 同样被占用
+	if err := env.client(t, "secret").Enroll("phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.client(t, "secret").Enroll("phone"); !errors.As(err, &refused) {
+		t.Fatalf("expect enrolling node id to be refused, got %v", err)
+	}
+	// token 无效时不占用
+	if err := env.client(t, "bad").Enroll("tablet"); err == nil {
+		t.Fatal("expect bad token to fail")
+	}
+	if err := env.client(t, "secret").Enroll("tablet"); err != nil {
+		t.Fatalf("expect failed enrollment to release the node id, got %v", err)
+	}
+}
+
+func TestCertOfAnotherSpace(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+
+	// 同一个 CA 给其它 space 签发的证书
+	client := env.client(t, "")
+	csr, err := client.Identity.CSR("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := env.authority.ca.Sign(csr, "laptop", "space2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Identity.SetCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.Connect(registerRequest("laptop"))
+	var refused *protocol.RefusedError
+	if !errors.As(err, &refused) || refused.Code != protocol.ErrCodeUnauthorized {
+		t.Fatalf("expect certificate of another space to be refused, got %v", err)
+	}
+	// 也不能用来证明自己持有已有的 NodeID
+	if _, _, err := env.client(t, "secret").Connect(registerRequest("laptop")); err != nil {
+		t.Fatal(err)
+	}
+	client.Token = "secret"
+	if err := client.Enroll("laptop"); !errors.As(err, &refused) {
+		t.Fatalf("expect enrollment with certificate of another space to be refused, got %v", err)
+	}
+}
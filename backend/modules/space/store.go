@@ -0,0 +1,223 @@
+package space
+
+import (
+	"net/netip"
+	"spacenode/libs/models"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Store 持久化 IP 租约和结点记录，为空时只保存在内存中，重启之后丢失
+type Store interface {
+	Leases(spaceID string) ([]*models.IPLease, error)
+	SaveLease(l *models.IPLease) error
+	DeleteLease(spaceID string, ip string) error
+	Nodes(spaceID string) ([]*models.NodeRecord, error)
+	SaveNode(n *models.NodeRecord) error
+	DeleteNode(spaceID string, nodeID string) error
+	Reservations(spaceID string) ([]*models.IPReservation, error)
+	SaveReservation(r *models.IPReservation) error
+	DeleteReservation(spaceID string, nodeID string) error
+	Routes(spaceID string) ([]*models.SubnetRoute, error)
+	SaveRoute(r *models.SubnetRoute) error
+	DeleteRoute(spaceID string, nodeID string, prefix string) error
+	ExitNodes(spaceID string) ([]*models.ExitNode, error)
+	SaveExitNode(e *models.ExitNode) error
+	DeleteExitNode(spaceID string, nodeID string) error
+}
+
+// WithStore 启动时恢复租约和结点，之后的变更写回 store
+func WithStore(st Store) Option {
+	return func(s *Space) {
+		s.store = st
+	}
+}
+
+// restore 从 store 恢复租约和结点，恢复的结点为 offline
+func (s *Space) restore() error {
+	if s.store == nil {
+		return nil
+	}
+	leases, err := s.store.Leases(s.conf().ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, l := range leases {
+		// 跟随会话的租约在服务端重启时已经失效
+		if l.Session || !now.Before(l.ExpiresAt) {
+			s.deleteLease(l.IP)
+			continue
+		}
+		addr, err := netip.ParseAddr(l.IP)
+		if err == nil {
+			err = s.pool().Restore(addr, l.ExpiresAt)
+		}
+		if err != nil {
+			logrus.Warnf("restore lease %s of node %s: %v", l.IP, l.NodeID, err)
+			continue
+		}
+		s.leases.Store(l.IP, l)
+	}
+
+	// 租约恢复之后再保留地址，保留的地址可能正被它的结点使用
+	reservations, err := s.store.Reservations(s.conf().ID)
+	if err != nil {
+		return err
+	}
+	for _, r := range reservations {
+		addr, err := netip.ParseAddr(r.IP)
+		if err == nil {
+			err = s.pool().Reserve(addr)
+		}
+		if err != nil {
+			logrus.Warnf("restore reservation %s of node %s: %v", r.IP, r.NodeID, err)
+			continue
+		}
+		s.reservations.Store(r.NodeID, r)
+	}
+
+	routes, err := s.store.Routes(s.conf().ID)
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		s.routes.Store(routeKey{r.NodeID, r.Prefix}, r)
+	}
+	exitNodes, err := s.store.ExitNodes(s.conf().ID)
+	if err != nil {
+		return err
+	}
+	for _, e := range exitNodes {
+		s.exitNodes.Store(e.NodeID, e)
+	}
+
+	nodes, err := s.store.Nodes(s.conf().ID)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		item := &NodeItem{
+			Node: models.SpaceNode{
+				SpaceID:  n.SpaceID,
+				NodeID:   n.NodeID,
+				NodeType: n.NodeType,
+				AppID:    n.AppID,
+				Service:  n.Service,
+				Domain:   n.Domain,
+			},
+			PublicKey: n.PublicKey,
+			traffic:   &traffic{},
+		}
+		item.setAddr(n.IP, "")
+		item.status.Store(NodeOffline)
+		item.lastSeen.Store(n.LastSeen.UnixNano())
+		s.nodes.Store(n.NodeID, item)
+	}
+	logrus.Infof("%s: restored %d leases and %d nodes", s.conf().ID, len(leases), len(nodes))
+	return nil
+}
+
+// Leases 当前有效的租约，包括离线结点的租约
+func (s *Space) Leases() []*models.IPLease {
+	arr := make([]*models.IPLease, 0)
+	now := time.Now()
+	s.leases.Range(func(key string, value *models.IPLease) bool {
+		if now.Before(value.ExpiresAt) {
+			arr = append(arr, value)
+		}
+		return true
+	})
+	return arr
+}
+
+// leaseOf 结点还没有过期的租约
+func (s *Space) leaseOf(nodeID string) (string, bool) {
+	var ip string
+	now := time.Now()
+	s.leases.Range(func(key string, value *models.IPLease) bool {
+		if value.NodeID == nodeID && now.Before(value.ExpiresAt) {
+			ip = key
+			return false
+		}
+		return true
+	})
+	return ip, ip != ""
+}
+
+// saveLease 记录 ip 分配给了 nodeID，ttl 小于 0 时租约跟随会话
+func (s *Space) saveLease(nodeID, ip string, ttl time.Duration) {
+	now := time.Now()
+	l := &models.IPLease{
+		SpaceID:   s.conf().ID,
+		IP:        ip,
+		NodeID:    nodeID,
+		ExpiresAt: now.Add(poolTTL(ttl)),
+		Session:   ttl < 0,
+		LastSeen:  now,
+	}
+	s.leases.Store(ip, l)
+	if s.store == nil {
+		return
+	}
+	if err := s.store.SaveLease(l); err != nil {
+		logrus.Warnf("save lease %s of node %s: %v", ip, nodeID, err)
+	}
+}
+
+// touchLease 更新租约的最后在线时间，租约已经属于其它结点时不更新
+func (s *Space) touchLease(nodeID, ip string, seen time.Time) {
+	old, ok := s.leases.Load(ip)
+	if !ok || old.NodeID != nodeID {
+		return
+	}
+	l := *old
+	l.LastSeen = seen
+	s.leases.Store(ip, &l)
+	if s.store == nil {
+		return
+	}
+	if err := s.store.SaveLease(&l); err != nil {
+		logrus.Warnf("save lease %s of node %s: %v", ip, nodeID, err)
+	}
+}
+
+func (s *Space) deleteLease(ip string) {
+	s.leases.Delete(ip)
+	if s.store == nil {
+		return
+	}
+	if err := s.store.DeleteLease(s.conf().ID, ip); err != nil {
+		logrus.Warnf("delete lease %s: %v", ip, err)
+	}
+}
+
+func (s *Space) saveNode(item *NodeItem) {
+	if s.store == nil {
+		return
+	}
+	rec := &models.NodeRecord{
+		SpaceID:   s.conf().ID,
+		NodeID:    item.Node.NodeID,
+		NodeType:  item.Node.NodeType,
+		AppID:     item.Node.AppID,
+		Service:   item.Node.Service,
+		Domain:    item.Node.Domain,
+		IP:        item.IP(),
+		PublicKey: item.PublicKey,
+		LastSeen:  item.LastSeen(),
+	}
+	if err := s.store.SaveNode(rec); err != nil {
+		logrus.Warnf("save node %s: %v", item.Node.NodeID, err)
+	}
+}
+
+func (s *Space) deleteNode(nodeID string) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.DeleteNode(s.conf().ID, nodeID); err != nil {
+		logrus.Warnf("delete node %s: %v", nodeID, err)
+	}
+}
@@ -0,0 +1,97 @@
+package space
+
+import (
+	"fmt"
+	"spacenode/libs/models"
+	"testing"
+	"time"
+)
+
+func TestPersistence(t *testing.T) {
+	store := newTestStore(t)
+	dir := t.TempDir()
+	env := newTestEnvIn(t, dir, models.SpaceItemConfig{}, WithStore(store))
+	clientA := env.client(t, "secret")
+	a, respA, err := clientA.Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("connect a: %v", err)
+	}
+	a.Close()
+	eventually(t, "a to go offline", func() bool { return nodeIDs(t, env.space, "offline")["a"] != nil })
+	env.space.Stop()
+
+	// 服务端重启
+	env = newTestEnvIn(t, dir, models.SpaceItemConfig{}, WithStore(store))
+	item, ok := nodeIDs(t, env.space, "offline")["a"]
+	if !ok || item.IP() != respA.IPv4 {
+		t.Fatalf("expect offline node a with ip %s, got %v", respA.IPv4, item)
+	}
+	leases := env.space.Leases()
+	if len(leases) != 1 || leases[0].NodeID != "a" || leases[0].IP != respA.IPv4 {
+		t.Fatalf("unexpected leases: %+v", leases)
+	}
+
+	// 其它结点拿不到 a 的地址
+	for i := 0; i < 20; i++ {
+		ip, err := env.space.AssignIP(registerRequest(fmt.Sprintf("n%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip == respA.IPv4 {
+			t.Fatalf("ip %s of offline node is assigned to another node", ip)
+		}
+	}
+	// 服务端重启之后证书仍然有效
+	clientA.Server = env.addr
+	a, resp, err := clientA.Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("reconnect a: %v", err)
+	}
+	defer a.Close()
+	if resp.IPv4 != respA.IPv4 {
+		t.Fatalf("expect ip %s after restart, got %s", respA.IPv4, resp.IPv4)
+	}
+
+	if err := env.space.Remove(models.SpaceNode{NodeID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "removed node to be deleted", func() bool {
+		nodes, _ := store.Nodes("space1")
+		return len(nodes) == 0
+	})
+}
+
+func TestStaticReconnect(t *testing.T) {
+	store := newTestStore(t)
+	dir := t.TempDir()
+	env := newTestEnvIn(t, dir, models.SpaceItemConfig{}, WithStore(store))
+	client := env.client(t, "secret")
+	req := registerRequest("a")
+	req.NetConfig = models.NetConfig{Type: "ipv4", DHCPType: "static", IPv4: "10.10.0.50", Alive: time.Hour}
+	connect := func() {
+		t.Helper()
+		a, resp, err := client.Connect(req)
+		if err != nil {
+			t.Fatalf("connect a: %v", err)
+		}
+		if resp.IPv4 != "10.10.0.50" {
+			t.Fatalf("expect static ip, got %s", resp.IPv4)
+		}
+		a.Close()
+		eventually(t, "a to go offline", func() bool { return nodeIDs(t, env.space, "offline")["a"] != nil })
+	}
+	// 断开之后租约保留，不带票据重连仍然拿到同一个地址
+	connect()
+	connect()
+	// 服务端重启之后从存储恢复租约
+	env.space.Stop()
+	env = newTestEnvIn(t, dir, models.SpaceItemConfig{}, WithStore(store))
+	client.Server = env.addr
+	connect()
+	// 其它结点不能使用这个地址
+	other := registerRequest("b")
+	other.NetConfig = req.NetConfig
+	if _, err := env.space.AssignIP(other); err == nil {
+		t.Fatalf("expect leased static ip to be refused for another node")
+	}
+}
@@ -0,0 +1,140 @@
+package space
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 票据的有效期，连接期间每隔一半的有效期下发新票据
+const ticketTTL = 10 * time.Minute
+
+var errInvalidTicket = errors.New("invalid session ticket")
+
+// ticket 会话票据，结点断线之后用它恢复原来的 IP
+//
+//	base64url(json) "." base64url(HMAC-SHA256(json))
+//
+// 密钥在 space 启动时随机生成，重启之后旧票据失效
+type ticket struct {
+	SpaceID string `json:"space_id"`
+	NodeID  string `json:"node_id"`
+	IP      string `json:"ip"`
+	Expires int64  `json:"expires"`
+}
+
+func (s *Space) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, s.ticketKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (s *Space) issueTicket(nodeID, ip string) (string, error) {
+	data, err := json.Marshal(&ticket{
+		SpaceID: s.conf().ID,
+		NodeID:  nodeID,
+		IP:      ip,
+		Expires: time.Now().Add(ticketTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(data) + "." + enc.EncodeToString(s.sign(data)), nil
+}
+
+// parseTicket 校验票据，票据必须属于 nodeID
+func (s *Space) parseTicket(v string, nodeID string) (*ticket, error) {
+	payload, sig, ok := strings.Cut(v, ".")
+	if !ok {
+		return nil, errInvalidTicket
+	}
+	enc := base64.RawURLEncoding
+	data, err := enc.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidTicket
+	}
+	mac, err := enc.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.sign(data)) {
+		return nil, errInvalidTicket
+	}
+	t := &ticket{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, errInvalidTicket
+	}
+	if t.SpaceID != s.conf().ID || t.NodeID != nodeID {
+		return nil, fmt.Errorf("%w: issued for another node", errInvalidTicket)
+	}
+	if time.Now().Unix() > t.Expires {
+		return nil, fmt.Errorf("%w: expired", errInvalidTicket)
+	}
+	return t, nil
+}
+
+// resume 用票据恢复结点原来的 IP，IP 已经被其它在线结点占用时返回 false
+func (s *Space) resume(req *models.RegisterRequest) (string, bool) {
+	if req.Ticket == "" {
+		return "", false
+	}
+	nodeID := req.SpaceNode.NodeID
+	t, err := s.parseTicket(req.Ticket, nodeID)
+	if err != nil {
+		logrus.Infof("node %s cannot resume: %v", nodeID, err)
+		return "", false
+	}
+	s.renumberMu.RLock()
+	defer s.renumberMu.RUnlock()
+	if ip, ok := s.reservedIP(nodeID); ok && ip != t.IP {
+		logrus.Infof("node %s has a reservation, not resuming ip %s", nodeID, t.IP)
+		return "", false
+	}
+	// 重新编址之后租约已经换到了新的地址
+	if ip, ok := s.leaseOf(nodeID); ok && ip != t.IP {
+		logrus.Infof("node %s has moved to %s, not resuming ip %s", nodeID, ip, t.IP)
+		return "", false
+	}
+	if s.ipInUse(nodeID, t.IP) {
+		logrus.Warnf("node %s cannot resume: ip %s is used by another node", nodeID, t.IP)
+		return "", false
+	}
+	ttl := s.leaseTTL(req.NetConfig.Alive)
+	if err := s.renewIP(t.IP, ttl); err != nil {
+		logrus.Warnf("node %s cannot resume ip %s: %v", nodeID, t.IP, err)
+		return "", false
+	}
+	s.saveLease(nodeID, t.IP, ttl)
+	logrus.Infof("node %s resumed with ip %s", nodeID, t.IP)
+	return t.IP, true
+}
+
+// ticketLoop 在票据过期之前下发新票据，连接关闭后退出
+func (s *Space) ticketLoop(item *NodeItem, pc *protocol.Conn) {
+	ticker := time.NewTicker(ticketTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pc.Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t, err := s.issueTicket(item.Node.NodeID, item.IP())
+		if err != nil {
+			logrus.Errorln("issue ticket", err)
+			continue
+		}
+		if err := pc.WriteJSON(protocol.FrameTicket, &models.SessionTicket{Ticket: t}); err != nil {
+			logrus.Debugf("node %s: write ticket: %v", item.Node.NodeID, err)
+		}
+	}
+}
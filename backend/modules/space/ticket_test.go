@@ -0,0 +1,78 @@
+package space
+
+import (
+	"spacenode/libs/models"
+	"testing"
+	"time"
+)
+
+func TestResume(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+
+	a, respA, err := env.client(t, "secret").Dial(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("dial a: %v", err)
+	}
+	defer a.Close()
+	reconnected := make(chan *models.RegisterResp, 1)
+	a.OnReconnect = func(resp *models.RegisterResp) { reconnected <- resp }
+	if respA.Ticket == "" {
+		t.Fatalf("expect a session ticket")
+	}
+	b, respB, err := env.client(t, "secret").Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+	waitOnline(t, env.space, "a", "b")
+	old, _ := env.space.nodes.Load("a")
+
+	// 模拟网络中断
+	a.Session().Conn.Close()
+	select {
+	case resp := <-reconnected:
+		if !resp.Resumed || resp.IPv4 != respA.IPv4 {
+			t.Fatalf("expect ip %s to be resumed, got %+v", respA.IPv4, resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for reconnect")
+	}
+	eventually(t, "resumed session", func() bool {
+		item, _ := env.space.nodes.Load("a")
+		return item != old
+	})
+	waitOnline(t, env.space, "a")
+
+	pkt := ipv4Packet(t, respB.IPv4, respA.IPv4)
+	if err := b.WritePacket(pkt); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got, err := a.ReadPacket()
+	if err != nil || string(got) != string(pkt) {
+		t.Fatalf("read after resume: %v", err)
+	}
+}
+
+func TestTicket(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+	s := env.space
+
+	v, err := s.issueTicket("a", "10.10.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk, err := s.parseTicket(v, "a"); err != nil || tk.IP != "10.10.0.5" {
+		t.Fatalf("parse ticket: %v", err)
+	}
+	if _, err := s.parseTicket(v, "b"); err == nil {
+		t.Fatalf("expect ticket of another node to be rejected")
+	}
+	if _, err := s.parseTicket("x"+v, "a"); err == nil {
+		t.Fatalf("expect tampered ticket to be rejected")
+	}
+	// 其它 space 签发的票据
+	other := newTestEnv(t, models.SpaceItemConfig{})
+	if _, err := other.space.parseTicket(v, "a"); err == nil {
+		t.Fatalf("expect ticket signed by another key to be rejected")
+	}
+}
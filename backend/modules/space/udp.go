@@ -0,0 +1,166 @@
+package space
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"spacenode/libs/models"
+	"spacenode/libs/protocol"
+	"spacenode/libs/router"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 超过这个时间没有收到结点的数据报，发往结点的包回退到 tcp
+const udpIdleTimeout = 30 * time.Second
+
+// udpSession 一个结点的 UDP 数据通道，结点的地址以最后一个有效数据报为准
+type udpSession struct {
+	item     *NodeItem
+	dg       *protocol.Datagram
+	addr     atomic.Pointer[net.UDPAddr]
+	lastSeen atomic.Int64
+}
+
+func (u *udpSession) active() bool {
+	return u.addr.Load() != nil && time.Since(time.Unix(0, u.lastSeen.Load())) < udpIdleTimeout
+}
+
+// listenUDP 接收结点的数据报，与 tcp 使用相同的端口
+func (s *Space) listenUDP(addr string) (*net.UDPConn, error) {
+	ua, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", ua)
+	if err != nil {
+		return nil, err
+	}
+	go s.serveUDP(conn)
+	return conn, nil
+}
+
+// udp 当前的 UDP 监听，没有时为空
+func (s *Space) udp() *net.UDPConn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.udpConn
+}
+
+func (s *Space) serveUDP(conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.Errorln("read udp", err)
+			continue
+		}
+		sid, err := protocol.DatagramSessionID(buf[:n])
+		if err != nil {
+			continue
+		}
+		sess, ok := s.udpSessions.Load(sid)
+		if !ok {
+			continue
+		}
+		t, payload, err := sess.dg.Open(buf[:n])
+		if err != nil {
+			logrus.Debugf("drop datagram from %s: %v", addr, err)
+			continue
+		}
+		sess.addr.Store(addr)
+		sess.lastSeen.Store(time.Now().UnixNano())
+		sess.item.touch()
+
+		switch t {
+		case protocol.FrameUDPPing:
+			if err := s.writeUDP(sess, protocol.FrameUDPPong, nil); err != nil {
+				logrus.Debugf("write udp pong to %s: %v", addr, err)
+			}
+		case protocol.FramePacket:
+			sess.item.traffic.received(len(payload))
+			s.router.Route(sess.item.IP(), router.PacketIP, payload)
+		case protocol.FrameSealed:
+			sess.item.traffic.received(len(payload))
+			s.router.Route(sess.item.IP(), router.PacketSealed, payload)
+		}
+	}
+}
+
+func (s *Space) writeUDP(sess *udpSession, t protocol.FrameType, payload []byte) error {
+	data, err := sess.dg.Seal(t, payload)
+	if err != nil {
+		return err
+	}
+	conn := s.udp()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	_, err = conn.WriteToUDP(data, sess.addr.Load())
+	return err
+}
+
+// newUDPSession 生成会话和密钥，通过 tcp 下发给结点
+func (s *Space) newUDPSession(pc *protocol.Conn, item *NodeItem) (*udpSession, error) {
+	conn := s.udp()
+	if conn == nil {
+		return nil, net.ErrClosed
+	}
+	var sid protocol.SessionID
+	if _, err := rand.Read(sid[:]); err != nil {
+		return nil, err
+	}
+	key := make([]byte, protocol.DatagramKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	dg, err := protocol.NewDatagram(sid, key, true)
+	if err != nil {
+		return nil, err
+	}
+	sess := &udpSession{item: item, dg: dg}
+	s.udpSessions.Store(sid, sess)
+
+	err = pc.WriteJSON(protocol.FrameUDPSession, &models.UDPSession{
+		SessionID: hex.EncodeToString(sid[:]),
+		Key:       base64.StdEncoding.EncodeToString(key),
+		Port:      conn.LocalAddr().(*net.UDPAddr).Port,
+	})
+	if err != nil {
+		s.udpSessions.Delete(sid)
+		return nil, err
+	}
+	return sess, nil
+}
+
+// udpLink 结点的 UDP 通道可用时发往结点的包走 UDP，否则走 tcp
+type udpLink struct {
+	router.Link
+	s    *Space
+	pc   *protocol.Conn
+	sess *udpSession
+}
+
+func (l *udpLink) WritePacket(t router.PacketType, pkt []byte) error {
+	if !l.sess.active() {
+		return l.Link.WritePacket(t, pkt)
+	}
+	ft := protocol.FramePacket
+	if t == router.PacketSealed {
+		if !l.pc.HasCap(protocol.CapE2E) {
+			return router.ErrUnsupported
+		}
+		ft = protocol.FrameSealed
+	}
+	if err := l.s.writeUDP(l.sess, ft, pkt); err != nil {
+		return l.Link.WritePacket(t, pkt)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package space
+
+import (
+	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"testing"
+)
+
+// listenUDP 在随机端口上开启 UDP 通道
+func (e *testEnv) listenUDP(t *testing.T) {
+	t.Helper()
+	conn, err := e.space.listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.space.udpConn = conn
+}
+
+// waitUDP 等待 UDP 通道可用
+func waitUDP(t *testing.T, sessions ...*nodeclient.Session) {
+	t.Helper()
+	for _, sess := range sessions {
+		eventually(t, "udp data path", sess.UDPActive)
+	}
+}
+
+func TestUDPForward(t *testing.T) {
+	for _, e2e := range []bool{false, true} {
+		env := newTestEnv(t, models.SpaceItemConfig{E2E: e2e})
+		env.listenUDP(t)
+
+		a, respA, err := env.client(t, "secret").Connect(registerRequest("a"))
+		if err != nil {
+			t.Fatalf("connect a: %v", err)
+		}
+		defer a.Close()
+		b, respB, err := env.client(t, "secret").Connect(registerRequest("b"))
+		if err != nil {
+			t.Fatalf("connect b: %v", err)
+		}
+		defer b.Close()
+		waitUDP(t, a, b)
+		waitOnline(t, env.space, "a", "b")
+		waitPeers(t, map[string]*nodeclient.Session{respA.IPv4: a, respB.IPv4: b})
+
+		pkt := ipv4Packet(t, respA.IPv4, respB.IPv4)
+		if err := a.WritePacket(pkt); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		got, err := readPacket(t, b)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != string(pkt) {
+			t.Fatalf("forwarded packet differs")
+		}
+	}
+}
+
+func TestUDPFallback(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+	env.listenUDP(t)
+	// UDP 被拦截
+	env.space.udpConn.Close()
+
+	a, respA, err := env.client(t, "secret").Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("connect a: %v", err)
+	}
+	defer a.Close()
+	b, respB, err := env.client(t, "secret").Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+	waitOnline(t, env.space, "a", "b")
+	if a.UDPActive() || b.UDPActive() {
+		t.Fatalf("expect udp to be inactive")
+	}
+
+	pkt := ipv4Packet(t, respA.IPv4, respB.IPv4)
+	if err := a.WritePacket(pkt); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got, err := readPacket(t, b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(pkt) {
+		t.Fatalf("forwarded packet differs")
+	}
+}
@@ -0,0 +1,20 @@
+package space
+
+import (
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketHandler 通过 http 入口接入结点，用于只能访问 https 的网络
+// ws 连接上的数据与 tcp 端口完全相同，包括 tls，因此客户端证书和指纹校验都不受 https 代理影响
+func (s *Space) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		// 客户端不是浏览器，不校验 Origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			s.ServeConn(ws)
+		},
+	}
+}
@@ -0,0 +1,45 @@
+package space
+
+import (
+	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"testing"
+)
+
+func TestWebSocket(t *testing.T) {
+	env := newTestEnv(t, models.SpaceItemConfig{})
+
+	// 通过 ws 申请证书并注册，与 tcp 上的结点互通
+	wsClient := env.client(t, "secret")
+	wsClient.Server = env.wsURL
+	a, respA, err := wsClient.Connect(registerRequest("a"))
+	if err != nil {
+		t.Fatalf("connect over websocket: %v", err)
+	}
+	defer a.Close()
+	b, respB, err := env.client(t, "secret").Connect(registerRequest("b"))
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	defer b.Close()
+	waitOnline(t, env.space, "a", "b")
+
+	for _, c := range []struct {
+		from, to *nodeclient.Session
+		pkt      []byte
+	}{
+		{a, b, ipv4Packet(t, respA.IPv4, respB.IPv4)},
+		{b, a, ipv4Packet(t, respB.IPv4, respA.IPv4)},
+	} {
+		if err := c.from.WritePacket(c.pkt); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		got, err := readPacket(t, c.to)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != string(c.pkt) {
+			t.Fatalf("forwarded packet differs")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package spacehttp
+
+import (
+	"errors"
+	"fmt"
+	"spacenode/libs/capture"
+	"spacenode/modules/space"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// captureOptions 从参数中读取抓包的过滤条件和限制，duration 为秒，省略时使用默认值
+func captureOptions(ctx *gin.Context) (capture.Options, error) {
+	opts := capture.Options{Filter: ctx.Query("filter")}
+	if _, err := capture.Compile(opts.Filter); err != nil {
+		return opts, fmt.Errorf("invalid filter: %w", err)
+	}
+	var duration, snaplen int64
+	for name, v := range map[string]*int64{
+		"duration":    &duration,
+		"max_bytes":   &opts.MaxBytes,
+		"max_packets": &opts.MaxPackets,
+		"snaplen":     &snaplen,
+	} {
+		q := ctx.Query(name)
+		if q == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(q, 10, 64)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s %q", name, q)
+		}
+		*v = n
+	}
+	opts.Duration = time.Duration(duration) * time.Second
+	opts.SnapLen = int(snaplen)
+	return opts, nil
+}
+
+func captureError(ctx *gin.Context, err error) {
+	code := 400
+	switch {
+	case errors.Is(err, space.ErrCaptureNotFound):
+		code = 404
+	case errors.Is(err, space.ErrCaptureRunning):
+		code = 409
+	case errors.Is(err, space.ErrTooManyCaptures):
+		code = 429
+	}
+	ctx.JSON(code, gin.H{"error": err.Error()})
+}
+
+// streamWriter 第一次写入时才发送头部，开始之前出错还可以返回 json
+type streamWriter struct {
+	ctx *gin.Context
+	// 下载的文件名
+	name    string
+	started bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.ctx.Header("Content-Type", "application/vnd.tcpdump.pcap")
+		w.ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pcapng"`, w.name))
+		w.ctx.Status(200)
+	}
+	return w.ctx.Writer.Write(p)
+}
+
+func (w *streamWriter) Flush() {
+	w.ctx.Writer.Flush()
+}
+
+// 抓包，nodeid 为空时抓整个 space 的包，结果为 pcapng，链路类型为裸 IP
+func (s *Server) registerCapture(group *gin.RouterGroup) {
+	group.GET("/list", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, sp.Captures())
+	})
+
+	// 在后台抓包，结束之后通过 download 下载
+	group.POST("/start", func(ctx *gin.Context) {
+		opts, err := captureOptions(ctx)
+		if err != nil {
+			ctx.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		info, err := sp.StartCapture(ctx.Query("nodeid"), opts)
+		if err != nil {
+			captureError(ctx, err)
+			return
+		}
+		ctx.JSON(200, info)
+	})
+
+	// 边抓边下载，断开连接时结束，比如 curl ... | wireshark -k -i -
+	group.GET("/stream", func(ctx *gin.Context) {
+		opts, err := captureOptions(ctx)
+		if err != nil {
+			ctx.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		w := &streamWriter{ctx: ctx, name: sp.GetConifg().ID}
+		if err := sp.StreamCapture(ctx.Request.Context(), w, ctx.Query("nodeid"), opts); err != nil && !w.started {
+			captureError(ctx, err)
+		}
+	})
+
+	group.POST("/stop", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		if err := sp.StopCapture(ctx.Query("id")); err != nil {
+			captureError(ctx, err)
+			return
+		}
+		ctx.JSON(200, gin.H{"message": "stop capture success"})
+	})
+
+	group.GET("/download", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		id := ctx.Query("id")
+		path, err := sp.CaptureFile(id)
+		if err != nil {
+			captureError(ctx, err)
+			return
+		}
+		ctx.Header("Content-Type", "application/vnd.tcpdump.pcap")
+		ctx.FileAttachment(path, id+".pcapng")
+	})
+
+	group.POST("/delete", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		if err := sp.DeleteCapture(ctx.Query("id")); err != nil {
+			captureError(ctx, err)
+			return
+		}
+		ctx.JSON(200, gin.H{"message": "delete capture success"})
+	})
+}
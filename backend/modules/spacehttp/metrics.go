@@ -0,0 +1,122 @@
+package spacehttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"spacenode/libs/router"
+	"spacenode/modules/space"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter 按 Prometheus 文本格式输出，同一个指标的样本需要写在一起
+type promWriter struct {
+	w *bufio.Writer
+}
+
+// family 写指标的 HELP 和 TYPE
+func (p *promWriter) family(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample labels 为成对的名字和值
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			fmt.Fprintf(p.w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		p.w.WriteByte('}')
+	}
+	fmt.Fprintf(p.w, " %v\n", value)
+}
+
+// writeMetrics 输出所有 space 的指标
+func writeMetrics(w io.Writer, all []space.Metrics) error {
+	p := &promWriter{w: bufio.NewWriter(w)}
+
+	p.family("spacenode_registrations_total", "counter", "Node registrations by result, including reconnects.")
+	for _, m := range all {
+		p.sample("spacenode_registrations_total", float64(m.Registrations), "space", m.ID, "result", "accepted")
+		p.sample("spacenode_registrations_total", float64(m.Refused), "space", m.ID, "result", "refused")
+	}
+	p.family("spacenode_sessions", "gauge", "Nodes currently online.")
+	for _, m := range all {
+		p.sample("spacenode_sessions", float64(m.Sessions), "space", m.ID)
+	}
+	p.family("spacenode_pool_size", "gauge", "Addresses the pool can assign.")
+	for _, m := range all {
+		p.sample("spacenode_pool_size", float64(m.PoolSize), "space", m.ID)
+	}
+	p.family("spacenode_pool_used", "gauge", "Addresses assigned or reserved.")
+	for _, m := range all {
+		p.sample("spacenode_pool_used", float64(m.PoolUsed), "space", m.ID)
+	}
+	p.family("spacenode_pool_utilization", "gauge", "Fraction of the pool in use.")
+	for _, m := range all {
+		var ratio float64
+		if m.PoolSize > 0 {
+			ratio = float64(m.PoolUsed) / float64(m.PoolSize)
+		}
+		p.sample("spacenode_pool_utilization", ratio, "space", m.ID)
+	}
+	p.family("spacenode_acl_denied_total", "counter", "Packets denied by the access control policy.")
+	for _, m := range all {
+		p.sample("spacenode_acl_denied_total", float64(m.ACLDenied), "space", m.ID)
+	}
+
+	p.family("spacenode_node_packets_total", "counter", "Packets received from (rx) and written to (tx) a node.")
+	for _, m := range all {
+		for _, n := range m.Nodes {
+			p.sample("spacenode_node_packets_total", float64(n.Traffic.RxPackets), "space", m.ID, "node", n.NodeID, "direction", "rx")
+			p.sample("spacenode_node_packets_total", float64(n.Traffic.TxPackets), "space", m.ID, "node", n.NodeID, "direction", "tx")
+		}
+	}
+	p.family("spacenode_node_bytes_total", "counter", "Bytes received from (rx) and written to (tx) a node.")
+	for _, m := range all {
+		for _, n := range m.Nodes {
+			p.sample("spacenode_node_bytes_total", float64(n.Traffic.RxBytes), "space", m.ID, "node", n.NodeID, "direction", "rx")
+			p.sample("spacenode_node_bytes_total", float64(n.Traffic.TxBytes), "space", m.ID, "node", n.NodeID, "direction", "tx")
+		}
+	}
+	p.family("spacenode_node_drops_total", "counter", "Packets from a node dropped by the router, by reason.")
+	for _, m := range all {
+		for _, n := range m.Nodes {
+			reasons := make([]string, 0, len(n.Traffic.Drops))
+			for r := range n.Traffic.Drops {
+				reasons = append(reasons, string(r))
+			}
+			sort.Strings(reasons)
+			for _, r := range reasons {
+				p.sample("spacenode_node_drops_total", float64(n.Traffic.Drops[router.DropReason(r)]), "space", m.ID, "node", n.NodeID, "reason", r)
+			}
+		}
+	}
+	return p.w.Flush()
+}
+
+// metrics Prometheus 抓取的接口，包括所有 space
+func (s *Server) metrics(ctx *gin.Context) {
+	var all []space.Metrics
+	for _, cfg := range s.spaces.List() {
+		sp, err := s.spaces.Get(cfg.ID)
+		if err != nil {
+			continue
+		}
+		all = append(all, sp.Metrics())
+	}
+	ctx.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	ctx.Status(200)
+	if err := writeMetrics(ctx.Writer, all); err != nil {
+		ctx.Error(err)
+	}
+}
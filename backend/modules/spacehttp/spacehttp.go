@@ -1,61 +1,114 @@
 package spacehttp
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"spacenode/libs/lzcutils"
 	"spacenode/libs/models"
+	"spacenode/libs/spaceca"
+	"spacenode/libs/spacetls"
+	"spacenode/libs/subnet"
 	"spacenode/modules/appaider"
 	"spacenode/modules/db"
+	"spacenode/modules/jointoken"
 	"spacenode/modules/lzcapp"
+	"spacenode/modules/nodeca"
 	"spacenode/modules/space"
+	"spacenode/modules/spacemanager"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
+// defaultSpaceID 第一次启动时创建的 space，请求没有 spaceid 参数时使用
+const defaultSpaceID = "space1"
+
 type Server struct {
-	engin        *gin.Engine
-	port         int
-	spaceManager *space.Space
-	appAider     appaider.AppAider
-	lzcapp       lzcapp.LzcAppManager
+	engin     *gin.Engine
+	port      int
+	spaces    spacemanager.Manager
+	appAider  appaider.AppAider
+	lzcapp    lzcapp.LzcAppManager
+	tokens    jointoken.Manager
+	authority nodeca.Authority
 }
 
-func NewServer(port int) (*Server, error) {
+// tlsDir 保存 space 监听端的证书，e2e 开启结点之间的端到端加密
+// network 为默认 space 的网段，为空时使用 subnet.Default
+// e2e 和 network 只在第一次启动、数据库中还没有 space 时生效，之后通过 /spaces 接口修改
+func NewServer(port int, tlsDir string, e2e bool, network string) (*Server, error) {
 	lzcm, err := lzcapp.NewLzcAppManager()
 	if err != nil {
 		logrus.Errorf("failed to init lzcapp manager: %v", err)
 		return nil, err
 	}
 
-	// WARN: 目前是写死的，因为没有必要的过早进行 扩展式的设计
-	sm, err := space.NewSpace(models.SpaceItemConfig{
+	cert, err := spacetls.LoadOrCreateServerCert(tlsDir, []string{"host.lzcapp", os.Getenv("LAZYCAT_APP_DOMAIN")})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	fingerprint, err := spacetls.CertFingerprint(cert)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infoln("space server fingerprint:", fingerprint)
+
+	tokens := jointoken.NewManager(db.DB())
+	ca, err := spaceca.LoadOrCreate(tlsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node ca: %w", err)
+	}
+	authority, err := nodeca.NewAuthority(db.DB(), ca)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := subnet.Pick(network)
+	if err != nil {
+		return nil, err
+	}
+
+	spaces, err := spacemanager.NewManager(db.DB(), fingerprint,
+		space.WithTLS(ca.ServerConfig(cert)),
+		space.WithTokenValidator(tokens),
+		space.WithCertAuthority(authority),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := spaces.Ensure(models.SpaceItemConfig{
 		Port:    59393,
 		Host:    "host.lzcapp",
-		ID:      "space1",
-		NetAddr: "172.168.1.0",
-		Mask:    "255.255.255.0",
-	})
-	if err != nil {
+		ID:      defaultSpaceID,
+		NetAddr: prefix.Addr().String(),
+		Mask:    subnet.Mask(prefix),
+		E2E:     e2e,
+	}); err != nil {
+		spaces.Stop()
 		return nil, err
 	}
-	go func() {
-		defer sm.Stop()
-		if err := sm.Start(); err != nil {
-			logrus.Errorln("space manager start failed: ", err)
+	aa, err := appaider.NewAppAider(db.DB(), lzcm, func(spaceID string) (models.SpaceItemConfig, error) {
+		sp, err := spaces.Get(spaceID)
+		if err != nil {
+			return models.SpaceItemConfig{}, err
 		}
-	}()
-	aa, err := appaider.NewAppAider(db.DB(), lzcm)
+		return *sp.GetConifg(), nil
+	}, tokens)
 	if err != nil {
+		spaces.Stop()
 		return nil, err
 	}
 	s := &Server{
-		engin:        gin.Default(),
-		port:         port,
-		lzcapp:       lzcm,
-		appAider:     aa,
-		spaceManager: sm,
+		engin:     gin.Default(),
+		port:      port,
+		lzcapp:    lzcm,
+		appAider:  aa,
+		spaces:    spaces,
+		tokens:    tokens,
+		authority: authority,
 	}
 	s.register()
 	return s, nil
@@ -65,10 +118,22 @@ func (s *Server) Start() error {
 	return s.engin.Run(fmt.Sprintf(":%d", s.port))
 }
 
+// space 请求中 spaceid 参数对应的 space，不存在时返回 404
+func (s *Server) space(ctx *gin.Context) (*space.Space, bool) {
+	sp, err := s.spaces.Get(ctx.DefaultQuery("spaceid", defaultSpaceID))
+	if err != nil {
+		ctx.JSON(404, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return sp, true
+}
+
 func (s *Server) register() {
 	s.registerSpaceManager(s.engin.Group("space"))
+	s.registerSpaces(s.engin.Group("spaces"))
 	s.registerAppAider(s.engin.Group("app"))
 	s.registerLzcApp(s.engin.Group("lzcapp"))
+	s.engin.GET("/metrics", s.metrics)
 }
 
 func (s *Server) registerLzcApp(group *gin.RouterGroup) {
@@ -83,22 +148,429 @@ func (s *Server) registerLzcApp(group *gin.RouterGroup) {
 	})
 }
 
+// 创建、修改和删除 space，配置保存在数据库中
+func (s *Server) registerSpaces(group *gin.RouterGroup) {
+	group.GET("/list", func(ctx *gin.Context) {
+		ctx.JSON(200, s.spaces.List())
+	})
+
+	// 请求体为 SpaceItemConfig，没有 net_addr 时自动选择网段
+	group.POST("/create", func(ctx *gin.Context) {
+		var cfg models.SpaceItemConfig
+		if err := ctx.ShouldBindJSON(&cfg); err != nil {
+			ctx.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		created, err := s.spaces.Create(cfg)
+		if err != nil {
+			code := 400
+			if errors.Is(err, spacemanager.ErrExists) {
+				code = 409
+			}
+			ctx.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, created)
+	})
+
+	// 在运行中修改配置，网段变化时地址变化的结点会重新编址，修改 e2e 会重启 space
+	// 请求体中没有的字段沿用当前的配置
+	group.POST("/update", func(ctx *gin.Context) {
+		body, err := ctx.GetRawData()
+		if err != nil {
+			ctx.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		var target struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(body, &target); err != nil || target.ID == "" {
+			ctx.JSON(400, gin.H{"error": "space id is required"})
+			return
+		}
+		if err := s.spaces.Patch(target.ID, body); err != nil {
+			code := 400
+			if errors.Is(err, spacemanager.ErrNotFound) {
+				code = 404
+			}
+			ctx.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, gin.H{"message": "update space success"})
+	})
+
+	group.POST("/delete", func(ctx *gin.Context) {
+		spaceID := ctx.Query("spaceid")
+		if spaceID == "" {
+			ctx.JSON(400, gin.H{"error": "spaceid is required"})
+			return
+		}
+		if err := s.spaces.Delete(spaceID); err != nil {
+			code := 500
+			if errors.Is(err, spacemanager.ErrNotFound) {
+				code = 404
+			}
+			ctx.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+		s.authority.Forget(spaceID)
+		ctx.JSON(200, gin.H{"message": "delete space success"})
+	})
+}
+
+// 以下接口都通过 spaceid 参数指定 space，默认为 space1
 func (s *Server) registerSpaceManager(group *gin.RouterGroup) {
+	// status=online|offline|all，默认 all
 	group.GET("/list", func(ctx *gin.Context) {
-		ctx.JSON(200, s.spaceManager.Nodelist())
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		nodes, err := sp.Nodelist(ctx.Query("status"))
+		if err != nil {
+			ctx.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, nodes)
+	})
+	// 地址租约，包括离线结点的租约
+	group.GET("/leases", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, sp.Leases())
+	})
+	// 地址池的网关、DNS 和每个范围的使用情况
+	group.GET("/pool", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, sp.PoolStats())
 	})
-	// 后期待改成 拿对应spaceid的config
 	group.GET("/config", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		conf := sp.GetConifg()
 		cfg := fmt.Sprintf(`space_config:
-    port: 59393
-    host: %s`, os.Getenv("LAZYCAT_APP_DOMAIN"))
+    port: %d
+    host: %s
+    fingerprint: %s`, conf.Port, os.Getenv("LAZYCAT_APP_DOMAIN"), conf.Fingerprint)
 		ctx.String(200, cfg)
 	})
+
+	// 结点通过 https 入口接入: wss://<域名>/api/space/ws?spaceid=<id>
+	group.GET("/ws", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		sp.WebSocketHandler().ServeHTTP(ctx.Writer, ctx.Request)
+	})
+
+	s.registerReservation(group.Group("reservation"))
+	s.registerRoute(group.Group("route"))
+	s.registerExit(group.Group("exit"))
+	s.registerACL(group.Group("acl"))
+	s.registerCapture(group.Group("capture"))
+	s.registerJoinToken(group.Group("token"))
+	s.registerNodeCA(group.Group("node"))
+}
+
+func (s *Server) registerNodeCA(group *gin.RouterGroup) {
+	group.GET("/revoked", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		nodes, err := s.authority.ListRevoked(sp.GetConifg().ID)
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, nodes)
+	})
+
+	// 吊销之后结点立刻断开，并且不能再申请证书和注册
+	group.POST("/revoke", func(ctx *gin.Context) {
+		nodeid := ctx.Query("nodeid")
+		if nodeid == "" {
+			ctx.JSON(400, gin.H{"error": "nodeid is required"})
+			return
+		}
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		if err := s.authority.Revoke(sp.GetConifg().ID, nodeid, ctx.Query("reason")); err != nil {
+			ctx.JSON(500, gin.H{"error": err.Error()})
+			logrus.Errorf("revoke node error: %v", err)
+			return
+		}
+		// 吊销对所有 space 生效，结点在哪个 space 中都要断开
+		for _, cfg := range s.spaces.List() {
+			other, err := s.spaces.Get(cfg.ID)
+			if err != nil {
+				continue
+			}
+			if err := other.Remove(models.SpaceNode{NodeID: nodeid}); err != nil && other == sp {
+				logrus.Warnf("revoke node %s: %v", nodeid, err)
+			}
+		}
+		ctx.JSON(200, gin.H{"message": "revoke node success"})
+	})
+}
+
+// 为结点固定地址，结点下次注册时生效
+func (s *Server) registerReservation(group *gin.RouterGroup) {
+	group.GET("/list", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, sp.Reservations())
+	})
+
+	group.POST("/create", func(ctx *gin.Context) {
+		nodeid := ctx.Query("nodeid")
+		ip := ctx.Query("ip")
+		if nodeid == "" || ip == "" {
+			ctx.JSON(400, gin.H{"error": "nodeid and ip are required"})
+			return
+		}
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		if err := sp.Reserve(nodeid, ip); err != nil {
+			code := 400
+			if errors.Is(err, space.ErrIPConflict) {
+				code = 409
+			}
+			ctx.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, gin.H{"message": "reserve ip success"})
+	})
+
+	group.POST("/delete", func(ctx *gin.Context) {
+		nodeid := ctx.Query("nodeid")
+		if nodeid == "" {
+			ctx.JSON(400, gin.H{"error": "nodeid is required"})
+			return
+		}
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		if err := sp.Unreserve(nodeid); err != nil {
+			ctx.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, gin.H{"message": "delete reservation success"})
+	})
+}
+
+// 结点通告的网段，管理员批准之后生效
+func (s *Server) registerRoute(group *gin.RouterGroup) {
+	group.GET("/list", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, sp.Routes())
+	})
+
+	approve := func(approved bool) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			nodeid := ctx.Query("nodeid")
+			prefix := ctx.Query("prefix")
+			if nodeid == "" || prefix == "" {
+				ctx.JSON(400, gin.H{"error": "nodeid and prefix are required"})
+				return
+			}
+			sp, ok := s.space(ctx)
+			if !ok {
+				return
+			}
+			if err := sp.ApproveRoute(nodeid, prefix, approved); err != nil {
+				code := 400
+				switch {
+				case errors.Is(err, space.ErrRouteNotFound):
+					code = 404
+				case errors.Is(err, space.ErrRouteConflict):
+					code = 409
+				}
+				ctx.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			ctx.JSON(200, gin.H{"message": "update route success"})
+		}
+	}
+	group.POST("/approve", approve(true))
+	group.POST("/revoke", approve(false))
+}
+
+// 愿意作为出口结点的结点，批准之后其它结点才能选择
+func (s *Server) registerExit(group *gin.RouterGroup) {
+	group.GET("/list", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, sp.ExitNodes())
+	})
+
+	approve := func(approved bool) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			nodeid := ctx.Query("nodeid")
+			if nodeid == "" {
+				ctx.JSON(400, gin.H{"error": "nodeid is required"})
+				return
+			}
+			sp, ok := s.space(ctx)
+			if !ok {
+				return
+			}
+			if err := sp.ApproveExit(nodeid, approved); err != nil {
+				code := 400
+				if errors.Is(err, space.ErrExitNotFound) {
+					code = 404
+				}
+				ctx.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			ctx.JSON(200, gin.H{"message": "update exit node success"})
+		}
+	}
+	group.POST("/approve", approve(true))
+	group.POST("/revoke", approve(false))
+}
+
+// 结点之间的访问控制策略，保存在 space 的配置中，修改之后立刻生效
+func (s *Server) registerACL(group *gin.RouterGroup) {
+	group.GET("/policy", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, sp.GetConifg().ACL)
+	})
+
+	// 被拒绝的包的计数，rules 的下标与策略中的规则相同
+	group.GET("/stats", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(200, sp.ACLStats())
+	})
+
+	setPolicy := func(ctx *gin.Context, p *models.ACLPolicy) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		cfg := *sp.GetConifg()
+		cfg.ACL = p
+		if err := s.spaces.Update(cfg); err != nil {
+			ctx.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, gin.H{"message": "update acl success"})
+	}
+	// 请求体为 ACLPolicy
+	group.POST("/update", func(ctx *gin.Context) {
+		var p models.ACLPolicy
+		if err := ctx.ShouldBindJSON(&p); err != nil {
+			ctx.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		setPolicy(ctx, &p)
+	})
+	// 删除策略之后结点之间可以互相访问
+	group.POST("/delete", func(ctx *gin.Context) {
+		setPolicy(ctx, nil)
+	})
+}
+
+func (s *Server) registerJoinToken(group *gin.RouterGroup) {
+	group.GET("/list", func(ctx *gin.Context) {
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		tokens, err := s.tokens.List(sp.GetConifg().ID)
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, tokens)
+	})
+
+	// reusable=true 可重复使用，ttl 为 time.ParseDuration 的格式，为空表示不过期
+	group.POST("/create", func(ctx *gin.Context) {
+		var ttl time.Duration
+		if v := ctx.Query("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				ctx.JSON(400, gin.H{"error": "invalid ttl"})
+				return
+			}
+			ttl = d
+		}
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		t, err := s.tokens.Create(sp.GetConifg().ID, ctx.Query("reusable") == "true", ttl)
+		if err != nil {
+			ctx.JSON(500, gin.H{"error": err.Error()})
+			logrus.Errorf("create join token error: %v", err)
+			return
+		}
+		ctx.JSON(200, t)
+	})
+
+	group.POST("/revoke", func(ctx *gin.Context) {
+		token := ctx.Query("token")
+		if token == "" {
+			ctx.JSON(400, gin.H{"error": "token is required"})
+			return
+		}
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		if err := s.tokens.Revoke(sp.GetConifg().ID, token); err != nil {
+			code := 500
+			if errors.Is(err, jointoken.ErrInvalidToken) {
+				code = 404
+			}
+			ctx.JSON(code, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(200, gin.H{"message": "revoke token success"})
+	})
 }
 
 func (s *Server) registerAppAider(group *gin.RouterGroup) {
 	group.GET("/list", func(ctx *gin.Context) {
-		ctx.JSON(200, s.appAider.List())
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		id := sp.GetConifg().ID
+		arr := make([]*models.AppNode, 0)
+		for _, app := range s.appAider.List() {
+			if app.SpaceID == id {
+				arr = append(arr, app)
+			}
+		}
+		ctx.JSON(200, arr)
 	})
 
 	group.POST("/add", func(ctx *gin.Context) {
@@ -107,10 +579,14 @@ func (s *Server) registerAppAider(group *gin.RouterGroup) {
 			ctx.JSON(400, gin.H{"error": "appid is required"})
 			return
 		}
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
 
 		if err := s.appAider.Add(lzcutils.ToGrpcCtxFromGinCtx(ctx), &models.AppNode{
 			AppID:   appid,
-			SpaceID: "space1",
+			SpaceID: sp.GetConifg().ID,
 		}); err != nil {
 			ctx.JSON(500, gin.H{"error": err.Error()})
 			logrus.Errorf("add app error: %v", err)
@@ -126,7 +602,11 @@ func (s *Server) registerAppAider(group *gin.RouterGroup) {
 			ctx.JSON(400, gin.H{"error": "appid is required"})
 			return
 		}
-		if err := s.spaceManager.Remove(models.SpaceNode{
+		sp, ok := s.space(ctx)
+		if !ok {
+			return
+		}
+		if err := sp.Remove(models.SpaceNode{
 			NodeID: nodeid,
 		}); err != nil {
 			ctx.JSON(500, gin.H{"error": err.Error()})
@@ -135,7 +615,7 @@ func (s *Server) registerAppAider(group *gin.RouterGroup) {
 		}
 		if err := s.appAider.Remove(lzcutils.ToGrpcCtxFromGinCtx(ctx), &models.AppNode{
 			AppID:   appid,
-			SpaceID: "space1",
+			SpaceID: sp.GetConifg().ID,
 		}); err != nil {
 			ctx.JSON(500, gin.H{"error": err.Error()})
 			logrus.Errorf("remove app error: %v", err)
@@ -0,0 +1,348 @@
+package spacemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"spacenode/libs/models"
+	"spacenode/libs/subnet"
+	"spacenode/libs/syncmap"
+	"spacenode/modules/nodestore"
+	"spacenode/modules/space"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotFound = errors.New("space not found")
+	ErrExists   = errors.New("space already exists")
+)
+
+// Manager 管理服务端上的多个 space，配置保存在数据库中，每个 space 监听自己的端口
+type Manager interface {
+	// Get 运行中的 space
+	Get(spaceID string) (*space.Space, error)
+	List() []models.SpaceItemConfig
+	// Create 创建并启动 space，没有指定网段时选择一个不与本机网络和其它 space 重叠的 /24
+	Create(cfg models.SpaceItemConfig) (*models.SpaceItemConfig, error)
+	// Update 在运行中修改 space 的配置，不能在运行中生效的修改(e2e)会重启 space
+	// cfg 是完整的配置，保存失败时恢复原来的配置
+	Update(cfg models.SpaceItemConfig) error
+	// Patch 只修改 patch(json)中出现的字段，其它字段沿用当前的配置
+	Patch(spaceID string, patch []byte) error
+	// Delete 停止 space，删除它的配置、租约、结点记录、子网路由、join token 和吊销记录
+	Delete(spaceID string) error
+	// Ensure 数据库中没有任何 space 时创建 cfg，用于第一次启动
+	Ensure(cfg models.SpaceItemConfig) error
+	Stop()
+}
+
+type manager struct {
+	db    *gorm.DB
+	store nodestore.Store
+	// 服务端证书指纹，所有 space 共用同一个证书
+	fingerprint string
+	opts        []space.Option
+	// 串行化创建、修改和删除
+	mu     sync.Mutex
+	spaces syncmap.SyncMap[string, *space.Space]
+}
+
+// NewManager 启动数据库中保存的所有 space，opts 用于每个 space
+func NewManager(db *gorm.DB, fingerprint string, opts ...space.Option) (Manager, error) {
+	store := nodestore.NewStore(db)
+	m := &manager{
+		db:          db,
+		store:       store,
+		fingerprint: fingerprint,
+		opts:        append(opts, space.WithStore(store)),
+	}
+	var arr []models.SpaceItemConfig
+	if err := db.Find(&arr).Error; err != nil {
+		return nil, err
+	}
+	for _, cfg := range arr {
+		// 一个 space 启动失败不影响其它 space
+		if err := m.start(cfg); err != nil {
+			logrus.Errorf("start space %s: %v", cfg.ID, err)
+		}
+	}
+	return m, nil
+}
+
+func (m *manager) Get(spaceID string) (*space.Space, error) {
+	sp, ok := m.spaces.Load(spaceID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, spaceID)
+	}
+	return sp, nil
+}
+
+func (m *manager) List() []models.SpaceItemConfig {
+	arr := make([]models.SpaceItemConfig, 0)
+	m.spaces.Range(func(key string, value *space.Space) bool {
+		arr = append(arr, *value.GetConifg())
+		return true
+	})
+	sort.Slice(arr, func(i, j int) bool { return arr[i].ID < arr[j].ID })
+	return arr
+}
+
+func (m *manager) Create(cfg models.SpaceItemConfig) (*models.SpaceItemConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cfg.ID == "" {
+		return nil, errors.New("space id is required")
+	}
+	if _, ok := m.spaces.Load(cfg.ID); ok {
+		return nil, fmt.Errorf("%w: %s", ErrExists, cfg.ID)
+	}
+	if err := m.checkPort(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.NetAddr == "" {
+		prefix, err := m.pickSubnet()
+		if err != nil {
+			return nil, err
+		}
+		cfg.NetAddr = prefix.Addr().String()
+		cfg.Mask = subnet.Mask(prefix)
+	}
+	if err := m.start(cfg); err != nil {
+		return nil, err
+	}
+	// 保存系统分配的端口
+	sp, _ := m.spaces.Load(cfg.ID)
+	cfg.Port = sp.GetConifg().Port
+	if err := m.db.Create(&cfg).Error; err != nil {
+		m.stop(cfg.ID)
+		return nil, err
+	}
+	logrus.Infof("space %s created", cfg.ID)
+	created := *sp.GetConifg()
+	return &created, nil
+}
+
+func (m *manager) Update(cfg models.SpaceItemConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.update(cfg)
+}
+
+func (m *manager) Patch(spaceID string, patch []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sp, ok := m.spaces.Load(spaceID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, spaceID)
+	}
+	cfg, err := mergeConfig(*sp.GetConifg(), patch)
+	if err != nil {
+		return err
+	}
+	if cfg.ID != spaceID {
+		return fmt.Errorf("space id %q cannot be changed", cfg.ID)
+	}
+	return m.update(cfg)
+}
+
+func (m *manager) update(cfg models.SpaceItemConfig) error {
+	old, ok := m.spaces.Load(cfg.ID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, cfg.ID)
+	}
+	prev := *old.GetConifg()
+	// 端口为 0 时沿用正在监听的端口
+	if cfg.Port == 0 {
+		cfg.Port = prev.Port
+	}
+	if err := m.checkPort(cfg); err != nil {
+		return err
+	}
+	cfg.Fingerprint = m.fingerprint
+	if err := m.apply(old, cfg); err != nil {
+		return err
+	}
+	if sp, ok := m.spaces.Load(cfg.ID); ok {
+		cfg.Port = sp.GetConifg().Port
+	}
+	// 保存失败时恢复原来的配置，否则重启之后配置会悄悄回退
+	if err := m.db.Save(&cfg).Error; err != nil {
+		if sp, ok := m.spaces.Load(cfg.ID); ok {
+			if rerr := m.apply(sp, prev); rerr != nil {
+				logrus.Errorf("restore config of space %s: %v", cfg.ID, rerr)
+			}
+		}
+		return err
+	}
+	logrus.Infof("space %s updated", cfg.ID)
+	return nil
+}
+
+// apply 在运行中修改配置，不能在运行中修改时重启 space
+func (m *manager) apply(sp *space.Space, cfg models.SpaceItemConfig) error {
+	err := sp.SetConifg(cfg)
+	if errors.Is(err, space.ErrNotLive) {
+		err = m.restart(sp, cfg)
+	}
+	return err
+}
+
+// mergeConfig 用 patch 中出现的顶层字段替换 cfg 中对应的字段
+// 字段整体替换，例如 acl 不与原来的策略合并
+func mergeConfig(cfg models.SpaceItemConfig, patch []byte) (models.SpaceItemConfig, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return cfg, err
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	merged := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return cfg, err
+	}
+	for k, v := range fields {
+		// json 的字段名不区分大小写
+		for old := range merged {
+			if strings.EqualFold(old, k) {
+				delete(merged, old)
+			}
+		}
+		merged[k] = v
+	}
+	if data, err = json.Marshal(merged); err != nil {
+		return cfg, err
+	}
+	var out models.SpaceItemConfig
+	if err := json.Unmarshal(data, &out); err != nil {
+		return cfg, err
+	}
+	return out, nil
+}
+
+func (m *manager) Delete(spaceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.spaces.Load(spaceID); !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, spaceID)
+	}
+	m.stop(spaceID)
+	if err := m.db.Delete(&models.SpaceItemConfig{ID: spaceID}).Error; err != nil {
+		return err
+	}
+	if err := m.store.DeleteSpace(spaceID); err != nil {
+		return err
+	}
+	logrus.Infof("space %s deleted", spaceID)
+	return nil
+}
+
+func (m *manager) Ensure(cfg models.SpaceItemConfig) error {
+	var n int64
+	if err := m.db.Model(&models.SpaceItemConfig{}).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := m.Create(cfg)
+	return err
+}
+
+func (m *manager) Stop() {
+	m.spaces.Range(func(key string, value *space.Space) bool {
+		m.stop(key)
+		return true
+	})
+}
+
+// start 创建 space 并开始监听，端口被占用时返回错误
+func (m *manager) start(cfg models.SpaceItemConfig) error {
+	cfg.Fingerprint = m.fingerprint
+	sp, err := space.NewSpace(cfg, m.opts...)
+	if err != nil {
+		return err
+	}
+	if err := sp.Listen(); err != nil {
+		sp.Stop()
+		return err
+	}
+	m.spaces.Store(cfg.ID, sp)
+	go func() {
+		if err := sp.Serve(); err != nil {
+			logrus.Errorf("space %s stopped: %v", cfg.ID, err)
+		}
+	}()
+	return nil
+}
+
+// restart 用新的配置重启 space，结点重连之后恢复原来的地址，失败时恢复原来的 space
+func (m *manager) restart(old *space.Space, cfg models.SpaceItemConfig) error {
+	prev := *old.GetConifg()
+	m.stop(cfg.ID)
+	if err := m.start(cfg); err != nil {
+		if rerr := m.start(prev); rerr != nil {
+			logrus.Errorf("restore space %s: %v", cfg.ID, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *manager) stop(spaceID string) {
+	if sp, ok := m.spaces.LoadAndDelete(spaceID); ok {
+		sp.Stop()
+	}
+}
+
+// checkPort 每个 space 监听自己的端口，端口为 0 时由系统分配，分配到的端口保存在配置中
+func (m *manager) checkPort(cfg models.SpaceItemConfig) error {
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid port %d", cfg.Port)
+	}
+	var err error
+	m.spaces.Range(func(key string, value *space.Space) bool {
+		if key != cfg.ID && cfg.Port != 0 && value.GetConifg().Port == cfg.Port {
+			err = fmt.Errorf("port %d is used by space %s", cfg.Port, key)
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// pickSubnet 不与本机网络和其它 space 重叠的 /24
+func (m *manager) pickSubnet() (netip.Prefix, error) {
+	used, err := subnet.Local()
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	m.spaces.Range(func(key string, value *space.Space) bool {
+		if prefix, ok := configPrefix(*value.GetConifg()); ok {
+			used = append(used, subnet.Network{Prefix: prefix, Iface: "space " + key})
+		}
+		return true
+	})
+	return subnet.Suggest(used)
+}
+
+func configPrefix(cfg models.SpaceItemConfig) (netip.Prefix, bool) {
+	addr, err := netip.ParseAddr(cfg.NetAddr)
+	mask := net.ParseIP(cfg.Mask).To4()
+	if err != nil || mask == nil {
+		return netip.Prefix{}, false
+	}
+	ones, bits := net.IPMask(mask).Size()
+	if bits == 0 {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr.Unmap(), ones).Masked(), true
+}
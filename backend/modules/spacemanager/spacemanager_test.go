@@ -0,0 +1,181 @@
+package spacemanager
+
+import (
+	"errors"
+	"path/filepath"
+	"spacenode/libs/models"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "space.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&models.SpaceItemConfig{}, &models.IPLease{}, &models.NodeRecord{}, &models.IPReservation{}, &models.SubnetRoute{}, &models.ExitNode{}, &models.JoinToken{}, &models.RevokedNode{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func newTestManager(t *testing.T, db *gorm.DB) Manager {
+	m, err := NewManager(db, "fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Stop)
+	return m
+}
+
+func TestManager(t *testing.T) {
+	db := newTestDB(t)
+	m := newTestManager(t, db)
+
+	if err := m.Ensure(models.SpaceItemConfig{ID: "space1", Host: "127.0.0.1", NetAddr: "10.10.0.0", Mask: "255.255.255.0"}); err != nil {
+		t.Fatal(err)
+	}
+	// 已经有 space 时不再创建
+	if err := m.Ensure(models.SpaceItemConfig{ID: "other", Host: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := m.Create(models.SpaceItemConfig{ID: "space2", Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 自动选择的网段不与 space1 重叠
+	// 端口为 0 时保存系统分配的端口
+	if cfg.NetAddr == "" || cfg.NetAddr == "10.10.0.0" || cfg.Fingerprint != "fp" || cfg.Port == 0 {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if _, err := m.Create(models.SpaceItemConfig{ID: "space2", Host: "127.0.0.1"}); !errors.Is(err, ErrExists) {
+		t.Fatalf("expect duplicated space to fail, got %v", err)
+	}
+	if _, err := m.Create(models.SpaceItemConfig{ID: "bad", Host: "127.0.0.1", NetAddr: "8.8.8.0", Mask: "255.255.255.0"}); err == nil {
+		t.Fatalf("expect public subnet to fail")
+	}
+	if _, err := m.Get("bad"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect failed space not to be kept, got %v", err)
+	}
+
+	list := m.List()
+	if len(list) != 2 || list[0].ID != "space1" || list[1].ID != "space2" {
+		t.Fatalf("unexpected spaces %+v", list)
+	}
+
+	port := list[0].Port
+	update := list[0]
+	update.Port = 0
+	update.E2E = true
+	update.LeaseDefault = time.Hour
+	update.ACL = &models.ACLPolicy{
+		Default: models.ACLDeny,
+		Rules:   []models.ACLRule{{Action: models.ACLAccept, Src: []string{"type:client"}, Dst: []string{"*"}, Proto: "tcp", Ports: []string{"22"}}},
+	}
+	if err := m.Update(update); err != nil {
+		t.Fatal(err)
+	}
+	sp, err := m.Get("space1")
+	if err != nil || !sp.GetConifg().E2E || sp.GetConifg().Port != port {
+		t.Fatalf("expect space1 to be updated on the same port, %v", err)
+	}
+	// 新配置无效时保留原来的 space
+	bad := update
+	bad.ACL = &models.ACLPolicy{Rules: []models.ACLRule{{Action: models.ACLAccept, Src: []string{"tag:missing"}, Dst: []string{"*"}}}}
+	if err := m.Update(bad); err == nil {
+		t.Fatalf("expect invalid acl to fail")
+	}
+	update.Mask = "255.0.255.0"
+	if err := m.Update(update); err == nil {
+		t.Fatalf("expect invalid config to fail")
+	}
+	if sp, err := m.Get("space1"); err != nil || sp.GetConifg().Mask != "255.255.255.0" {
+		t.Fatalf("expect space1 to keep running, %v", err)
+	}
+
+	if err := m.Delete("space2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete("space2"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect deleted space not found, got %v", err)
+	}
+
+	// 重启之后从数据库恢复
+	m.Stop()
+	m2 := newTestManager(t, db)
+	list = m2.List()
+	if len(list) != 1 || list[0].ID != "space1" || !list[0].E2E || list[0].LeaseDefault != time.Hour || list[0].Port != port {
+		t.Fatalf("unexpected spaces after restart %+v", list)
+	}
+	if acl := list[0].ACL; acl == nil || acl.Default != models.ACLDeny || len(acl.Rules) != 1 || acl.Rules[0].Ports[0] != "22" {
+		t.Fatalf("expect acl restored, got %+v", acl)
+	}
+}
+
+func TestPortConflict(t *testing.T) {
+	m := newTestManager(t, newTestDB(t))
+	if _, err := m.Create(models.SpaceItemConfig{ID: "a", Host: "127.0.0.1", Port: 49393, NetAddr: "10.10.0.0", Mask: "255.255.255.0"}); err != nil {
+		t.Skipf("port not available: %v", err)
+	}
+	if _, err := m.Create(models.SpaceItemConfig{ID: "b", Host: "127.0.0.1", Port: 49393}); err == nil {
+		t.Fatalf("expect port conflict")
+	}
+	// 删除之后端口马上可以重新使用
+	if err := m.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Create(models.SpaceItemConfig{ID: "b", Host: "127.0.0.1", Port: 49393}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	db := newTestDB(t)
+	m := newTestManager(t, db)
+	acl := &models.ACLPolicy{Default: models.ACLDeny}
+	if _, err := m.Create(models.SpaceItemConfig{ID: "space1", Host: "127.0.0.1", NetAddr: "10.10.0.0", Mask: "255.255.255.0", DNS: []string{"1.1.1.1"}, ACL: acl}); err != nil {
+		t.Fatal(err)
+	}
+	// 请求体中没有的字段不变
+	if err := m.Patch("space1", []byte(`{"id":"space1","lease_default":3600000000000}`)); err != nil {
+		t.Fatal(err)
+	}
+	sp, _ := m.Get("space1")
+	cfg := sp.GetConifg()
+	if cfg.LeaseDefault != time.Hour || cfg.Host != "127.0.0.1" || len(cfg.DNS) != 1 || cfg.ACL == nil || cfg.ACL.Default != models.ACLDeny {
+		t.Fatalf("expect omitted fields to be kept, got %+v", cfg)
+	}
+	// 出现的字段整体替换
+	if err := m.Patch("space1", []byte(`{"id":"space1","acl":null,"dns":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := sp.GetConifg(); cfg.ACL != nil || len(cfg.DNS) != 0 || cfg.LeaseDefault != time.Hour {
+		t.Fatalf("expect acl and dns to be replaced, got %+v", cfg)
+	}
+	if err := m.Patch("space1", []byte(`{"id":"space2"}`)); err == nil {
+		t.Fatalf("expect space id change to fail")
+	}
+	if err := m.Patch("missing", []byte(`{"id":"missing"}`)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect missing space, got %v", err)
+	}
+
+	// 保存失败时运行中的 space 恢复原来的配置
+	if err := db.Migrator().DropTable(&models.SpaceItemConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Patch("space1", []byte(`{"id":"space1","lease_default":60000000000}`)); err == nil {
+		t.Fatalf("expect save to fail")
+	}
+	if cfg := sp.GetConifg(); cfg.LeaseDefault != time.Hour {
+		t.Fatalf("expect live config to be restored, got %s", cfg.LeaseDefault)
+	}
+	if err := m.Patch("space1", []byte(`{"id":"space1","e2e":true}`)); err == nil {
+		t.Fatalf("expect save to fail")
+	}
+	if sp, err := m.Get("space1"); err != nil || sp.GetConifg().E2E {
+		t.Fatalf("expect restarted space to be restored, %v", err)
+	}
+}
@@ -1,20 +1,24 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"net"
+	"net/netip"
+	"os"
+	"slices"
 	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"spacenode/libs/protocol"
+	"spacenode/libs/router"
+	"spacenode/libs/spaceca"
 	"spacenode/libs/spacetun"
+	"spacenode/libs/subnet"
 	"spacenode/libs/ymlutils"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
@@ -22,17 +26,40 @@ import (
 var (
 	moon   = flag.String("ipaddr", "172.23.253.179:9393", "MoonServer IP")
 	config = flag.String("config", "", "config file path")
+	// 服务端证书指纹，见 /space/config
+	fingerprint = flag.String("fingerprint", "", "MoonServer certificate SHA-256 fingerprint")
+	token       = flag.String("token", "", "join token of the space")
+	spaceID     = flag.String("space", "", "ID of the space to join, re-enroll with the token when the certificate is for another space")
+	identityDir = flag.String("identity-dir", "/var/lib/spacenode", "dir to keep the node key and certificate")
+	// 只能访问 https 时通过 WebSocket 接入，例如 wss://lzcspace.example.com/api/space/ws
+	serverURL = flag.String("server-url", "", "MoonServer WebSocket url (ws:// or wss://), overrides ipaddr")
+	noUDP     = flag.Bool("no-udp", false, "tunnel packets over TCP only")
+	nodeName  = flag.String("name", "", "name of the node in the space DNS, defaults to the hostname")
+	// 例如家里的局域网，管理员在 /space/route/approve 批准之后 space 中的结点可以经过本机访问
+	advertiseRoutes = flag.String("advertise-routes", "", "comma separated LAN prefixes to route for the space, e.g. 192.168.1.0/24")
+	// 本机作为出口结点，选择了它的结点访问 space 之外的地址时经过本机
+	advertiseExit = flag.Bool("advertise-exit-node", false, "offer this node as an exit node for internet traffic of the space")
+	// 选择出口结点之后 space 之外的流量都经过它，到 MoonServer 的路由保持不变
+	exitNode = flag.String("exit-node", "", "NodeID of the exit node to send internet traffic through, e.g. linuxnode_3f2a9c1d, the exit node must be approved by the admin")
+	// 网段与本机网络重叠时默认拒绝安装地址
+	allowOverlap = flag.Bool("allow-overlap", false, "install the TUN address even if the space subnet overlaps a local network")
 )
 
 // 编译的时候， app / client
 var BuildNodeType string
 
+// 客户端模式下 TUN 的名字
+const defaultTunName = "spacenode0"
+
 func main() {
 	flag.Parse()
 	logrus.SetReportCaller(true)
 
 	var log *logrus.Entry
 	var rr *models.RegisterRequest
+	serverFingerprint := *fingerprint
+	targetSpace := *spaceID
+	nodeIdentityDir := *identityDir
 	if *config != "" {
 		cfg, err := ymlutils.ParseYAML[*models.SpaceAppNodeConfig](*config)
 		if err != nil {
@@ -43,12 +70,24 @@ func main() {
 			SpaceNode: cfg.NodeConfig,
 			NodeName:  cfg.NodeConfig.NodeID,
 			NetConfig: models.NetConfig{
-				Type:     "ipv4",
+				Type:     "ip",
 				DHCPType: "auto",
 				Alive:    -1,
 			},
 			MoonServer: fmt.Sprintf("%s:%d", cfg.SpaceConfig.Host, cfg.SpaceConfig.Port),
 		}
+		if cfg.SpaceConfig.Fingerprint != "" {
+			serverFingerprint = cfg.SpaceConfig.Fingerprint
+		}
+		if cfg.SpaceConfig.ID != "" {
+			targetSpace = cfg.SpaceConfig.ID
+		}
+		if cfg.Token != "" {
+			rr.Token = cfg.Token
+		}
+		if cfg.IdentityDir != "" {
+			nodeIdentityDir = cfg.IdentityDir
+		}
 
 		log = logrus.WithField("service", cfg.NodeConfig.Service).
 			WithField("appid", rr.SpaceNode.AppID).
@@ -58,9 +97,10 @@ func main() {
 			SpaceNode: models.SpaceNode{
 				NodeID:   "linuxnode_" + uuid.New().String()[:8],
 				NodeType: models.NodeType(BuildNodeType),
+				Domain:   hostName(),
 			},
 			NetConfig: models.NetConfig{
-				Type:     "ipv4",
+				Type:     "ip",
 				DHCPType: "auto",
 				Alive:    time.Hour * 30 * 24,
 			},
@@ -72,79 +112,147 @@ func main() {
 		rr.SpaceNode = models.SpaceNode{
 			NodeID:   "linuxnode_" + uuid.New().String()[:8],
 			NodeType: models.NodeType(BuildNodeType),
+			Domain:   hostName(),
 		}
 	}
 
 	log.Info("Creating register request")
 
-	log.Infof("Dialing MoonServer at %s", rr.MoonServer)
-	conn, err := net.Dial("tcp", rr.MoonServer)
+	if rr.Token == "" {
+		rr.Token = *token
+	}
+	advertised := parseRoutes(log, *advertiseRoutes)
+	for _, r := range advertised {
+		rr.Routes = append(rr.Routes, r.String())
+	}
+	rr.AdvertiseExit = *advertiseExit
+	rr.ExitNode = *exitNode
+	// 出口结点转发 space 之外的全部地址
+	forwarded := advertised
+	if *advertiseExit {
+		forwarded = append(slices.Clip(advertised), netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"))
+	}
+	if *serverURL != "" {
+		rr.MoonServer = *serverURL
+	}
+
+	identity, err := spaceca.LoadIdentity(nodeIdentityDir)
 	if err != nil {
-		log.Fatalf("Failed to dial MoonServer: %v", err)
+		log.Fatalf("Failed to load node identity: %v", err)
+	}
+	client := &nodeclient.Client{
+		Server:      rr.MoonServer,
+		Fingerprint: serverFingerprint,
+		Token:       rr.Token,
+		Identity:    identity,
+		SpaceID:     targetSpace,
+		DisableUDP:  *noUDP,
+		Log:         log,
 	}
-	defer conn.Close()
 
-	log.Info("Encoding register request to JSON")
-	requestBF := &bytes.Buffer{}
-	if err := json.NewEncoder(requestBF).Encode(rr); err != nil {
-		log.Fatalf("Failed to encode register request: %v", err)
+	// 客户端模式没有 NodeName，使用固定的 TUN 名字，重启之后能找到旧的 TUN
+	tunName := rr.NodeName
+	if tunName == "" {
+		tunName = defaultTunName
 	}
-	requestBF.WriteByte('\n')
 
 	log.Info("Sending register request")
-	_, err = conn.Write(requestBF.Bytes())
+	pc, response, err := client.Dial(rr)
 	if err != nil {
-		log.Fatalf("Failed to send register request: %v", err)
+		var refused *protocol.RefusedError
+		if errors.As(err, &refused) {
+			log.Fatalf("MoonServer refused registration: %s (%s)", refused.Message, refused.Code)
+		}
+		log.Fatalf("Failed to register: %v", err)
 	}
+	defer pc.Close()
+	log.Info("Response from MoonServer received", response)
 
-	packet := make([]byte, 1024)
-	log.Info("Waiting for response from MoonServer")
-	n, err := conn.Read(packet)
+	addr4, addr6 := tunAddrs(response)
+	// 与本机网卡或路由重叠的网段会抢走本地流量，旧的同名 TUN 不计入
+	// 放弃注册时通知 MoonServer 收回地址，不留下租约和在线的会话
+	prefix, err := netip.ParsePrefix(addr4)
 	if err != nil {
-		log.Fatalf("Failed to read response: %v", err)
+		pc.Leave()
+		log.Fatalf("Invalid address from MoonServer: %v", err)
 	}
-
-	response := &models.RegisterResp{}
-	log.Info("Decoding response from MoonServer")
-	if err := json.Unmarshal(packet[:n], response); err != nil {
-		log.Fatalf("Failed to decode response: %v", err)
+	if !subnet.IsPrivate(prefix) {
+		log.Warnf("Space subnet %s is not a private range", prefix.Masked())
+	}
+	local, err := subnet.Local(tunName)
+	if err != nil {
+		log.Warnf("Failed to list local networks: %v", err)
+	}
+	if conflicts := subnet.Conflicts(prefix.Masked(), local); len(conflicts) > 0 {
+		if !*allowOverlap {
+			pc.Leave()
+			log.Fatalf("Space subnet %s overlaps %s, use -allow-overlap to ignore", prefix.Masked(), conflicts[0])
+		}
+		log.Warnf("Space subnet %s overlaps %s", prefix.Masked(), conflicts[0])
 	}
-	log.Info("Response from MoonServer received", response)
 
 	log.Info("Setting up TUN interface")
 	ifce, err := spacetun.SetupTUN(&models.TunSetupConfig{
-		Name: rr.NodeName,
-		IPv4: response.IPv4 + "/24",
+		Name: tunName,
+		IPv4: addr4,
+		IPv6: addr6,
 	})
 	if err != nil {
+		pc.Leave()
 		log.Fatalf("Failed to setup TUN interface: %v", err)
 		return
 	}
 	defer ifce.Close()
-	defer conn.Close()
+	if *exitNode != "" {
+		pinServer(log, client, ifce.Name())
+	}
+	profile := models.NetProfile{}
+	applyProfile(log, ifce.Name(), &profile, withExit(&response.NetProfile, addr6 != ""))
+	nets := spaceNets(addr4, addr6)
+	masquerade(log, ifce.Name(), nil, nets, forwarded)
 
-	go func() {
-		for {
-			lengthBuf := make([]byte, 2)
-			if _, err := io.ReadFull(conn, lengthBuf); err != nil {
-				if err == io.EOF {
-					log.Errorln("MoonServer 关闭连接")
-					return
-				}
-				log.Errorf("读取长度头失败: %v", err)
-				continue
+	// 断线重连之后没能恢复原来的 IP，或者 space 重新编址时更新网卡地址
+	var addrMu sync.Mutex
+	pc.OnReconnect = func(resp *models.RegisterResp) {
+		addrMu.Lock()
+		defer addrMu.Unlock()
+		new4, new6 := tunAddrs(resp)
+		if new4 != addr4 {
+			if err := spacetun.ReplaceAddr(ifce.Name(), addr4, new4); err != nil {
+				log.Errorf("Failed to update TUN address: %v", err)
+				return
+			}
+			addr4 = new4
+		}
+		if new6 != addr6 {
+			if err := spacetun.ReplaceAddr(ifce.Name(), addr6, new6); err != nil {
+				log.Errorf("Failed to update TUN IPv6 address: %v", err)
+				return
 			}
+			addr6 = new6
+		}
+		applyProfile(log, ifce.Name(), &profile, withExit(&resp.NetProfile, addr6 != ""))
+		if next := spaceNets(addr4, addr6); !slices.Equal(nets, next) {
+			masquerade(log, ifce.Name(), nets, next, forwarded)
+			nets = next
+		}
+	}
+	pc.OnRenumber = pc.OnReconnect
+	// 服务端修改了 MTU、路由、DNS 或者出口结点
+	pc.OnProfile = func(p *models.NetProfile) {
+		addrMu.Lock()
+		defer addrMu.Unlock()
+		applyProfile(log, ifce.Name(), &profile, withExit(p, addr6 != ""))
+	}
 
-			pktLength := binary.BigEndian.Uint16(lengthBuf)
-			// 读取实际数据
-			packetData := make([]byte, pktLength)
-			if _, err := io.ReadFull(conn, packetData); err != nil {
-				log.Errorf("读取数据体失败: %v", err)
-				continue
+	go func() {
+		for {
+			packetData, err := pc.ReadPacket()
+			if err != nil {
+				log.Errorf("读取数据包失败: %v", err)
+				return
 			}
-			packet := gopacket.NewPacket(packetData, layers.LayerTypeIPv4, gopacket.Default)
-			ipLayer := packet.Layer(layers.LayerTypeIPv4)
-			if ipLayer == nil {
+			if _, ok := router.DstIP(packetData); !ok {
 				log.Errorln("skip ")
 				continue
 			}
@@ -161,12 +269,7 @@ func main() {
 				log.Errorf("ifce 读取失败: %v", err)
 				break
 			}
-			lengthBuf := make([]byte, 2)
-			binary.BigEndian.PutUint16(lengthBuf, uint16(n))
-
-			dataToSend := append(lengthBuf, buf[:n]...)
-
-			if _, err := conn.Write(dataToSend); err != nil {
+			if err := pc.WritePacket(buf[:n]); err != nil {
 				log.Errorf("conn 写入失败: %v", err)
 				break
 			}
@@ -174,3 +277,137 @@ func main() {
 	}()
 	select {}
 }
+
+// hostName 结点在 space DNS 中的名字
+func hostName() string {
+	if *nodeName != "" {
+		return *nodeName
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// applyProfile 把网卡从 cur 的配置更新到 next，只修改有变化的部分，成功的部分记录到 cur
+// 老版本服务端不下发 MTU 和 DNS，保持系统默认
+func applyProfile(log *logrus.Entry, name string, cur *models.NetProfile, next *models.NetProfile) {
+	if next.MTU > 0 && next.MTU != cur.MTU {
+		if err := spacetun.SetMTU(name, next.MTU); err != nil {
+			log.Errorf("Failed to set MTU %d: %v", next.MTU, err)
+		} else {
+			cur.MTU = next.MTU
+		}
+	}
+	if !slices.Equal(cur.Routes, next.Routes) {
+		if err := spacetun.ReplaceRoutes(name, cur.Routes, next.Routes); err != nil {
+			log.Errorf("Failed to update routes: %v", err)
+		} else {
+			cur.Routes = next.Routes
+		}
+	}
+	// DNS 失败时只影响域名解析
+	if len(next.DNS) > 0 && (!slices.Equal(cur.DNS, next.DNS) || !slices.Equal(cur.Search, next.Search)) {
+		if err := spacetun.SetDNS(name, next.DNS, next.Search); err != nil {
+			log.Warnf("Failed to configure space DNS: %v", err)
+		} else {
+			cur.DNS, cur.Search = next.DNS, next.Search
+			log.Infof("Space DNS %v, search %v", next.DNS, next.Search)
+		}
+	}
+	if next.Exit != cur.Exit {
+		if next.Exit != "" {
+			log.Infof("Sending internet traffic through exit node %s", next.Exit)
+		} else if *exitNode != "" {
+			log.Warnf("Exit node %s is not available, internet traffic stays local", *exitNode)
+		}
+	}
+	cur.Bits, cur.Exit = next.Bits, next.Exit
+}
+
+// withExit 使用出口结点时用两条 /1 路由覆盖默认路由，不修改系统原来的默认路由
+// v6 为 true 时 IPv6 的流量也经过出口结点
+func withExit(p *models.NetProfile, v6 bool) *models.NetProfile {
+	if p.Exit == "" {
+		return p
+	}
+	next := *p
+	next.Routes = append(slices.Clip(p.Routes), "0.0.0.0/1", "128.0.0.0/1")
+	if v6 {
+		next.Routes = append(next.Routes, "::/1", "8000::/1")
+	}
+	return &next
+}
+
+// pinServer 在安装出口结点的路由之前固定到 MoonServer 的路由，避免隧道经过自己
+func pinServer(log *logrus.Entry, client *nodeclient.Client, name string) {
+	addrs, err := client.ServerAddrs()
+	if err != nil {
+		log.Warnf("Failed to resolve MoonServer: %v", err)
+		return
+	}
+	for _, addr := range addrs {
+		if err := spacetun.PinRoute(name, addr); err != nil {
+			log.Warnf("Failed to keep the route to MoonServer %s: %v", addr, err)
+		}
+	}
+}
+
+// parseRoutes 解析 -advertise-routes
+func parseRoutes(log *logrus.Entry, s string) []netip.Prefix {
+	var routes []netip.Prefix
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			log.Fatalf("Invalid route %q: %v", r, err)
+		}
+		routes = append(routes, prefix.Masked())
+	}
+	return routes
+}
+
+// spaceNets 网卡地址所在的 space 网段
+func spaceNets(addrs ...string) []netip.Prefix {
+	var nets []netip.Prefix
+	for _, a := range addrs {
+		if p, err := netip.ParsePrefix(a); err == nil {
+			nets = append(nets, p.Masked())
+		}
+	}
+	return nets
+}
+
+// masquerade 把通告网段的转发规则从 space 网段 old 换成 next
+func masquerade(log *logrus.Entry, name string, old, next []netip.Prefix, routes []netip.Prefix) {
+	if len(routes) == 0 {
+		return
+	}
+	for _, p := range old {
+		if !slices.Contains(next, p) {
+			spacetun.Unmasquerade(name, p, routes)
+		}
+	}
+	for _, p := range next {
+		if err := spacetun.Masquerade(name, p, routes); err != nil {
+			log.Errorf("Failed to forward %v for %s: %v", routes, p, err)
+		}
+	}
+}
+
+// tunAddrs 网卡的 IPv4 和 IPv6 地址，带前缀长度，没有分配 IPv6 时为空
+func tunAddrs(resp *models.RegisterResp) (string, string) {
+	var addr4, addr6 string
+	for _, p := range resp.Prefixes() {
+		if p.Addr().Is4() {
+			addr4 = p.String()
+		} else {
+			addr6 = p.String()
+		}
+	}
+	return addr4, addr6
+}
@@ -1,23 +1,26 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"net"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"spacenode/libs/models"
+	"spacenode/libs/nodeclient"
+	"spacenode/libs/protocol"
+	"spacenode/libs/router"
+	"spacenode/libs/spaceca"
 	"spacenode/libs/ymlutils"
+	"sync"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 )
@@ -25,6 +28,13 @@ import (
 var (
 	moon   = flag.String("ipaddr", "172.23.253.179:9393", "MoonServer IP")
 	config = flag.String("config", "", "config file path")
+	// 服务端证书指纹，见 /space/config
+	fingerprint = flag.String("fingerprint", "", "MoonServer certificate SHA-256 fingerprint")
+	token       = flag.String("token", "", "join token of the space")
+	spaceID     = flag.String("space", "", "ID of the space to join, re-enroll with the token when the certificate is for another space")
+	identityDir = flag.String("identity-dir", defaultIdentityDir(), "dir to keep the node key and certificate")
+	noUDP       = flag.Bool("no-udp", false, "tunnel packets over TCP only")
+	nodeName    = flag.String("name", "", "name of the node in the space DNS, defaults to the hostname")
 )
 var BuildNodeType string = "client"
 
@@ -38,6 +48,9 @@ func main() {
 
 	var log *logrus.Entry
 	var rr *models.RegisterRequest
+	serverFingerprint := *fingerprint
+	targetSpace := *spaceID
+	nodeIdentityDir := *identityDir
 	if *config != "" {
 		cfg, err := ymlutils.ParseYAML[*models.SpaceAppNodeConfig](*config)
 		if err != nil {
@@ -47,19 +60,31 @@ func main() {
 		rr = &models.RegisterRequest{
 			NodeName: cfg.NodeConfig.NodeID,
 			NetConfig: models.NetConfig{
-				Type:     "ipv4",
+				Type:     "ip",
 				DHCPType: "auto",
 				Alive:    -1,
 			},
 			MoonServer: fmt.Sprintf("%s:%d", cfg.SpaceConfig.Host, cfg.SpaceConfig.Port),
 		}
+		if cfg.SpaceConfig.Fingerprint != "" {
+			serverFingerprint = cfg.SpaceConfig.Fingerprint
+		}
+		if cfg.SpaceConfig.ID != "" {
+			targetSpace = cfg.SpaceConfig.ID
+		}
+		if cfg.Token != "" {
+			rr.Token = cfg.Token
+		}
+		if cfg.IdentityDir != "" {
+			nodeIdentityDir = cfg.IdentityDir
+		}
 		log = logrus.WithField("service", cfg.NodeConfig.Service).
 			WithField("appid", rr.SpaceNode.AppID).
 			WithField("pid", cfg.NodeConfig.DockerPid)
 	} else {
 		rr = &models.RegisterRequest{
 			NetConfig: models.NetConfig{
-				Type:     "ipv4",
+				Type:     "ip",
 				DHCPType: "auto",
 				Alive:    time.Hour * 30 * 24,
 			},
@@ -71,40 +96,37 @@ func main() {
 	rr.SpaceNode = models.SpaceNode{
 		NodeID:   "winnode_" + uuid.New().String()[:8],
 		NodeType: models.NodeType(BuildNodeType),
+		Domain:   hostName(),
 	}
 
-	logrus.Infof("Dialing MoonServer at %s", rr.MoonServer)
-	conn, err := net.Dial("tcp", rr.MoonServer)
-	if err != nil {
-		logrus.Fatalf("Failed to dial MoonServer: %v", err)
+	if rr.Token == "" {
+		rr.Token = *token
 	}
-	defer conn.Close()
 
-	logrus.Info("Encoding register request to JSON")
-	requestBF := &bytes.Buffer{}
-	if err := json.NewEncoder(requestBF).Encode(rr); err != nil {
-		logrus.Fatalf("Failed to encode register request: %v", err)
-	}
-	requestBF.WriteByte('\n')
-
-	logrus.Info("Sending register request")
-	_, err = conn.Write(requestBF.Bytes())
+	identity, err := spaceca.LoadIdentity(nodeIdentityDir)
 	if err != nil {
-		logrus.Fatalf("Failed to send register request: %v", err)
+		logrus.Fatalf("Failed to load node identity: %v", err)
 	}
-
-	packet := make([]byte, 1024)
-	logrus.Info("Waiting for response from MoonServer")
-	n, err := conn.Read(packet)
-	if err != nil {
-		logrus.Fatalf("Failed to read response: %v", err)
+	client := &nodeclient.Client{
+		Server:      rr.MoonServer,
+		Fingerprint: serverFingerprint,
+		Token:       rr.Token,
+		Identity:    identity,
+		SpaceID:     targetSpace,
+		DisableUDP:  *noUDP,
+		Log:         logrus.WithField("nodeid", rr.SpaceNode.NodeID),
 	}
 
-	response := &models.RegisterResp{}
-	logrus.Info("Decoding response from MoonServer")
-	if err := json.Unmarshal(packet[:n], response); err != nil {
-		logrus.Fatalf("Failed to decode response: %v", err)
+	logrus.Info("Sending register request")
+	pc, response, err := client.Dial(rr)
+	if err != nil {
+		var refused *protocol.RefusedError
+		if errors.As(err, &refused) {
+			logrus.Fatalf("MoonServer refused registration: %s (%s)", refused.Message, refused.Code)
+		}
+		logrus.Fatalf("Failed to register: %v", err)
 	}
+	defer pc.Close()
 	logrus.Info("Response from MoonServer received", response)
 
 	logrus.Info("Setting up TUN interface")
@@ -114,36 +136,29 @@ func main() {
 		return
 	}
 	defer ifce.Close()
-	defer conn.Close()
 	logrus.Infoln("batchsize", ifce.BatchSize())
 
+	// 断线重连之后没能恢复原来的 IP，或者 space 重新编址时更新网卡地址
+	pc.OnReconnect = func(resp *models.RegisterResp) {
+		configureTUN(ifce, resp)
+	}
+	pc.OnRenumber = pc.OnReconnect
+	// 服务端修改了 MTU、路由或 DNS
+	pc.OnProfile = func(p *models.NetProfile) {
+		applyProfile(winipcfg.LUID(ifce.(*tun.NativeTun).LUID()), p)
+	}
+
 	go func() {
 		for {
-			lengthBuf := make([]byte, 2)
-			if _, err := io.ReadFull(conn, lengthBuf); err != nil {
-				if err == io.EOF {
-					logrus.Errorln("MoonServer 关闭连接")
-					return
-				}
-				logrus.Errorf("读取长度头失败: %v", err)
-				continue
-			}
-
-			pktLength := binary.BigEndian.Uint16(lengthBuf)
-			// 读取实际数据
-			packetData := make([]byte, pktLength)
-			if _, err := io.ReadFull(conn, packetData); err != nil {
-				logrus.Errorf("读取数据体失败: %v", err)
-				continue
+			packetData, err := pc.ReadPacket()
+			if err != nil {
+				logrus.Errorf("读取数据包失败: %v", err)
+				return
 			}
-			packet := gopacket.NewPacket(packetData, layers.LayerTypeIPv4, gopacket.Default)
-			ipLayer := packet.Layer(layers.LayerTypeIPv4)
-			if ipLayer == nil {
+			if _, ok := router.DstIP(packetData); !ok {
 				logrus.Errorln("skip ")
 				continue
 			}
-			// ipv4, _ := ipLayer.(*layers.IPv4)
-			// logrus.Infoln(ipLayer.LayerType(), ipv4.SrcIP, ipv4.DstIP, "len", pktLength)
 			if _, err := ifce.Write([][]byte{packetData}, 0); err != nil {
 				logrus.Errorf("ifce 写入失败: %v", err)
 				continue
@@ -155,7 +170,7 @@ func main() {
 		bufs := make([][]byte, ifce.BatchSize())
 		sizes := make([]int, ifce.BatchSize())
 		for i := range bufs {
-			bufs[i] = make([]byte, 1500) // MTU大小
+			bufs[i] = make([]byte, 65535) // 任何 MTU 的包都放得下
 		}
 		for {
 			_, err := ifce.Read(bufs, sizes, 0)
@@ -163,14 +178,9 @@ func main() {
 				logrus.Errorf("ifce 读取失败: %v", err)
 				break
 			}
-			lengthBuf := make([]byte, 2)
-			binary.BigEndian.PutUint16(lengthBuf, uint16(sizes[0]))
-
 			// logrus.Infoln("readpages", n, "sizes", sizes)
 
-			dataToSend := append(lengthBuf, bufs[0][:sizes[0]]...)
-
-			if _, err := conn.Write(dataToSend); err != nil {
+			if err := pc.WritePacket(bufs[0][:sizes[0]]); err != nil {
 				logrus.Errorf("conn 写入失败: %v", err)
 				break
 			}
@@ -186,8 +196,12 @@ func createWindowsTunl(resp *models.RegisterResp) (tun.Device, error) {
 		devName = "Wintun" + uuid.NewString()[:3]
 	}
 
-	// 创建TUN设备（参数说明：设备名, MTU大小）
-	wintun, err := tun.CreateTUN(devName, 1500)
+	// 创建TUN设备（参数说明：设备名, MTU大小），老版本服务端不下发 MTU
+	mtu := resp.MTU
+	if mtu == 0 {
+		mtu = 1500
+	}
+	wintun, err := tun.CreateTUN(devName, mtu)
 	if err != nil {
 		logrus.Errorf("创建TUN设备失败: %v", err)
 		return nil, err
@@ -207,22 +221,127 @@ func configureTUN(dev tun.Device, resp *models.RegisterResp) {
 	nativeTun := dev.(*tun.NativeTun)
 	luid := winipcfg.LUID(nativeTun.LUID())
 
-	// 设置IP地址（例如10.0.0.2/24）
-	ip, _ := netip.ParsePrefix(fmt.Sprintf("%s/24", resp.IPv4))
-	err := luid.SetIPAddresses([]netip.Prefix{ip})
+	// 设置IP地址（例如10.0.0.2/24），双栈时同时设置 IPv6 地址
+	err := luid.SetIPAddresses(resp.Prefixes())
 	if err != nil {
 		logrus.Fatal("Failed to set IP:", err)
 	}
+	applyProfile(luid, &resp.NetProfile)
+}
+
+// profile 已经应用到网卡的网络配置
+var (
+	profileMu sync.Mutex
+	profile   models.NetProfile
+)
+
+// applyProfile 更新网卡的 MTU、路由和 DNS，只修改有变化的部分
+// 老版本服务端不下发 MTU 和 DNS，保持系统默认
+func applyProfile(luid winipcfg.LUID, next *models.NetProfile) {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	if next.MTU > 0 && next.MTU != profile.MTU {
+		for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+			iface, err := luid.IPInterface(family)
+			if err != nil {
+				// 没有 IPv6 地址时接口可能不存在
+				continue
+			}
+			iface.NLMTU = uint32(next.MTU)
+			if err := iface.Set(); err != nil {
+				logrus.Errorf("Failed to set MTU %d: %v", next.MTU, err)
+			}
+		}
+		profile.MTU = next.MTU
+	}
+	if !slices.Equal(profile.Routes, next.Routes) {
+		setRoutes(luid, profile.Routes, next.Routes)
+		profile.Routes = next.Routes
+	}
+	// DNS 失败时只影响域名解析
+	if len(next.DNS) > 0 && (!slices.Equal(profile.DNS, next.DNS) || !slices.Equal(profile.Search, next.Search)) {
+		configureDNS(luid, next)
+		profile.DNS, profile.Search = next.DNS, next.Search
+	}
+}
+
+// setRoutes 把经过网卡的路由从 oldRoutes 换成 newRoutes
+func setRoutes(luid winipcfg.LUID, oldRoutes, newRoutes []string) {
+	for _, r := range oldRoutes {
+		if slices.Contains(newRoutes, r) {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(r); err == nil {
+			if err := luid.DeleteRoute(prefix, onLink(prefix)); err != nil {
+				logrus.Warnln("Failed to delete route", r, err)
+			}
+		}
+	}
+	for _, r := range newRoutes {
+		if slices.Contains(oldRoutes, r) {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			continue
+		}
+		err = luid.AddRoute(prefix, onLink(prefix), 0)
+		if err != nil && !errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+			logrus.Errorln("Failed to add route", r, err)
+		}
+	}
+}
+
+// onLink 直接从网卡发出的路由的下一跳
+func onLink(prefix netip.Prefix) netip.Addr {
+	if prefix.Addr().Is4() {
+		return netip.IPv4Unspecified()
+	}
+	return netip.IPv6Unspecified()
+}
 
-	// // 添加路由（例如将所有流量路由到TUN设备）
-	// route := &winipcfg.RouteData{
-	// 	Destination: netip.MustParsePrefix("0.0.0.0/0"),
-	// 	NextHop:     netip.MustParseAddr("10.0.0.1"), // 服务器端TUN设备IP
-	// 	Metric:      0,
-	// }
+// configureDNS 使用 space 内置的 DNS
+func configureDNS(luid winipcfg.LUID, p *models.NetProfile) {
+	var v4, v6 []netip.Addr
+	for _, s := range p.DNS {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	if len(v4) > 0 {
+		if err := luid.SetDNS(windows.AF_INET, v4, p.Search); err != nil {
+			logrus.Warnln("Failed to set DNS:", err)
+		}
+	}
+	if len(v6) > 0 {
+		if err := luid.SetDNS(windows.AF_INET6, v6, p.Search); err != nil {
+			logrus.Warnln("Failed to set IPv6 DNS:", err)
+		}
+	}
+}
+
+// hostName 结点在 space DNS 中的名字
+func hostName() string {
+	if *nodeName != "" {
+		return *nodeName
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
 
-	// err = luid.SetRoutes([]*winipcfg.RouteData{route})
-	// if err != nil {
-	// 	log.Fatal("Failed to set route:", err)
-	// }
+func defaultIdentityDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "spacenode"
+	}
+	return filepath.Join(dir, "spacenode")
 }
@@ -5,8 +5,14 @@ import (
 	"os"
 	"os/signal"
 	"spacenode/libs/models"
+	"spacenode/libs/spaceca"
+	"spacenode/libs/spacetls"
+	"spacenode/libs/subnet"
 	"spacenode/modules/db"
+	"spacenode/modules/jointoken"
+	"spacenode/modules/nodeca"
 	"spacenode/modules/space"
+	"spacenode/modules/spacemanager"
 	"syscall"
 
 	"github.com/sirupsen/logrus"
@@ -18,6 +24,21 @@ var (
 		"/lzcapp/var/db.db",
 		"database path",
 	)
+	tlsDir = flag.String(
+		"tls-dir",
+		"/lzcapp/var/tls",
+		"space listener certificate dir",
+	)
+	e2e = flag.Bool(
+		"e2e",
+		false,
+		"require end-to-end encryption between nodes",
+	)
+	network = flag.String(
+		"subnet",
+		"",
+		"space subnet, e.g. 10.144.0.0/24; default 10.144.0.0/24",
+	)
 )
 
 func main() {
@@ -25,23 +46,52 @@ func main() {
 	logrus.SetReportCaller(true)
 	db.InitDB(*dbpath)
 
-	sm, err := space.NewSpace(models.SpaceItemConfig{
+	cert, err := spacetls.LoadOrCreateServerCert(*tlsDir, []string{"host.lzcapp"})
+	if err != nil {
+		logrus.Fatalln("failed to load server certificate: ", err)
+	}
+	fingerprint, err := spacetls.CertFingerprint(cert)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	logrus.Infoln("space server fingerprint:", fingerprint)
+
+	ca, err := spaceca.LoadOrCreate(*tlsDir)
+	if err != nil {
+		logrus.Fatalln("failed to load node ca: ", err)
+	}
+	authority, err := nodeca.NewAuthority(db.DB(), ca)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	prefix, err := subnet.Pick(*network)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	logrus.Infoln("space subnet:", prefix)
+
+	// 数据库中已经有 space 时不再使用命令行参数创建
+	spaces, err := spacemanager.NewManager(db.DB(), fingerprint,
+		space.WithTLS(ca.ServerConfig(cert)),
+		space.WithTokenValidator(jointoken.NewManager(db.DB())),
+		space.WithCertAuthority(authority),
+	)
+	if err != nil {
+		logrus.Fatalln("failed to create space manager: ", err)
+	}
+	if err := spaces.Ensure(models.SpaceItemConfig{
 		Port:    59393,
 		Host:    "host.lzcapp",
 		ID:      "space1",
-		NetAddr: "172.168.1.0",
-		Mask:    "255.255.255.0",
-	})
-	if err != nil {
-		logrus.Fatalln("failed to create space manager: ", err)
+		NetAddr: prefix.Addr().String(),
+		Mask:    subnet.Mask(prefix),
+		E2E:     *e2e,
+	}); err != nil {
+		spaces.Stop()
+		logrus.Fatalln("failed to create space: ", err)
 	}
 
-	go func() {
-		if err := sm.Start(); err != nil {
-			logrus.Warnln("space manager stopped: ", err)
-		}
-	}()
-
 	// 设置信号监听
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -49,7 +99,7 @@ func main() {
 	// 等待信号或上下文取消
 	select {
 	case sig := <-sigChan:
-		sm.Stop()
+		spaces.Stop()
 		logrus.Infof("received signal %v, shutting down gracefully", sig)
 	}
 }
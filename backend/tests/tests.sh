@@ -1,6 +1,14 @@
 #!/bin/bash
 # Test GET /space/list
 curl -X GET http://localhost:8080/space/list -H "X-Hc-User-Id: dzh"
+curl -X GET "http://localhost:8080/space/list?status=online" -H "X-Hc-User-Id: dzh"
+# Test GET /space/leases
+curl -X GET http://localhost:8080/space/leases -H "X-Hc-User-Id: dzh"
+# Test GET /space/pool
+curl -X GET http://localhost:8080/space/pool -H "X-Hc-User-Id: dzh"
+# Test POST /space/reservation/create
+curl -X POST "http://localhost:8080/space/reservation/create?nodeid=winnode_1&ip=10.144.0.10" -H "X-Hc-User-Id: dzh"
+curl -X GET http://localhost:8080/space/reservation/list -H "X-Hc-User-Id: dzh"
 
 # Test GET /app/list
 curl -X GET http://localhost:8080/app/list -H "X-Hc-User-Id: dzh"
@@ -13,3 +21,23 @@ curl -X POST http://localhost:8080/app/remove?appid=test-app -H "X-Hc-User-Id: d
 
 # Test GET /lzcapp/applist
 curl -X GET http://localhost:8080/lzcapp/applist -H "X-Hc-User-Id: dzh"
+
+# Test POST /space/token/create
+curl -X POST "http://localhost:8080/space/token/create?reusable=true&ttl=24h" -H "X-Hc-User-Id: dzh"
+
+# Test GET /space/token/list
+curl -X GET http://localhost:8080/space/token/list -H "X-Hc-User-Id: dzh"
+
+# Test POST /space/node/revoke
+curl -X POST "http://localhost:8080/space/node/revoke?nodeid=test-node&reason=lost" -H "X-Hc-User-Id: dzh"
+
+# Test GET /space/node/revoked
+curl -X GET http://localhost:8080/space/node/revoked -H "X-Hc-User-Id: dzh"
+# Test GET /spaces/list
+curl -X GET http://localhost:8080/spaces/list -H "X-Hc-User-Id: dzh"
+# Test POST /spaces/create
+curl -X POST http://localhost:8080/spaces/create -H "X-Hc-User-Id: dzh" -H "Content-Type: application/json" -d '{"id":"space2","host":"host.lzcapp","port":59394}'
+# Test GET /space/pool?spaceid=space2
+curl -X GET "http://localhost:8080/space/pool?spaceid=space2" -H "X-Hc-User-Id: dzh"
+# Test POST /spaces/delete
+curl -X POST "http://localhost:8080/spaces/delete?spaceid=space2" -H "X-Hc-User-Id: dzh"